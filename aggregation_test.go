@@ -0,0 +1,544 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// aggregationVector is a golden test case in testdata/aggregation: fixed
+// readings and the hand-computed figures they must aggregate to. Only
+// the outputs a vector lists are checked.
+type aggregationVector struct {
+	Description string          `json:"description"`
+	Timezone    string          `json:"timezone"`
+	From        time.Time       `json:"from"`
+	To          time.Time       `json:"to"`
+	Calibration calibration     `json:"calibration"`
+	Registry    []sensorInfo    `json:"registry"`
+	Readings    []goldenReading `json:"readings"`
+	Series      []goldenSeries  `json:"series"`
+	Hourly      []goldenBucket  `json:"hourly"`
+	Daily       []goldenBucket  `json:"daily"`
+	TimeWeighed []goldenBucket  `json:"timeWeightedHourly"`
+	Anomalies   []goldenAnomaly `json:"anomalies"`
+}
+
+type goldenReading struct {
+	SensorID    string    `json:"sensorId"`
+	Temperature float64   `json:"temperature"`
+	Humidity    float64   `json:"humidity"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// goldenSeries is a run of readings at a fixed interval, one per
+// temperature.
+type goldenSeries struct {
+	SensorID     string    `json:"sensorId"`
+	Start        time.Time `json:"start"`
+	Every        string    `json:"every"`
+	Temperatures []float64 `json:"temperatures"`
+	Humidity     float64   `json:"humidity"`
+}
+
+type goldenBucket struct {
+	Key         string  `json:"key"`
+	Sensor      string  `json:"sensor"`
+	Temperature float64 `json:"temperature"`
+	Humidity    float64 `json:"humidity"`
+	Count       int64   `json:"count"`
+}
+
+type goldenAnomaly struct {
+	Kind    string    `json:"kind"`
+	Sensor  string    `json:"sensor"`
+	From    time.Time `json:"from"`
+	To      time.Time `json:"to"`
+	Ongoing bool      `json:"ongoing"`
+	Detail  string    `json:"detail"`
+}
+
+// readings returns the vector's readings, series expanded, oldest first.
+func (v aggregationVector) readings(t *testing.T) []reading {
+	var rs []reading
+	for _, r := range v.Readings {
+		rs = append(rs, reading{SensorID: r.SensorID, Temperature: r.Temperature, Humidity: r.Humidity, UpdatedAt: r.UpdatedAt})
+	}
+	for _, s := range v.Series {
+		every, err := time.ParseDuration(s.Every)
+		if err != nil {
+			t.Fatalf("series every: %v", err)
+		}
+		for i, temperature := range s.Temperatures {
+			rs = append(rs, reading{SensorID: s.SensorID, Temperature: temperature, Humidity: s.Humidity, UpdatedAt: s.Start.Add(time.Duration(i) * every)})
+		}
+	}
+	slices.SortStableFunc(rs, func(a, b reading) int { return a.UpdatedAt.Compare(b.UpdatedAt) })
+	return rs
+}
+
+func TestAggregationVectors(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "aggregation", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("no vectors in testdata/aggregation")
+	}
+	for _, path := range paths {
+		t.Run(strings.TrimSuffix(filepath.Base(path), ".json"), func(t *testing.T) {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var v aggregationVector
+			if err := json.Unmarshal(data, &v); err != nil {
+				t.Fatal(err)
+			}
+			loc, err := time.LoadLocation(v.Timezone)
+			if err != nil {
+				t.Fatal(err)
+			}
+			history := v.readings(t)
+
+			// Sample averages go through the same merge as archived
+			// readings, with the report's hourly key
+			rows := make([]coldReading, len(history))
+			for i, r := range history {
+				rows[i] = coldReading{UpdatedAt: r.UpdatedAt, SensorID: r.SensorID, Temperature: r.Temperature, Humidity: r.Humidity}
+			}
+			v.Calibration.apply(rows)
+			if v.Hourly != nil {
+				compareBuckets(t, "hourly", mergeCold(nil, rows, hourlyKey(loc)), v.Hourly)
+				// So must the aggregations MongoDB runs
+				hourly := hourlyPipeline(v.From, v.To, v.Timezone, nil, v.Calibration)
+				compareBuckets(t, "hourly pipeline", pipelineBuckets[string](t, hourly, history), v.Hourly)
+				// Intervals average every sensor asked for together
+				var intervals []bucketAvg[int64]
+				for _, sensor := range goldenSensors(v.Hourly) {
+					interval := intervalPipeline(v.From, v.To, time.Hour.Milliseconds(), []string{sensor}, v.Calibration)
+					for _, b := range pipelineBuckets[int64](t, interval, history) {
+						b.Sensor = sensor
+						intervals = append(intervals, b)
+					}
+				}
+				compareBuckets(t, "interval pipeline", localHours(intervals, loc), v.Hourly)
+			}
+			if v.Daily != nil {
+				daily := mergeCold(nil, rows, func(c coldReading) (string, string) {
+					return c.UpdatedAt.In(loc).Format(time.DateOnly), c.SensorID
+				})
+				compareBuckets(t, "daily", daily, v.Daily)
+			}
+			if v.TimeWeighed != nil {
+				compareBuckets(t, "time-weighted hourly", timeWeightedAverages(history, v.Calibration, true, hourBucket(loc)), v.TimeWeighed)
+			}
+			if v.Anomalies != nil {
+				registry := map[string]sensorInfo{}
+				for _, s := range v.Registry {
+					registry[s.ID] = s
+				}
+				compareAnomalies(t, findAnomalies(history, v.Calibration, registry, v.From, v.To), v.Anomalies)
+			}
+		})
+	}
+}
+
+// closeEnough allows for the rounding of summing floats in another order.
+func closeEnough(a, b float64) bool {
+	return math.Abs(a-b) <= 1e-9*max(1, math.Abs(b))
+}
+
+func compareBuckets(t *testing.T, name string, got []bucketAvg[string], want []goldenBucket) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Errorf("%s: got %d buckets, want %d", name, len(got), len(want))
+	}
+	for i := range min(len(got), len(want)) {
+		g, w := got[i], want[i]
+		if g.Key != w.Key || g.Sensor != w.Sensor || g.Count != w.Count ||
+			!closeEnough(g.Temperature, w.Temperature) || !closeEnough(g.Humidity, w.Humidity) {
+			t.Errorf("%s bucket %d: got %s %s temperature %v humidity %v count %d, want %s %s temperature %v humidity %v count %d",
+				name, i, g.Key, g.Sensor, g.Temperature, g.Humidity, g.Count, w.Key, w.Sensor, w.Temperature, w.Humidity, w.Count)
+		}
+	}
+}
+
+func compareAnomalies(t *testing.T, got []anomaly, want []goldenAnomaly) {
+	t.Helper()
+	slices.SortFunc(got, func(a, b anomaly) int {
+		return cmp.Or(cmp.Compare(a.kind, b.kind), cmp.Compare(a.sensor, b.sensor), a.from.Compare(b.from))
+	})
+	slices.SortFunc(want, func(a, b goldenAnomaly) int {
+		return cmp.Or(cmp.Compare(a.Kind, b.Kind), cmp.Compare(a.Sensor, b.Sensor), a.From.Compare(b.From))
+	})
+	if len(got) != len(want) {
+		t.Errorf("got %d anomalies, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range min(len(got), len(want)) {
+		g, w := got[i], want[i]
+		if g.kind != w.Kind || g.sensor != w.Sensor || !g.from.Equal(w.From) || !g.to.Equal(w.To) || g.ongoing != w.Ongoing || g.detail != w.Detail {
+			t.Errorf("anomaly %d: got %s %s %s-%s ongoing=%v %q, want %s %s %s-%s ongoing=%v %q", i,
+				g.kind, g.sensor, g.from.Format(time.RFC3339), g.to.Format(time.RFC3339), g.ongoing, g.detail,
+				w.Kind, w.Sensor, w.From.Format(time.RFC3339), w.To.Format(time.RFC3339), w.Ongoing, w.Detail)
+		}
+	}
+}
+
+// goldenSensors lists the sensors of buckets.
+func goldenSensors(buckets []goldenBucket) []string {
+	var sensors []string
+	for _, b := range buckets {
+		sensors = append(sensors, b.Sensor)
+	}
+	slices.Sort(sensors)
+	return slices.Compact(sensors)
+}
+
+// pipelineBuckets runs an aggregation of the store over readings.
+func pipelineBuckets[K cmp.Ordered](t *testing.T, p mongo.Pipeline, readings []reading) []bucketAvg[K] {
+	t.Helper()
+	docs := make([]bson.M, len(readings))
+	for i, r := range readings {
+		docs[i] = bson.M{"sensorId": r.SensorID, "temperature": r.Temperature, "humidity": r.Humidity, "updatedAt": r.UpdatedAt}
+	}
+	var buckets []bucketAvg[K]
+	for _, d := range runPipeline(t, p, docs) {
+		data, err := bson.Marshal(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var b bucketAvg[K]
+		if err := bson.Unmarshal(data, &b); err != nil {
+			t.Fatal(err)
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets
+}
+
+// localHours keys epoch-aligned hourly buckets by local hour, as reports
+// do, folding together the two hours a fall back repeats.
+func localHours(buckets []bucketAvg[int64], loc *time.Location) []bucketAvg[string] {
+	var out []bucketAvg[string]
+	for _, b := range buckets {
+		key := time.UnixMilli(b.Key).In(loc).Format("2006-01-02 15:00:00")
+		i := slices.IndexFunc(out, func(o bucketAvg[string]) bool { return o.Key == key && o.Sensor == b.Sensor })
+		if i < 0 {
+			out = append(out, bucketAvg[string]{Key: key, Sensor: b.Sensor})
+			i = len(out) - 1
+		}
+		o := &out[i]
+		n, m := float64(o.Count), float64(b.Count)
+		o.Temperature = (o.Temperature*n + b.Temperature*m) / (n + m)
+		o.Humidity = (o.Humidity*n + b.Humidity*m) / (n + m)
+		o.Count += b.Count
+	}
+	slices.SortFunc(out, func(a, b bucketAvg[string]) int {
+		return cmp.Or(cmp.Compare(a.Key, b.Key), cmp.Compare(a.Sensor, b.Sensor))
+	})
+	return out
+}
+
+// runPipeline evaluates an aggregation over docs in memory, as MongoDB
+// would, for only the stages and operators hourlyPipeline and
+// intervalPipeline emit, failing the test on any other. It leaves out
+// what those pipelines don't lean on: missing fields and nulls matter
+// only to $isNumber and $avg, values of different BSON types aren't
+// ordered against each other, numbers are int, int64 or double (no
+// Decimal128, no overflow into doubles), $dateToString knows %Y, %m, %d,
+// %H, %M and %S alone, and queries compare top-level fields without
+// array semantics.
+func runPipeline(t *testing.T, p mongo.Pipeline, docs []bson.M) []bson.M {
+	t.Helper()
+	for _, stage := range p {
+		op, arg := stage[0].Key, stage[0].Value
+		switch op {
+		case "$match":
+			docs = slices.DeleteFunc(docs, func(d bson.M) bool { return !pipelineMatch(t, d, arg) })
+		case "$addFields":
+			out := make([]bson.M, len(docs))
+			for i, d := range docs {
+				out[i] = maps.Clone(d)
+				for _, f := range pipelineFields(arg) {
+					out[i][f.Key] = pipelineEval(t, d, f.Value)
+				}
+			}
+			docs = out
+		case "$group":
+			docs = pipelineGroup(t, docs, pipelineFields(arg))
+		case "$sort":
+			order := pipelineFields(arg)
+			slices.SortStableFunc(docs, func(a, b bson.M) int {
+				for _, f := range order {
+					if c := pipelineCompare(t, pipelinePath(a, f.Key), pipelinePath(b, f.Key)); c != 0 {
+						return c * f.Value.(int)
+					}
+				}
+				return 0
+			})
+		default:
+			t.Fatalf("pipeline stage %s isn't evaluated", op)
+		}
+	}
+	return docs
+}
+
+// pipelineFields returns a document's fields, in key order if it is a map.
+func pipelineFields(v any) bson.D {
+	switch v := v.(type) {
+	case bson.D:
+		return v
+	case bson.M:
+		var d bson.D
+		for k, e := range v {
+			d = append(d, bson.E{Key: k, Value: e})
+		}
+		slices.SortFunc(d, func(a, b bson.E) int { return cmp.Compare(a.Key, b.Key) })
+		return d
+	}
+	return nil
+}
+
+func pipelinePath(d bson.M, path string) any {
+	var v any = d
+	for _, name := range strings.Split(path, ".") {
+		m, ok := v.(bson.M)
+		if !ok {
+			return nil
+		}
+		v = m[name]
+	}
+	return v
+}
+
+// pipelineMatch evaluates the $gte, $lt and $in conditions of a query.
+func pipelineMatch(t *testing.T, d bson.M, filter any) bool {
+	for _, f := range pipelineFields(filter) {
+		v := pipelinePath(d, f.Key)
+		for _, c := range pipelineFields(f.Value) {
+			var ok bool
+			switch c.Key {
+			case "$gte":
+				ok = pipelineCompare(t, v, c.Value) >= 0
+			case "$lt":
+				ok = pipelineCompare(t, v, c.Value) < 0
+			case "$in":
+				ok = slices.ContainsFunc(c.Value.([]string), func(s string) bool { return v == s })
+			default:
+				t.Fatalf("query operator %s isn't evaluated", c.Key)
+			}
+			if !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func pipelineGroup(t *testing.T, docs []bson.M, spec bson.D) []bson.M {
+	var keys []string
+	groups := map[string][]bson.M{}
+	ids := map[string]any{}
+	for _, d := range docs {
+		id := pipelineEval(t, d, spec[0].Value)
+		k := fmt.Sprint(id)
+		if _, ok := groups[k]; !ok {
+			keys = append(keys, k)
+			ids[k] = id
+		}
+		groups[k] = append(groups[k], d)
+	}
+	out := make([]bson.M, len(keys))
+	for i, k := range keys {
+		g := bson.M{"_id": ids[k]}
+		for _, stat := range spec[1:] {
+			acc := pipelineFields(stat.Value)[0]
+			var values []any
+			for _, d := range groups[k] {
+				if v, ok := pipelineNumber(pipelineEval(t, d, acc.Value)); ok {
+					values = append(values, v)
+				}
+			}
+			switch acc.Key {
+			case "$sum":
+				g[stat.Key] = pipelineArith(t, "$add", values)
+			case "$avg":
+				if len(values) == 0 {
+					g[stat.Key] = nil
+					continue
+				}
+				sum, _ := pipelineNumber(pipelineArith(t, "$add", values))
+				g[stat.Key] = pipelineFloat(sum) / float64(len(values))
+			default:
+				t.Fatalf("accumulator %s isn't evaluated", acc.Key)
+			}
+		}
+		out[i] = g
+	}
+	return out
+}
+
+// pipelineEval evaluates an aggregation expression against d.
+func pipelineEval(t *testing.T, d bson.M, expr any) any {
+	if path, ok := expr.(string); ok && strings.HasPrefix(path, "$") {
+		return pipelinePath(d, path[1:])
+	}
+	if a, ok := expr.(bson.A); ok {
+		out := make([]any, len(a))
+		for i, e := range a {
+			out[i] = pipelineEval(t, d, e)
+		}
+		return out
+	}
+	fields := pipelineFields(expr)
+	if fields == nil {
+		return expr
+	}
+	op, arg := fields[0].Key, fields[0].Value
+	if !strings.HasPrefix(op, "$") {
+		// A document of expressions
+		out := bson.M{}
+		for _, f := range fields {
+			out[f.Key] = pipelineEval(t, d, f.Value)
+		}
+		return out
+	}
+	args := func() []any {
+		a, _ := pipelineEval(t, d, arg).([]any)
+		return a
+	}
+	switch op {
+	case "$add", "$subtract", "$mod":
+		return pipelineArith(t, op, args())
+	case "$eq":
+		a := args()
+		return pipelineCompare(t, a[0], a[1]) == 0
+	case "$isNumber":
+		_, ok := pipelineNumber(pipelineEval(t, d, arg))
+		return ok
+	case "$cond":
+		a := arg.(bson.A)
+		if pipelineEval(t, d, a[0]) == true {
+			return pipelineEval(t, d, a[1])
+		}
+		return pipelineEval(t, d, a[2])
+	case "$switch":
+		spec := arg.(bson.M)
+		for _, branch := range spec["branches"].(bson.A) {
+			b := branch.(bson.M)
+			if pipelineEval(t, d, b["case"]) == true {
+				return pipelineEval(t, d, b["then"])
+			}
+		}
+		return pipelineEval(t, d, spec["default"])
+	case "$toDate":
+		// updatedAt is a date already
+		return pipelineEval(t, d, arg).(time.Time)
+	case "$toLong":
+		return pipelineEval(t, d, arg).(time.Time).UnixMilli()
+	case "$dateToString":
+		spec := pipelineFields(arg)
+		var format, tz string
+		var at time.Time
+		for _, f := range spec {
+			switch f.Key {
+			case "format":
+				format = f.Value.(string)
+			case "date":
+				at = pipelineEval(t, d, f.Value).(time.Time)
+			case "timezone":
+				tz = f.Value.(string)
+			}
+		}
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			t.Fatal(err)
+		}
+		layout := strings.NewReplacer("%Y", "2006", "%m", "01", "%d", "02", "%H", "15", "%M", "04", "%S", "05").Replace(format)
+		return at.In(loc).Format(layout)
+	}
+	t.Fatalf("expression %s isn't evaluated", op)
+	return nil
+}
+
+// pipelineNumber reports whether v is a number, as $isNumber does.
+func pipelineNumber(v any) (any, bool) {
+	switch v.(type) {
+	case int, int64, float64:
+		return v, true
+	}
+	return nil, false
+}
+
+func pipelineFloat(v any) float64 {
+	switch v := v.(type) {
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case float64:
+		return v
+	}
+	return math.NaN()
+}
+
+// pipelineArith applies $add, $subtract or $mod. Whole numbers stay
+// whole, as counts and epoch milliseconds must; only calibrated readings
+// add doubles.
+func pipelineArith(t *testing.T, op string, args []any) any {
+	if op == "$add" && slices.ContainsFunc(args, func(a any) bool { _, ok := a.(float64); return ok }) {
+		var sum float64
+		for _, a := range args {
+			sum += pipelineFloat(a)
+		}
+		return sum
+	}
+	n := make([]int64, len(args))
+	for i, a := range args {
+		switch a := a.(type) {
+		case int:
+			n[i] = int64(a)
+		case int64:
+			n[i] = a
+		default:
+			t.Fatalf("%s of %v", op, args)
+		}
+	}
+	switch op {
+	case "$subtract":
+		return n[0] - n[1]
+	case "$mod":
+		return n[0] % n[1]
+	}
+	var sum int64
+	for _, v := range n {
+		sum += v
+	}
+	return sum
+}
+
+func pipelineCompare(t *testing.T, a, b any) int {
+	switch a := a.(type) {
+	case time.Time:
+		return a.Compare(b.(time.Time))
+	case string:
+		return cmp.Compare(a, b.(string))
+	}
+	if _, ok := pipelineNumber(a); ok {
+		return cmp.Compare(pipelineFloat(a), pipelineFloat(b))
+	}
+	t.Fatalf("comparing %v with %v", a, b)
+	return 0
+}
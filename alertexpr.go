@@ -0,0 +1,879 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// alertMetrics are the values an alert expression can refer to, with
+// their aliases. Dew point is derived from temperature and humidity.
+var alertMetrics = map[string]string{
+	"temperature": "temperature",
+	"temp":        "temperature",
+	"humidity":    "humidity",
+	"rh":          "humidity",
+	"co2":         "co2",
+	"pressure":    "pressure",
+	"dewpoint":    "dewpoint",
+}
+
+// errNoValue means an expression refers to a metric the reading
+// doesn't have, such as CO2 from a plain hygrometer. Such a condition
+// is neither true nor false and never fires.
+var errNoValue = errors.New("no value")
+
+// alertEnv supplies metric values to an expression: those of the
+// reading being evaluated, and the latest of other sensors.
+type alertEnv interface {
+	// temperatureUnit is the unit temperatures are evaluated in
+	temperatureUnit() string
+	metric(name string) (float64, error)
+	sensorMetric(sensor, name string) (float64, error)
+	locationMetrics(location, name string) ([]float64, error)
+	// percentile is the pth percentile of a metric in the sensor's own
+	// history for the season
+	percentile(name string, p int) (float64, error)
+	// baseline is the typical value of a metric at the sensor's week of
+	// the year and hour of the day, and the spread around it
+	baseline(name string) (typical, spread float64, err error)
+}
+
+// alertExpr is a parsed alert expression. Conditions evaluate to 1 when
+// true and 0 when false.
+type alertExpr interface {
+	eval(env alertEnv) (float64, error)
+	String() string
+}
+
+type numberExpr float64
+
+func (n numberExpr) eval(alertEnv) (float64, error) { return float64(n), nil }
+func (n numberExpr) String() string                 { return strconv.FormatFloat(float64(n), 'f', -1, 64) }
+
+// degreesExpr is a temperature written with its unit, as in 40°F,
+// converted to the rule's unit when evaluated. One that is a difference
+// of temperatures, as in attic.temperature - outdoor.temperature > 30F,
+// is only scaled; markDifferences finds those.
+type degreesExpr struct {
+	value float64
+	unit  string
+	delta bool
+}
+
+func (d degreesExpr) eval(env alertEnv) (float64, error) {
+	if d.delta {
+		return d.difference(env), nil
+	}
+	switch to := env.temperatureUnit(); {
+	case d.unit == unitFahrenheit && to == unitCelsius:
+		return (d.value - 32) * 5 / 9, nil
+	case d.unit == unitCelsius && to == unitFahrenheit:
+		return d.value*9/5 + 32, nil
+	}
+	return d.value, nil
+}
+
+// difference converts the value as a temperature difference.
+func (d degreesExpr) difference(env alertEnv) float64 {
+	switch to := env.temperatureUnit(); {
+	case d.unit == unitFahrenheit && to == unitCelsius:
+		return d.value * 5 / 9
+	case d.unit == unitCelsius && to == unitFahrenheit:
+		return d.value * 9 / 5
+	}
+	return d.value
+}
+
+func (d degreesExpr) String() string {
+	return strconv.FormatFloat(d.value, 'f', -1, 64) + "°" + d.unit
+}
+
+type metricExpr string
+
+func (m metricExpr) eval(env alertEnv) (float64, error) { return env.metric(string(m)) }
+func (m metricExpr) String() string                     { return string(m) }
+
+// sensorMetricExpr is a metric of a named sensor, as in
+// attic.temperature or "sensorpush-123".humidity.
+type sensorMetricExpr struct{ sensor, metric string }
+
+func (m sensorMetricExpr) eval(env alertEnv) (float64, error) {
+	return env.sensorMetric(m.sensor, m.metric)
+}
+func (m sensorMetricExpr) String() string { return strconv.Quote(m.sensor) + "." + m.metric }
+
+// locationMetricExpr is a metric of every sensor under a location, as
+// in location("HQ/Basement").humidity. It only appears in aggregates.
+type locationMetricExpr struct{ location, metric string }
+
+func (m locationMetricExpr) eval(env alertEnv) (float64, error) {
+	return 0, errors.New("location values must be aggregated")
+}
+
+func (m locationMetricExpr) String() string {
+	return "location(" + strconv.Quote(m.location) + ")." + m.metric
+}
+
+// percentileExpr is a percentile of the reading's sensor's history in
+// the current season, as in percentile(humidity, 99), worked out by
+// serve or alerts percentiles.
+type percentileExpr struct {
+	metric string
+	p      int
+}
+
+func (e percentileExpr) eval(env alertEnv) (float64, error) { return env.percentile(e.metric, e.p) }
+func (e percentileExpr) String() string {
+	return "percentile(" + e.metric + ", " + strconv.Itoa(e.p) + ")"
+}
+
+// baselineExpr is the typical value or spread of the reading's sensor's
+// metric at this time of year and day, as in typical(humidity) or
+// spread(temperature), from its seasonal baseline.
+type baselineExpr struct {
+	fn     string
+	metric string
+}
+
+func (e baselineExpr) eval(env alertEnv) (float64, error) {
+	typical, spread, err := env.baseline(e.metric)
+	if e.fn == "spread" {
+		return spread, err
+	}
+	return typical, err
+}
+func (e baselineExpr) String() string { return e.fn + "(" + e.metric + ")" }
+
+// aggregateExpr reduces metrics of several sensors with max, min or
+// avg, skipping sensors without a recent value.
+type aggregateExpr struct {
+	fn   string
+	args []alertExpr
+}
+
+func (a aggregateExpr) eval(env alertEnv) (float64, error) {
+	var values []float64
+	for _, arg := range a.args {
+		if loc, ok := arg.(locationMetricExpr); ok {
+			vs, err := env.locationMetrics(loc.location, loc.metric)
+			if err != nil && !errors.Is(err, errNoValue) {
+				return 0, err
+			}
+			values = append(values, vs...)
+			continue
+		}
+		v, err := arg.eval(env)
+		if errors.Is(err, errNoValue) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		values = append(values, v)
+	}
+	if len(values) == 0 {
+		return 0, errNoValue
+	}
+	switch a.fn {
+	case "max":
+		return slices.Max(values), nil
+	case "min":
+		return slices.Min(values), nil
+	}
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values)), nil
+}
+
+func (a aggregateExpr) String() string {
+	args := make([]string, len(a.args))
+	for i, arg := range a.args {
+		args[i] = arg.String()
+	}
+	return a.fn + "(" + strings.Join(args, ", ") + ")"
+}
+
+type unaryExpr struct {
+	op string
+	x  alertExpr
+}
+
+func (u unaryExpr) eval(env alertEnv) (float64, error) {
+	x, err := u.x.eval(env)
+	if err != nil {
+		return 0, err
+	}
+	switch u.op {
+	case "-":
+		return -x, nil
+	case "abs":
+		return math.Abs(x), nil
+	default: // NOT
+		return truth(x == 0), nil
+	}
+}
+
+func (u unaryExpr) String() string {
+	if u.op == "-" {
+		return "-" + u.x.String()
+	}
+	if u.op == "abs" {
+		return "abs(" + u.x.String() + ")"
+	}
+	return "NOT " + u.x.String()
+}
+
+type binaryExpr struct {
+	op   string
+	l, r alertExpr
+}
+
+func (b binaryExpr) eval(env alertEnv) (float64, error) {
+	l, lerr := b.l.eval(env)
+	// AND and OR only need one known side to decide
+	switch b.op {
+	case "AND":
+		if lerr == nil && l == 0 {
+			return 0, nil
+		}
+	case "OR":
+		if lerr == nil && l != 0 {
+			return 1, nil
+		}
+	}
+	r, rerr := b.r.eval(env)
+	switch b.op {
+	case "AND":
+		if rerr == nil && r == 0 {
+			return 0, nil
+		}
+	case "OR":
+		if rerr == nil && r != 0 {
+			return 1, nil
+		}
+	}
+	if err := errors.Join(lerr, rerr); err != nil {
+		return 0, err
+	}
+	switch b.op {
+	case "+":
+		return l + r, nil
+	case "-":
+		return l - r, nil
+	case "*":
+		return l * r, nil
+	case "/":
+		if r == 0 {
+			return 0, errNoValue
+		}
+		return l / r, nil
+	case ">":
+		return truth(l > r), nil
+	case ">=":
+		return truth(l >= r), nil
+	case "<":
+		return truth(l < r), nil
+	case "<=":
+		return truth(l <= r), nil
+	case "==":
+		return truth(l == r), nil
+	case "!=":
+		return truth(l != r), nil
+	default: // AND, OR with both sides known and not short-circuited
+		return truth(b.op == "AND"), nil
+	}
+}
+
+func (b binaryExpr) String() string {
+	return "(" + b.l.String() + " " + b.op + " " + b.r.String() + ")"
+}
+
+// withinExpr is "x WITHIN tolerance OF y", true when the two values
+// differ by no more than the tolerance.
+type withinExpr struct {
+	x, tolerance, y alertExpr
+}
+
+func (w withinExpr) eval(env alertEnv) (float64, error) {
+	x, err := w.x.eval(env)
+	if err != nil {
+		return 0, err
+	}
+	tol, err := w.tolerance.eval(env)
+	if err != nil {
+		return 0, err
+	}
+	// A tolerance in degrees is a difference, so only scaled
+	if d, ok := w.tolerance.(degreesExpr); ok {
+		tol = d.difference(env)
+	}
+	y, err := w.y.eval(env)
+	if err != nil {
+		return 0, err
+	}
+	return truth(math.Abs(x-y) <= tol), nil
+}
+
+func (w withinExpr) String() string {
+	return "(" + w.x.String() + " WITHIN " + w.tolerance.String() + " OF " + w.y.String() + ")"
+}
+
+func truth(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// alertHoldPattern matches the trailing "for 30m" of a condition that
+// must hold for a while before it fires.
+var alertHoldPattern = regexp.MustCompile(`(?i)\s+for\s+(\S+)\s*$`)
+
+// parseAlertCondition parses a condition such as
+// "humidity > 65 AND temperature > 75 for 30m" into its expression and
+// how long it must hold.
+func parseAlertCondition(s string) (alertExpr, time.Duration, error) {
+	var hold time.Duration
+	if m := alertHoldPattern.FindStringSubmatchIndex(s); m != nil {
+		var err error
+		if hold, err = time.ParseDuration(s[m[2]:m[3]]); err != nil {
+			return nil, 0, fmt.Errorf("for: %w", err)
+		}
+		s = s[:m[0]]
+	}
+	tokens, err := lexAlert(s)
+	if err != nil {
+		return nil, 0, err
+	}
+	p := &alertParser{tokens: tokens}
+	expr, err := p.or()
+	if err != nil {
+		return nil, 0, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, 0, fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	expr, _ = markDifferences(expr)
+	return expr, hold, nil
+}
+
+// What an expression's value is, as far as converting the temperatures
+// written with a unit next to it goes
+const (
+	valueOther = iota
+	valueTemperature
+	// valueDifference is a difference of temperatures, such as a
+	// subtraction of two or a seasonal spread
+	valueDifference
+)
+
+// markDifferences marks the temperatures written with a unit that are
+// differences: those added to or subtracted from a temperature, and
+// those compared with a difference. It returns e marked, and what its
+// value is.
+func markDifferences(e alertExpr) (alertExpr, int) {
+	switch e := e.(type) {
+	case degreesExpr:
+		return e, valueTemperature
+	case metricExpr:
+		return e, metricValue(string(e))
+	case sensorMetricExpr:
+		return e, metricValue(e.metric)
+	case locationMetricExpr:
+		return e, metricValue(e.metric)
+	case percentileExpr:
+		return e, metricValue(e.metric)
+	case baselineExpr:
+		kind := metricValue(e.metric)
+		if e.fn == "spread" && kind == valueTemperature {
+			kind = valueDifference
+		}
+		return e, kind
+	case aggregateExpr:
+		kind := valueOther
+		args := make([]alertExpr, len(e.args))
+		for i, arg := range e.args {
+			args[i], kind = markDifferences(arg)
+		}
+		return aggregateExpr{e.fn, args}, kind
+	case unaryExpr:
+		x, kind := markDifferences(e.x)
+		if e.op == "NOT" {
+			kind = valueOther
+		}
+		return unaryExpr{e.op, x}, kind
+	case withinExpr:
+		x, _ := markDifferences(e.x)
+		y, _ := markDifferences(e.y)
+		// eval scales a tolerance in degrees itself
+		return withinExpr{x, e.tolerance, y}, valueOther
+	case binaryExpr:
+		l, lkind := markDifferences(e.l)
+		r, rkind := markDifferences(e.r)
+		_, ldegrees := l.(degreesExpr)
+		_, rdegrees := r.(degreesExpr)
+		kind := valueOther
+		switch e.op {
+		case "+", "-":
+			switch {
+			case lkind != valueOther && rdegrees:
+				// A temperature or difference offset by a difference
+				r, kind = asDifference(r), lkind
+			case e.op == "+" && ldegrees && rkind != valueOther:
+				l, kind = asDifference(l), rkind
+			case e.op == "-" && lkind == valueTemperature && rkind == valueTemperature:
+				kind = valueDifference
+			case lkind == rkind:
+				kind = lkind
+			}
+		case ">", ">=", "<", "<=", "==", "!=":
+			if lkind == valueDifference && rdegrees {
+				r = asDifference(r)
+			}
+			if rkind == valueDifference && ldegrees {
+				l = asDifference(l)
+			}
+		case "*", "/":
+			// Scaling keeps what a value is, as in (a + b) / 2
+			if _, ok := r.(numberExpr); ok {
+				kind = lkind
+			} else if _, ok := l.(numberExpr); ok && e.op == "*" {
+				kind = rkind
+			}
+		}
+		return binaryExpr{e.op, l, r}, kind
+	}
+	return e, valueOther
+}
+
+// metricValue is what a metric's value is.
+func metricValue(metric string) int {
+	if metric == "temperature" || metric == "dewpoint" {
+		return valueTemperature
+	}
+	return valueOther
+}
+
+// asDifference marks e as a difference when it is a temperature written
+// with a unit.
+func asDifference(e alertExpr) alertExpr {
+	if d, ok := e.(degreesExpr); ok {
+		d.delta = true
+		return d
+	}
+	return e
+}
+
+// alertKeywords are matched case-insensitively.
+var alertKeywords = map[string]string{
+	"and": "AND", "or": "OR", "not": "NOT", "within": "WITHIN", "of": "OF",
+	"plus": "+", "minus": "-", "while": "AND",
+}
+
+// lexAlert splits an expression into numbers, names, keywords (upper
+// case) and operators.
+func lexAlert(s string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case unicode.IsDigit(c) || c == '.' && i+1 < len(s) && unicode.IsDigit(rune(s[i+1])):
+			j := i
+			for j < len(s) && (unicode.IsDigit(rune(s[j])) || s[j] == '.') {
+				j++
+			}
+			number := s[i:j]
+			// Units may follow: 65% is plain 65, while 40°F and 4.5C are
+			// temperatures in that unit
+			rest := strings.TrimPrefix(s[j:], "°")
+			if strings.HasPrefix(s[j:], "%") {
+				j++
+			} else if len(rest) > 0 && strings.ContainsRune("FfCc", rune(rest[0])) &&
+				(len(rest) == 1 || !unicode.IsLetter(rune(rest[1])) && !unicode.IsDigit(rune(rest[1])) && rest[1] != '_') {
+				number += "°" + strings.ToUpper(rest[:1])
+				j = len(s) - len(rest) + 1
+			}
+			tokens = append(tokens, number)
+			i = j
+		case unicode.IsLetter(c) || c == '_':
+			j := i
+			for j < len(s) && (unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j])) || s[j] == '_') {
+				j++
+			}
+			word := s[i:j]
+			if kw, ok := alertKeywords[strings.ToLower(word)]; ok {
+				word = kw
+			}
+			tokens = append(tokens, word)
+			i = j
+		case c == '"':
+			j := strings.IndexByte(s[i+1:], '"')
+			if j < 0 {
+				return nil, errors.New("unterminated string")
+			}
+			// Strings keep their quotes to tell them from names
+			tokens = append(tokens, s[i:i+j+2])
+			i += j + 2
+		default:
+			op := ""
+			for _, candidate := range []string{">=", "<=", "==", "!=", "&&", "||", ">", "<", "=", "+", "-", "*", "/", "(", ")", "!", ".", ","} {
+				if strings.HasPrefix(s[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected %q", s[i:i+1])
+			}
+			switch op {
+			case "&&":
+				tokens = append(tokens, "AND")
+			case "||":
+				tokens = append(tokens, "OR")
+			case "!":
+				tokens = append(tokens, "NOT")
+			case "=":
+				tokens = append(tokens, "==")
+			default:
+				tokens = append(tokens, op)
+			}
+			i += len(op)
+		}
+	}
+	return tokens, nil
+}
+
+// alertParser is a recursive-descent parser over lexAlert's tokens.
+type alertParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *alertParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *alertParser) accept(tokens ...string) (string, bool) {
+	for _, t := range tokens {
+		if p.peek() == t {
+			p.pos++
+			return t, true
+		}
+	}
+	return "", false
+}
+
+func (p *alertParser) expect(token string) error {
+	if _, ok := p.accept(token); !ok {
+		if p.peek() == "" {
+			return fmt.Errorf("expected %q at end of expression", token)
+		}
+		return fmt.Errorf("expected %q, found %q", token, p.peek())
+	}
+	return nil
+}
+
+func (p *alertParser) or() (alertExpr, error) {
+	l, err := p.and()
+	for err == nil {
+		if _, ok := p.accept("OR"); !ok {
+			return l, nil
+		}
+		var r alertExpr
+		if r, err = p.and(); err == nil {
+			l = binaryExpr{"OR", l, r}
+		}
+	}
+	return nil, err
+}
+
+func (p *alertParser) and() (alertExpr, error) {
+	l, err := p.not()
+	for err == nil {
+		if _, ok := p.accept("AND"); !ok {
+			return l, nil
+		}
+		var r alertExpr
+		if r, err = p.not(); err == nil {
+			l = binaryExpr{"AND", l, r}
+		}
+	}
+	return nil, err
+}
+
+func (p *alertParser) not() (alertExpr, error) {
+	if _, ok := p.accept("NOT"); ok {
+		x, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return unaryExpr{"NOT", x}, nil
+	}
+	return p.comparison()
+}
+
+func (p *alertParser) comparison() (alertExpr, error) {
+	l, err := p.sum()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := p.accept("WITHIN"); ok {
+		tol, err := p.sum()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("OF"); err != nil {
+			return nil, err
+		}
+		r, err := p.sum()
+		if err != nil {
+			return nil, err
+		}
+		return withinExpr{l, tol, r}, nil
+	}
+	if op, ok := p.accept(">", ">=", "<", "<=", "==", "!="); ok {
+		r, err := p.sum()
+		if err != nil {
+			return nil, err
+		}
+		return binaryExpr{op, l, r}, nil
+	}
+	return l, nil
+}
+
+func (p *alertParser) sum() (alertExpr, error) {
+	l, err := p.product()
+	for err == nil {
+		op, ok := p.accept("+", "-")
+		if !ok {
+			return l, nil
+		}
+		var r alertExpr
+		if r, err = p.product(); err == nil {
+			l = binaryExpr{op, l, r}
+		}
+	}
+	return nil, err
+}
+
+func (p *alertParser) product() (alertExpr, error) {
+	l, err := p.unary()
+	for err == nil {
+		op, ok := p.accept("*", "/")
+		if !ok {
+			return l, nil
+		}
+		var r alertExpr
+		if r, err = p.unary(); err == nil {
+			l = binaryExpr{op, l, r}
+		}
+	}
+	return nil, err
+}
+
+func (p *alertParser) unary() (alertExpr, error) {
+	if _, ok := p.accept("-"); ok {
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return unaryExpr{"-", x}, nil
+	}
+	return p.primary()
+}
+
+func (p *alertParser) primary() (alertExpr, error) {
+	t := p.peek()
+	switch {
+	case t == "":
+		return nil, errors.New("unexpected end of expression")
+	case t == "(":
+		p.pos++
+		x, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		return x, p.expect(")")
+	case unicode.IsDigit(rune(t[0])) || t[0] == '.':
+		p.pos++
+		number, unit, degrees := strings.Cut(t, "°")
+		v, err := strconv.ParseFloat(number, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad number %q", number)
+		}
+		if degrees {
+			return degreesExpr{value: v, unit: unit}, nil
+		}
+		return numberExpr(v), nil
+	case strings.ToLower(t) == "abs":
+		p.pos++
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		x, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		return unaryExpr{"abs", x}, p.expect(")")
+	case strings.ToLower(t) == "percentile":
+		p.pos++
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		name := p.peek()
+		metric, ok := alertMetrics[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown metric %q", name)
+		}
+		p.pos++
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+		n, err := strconv.Atoi(p.peek())
+		if err != nil || n < 1 || n > 99 {
+			return nil, fmt.Errorf("percentile must be a whole number from 1 to 99, not %q", p.peek())
+		}
+		p.pos++
+		return percentileExpr{metric, n}, p.expect(")")
+	case strings.ToLower(t) == "typical" || strings.ToLower(t) == "spread":
+		p.pos++
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		name := p.peek()
+		metric, ok := alertMetrics[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown metric %q", name)
+		}
+		if !slices.Contains(baselineMetrics, metric) {
+			return nil, fmt.Errorf("no seasonal baseline of %s", metric)
+		}
+		p.pos++
+		return baselineExpr{strings.ToLower(t), metric}, p.expect(")")
+	case slices.Contains([]string{"max", "min", "avg"}, strings.ToLower(t)):
+		p.pos++
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		agg := aggregateExpr{fn: strings.ToLower(t)}
+		for {
+			arg, err := p.reference()
+			if err != nil {
+				return nil, err
+			}
+			agg.args = append(agg.args, arg)
+			if _, ok := p.accept(","); !ok {
+				break
+			}
+		}
+		return agg, p.expect(")")
+	}
+	next := ""
+	if p.pos+1 < len(p.tokens) {
+		next = p.tokens[p.pos+1]
+	}
+	if next == "." || strings.HasPrefix(t, `"`) || strings.ToLower(t) == "location" && next == "(" {
+		ref, err := p.reference()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := ref.(locationMetricExpr); ok {
+			return nil, errors.New("location values must be aggregated with max, min or avg")
+		}
+		return ref, nil
+	}
+	if metric, ok := alertMetrics[strings.ToLower(t)]; ok {
+		p.pos++
+		return metricExpr(metric), nil
+	}
+	return nil, fmt.Errorf("unknown metric %q", t)
+}
+
+// reference parses SENSOR.metric, "SENSOR".metric or
+// location("PATH").metric.
+func (p *alertParser) reference() (alertExpr, error) {
+	t := p.peek()
+	if t == "" {
+		return nil, errors.New("unexpected end of expression")
+	}
+	p.pos++
+	var loc string
+	isLocation := strings.ToLower(t) == "location" && p.peek() == "("
+	if isLocation {
+		p.pos++
+		s := p.peek()
+		if !strings.HasPrefix(s, `"`) {
+			return nil, errors.New(`location needs a quoted path, as in location("HQ/Basement")`)
+		}
+		p.pos++
+		loc = s[1 : len(s)-1]
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expect("."); err != nil {
+		return nil, err
+	}
+	name := p.peek()
+	metric, ok := alertMetrics[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unknown metric %q", name)
+	}
+	p.pos++
+	if isLocation {
+		return locationMetricExpr{loc, metric}, nil
+	}
+	return sensorMetricExpr{strings.Trim(t, `"`), metric}, nil
+}
+
+// hasSubject reports whether expr refers to metrics of the reading
+// being evaluated, rather than only to named sensors and locations.
+func hasSubject(expr alertExpr) bool {
+	switch e := expr.(type) {
+	case metricExpr, percentileExpr, baselineExpr:
+		return true
+	case unaryExpr:
+		return hasSubject(e.x)
+	case binaryExpr:
+		return hasSubject(e.l) || hasSubject(e.r)
+	case withinExpr:
+		return hasSubject(e.x) || hasSubject(e.tolerance) || hasSubject(e.y)
+	}
+	return false
+}
+
+// usesBaselines reports whether expr refers to seasonal baselines.
+func usesBaselines(expr alertExpr) bool {
+	switch e := expr.(type) {
+	case baselineExpr:
+		return true
+	case unaryExpr:
+		return usesBaselines(e.x)
+	case binaryExpr:
+		return usesBaselines(e.l) || usesBaselines(e.r)
+	case withinExpr:
+		return usesBaselines(e.x) || usesBaselines(e.tolerance) || usesBaselines(e.y)
+	}
+	return false
+}
+
+// dewPoint returns the dew point in °C using the Magnus formula.
+func dewPoint(celsius, humidity float64) float64 {
+	const b, c = 17.62, 243.12
+	gamma := math.Log(humidity/100) + b*celsius/(c+celsius)
+	return c * gamma / (b - gamma)
+}
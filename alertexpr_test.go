@@ -0,0 +1,123 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// testAlertEnv evaluates expressions against fixed values, in Celsius
+// unless unit says otherwise.
+type testAlertEnv struct {
+	unit    string
+	metrics map[string]float64
+	sensors map[string]map[string]float64
+	spread  float64
+}
+
+func (e testAlertEnv) temperatureUnit() string {
+	if e.unit == "" {
+		return unitCelsius
+	}
+	return e.unit
+}
+
+func (e testAlertEnv) metric(name string) (float64, error) {
+	v, ok := e.metrics[name]
+	if !ok {
+		return 0, errNoValue
+	}
+	return v, nil
+}
+
+func (e testAlertEnv) sensorMetric(sensor, name string) (float64, error) {
+	v, ok := e.sensors[sensor][name]
+	if !ok {
+		return 0, errNoValue
+	}
+	return v, nil
+}
+
+func (e testAlertEnv) locationMetrics(string, string) ([]float64, error) { return nil, errNoValue }
+func (e testAlertEnv) percentile(string, int) (float64, error)           { return 0, errNoValue }
+func (e testAlertEnv) baseline(string) (float64, float64, error)         { return 0, e.spread, nil }
+
+func TestAlertConditionUnits(t *testing.T) {
+	// The attic is 20°C (36°F) warmer than outdoors
+	env := testAlertEnv{
+		metrics: map[string]float64{"temperature": 30},
+		sensors: map[string]map[string]float64{
+			"attic":   {"temperature": 35},
+			"outdoor": {"temperature": 15},
+		},
+		spread: 2,
+	}
+	fahrenheit := testAlertEnv{
+		unit:    unitFahrenheit,
+		metrics: map[string]float64{"temperature": 86},
+		sensors: map[string]map[string]float64{
+			"attic":   {"temperature": 95},
+			"outdoor": {"temperature": 59},
+		},
+		spread: 3.6,
+	}
+	tests := []struct {
+		condition string
+		env       testAlertEnv
+		want      bool
+	}{
+		// Temperatures are converted as temperatures
+		{"temperature > 80F", env, true},
+		{"temperature > 90F", env, false},
+		{"temperature > 25C", fahrenheit, true},
+		// Differences are only scaled: 30°F is 16.7°C, 40°F is 22.2°C
+		{"attic.temperature - outdoor.temperature > 30F", env, true},
+		{"attic.temperature - outdoor.temperature > 40F", env, false},
+		{"30F < attic.temperature - outdoor.temperature", env, true},
+		{"abs(outdoor.temperature - attic.temperature) > 40F", env, false},
+		{"attic.temperature - outdoor.temperature > 15C", fahrenheit, true},
+		{"attic.temperature - outdoor.temperature > 25C", fahrenheit, false},
+		// So are offsets from a temperature: 30°C + 9°F is 35°C
+		{"attic.temperature >= temperature + 9F", env, true},
+		{"attic.temperature > temperature + 9F", env, false},
+		{"attic.temperature - 9F == temperature", env, true},
+		{"temperature + 5C == attic.temperature", fahrenheit, true},
+		// And seasonal spreads: 2°C is 3.6°F
+		{"spread(temperature) < 4F", env, true},
+		{"spread(temperature) * 2 > 7F", env, true},
+		{"spread(temperature) < 3F", env, false},
+		{"spread(temperature) >= 2C", fahrenheit, true},
+		// A tolerance too
+		{"attic.temperature WITHIN 36F OF outdoor.temperature", env, true},
+		{"attic.temperature WITHIN 35F OF outdoor.temperature", env, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.condition, func(t *testing.T) {
+			expr, _, err := parseAlertCondition(tt.condition)
+			if err != nil {
+				t.Fatal(err)
+			}
+			v, err := expr.eval(tt.env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := v != 0; got != tt.want {
+				t.Errorf("%s in %s = %v, want %v", expr, tt.env.temperatureUnit(), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAlertDegreesDifference(t *testing.T) {
+	expr, _, err := parseAlertCondition("attic.temperature - outdoor.temperature > 30F")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := expr.(binaryExpr).r.(degreesExpr)
+	if !d.delta {
+		t.Fatalf("%s: 30F not marked as a difference", expr)
+	}
+	v, _ := d.eval(testAlertEnv{})
+	if math.Abs(v-16.667) > 0.001 {
+		t.Errorf("30F as a difference in C = %v, want 16.667", v)
+	}
+}
@@ -0,0 +1,833 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// alertRulesCollection holds the alert rules evaluated by serve.
+const alertRulesCollection = "alert_rules"
+
+// alertRule fires when its condition holds for a sensor's readings,
+// e.g. "humidity > 65 AND temperature > 75 for 30m".
+type alertRule struct {
+	Name      string `bson:"_id"`
+	Condition string `bson:"condition"`
+	// Unit is the temperature unit the condition is written in;
+	// readings are converted to it before evaluation
+	Unit string `bson:"unit"`
+	// Sensors limits the rule to some sensors; empty means all
+	Sensors []string `bson:"sensors,omitempty"`
+	// Template formats the rule's messages instead of the server's
+	Template string `bson:"template,omitempty"`
+	// Cooldown is how long after resolving the rule stays quiet for the
+	// same sensor, so a value hovering at the threshold doesn't page on
+	// every crossing; zero means serve -alert-cooldown
+	Cooldown time.Duration `bson:"cooldown,omitempty"`
+	// Severity is critical, error, warning or info, for pagers; empty
+	// means warning
+	Severity  string    `bson:"severity,omitempty"`
+	CreatedAt time.Time `bson:"createdAt"`
+}
+
+// defaultAlertTemplate formats alert messages unless a rule or serve
+// -alert-template says otherwise.
+const defaultAlertTemplate = `Alert {{.Rule}} {{.State}}{{if .Name}} for {{.Name}}{{else if .SensorID}} for {{.SensorID}}{{end}}: {{.Condition}}`
+
+// parseAlertTemplate parses a message template, which is executed with
+// an alertEvent, e.g. "{{.Name}} in {{.Location}} is at
+// {{printf "%.1f" .Values.humidity}}% RH {{.ChartURL}}".
+func parseAlertTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		text = defaultAlertTemplate
+	}
+	return template.New("alert").Option("missingkey=zero").Parse(text)
+}
+
+func alertRules(client *mongo.Client) *mongo.Collection {
+	return client.Database(readingsDatabase).Collection(alertRulesCollection)
+}
+
+// runAlerts manages alert rules.
+func runAlerts(args []string) (err error) {
+	if len(args) == 0 {
+		return usageError("usage: alerts list|add|delete|test|whatif|percentiles [flags]")
+	}
+
+	ctx, stop := commandContext()
+	defer stop()
+	connectCtx, cancel := context.WithTimeout(ctx, mongoTimeouts.connect)
+	client, err := connectMongo(connectCtx, "")
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if rerr := mongoClients.release(ctx, client); err == nil {
+			err = rerr
+		}
+	}()
+	coll := alertRules(client)
+
+	switch args[0] {
+	case "list":
+		return listAlertRules(ctx, coll)
+	case "add":
+		return addAlertRule(ctx, coll, args[1:])
+	case "test":
+		return testAlertRule(ctx, client, args[1:])
+	case "whatif":
+		return whatIfAlerts(ctx, client, args[1:])
+	case "percentiles":
+		return runAlertsPercentiles(ctx, client, args[1:])
+	case "delete":
+		if len(args) != 2 {
+			return usageError("usage: alerts delete NAME")
+		}
+		res, err := coll.DeleteOne(ctx, bson.M{"_id": args[1]})
+		if err != nil {
+			return err
+		}
+		if res.DeletedCount == 0 {
+			return fmt.Errorf("no alert rule %q", args[1])
+		}
+		log.Printf("Deleted alert rule %s", args[1])
+		return nil
+	default:
+		return usageError(fmt.Sprintf("unknown alerts command %q (expected list, add, delete, test, whatif or percentiles)", args[0]))
+	}
+}
+
+func listAlertRules(ctx context.Context, coll *mongo.Collection) error {
+	cursor, err := coll.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return err
+	}
+	var rules []alertRule
+	if err := cursor.All(ctx, &rules); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tUNIT\tSENSORS\tCOOLDOWN\tSEVERITY\tCONDITION")
+	for _, r := range rules {
+		sensors := strings.Join(r.Sensors, ",")
+		if sensors == "" {
+			sensors = "all"
+		}
+		cooldown := "default"
+		if r.Cooldown > 0 {
+			cooldown = r.Cooldown.String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", r.Name, r.Unit, sensors, cooldown, r.severity(), r.Condition)
+	}
+	return w.Flush()
+}
+
+func addAlertRule(ctx context.Context, coll *mongo.Collection, args []string) error {
+	fs := flag.NewFlagSet("alerts add", flag.ExitOnError)
+	unit := fs.String("unit", "F", "temperature unit the condition is written in, F or C")
+	sensors := fs.String("sensors", "", "comma-separated sensor IDs the rule applies to (default all)")
+	tmpl := fs.String("template", "", "Go template for the rule's messages (default: serve -alert-template)")
+	cooldown := fs.Duration("cooldown", 0, "how long the rule stays quiet after resolving (default: serve -alert-cooldown)")
+	severity := fs.String("severity", severityWarning, "critical, error, warning or info; pagers only get alerts from serve -alert-page-severity up")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		return usageError(`usage: alerts add [-unit F|C] [-sensors ID,...] [-cooldown DURATION] [-severity LEVEL] NAME "CONDITION [for DURATION]"`)
+	}
+	if *cooldown < 0 {
+		return errors.New("-cooldown must not be negative")
+	}
+	if err := checkSeverity(*severity); err != nil {
+		return fmt.Errorf("-severity: %w", err)
+	}
+	if *unit != unitFahrenheit && *unit != unitCelsius {
+		return fmt.Errorf("unit must be F or C, not %q", *unit)
+	}
+	rule := alertRule{
+		Name:      fs.Arg(0),
+		Condition: fs.Arg(1),
+		Unit:      *unit,
+		Sensors:   splitList(*sensors),
+		Template:  *tmpl,
+		Cooldown:  *cooldown,
+		Severity:  *severity,
+		CreatedAt: time.Now(),
+	}
+	expr, hold, err := parseAlertCondition(rule.Condition)
+	if err != nil {
+		return fmt.Errorf("condition: %w", err)
+	}
+	if _, err := parseAlertTemplate(rule.Template); err != nil {
+		return fmt.Errorf("template: %w", err)
+	}
+	if _, err := coll.InsertOne(ctx, rule); mongo.IsDuplicateKeyError(err) {
+		return fmt.Errorf("alert rule %q already exists", rule.Name)
+	} else if err != nil {
+		return err
+	}
+	log.Printf("Added alert rule %s: %s held for %s", rule.Name, expr, hold)
+	return nil
+}
+
+// testAlertRule replays a range of history through one rule and lists
+// when it would have fired and resolved, optionally sending a test
+// notification so the webhooks can be checked too.
+func testAlertRule(ctx context.Context, client *mongo.Client, args []string) error {
+	fs := flag.NewFlagSet("alerts test", flag.ExitOnError)
+	start := fs.String("start", "", "replay readings from this date, YYYY-MM-DD (default 7 days ago)")
+	end := fs.String("end", "", "replay readings before this date, YYYY-MM-DD (default now)")
+	notify := fs.Bool("notify", false, "also send a test notification to the webhooks")
+	webhook := fs.String("webhook", os.Getenv("ALERT_WEBHOOK"), "URL test notifications are posted to as JSON")
+	slack := fs.String("slack", os.Getenv("ALERT_SLACK_WEBHOOK"), "Slack incoming webhook URL test notifications are posted to")
+	discord := fs.String("discord", os.Getenv("ALERT_DISCORD_WEBHOOK"), "Discord webhook URL test notifications are posted to")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return usageError("usage: alerts test [-start YYYY-MM-DD] [-end YYYY-MM-DD] [-notify] NAME")
+	}
+	to := time.Now()
+	from := to.AddDate(0, 0, -7)
+	var err error
+	if *start != "" {
+		if from, err = time.Parse(time.DateOnly, *start); err != nil {
+			return fmt.Errorf("-start: %w", err)
+		}
+	}
+	if *end != "" {
+		if to, err = time.Parse(time.DateOnly, *end); err != nil {
+			return fmt.Errorf("-end: %w", err)
+		}
+	}
+
+	store, err := openReadingStore(ctx, client)
+	if err != nil {
+		return err
+	}
+	defer store.close()
+	e := &alertEngine{
+		readings:  store,
+		rules:     alertRules(client),
+		sensors:   sensorRegistry(client),
+		notifiers: alertNotifiers(*webhook, *slack, *discord),
+		http:      &http.Client{Timeout: 10 * time.Second},
+		state:     map[alertKey]*alertState{},
+		latest:    map[string]reading{},
+		drill:     true,
+
+		chartURL: os.Getenv("ALERT_CHART_URL"),
+	}
+	if e.template, err = parseAlertTemplate(os.Getenv("ALERT_TEMPLATE")); err != nil {
+		return fmt.Errorf("ALERT_TEMPLATE: %w", err)
+	}
+	if err := e.reload(ctx); err != nil {
+		return err
+	}
+	i := slices.IndexFunc(e.compiled, func(r compiledRule) bool { return r.Name == fs.Arg(0) })
+	if i < 0 {
+		return fmt.Errorf("no valid alert rule %q", fs.Arg(0))
+	}
+	rule := e.compiled[i]
+	e.compiled = e.compiled[i : i+1]
+
+	cold, err := newColdStore()
+	if err != nil {
+		return err
+	}
+	replayed, err := e.replay(ctx, client, cold, from, to)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Replayed %d readings from %s to %s through %s: %s",
+		replayed, from.Format(time.DateOnly), to.Format(time.DateOnly), rule.Name, rule.Condition)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME	STATE	SENSOR	VALUES")
+	for _, ev := range e.events {
+		values := make([]string, 0, len(ev.Values))
+		for _, name := range []string{"temperature", "humidity", "co2", "pressure", "dewpoint"} {
+			if v, ok := ev.Values[name]; ok {
+				values = append(values, fmt.Sprintf("%s=%.1f", name, v))
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", ev.At.Format(time.RFC3339), ev.State, sensorName(e.registry, ev.SensorID), strings.Join(values, " "))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if len(e.events) == 0 {
+		log.Printf("%s would not have fired", rule.Name)
+	}
+
+	if !*notify {
+		return nil
+	}
+	if len(e.notifiers) == 0 {
+		return errors.New("-notify needs -webhook, -slack or -discord")
+	}
+	event := alertEvent{Rule: rule.Name, Condition: rule.Condition, Unit: rule.Unit, At: time.Now()}
+	if len(e.events) > 0 {
+		event = e.events[len(e.events)-1]
+	}
+	event.State = "test"
+	event.Message = rule.message(event)
+	fmt.Println(event.Message)
+	e.charts = &server{
+		store:   store,
+		sensors: e.sensors,
+		cold:    cold,
+		tiers:   client.Database(readingsDatabase).Collection(tiersCollection),
+	}
+	e.attachChart(ctx, &event)
+	if err := e.deliver(ctx, event); err != nil {
+		return fmt.Errorf("test notification: %w", err)
+	}
+	log.Printf("Sent a test notification for %s", rule.Name)
+	return nil
+}
+
+// alertEngine evaluates the alert rules against each new reading.
+type alertEngine struct {
+	readings readingStore
+	rules    *mongo.Collection
+	sensors  *mongo.Collection
+	// notifiers receive each alert
+	notifiers []alertNotifier
+	http      *http.Client
+	// template formats messages of rules without their own
+	template *template.Template
+	// chartURL links a chart of the sensor around the alert, with
+	// {sensor}, {from} and {to} (Unix milliseconds) filled in
+	chartURL string
+	// charts renders a chart attached to each firing alert, when set
+	charts *server
+	// cooldown applies to rules without their own
+	cooldown time.Duration
+	// staleAfter is how long a registered sensor may go without a
+	// reading before a stale alert fires; zero disables them
+	staleAfter time.Duration
+	// staleLevel is the severity of stale alerts
+	staleLevel string
+	started    time.Time
+	// stale holds the sensors with a stale alert firing
+	stale map[string]bool
+
+	compiled []compiledRule
+	registry map[string]sensorInfo
+	cal      calibration
+	state    map[alertKey]*alertState
+	// latest is the most recent reading of each sensor
+	latest map[string]reading
+	// percentiles are each sensor's, by metric and season in loc
+	percentiles map[percentileKey][]float64
+	loc         *time.Location
+	// baselines are loaded only while a rule refers to them
+	baselines baselineLibrary
+
+	// recent records the events sent, when set
+	recent *alertLog
+
+	// drill records events instead of sending them, for alerts test
+	drill  bool
+	events []alertEvent
+}
+
+// compiledRule is a rule with its condition parsed.
+type compiledRule struct {
+	alertRule
+	cond alertExpr
+	hold time.Duration
+	tmpl *template.Template
+	// subject is set when the condition refers to the metrics of the
+	// reading being evaluated, so each sensor is tracked separately
+	subject bool
+}
+
+type alertKey struct{ rule, sensor string }
+
+// alertState tracks one rule for one sensor.
+type alertState struct {
+	// since is when the condition started holding
+	since  time.Time
+	firing bool
+	// resolved is when the alert last resolved, for the cooldown
+	resolved time.Time
+}
+
+// message formats event with the rule's template, falling back to the
+// default when the template fails, e.g. on a value the event lacks.
+func (r compiledRule) message(event alertEvent) string {
+	var msg strings.Builder
+	err := r.tmpl.Execute(&msg, event)
+	if err == nil {
+		return msg.String()
+	}
+	log.Printf("Alert rule %s: template: %v", r.Name, err)
+	msg.Reset()
+	fallback, _ := parseAlertTemplate("")
+	fallback.Execute(&msg, event)
+	return msg.String()
+}
+
+// alertEvent is the body posted to the alert webhook, and what message
+// templates are executed with.
+type alertEvent struct {
+	Rule      string             `json:"rule"`
+	Condition string             `json:"condition"`
+	State     string             `json:"state"`
+	SensorID  string             `json:"sensorId,omitempty"`
+	Name      string             `json:"name,omitempty"`
+	Location  string             `json:"location,omitempty"`
+	Unit      string             `json:"unit"`
+	Severity  string             `json:"severity"`
+	Values    map[string]float64 `json:"values,omitempty"`
+	ChartURL  string             `json:"chartUrl,omitempty"`
+	// Chart is a PNG of the sensor's last hours, base64 in JSON
+	Chart   []byte    `json:"chart,omitempty"`
+	At      time.Time `json:"at"`
+	Message string    `json:"message"`
+}
+
+// alertReload is how often rule and sensor changes are picked up.
+const alertReload = time.Minute
+
+// run evaluates each new reading from hub until ctx is done.
+func (e *alertEngine) run(ctx context.Context, hub *liveHub) {
+	ch, unsubscribe := hub.subscribe()
+	defer unsubscribe()
+	e.started, e.stale = time.Now(), map[string]bool{}
+	if err := e.reload(ctx); err != nil {
+		log.Printf("Loading alert rules: %v", err)
+	}
+	if err := e.seed(ctx); err != nil {
+		log.Printf("Loading latest readings: %v", err)
+	}
+	ticker := time.NewTicker(alertReload)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := e.reload(ctx); err != nil {
+				log.Printf("Loading alert rules: %v", err)
+			}
+			e.checkStale(ctx, now)
+		case r := <-ch:
+			e.evaluate(ctx, r)
+		}
+	}
+}
+
+// reload reads the rules, registry and calibration. Rules that no
+// longer parse are skipped with a warning.
+func (e *alertEngine) reload(ctx context.Context) error {
+	cursor, err := e.rules.Find(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	var rules []alertRule
+	if err := cursor.All(ctx, &rules); err != nil {
+		return err
+	}
+	registry, err := loadSensors(ctx, e.sensors)
+	if err != nil {
+		return err
+	}
+	cal, err := loadCalibration(ctx, e.sensors)
+	if err != nil {
+		return err
+	}
+	percentiles, err := loadPercentiles(ctx, e.rules.Database().Collection(sensorPercentilesCollection))
+	if err != nil {
+		return err
+	}
+	loc, err := time.LoadLocation(reportTimezone)
+	if err != nil {
+		return err
+	}
+	compiled := make([]compiledRule, 0, len(rules))
+	for _, r := range rules {
+		cond, hold, err := parseAlertCondition(r.Condition)
+		if err != nil {
+			log.Printf("Alert rule %s: %v", r.Name, err)
+			continue
+		}
+		rule := compiledRule{alertRule: r, cond: cond, hold: hold, subject: hasSubject(cond), tmpl: e.template}
+		if r.Template != "" {
+			if rule.tmpl, err = parseAlertTemplate(r.Template); err != nil {
+				log.Printf("Alert rule %s: template: %v", r.Name, err)
+				continue
+			}
+		}
+		compiled = append(compiled, rule)
+	}
+	e.compiled, e.registry, e.cal = compiled, registry, cal
+	e.percentiles, e.loc = percentiles, loc
+	e.baselines = nil
+	if slices.ContainsFunc(compiled, func(r compiledRule) bool { return usesBaselines(r.cond) }) {
+		if e.baselines, err = loadBaselines(ctx, e.rules.Database().Collection(baselinesCollection), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replay evaluates the archived and live readings in [from, to)
+// together, in order, and returns how many there were.
+func (e *alertEngine) replay(ctx context.Context, client *mongo.Client, cold *coldStore, from, to time.Time) (int, error) {
+	history, err := readHistory(ctx, e.readings, client, cold, from, to, nil)
+	if err != nil {
+		return 0, err
+	}
+	for _, r := range history {
+		e.evaluate(ctx, r)
+	}
+	return len(history), nil
+}
+
+// readHistory returns the archived and live readings in [from, to),
+// oldest first, limited to the given sensors unless sensors is empty.
+func readHistory(ctx context.Context, store readingStore, client *mongo.Client, cold *coldStore, from, to time.Time, sensors []string) ([]reading, error) {
+	history, err := store.find(ctx, from, to, sensors)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := cold.coldReadings(ctx, client.Database(readingsDatabase).Collection(tiersCollection), from, to, sensors)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range rows {
+		history = append(history, reading{SensorID: c.SensorID, Temperature: c.Temperature, Humidity: c.Humidity, CO2: c.CO2, Pressure: c.Pressure, UpdatedAt: c.UpdatedAt})
+	}
+	slices.SortStableFunc(history, func(a, b reading) int { return a.UpdatedAt.Compare(b.UpdatedAt) })
+	return history, nil
+}
+
+// evaluate updates every rule that applies to r's sensor. Rules that
+// only name sensors and locations are evaluated on every reading, as
+// any of them may have changed.
+func (e *alertEngine) evaluate(ctx context.Context, r reading) {
+	if r.UpdatedAt.After(e.latest[r.SensorID].UpdatedAt) {
+		e.latest[r.SensorID] = r
+	}
+	e.resolveStale(ctx, r)
+	for _, rule := range e.compiled {
+		if len(rule.Sensors) > 0 && !slices.Contains(rule.Sensors, r.SensorID) {
+			continue
+		}
+		env := alertContext{e: e, unit: rule.Unit, at: r.UpdatedAt}
+		key := alertKey{rule: rule.Name}
+		if rule.subject {
+			subject := e.calibrated(r, rule.Unit)
+			env.subject = &subject
+			key.sensor = r.SensorID
+		}
+		v, err := rule.cond.eval(env)
+		holds := err == nil && v != 0
+
+		st, ok := e.state[key]
+		if !ok {
+			st = &alertState{}
+			e.state[key] = st
+		}
+		switch {
+		case holds && st.since.IsZero():
+			st.since = r.UpdatedAt
+		case !holds && !st.since.IsZero():
+			st.since = time.Time{}
+			if st.firing {
+				st.firing = false
+				st.resolved = r.UpdatedAt
+				e.notify(ctx, rule, key.sensor, env, r.UpdatedAt, "resolved")
+			}
+		}
+		// An alert fires once until it resolves, and not again until the
+		// cooldown is over
+		if holds && !st.firing && r.UpdatedAt.Sub(st.since) >= rule.hold && r.UpdatedAt.Sub(st.resolved) >= e.cooldownOf(rule) {
+			st.firing = true
+			e.notify(ctx, rule, key.sensor, env, r.UpdatedAt, "firing")
+		}
+	}
+}
+
+// cooldownOf returns how long rule stays quiet after resolving.
+func (e *alertEngine) cooldownOf(rule compiledRule) time.Duration {
+	if rule.Cooldown > 0 {
+		return rule.Cooldown
+	}
+	return e.cooldown
+}
+
+// calibrated presents r, calibrated and in unit, to a condition.
+func (e *alertEngine) calibrated(r reading, unit string) readingEnv {
+	off := e.cal[r.SensorID]
+	r.Temperature += off.Temperature
+	r.Humidity += off.Humidity
+	// Unregistered sensors are taken to report Celsius, as percentiles
+	// are worked out
+	from := sensorUnit(e.registry, r.SensorID)
+	switch {
+	case from == unitFahrenheit && unit == unitCelsius:
+		r.Temperature = (r.Temperature - 32) * 5 / 9
+	case from == unitCelsius && unit == unitFahrenheit:
+		r.Temperature = r.Temperature*9/5 + 32
+	}
+	return readingEnv{r: r, unit: unit}
+}
+
+// alertStale is how old another sensor's latest reading may be before
+// conditions referring to it stop holding.
+const alertStale = 15 * time.Minute
+
+// seed loads each sensor's latest recent reading, so conditions across
+// sensors work before every sensor has reported again.
+func (e *alertEngine) seed(ctx context.Context) error {
+	latest, err := e.readings.latest(ctx, time.Now().Add(-alertStale))
+	if err != nil {
+		return err
+	}
+	for _, r := range latest {
+		e.latest[r.SensorID] = r
+	}
+	return nil
+}
+
+// alertContext evaluates a condition for one reading, its subject, with
+// the latest readings of other sensors at hand. Rules that only name
+// sensors have no subject.
+type alertContext struct {
+	e       *alertEngine
+	subject *readingEnv
+	unit    string
+	at      time.Time
+}
+
+func (c alertContext) temperatureUnit() string { return c.unit }
+
+func (c alertContext) metric(name string) (float64, error) {
+	if c.subject == nil {
+		return 0, errNoValue
+	}
+	return c.subject.metric(name)
+}
+
+// percentile reads a percentile of the subject's metric for the season
+// of the reading, converted to the rule's unit.
+func (c alertContext) percentile(name string, p int) (float64, error) {
+	if c.subject == nil {
+		return 0, errNoValue
+	}
+	values, ok := c.e.percentiles[percentileKey{c.subject.r.SensorID, name, season(c.at.In(c.e.loc))}]
+	if !ok {
+		return 0, errNoValue
+	}
+	v := values[p-1]
+	if (name == "temperature" || name == "dewpoint") && c.unit == unitFahrenheit {
+		v = v*9/5 + 32
+	}
+	return v, nil
+}
+
+// baseline reads the subject's seasonal baseline of a metric at the
+// time of the reading, converted to the rule's unit.
+func (c alertContext) baseline(name string) (typical, spread float64, err error) {
+	if c.subject == nil {
+		return 0, 0, errNoValue
+	}
+	id := c.subject.r.SensorID
+	typical, spread, ok := c.e.baselines.at(id, name, c.at.In(c.e.loc))
+	if !ok {
+		return 0, 0, errNoValue
+	}
+	// Baselines are in the sensor's own unit, Celsius for unregistered
+	// sensors as for readings
+	from := sensorUnit(c.e.registry, id)
+	if name == "temperature" {
+		switch {
+		case from == unitFahrenheit && c.unit == unitCelsius:
+			typical, spread = (typical-32)*5/9, spread*5/9
+		case from == unitCelsius && c.unit == unitFahrenheit:
+			typical, spread = typical*9/5+32, spread*9/5
+		}
+	}
+	return typical, spread, nil
+}
+
+// sensorMetric reads a metric of the sensor with the given ID or name.
+func (c alertContext) sensorMetric(sensor, name string) (float64, error) {
+	id := sensor
+	if _, ok := c.e.registry[id]; !ok {
+		for _, s := range c.e.registry {
+			if strings.EqualFold(s.Name, sensor) {
+				id = s.ID
+				break
+			}
+		}
+	}
+	return c.latest(id, name)
+}
+
+// locationMetrics reads a metric of every sensor at or under location,
+// which may be a full path or the name of one level, like "Basement".
+func (c alertContext) locationMetrics(location, name string) ([]float64, error) {
+	var values []float64
+	for id, s := range c.e.registry {
+		if s.RetiredAt != nil || !matchesLocation(s.Location, location) {
+			continue
+		}
+		v, err := c.latest(id, name)
+		if errors.Is(err, errNoValue) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+func (c alertContext) latest(id, name string) (float64, error) {
+	r, ok := c.e.latest[id]
+	if !ok || c.at.Sub(r.UpdatedAt) > alertStale {
+		return 0, errNoValue
+	}
+	return c.e.calibrated(r, c.unit).metric(name)
+}
+
+// matchesLocation reports whether a sensor at location is under want.
+func matchesLocation(location, want string) bool {
+	want = strings.Trim(want, "/ ")
+	for _, level := range locationLevels(location) {
+		if strings.EqualFold(level, want) {
+			return true
+		}
+	}
+	if !strings.Contains(want, "/") {
+		for _, part := range strings.Split(location, "/") {
+			if strings.EqualFold(strings.TrimSpace(part), want) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (e *alertEngine) notify(ctx context.Context, rule compiledRule, sensor string, env alertContext, at time.Time, state string) {
+	event := alertEvent{
+		Rule:      rule.Name,
+		Condition: rule.Condition,
+		State:     state,
+		SensorID:  sensor,
+		Name:      e.registry[sensor].Name,
+		Location:  e.registry[sensor].Location,
+		Unit:      rule.Unit,
+		Severity:  rule.severity(),
+		At:        at,
+	}
+	if env.subject != nil {
+		event.Values = env.subject.values()
+	}
+	if sensor != "" && e.chartURL != "" {
+		// Show the hours leading up to the alert
+		event.ChartURL = strings.NewReplacer(
+			// %20 rather than + works in paths as well as queries
+			"{sensor}", strings.ReplaceAll(url.QueryEscape(sensor), "+", "%20"),
+			"{from}", strconv.FormatInt(at.Add(-chartWindow).UnixMilli(), 10),
+			"{to}", strconv.FormatInt(at.UnixMilli(), 10),
+		).Replace(e.chartURL)
+	}
+	event.Message = rule.message(event)
+	if e.drill {
+		e.events = append(e.events, event)
+		return
+	}
+	if state == "firing" {
+		e.attachChart(ctx, &event)
+	}
+	e.recent.add(event)
+	log.Print(event.Message)
+	if err := e.deliver(ctx, event); err != nil {
+		log.Printf("Alert notification: %v", err)
+	}
+}
+
+// attachChart renders the chart of a sensor's alert, if charts are on.
+// The alert goes out without one if rendering fails.
+func (e *alertEngine) attachChart(ctx context.Context, event *alertEvent) {
+	if e.charts == nil || event.SensorID == "" {
+		return
+	}
+	chart, err := e.charts.sensorChart(ctx, event.SensorID, event.At.Add(-chartWindow), event.At.Add(time.Second))
+	if err != nil {
+		log.Printf("Alert chart for %s: %v", event.SensorID, err)
+		return
+	}
+	event.Chart = chart
+}
+
+// readingEnv evaluates metrics from one reading whose temperature is
+// already in unit.
+type readingEnv struct {
+	r    reading
+	unit string
+}
+
+func (env readingEnv) metric(name string) (float64, error) {
+	switch name {
+	case "temperature":
+		return env.r.Temperature, nil
+	case "humidity":
+		return env.r.Humidity, nil
+	case "co2":
+		if env.r.CO2 == nil {
+			return 0, errNoValue
+		}
+		return *env.r.CO2, nil
+	case "pressure":
+		if env.r.Pressure == nil {
+			return 0, errNoValue
+		}
+		return *env.r.Pressure, nil
+	case "dewpoint":
+		if env.r.Humidity <= 0 {
+			return 0, errNoValue
+		}
+		t := env.r.Temperature
+		if env.unit == unitFahrenheit {
+			t = (t - 32) * 5 / 9
+		}
+		dp := dewPoint(t, env.r.Humidity)
+		if env.unit == unitFahrenheit {
+			dp = dp*9/5 + 32
+		}
+		return dp, nil
+	}
+	return 0, fmt.Errorf("unknown metric %q", name)
+}
+
+// values reports every metric the reading has, for notifications.
+func (env readingEnv) values() map[string]float64 {
+	out := map[string]float64{}
+	for _, name := range []string{"temperature", "humidity", "co2", "pressure", "dewpoint"} {
+		if v, err := env.metric(name); err == nil {
+			out[name] = v
+		}
+	}
+	return out
+}
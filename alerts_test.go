@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAlertUnregisteredSensorUnits(t *testing.T) {
+	// A shed that isn't registered, whose history runs from 10 to 20,
+	// taken to be Celsius by the percentile job as by the alert engine
+	registry := map[string]sensorInfo{}
+	var history []float64
+	for v := 10.0; v <= 20; v++ {
+		history = append(history, sensorCelsius(registry, "shed", v))
+	}
+	at := time.Date(2024, time.July, 1, 12, 0, 0, 0, time.UTC)
+	hours := make([]int, 24)
+	typical, spread := make([]float64, 24), make([]float64, 24)
+	for i := range hours {
+		hours[i], typical[i], spread[i] = baselineMinHours, 15, 1
+	}
+	_, week := at.ISOWeek()
+	e := &alertEngine{
+		registry:    registry,
+		percentiles: map[percentileKey][]float64{{"shed", "temperature", season(at)}: percentiles(history)},
+		baselines:   baselineLibrary{{"shed", "temperature", week}: {Typical: typical, Spread: spread, Hours: hours}},
+		loc:         time.UTC,
+	}
+	tests := []struct {
+		condition   string
+		temperature float64
+		want        bool
+	}{
+		{"temperature > percentile(temperature, 99)", 21, true},
+		{"temperature > percentile(temperature, 99)", 19, false},
+		{"temperature < percentile(temperature, 1)", 9, true},
+		{"temperature > typical(temperature) + 2 * spread(temperature)", 18, true},
+		{"temperature > typical(temperature) + 2 * spread(temperature)", 16, false},
+	}
+	for _, unit := range []string{unitCelsius, unitFahrenheit} {
+		for _, tt := range tests {
+			t.Run(unit+" "+tt.condition, func(t *testing.T) {
+				expr, _, err := parseAlertCondition(tt.condition)
+				if err != nil {
+					t.Fatal(err)
+				}
+				subject := e.calibrated(reading{SensorID: "shed", Temperature: tt.temperature, Humidity: 50, UpdatedAt: at}, unit)
+				v, err := expr.eval(alertContext{e: e, subject: &subject, unit: unit, at: at})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := v != 0; got != tt.want {
+					t.Errorf("%s at %v in %s = %v, want %v", expr, tt.temperature, unit, got, tt.want)
+				}
+			})
+		}
+	}
+}
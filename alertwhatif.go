@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// alertEpisode is one stretch of time a rule fired for.
+type alertEpisode struct {
+	rule, sensor string
+	from         time.Time
+	duration     time.Duration
+	// ongoing is set when the rule was still firing at the end
+	ongoing bool
+}
+
+// whatIfAlerts replays months of history through proposed conditions,
+// without storing them as rules, and reports how often each would have
+// fired and for how long. Several conditions are compared side by side
+// to help pick thresholds that don't page too often.
+func whatIfAlerts(ctx context.Context, client *mongo.Client, args []string) error {
+	fs := flag.NewFlagSet("alerts whatif", flag.ExitOnError)
+	months := fs.Int("months", 3, "months of history to replay")
+	unit := fs.String("unit", "F", "temperature unit the conditions are written in, F or C")
+	sensors := fs.String("sensors", "", "comma-separated sensor IDs the conditions apply to (default all)")
+	bySensor := fs.Bool("by-sensor", false, "also break the counts down by sensor")
+	cooldown := fs.Duration("cooldown", 0, "how long each condition stays quiet after resolving")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return usageError(`usage: alerts whatif [-months N] [-unit F|C] [-sensors ID,...] [-cooldown DURATION] "CONDITION [for DURATION]"...`)
+	}
+	if *unit != unitFahrenheit && *unit != unitCelsius {
+		return fmt.Errorf("unit must be F or C, not %q", *unit)
+	}
+	if *months < 1 {
+		return errors.New("-months must be at least 1")
+	}
+	tmpl, err := parseAlertTemplate("")
+	if err != nil {
+		return err
+	}
+
+	store, err := openReadingStore(ctx, client)
+	if err != nil {
+		return err
+	}
+	defer store.close()
+	e := &alertEngine{
+		readings: store,
+		rules:    alertRules(client),
+		sensors:  sensorRegistry(client),
+		state:    map[alertKey]*alertState{},
+		latest:   map[string]reading{},
+		drill:    true,
+		cooldown: *cooldown,
+	}
+	if err := e.reload(ctx); err != nil {
+		return err
+	}
+	// The proposals replace the stored rules, named by their position
+	e.compiled = nil
+	for i, condition := range fs.Args() {
+		cond, hold, err := parseAlertCondition(condition)
+		if err != nil {
+			return fmt.Errorf("condition %d: %w", i+1, err)
+		}
+		rule := alertRule{Name: strconv.Itoa(i + 1), Condition: condition, Unit: *unit, Sensors: splitList(*sensors)}
+		e.compiled = append(e.compiled, compiledRule{alertRule: rule, cond: cond, hold: hold, subject: hasSubject(cond), tmpl: tmpl})
+	}
+
+	to := time.Now()
+	from := to.AddDate(0, -*months, 0)
+	cold, err := newColdStore()
+	if err != nil {
+		return err
+	}
+	replayed, err := e.replay(ctx, client, cold, from, to)
+	if err != nil {
+		return err
+	}
+	log.Printf("Replayed %d readings from %s to %s", replayed, from.Format(time.DateOnly), to.Format(time.DateOnly))
+
+	episodes := alertEpisodes(e.events, to)
+	weeks := to.Sub(from).Hours() / (7 * 24)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CONDITION\tSENSOR\tALERTS\tPER WEEK\tMEDIAN\tP90\tLONGEST\tTIME FIRING")
+	for _, rule := range e.compiled {
+		var mine []alertEpisode
+		for _, ep := range episodes {
+			if ep.rule == rule.Name {
+				mine = append(mine, ep)
+			}
+		}
+		printEpisodes(w, rule.Condition, "all", mine, weeks)
+		if !*bySensor {
+			continue
+		}
+		var sensorIDs []string
+		for _, ep := range mine {
+			if ep.sensor != "" && !slices.Contains(sensorIDs, ep.sensor) {
+				sensorIDs = append(sensorIDs, ep.sensor)
+			}
+		}
+		slices.Sort(sensorIDs)
+		for _, id := range sensorIDs {
+			var theirs []alertEpisode
+			for _, ep := range mine {
+				if ep.sensor == id {
+					theirs = append(theirs, ep)
+				}
+			}
+			printEpisodes(w, "", sensorName(e.registry, id), theirs, weeks)
+		}
+	}
+	return w.Flush()
+}
+
+// alertEpisodes pairs each firing event with its resolution. Rules
+// still firing at end last until then.
+func alertEpisodes(events []alertEvent, end time.Time) []alertEpisode {
+	firing := map[alertKey]time.Time{}
+	var episodes []alertEpisode
+	for _, ev := range events {
+		key := alertKey{ev.Rule, ev.SensorID}
+		switch ev.State {
+		case "firing":
+			firing[key] = ev.At
+		case "resolved":
+			if since, ok := firing[key]; ok {
+				episodes = append(episodes, alertEpisode{rule: ev.Rule, sensor: ev.SensorID, from: since, duration: ev.At.Sub(since)})
+				delete(firing, key)
+			}
+		}
+	}
+	for key, since := range firing {
+		episodes = append(episodes, alertEpisode{rule: key.rule, sensor: key.sensor, from: since, duration: end.Sub(since), ongoing: true})
+	}
+	return episodes
+}
+
+// printEpisodes writes one row of alert counts and durations. Ongoing
+// alerts are counted with the time they had fired for so far.
+func printEpisodes(w *tabwriter.Writer, condition, sensor string, episodes []alertEpisode, weeks float64) {
+	if len(episodes) == 0 {
+		fmt.Fprintf(w, "%s\t%s\t0\t0\t-\t-\t-\t-\n", condition, sensor)
+		return
+	}
+	durations := make([]time.Duration, len(episodes))
+	var total time.Duration
+	var ongoing int
+	for i, ep := range episodes {
+		durations[i] = ep.duration
+		total += ep.duration
+		if ep.ongoing {
+			ongoing++
+		}
+	}
+	slices.Sort(durations)
+	count := strconv.Itoa(len(episodes))
+	if ongoing > 0 {
+		count += fmt.Sprintf(" (%d ongoing)", ongoing)
+	}
+	fmt.Fprintf(w, "%s\t%s\t%s\t%.1f\t%s\t%s\t%s\t%s\n", condition, sensor, count, float64(len(episodes))/weeks,
+		roughDuration(durations[len(durations)/2]), roughDuration(durations[(len(durations)-1)*9/10]),
+		roughDuration(durations[len(durations)-1]), roughDuration(total))
+}
+
+// roughDuration formats d to the minute, which is precise enough for
+// how long alerts and outages last.
+func roughDuration(d time.Duration) string {
+	if d < time.Minute {
+		return "<1m"
+	}
+	return strings.TrimSuffix(d.Round(time.Minute).String(), "0s")
+}
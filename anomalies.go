@@ -0,0 +1,243 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"time"
+)
+
+const (
+	// outlierSpread is how many robust standard deviations from its
+	// sensor's median a reading must be to count as an outlier
+	outlierSpread = 5
+	// outlierMinReadings is the fewest readings a sensor needs in a day
+	// for its median to be trusted
+	outlierMinReadings = 12
+	// A gap is a silence of gapFactor times the sensor's usual interval,
+	// and at least minGap; from offlineAfter on it counts as offline
+	gapFactor    = 5
+	minGap       = 10 * time.Minute
+	offlineAfter = time.Hour
+)
+
+// outlierFloor is the least spread assumed for each metric, so a steady
+// sensor doesn't flag every small wobble.
+var outlierFloor = map[string]float64{"temperature": 0.5, "humidity": 2, "co2": 50, "pressure": 1}
+
+// Anomaly kinds, in the order the report lists them.
+var anomalyKinds = []string{"alert", "outlier", "gap", "offline"}
+
+// anomaly is one entry of the report's anomalies and alerts section.
+type anomaly struct {
+	kind   string
+	sensor string
+	// from and to are equal for outliers, which happen at one time
+	from, to time.Time
+	// ongoing is set when the anomaly lasted past the end of the report
+	ongoing bool
+	detail  string
+}
+
+// findAnomalies looks through a day of readings, oldest first, for
+// outliers, gaps and offline periods in [from, to). Registered sensors
+// that are not retired are expected to report, so those without any
+// reading are offline all along.
+func findAnomalies(history []reading, cal calibration, registry map[string]sensorInfo, from, to time.Time) []anomaly {
+	bySensor := map[string][]reading{}
+	for _, r := range history {
+		o := cal[r.SensorID]
+		r.Temperature += o.Temperature
+		r.Humidity += o.Humidity
+		bySensor[r.SensorID] = append(bySensor[r.SensorID], r)
+	}
+	for id, s := range registry {
+		if _, ok := bySensor[id]; ok || s.CreatedAt.After(from) || (s.RetiredAt != nil && s.RetiredAt.Before(to)) {
+			continue
+		}
+		bySensor[id] = nil
+	}
+
+	var anomalies []anomaly
+	for id, rs := range bySensor {
+		anomalies = append(anomalies, outliers(id, rs)...)
+		anomalies = append(anomalies, silences(id, rs, from, to)...)
+	}
+	return anomalies
+}
+
+// outliers reports each metric of a sensor that strayed too far from
+// its median, with the reading that strayed furthest.
+func outliers(sensor string, rs []reading) []anomaly {
+	var anomalies []anomaly
+	for _, metric := range []string{"temperature", "humidity", "co2", "pressure"} {
+		var at []time.Time
+		var values []float64
+		for _, r := range rs {
+			if v, ok := readingMetric(r, metric); ok {
+				at = append(at, r.UpdatedAt)
+				values = append(values, v)
+			}
+		}
+		if len(values) < outlierMinReadings {
+			continue
+		}
+		med := median(values)
+		deviations := make([]float64, len(values))
+		for i, v := range values {
+			deviations[i] = math.Abs(v - med)
+		}
+		// 1.4826 scales the median absolute deviation to a standard
+		// deviation for normally distributed values
+		spread := max(1.4826*median(deviations), outlierFloor[metric])
+		worst, count := -1, 0
+		for i, d := range deviations {
+			if d <= outlierSpread*spread {
+				continue
+			}
+			count++
+			if worst < 0 || d > deviations[worst] {
+				worst = i
+			}
+		}
+		if count == 0 {
+			continue
+		}
+		anomalies = append(anomalies, anomaly{
+			kind:   "outlier",
+			sensor: sensor,
+			from:   at[worst],
+			to:     at[worst],
+			detail: fmt.Sprintf("%s %.2f (typically %.2f), %d of %d readings out of line", metric, values[worst], med, count, len(values)),
+		})
+	}
+	return anomalies
+}
+
+// readingMetric returns one metric of r, if r has it.
+func readingMetric(r reading, metric string) (float64, bool) {
+	switch metric {
+	case "temperature":
+		return r.Temperature, true
+	case "humidity":
+		return r.Humidity, true
+	case "co2":
+		if r.CO2 != nil {
+			return *r.CO2, true
+		}
+	case "pressure":
+		if r.Pressure != nil {
+			return *r.Pressure, true
+		}
+	}
+	return 0, false
+}
+
+// median returns the middle of values.
+func median(values []float64) float64 {
+	sorted := slices.Clone(values)
+	slices.Sort(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// silences reports the stretches of [from, to) a sensor didn't report
+// for, measured against its usual interval between readings.
+func silences(sensor string, rs []reading, from, to time.Time) []anomaly {
+	if len(rs) == 0 {
+		return []anomaly{{kind: "offline", sensor: sensor, from: from, to: to, ongoing: true, detail: "no readings"}}
+	}
+	var intervals []float64
+	for i := 1; i < len(rs); i++ {
+		intervals = append(intervals, float64(rs[i].UpdatedAt.Sub(rs[i-1].UpdatedAt)))
+	}
+	threshold := minGap
+	if len(intervals) > 0 {
+		threshold = max(threshold, gapFactor*time.Duration(median(intervals)))
+	}
+
+	var anomalies []anomaly
+	silence := func(start, end time.Time, ongoing bool) {
+		d := end.Sub(start)
+		switch {
+		case d >= offlineAfter:
+			anomalies = append(anomalies, anomaly{kind: "offline", sensor: sensor, from: start, to: end, ongoing: ongoing})
+		case d > threshold:
+			anomalies = append(anomalies, anomaly{kind: "gap", sensor: sensor, from: start, to: end, ongoing: ongoing})
+		}
+	}
+	silence(from, rs[0].UpdatedAt, false)
+	for i := 1; i < len(rs); i++ {
+		silence(rs[i-1].UpdatedAt, rs[i].UpdatedAt, false)
+	}
+	silence(rs[len(rs)-1].UpdatedAt, to, true)
+	return anomalies
+}
+
+// alertAnomalies turns the times rules fired into report entries.
+func alertAnomalies(episodes []alertEpisode, rules []compiledRule) []anomaly {
+	conditions := map[string]string{}
+	for _, rule := range rules {
+		conditions[rule.Name] = rule.Condition
+	}
+	anomalies := make([]anomaly, len(episodes))
+	for i, ep := range episodes {
+		anomalies[i] = anomaly{
+			kind:    "alert",
+			sensor:  ep.sensor,
+			from:    ep.from,
+			to:      ep.from.Add(ep.duration),
+			ongoing: ep.ongoing,
+			detail:  ep.rule + ": " + conditions[ep.rule],
+		}
+	}
+	return anomalies
+}
+
+// printAnomalies writes the anomalies and alerts section of the text
+// report to out, grouped by kind, in loc's time.
+func printAnomalies(out io.Writer, anomalies []anomaly, registry map[string]sensorInfo, loc *time.Location) {
+	if len(anomalies) == 0 {
+		fmt.Fprintln(out, "Anomalies and alerts: none")
+		return
+	}
+	sortAnomalies(anomalies, registry)
+	fmt.Fprintln(out, "Anomalies and alerts:")
+	const layout = "2006-01-02 15:04"
+	for _, a := range anomalies {
+		sensor := sensorName(registry, a.sensor)
+		if sensor == "" {
+			sensor = "-"
+		}
+		line := fmt.Sprintf("Anomaly: %s, Sensor: %s, ", a.kind, sensor)
+		if a.kind == "outlier" {
+			line += "At: " + a.from.In(loc).Format(layout)
+		} else {
+			to := a.to.In(loc).Format(layout)
+			if a.ongoing {
+				to += " (ongoing)"
+			}
+			line += fmt.Sprintf("From: %s, To: %s, Duration: %s", a.from.In(loc).Format(layout), to, roughDuration(a.to.Sub(a.from)))
+		}
+		if a.detail != "" {
+			line += ", Detail: " + a.detail
+		}
+		fmt.Fprintln(out, line)
+	}
+}
+
+// sortAnomalies orders anomalies by kind, then time and sensor.
+func sortAnomalies(anomalies []anomaly, registry map[string]sensorInfo) {
+	slices.SortFunc(anomalies, func(a, b anomaly) int {
+		return cmp.Or(
+			cmp.Compare(slices.Index(anomalyKinds, a.kind), slices.Index(anomalyKinds, b.kind)),
+			a.from.Compare(b.from),
+			cmp.Compare(sensorName(registry, a.sensor), sensorName(registry, b.sensor)),
+		)
+	})
+}
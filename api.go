@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Limits on a single ingestion request
+const (
+	maxIngestBody  = 1 << 20
+	maxIngestBatch = 1000
+)
+
+// apiKeys returns the keys allowed to call the write API, configured as
+// a comma-separated API_KEYS list.
+func apiKeys() []string {
+	return splitList(os.Getenv("API_KEYS"))
+}
+
+// requireAPIKey rejects requests that don't present one of the
+// configured keys, or the credential of an enrolled device with scope,
+// either as a bearer token or in X-API-Key. The device is passed on in
+// the request's context, and the firmware it reports recorded.
+func (s *server) requireAPIKey(scope string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := requestKey(r)
+		auditIdentify(r.Context(), key, nil)
+		if s.validAPIKey(key) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		d, err := s.deviceByKey(r.Context(), key)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if d == nil {
+			if key != "" {
+				log.Printf("Rejected an invalid API key from %s for %s %s", clientIP(r), r.Method, r.URL.Path)
+			}
+			writeError(w, http.StatusUnauthorized, errors.New("missing or invalid API key"))
+			return
+		}
+		auditIdentify(r.Context(), key, d)
+		if !d.can(scope) {
+			writeError(w, http.StatusForbidden, fmt.Errorf("device %s is not enrolled with the %s scope", d.ID, scope))
+			return
+		}
+		s.firmware.record(r.Context(), d.ID, r.Header.Get(firmwareHeader))
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), deviceContextKey{}, d)))
+	})
+}
+
+// requestKey returns the key a request presents, as X-API-Key or as a
+// bearer token.
+func requestKey(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return r.Header.Get("X-API-Key")
+}
+
+// validAPIKey reports whether key is one of the configured keys.
+func (s *server) validAPIKey(key string) bool {
+	for _, k := range s.apiKeys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(k)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// handleIngest stores a single reading object or an array of them. The
+// whole batch is rejected if any reading fails validation, with one
+// error per offending item. With ?mode=lenient, numbers sent as strings
+// with units or comma decimals are coerced and reported as warnings.
+func (s *server) handleIngest(w http.ResponseWriter, r *http.Request) {
+	mode, err := parseModeNamed(r.URL.Query().Get("mode"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	body, err := readBody(w, r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var items []json.RawMessage
+	if bytes.HasPrefix(bytes.TrimSpace(body), []byte("[")) {
+		if err := json.Unmarshal(body, &items); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	} else {
+		items = []json.RawMessage{body}
+	}
+	payloads := make([]readingPayload, len(items))
+	var warnings []string
+	for i, item := range items {
+		p, ws, err := mode.decodePayload(item)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("reading %d: %w", i, err))
+			return
+		}
+		for _, warning := range ws {
+			warnings = append(warnings, fmt.Sprintf("reading %d: %s", i, warning))
+		}
+		payloads[i] = p
+	}
+	if len(payloads) == 0 {
+		writeError(w, http.StatusBadRequest, errors.New("no readings in request"))
+		return
+	}
+	if len(payloads) > maxIngestBatch {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("at most %d readings per request", maxIngestBatch))
+		return
+	}
+
+	now := time.Now()
+	device := contextDevice(r.Context())
+	docs := make([]reading, 0, len(payloads))
+	var problems []string
+	for i, p := range payloads {
+		rd, err := p.reading(now)
+		if err == nil && !device.allows(rd.SensorID) {
+			err = fmt.Errorf("device %s may not write readings for sensor %q", device.ID, rd.SensorID)
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("reading %d: %v", i, err))
+			continue
+		}
+		docs = append(docs, rd)
+	}
+	auditNote(r.Context(), "received", len(payloads))
+	if len(problems) > 0 {
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]any{"errors": problems})
+		return
+	}
+
+	auditReadings(r.Context(), docs)
+	if err := s.store.insert(r.Context(), docs); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	resp := map[string]any{"inserted": len(docs)}
+	if len(warnings) > 0 {
+		resp["warnings"] = warnings
+	}
+	writeJSON(w, http.StatusCreated, resp)
+}
+
+// readBody reads the request body, refusing anything over maxIngestBody.
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	var buf bytes.Buffer
+	_, err := buf.ReadFrom(http.MaxBytesReader(w, r.Body, maxIngestBody))
+	return buf.Bytes(), err
+}
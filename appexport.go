@@ -0,0 +1,98 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// runImportAppExport loads the CSV history exported from a vendor's
+// phone app for one sensor: the Govee Home app for Govee hygrometers,
+// or the Aranet Home app for Aranet4 CO2 monitors. Neither vendor offers
+// a cloud API with history, so the app export is the only source.
+func runImportAppExport(vendor string, args []string) (err error) {
+	fs := flag.NewFlagSet("import "+vendor, flag.ExitOnError)
+	sensorID := fs.String("sensor", "", "sensor ID to store the readings under (required)")
+	name := fs.String("name", "", "friendly name if the sensor is not registered yet (defaults to the ID)")
+	timezone := fs.String("timezone", "Local", "timezone of the exported timestamps")
+	fs.Parse(args)
+	if *sensorID == "" || fs.NArg() == 0 {
+		return usageError(fmt.Sprintf("usage: import %s -sensor ID [-name NAME] [-timezone ZONE] FILE.csv ...", vendor))
+	}
+
+	ctx, stop := commandContext()
+	defer stop()
+	connectCtx, cancel := context.WithTimeout(ctx, mongoTimeouts.connect)
+	client, err := connectMongo(connectCtx, "")
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if rerr := mongoClients.release(ctx, client); err == nil {
+			err = rerr
+		}
+	}()
+	if err := registerImportedSensor(ctx, sensorRegistry(client), *sensorID, cmp.Or(*name, *sensorID), unitCelsius); err != nil {
+		return err
+	}
+
+	for _, path := range fs.Args() {
+		rows, err := readAppExport(path, *timezone)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		for i := range rows {
+			rows[i].SensorID = *sensorID
+		}
+		n, err := importReadings(ctx, readings(client), rows)
+		if err != nil {
+			return err
+		}
+		log.Printf("%s: imported %d new readings", filepath.Base(path), n)
+	}
+	return nil
+}
+
+// readAppExport parses an app export. Govee's columns look like
+// "Timestamp for sample frequency every 1 min min,Temperature_Fahrenheit,
+// Relative_Humidity" and Aranet4's like "Time(dd/mm/yyyy),Carbon
+// dioxide(ppm),Temperature(°F),Relative humidity(%),Atmospheric
+// pressure(hPa)". Units and date order are detected from the header,
+// and readings are converted to Celsius like other imports.
+func readAppExport(path, timezone string) ([]reading, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m, notes, err := detectCSVMapping(f)
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range notes {
+		log.Printf("%s: %s", filepath.Base(path), n)
+	}
+	m.Timezone = timezone
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	res, err := readCSVReadings(f, parseDefault, m)
+	if err != nil {
+		return nil, err
+	}
+	if len(res.rejects) > 0 {
+		log.Printf("%s: skipped %d unreadable rows, the first at line %d: %v",
+			filepath.Base(path), len(res.rejects), res.rejects[0].Line, res.rejects[0].Err)
+	}
+	rows := make([]reading, len(res.rows))
+	for i, r := range res.rows {
+		rows[i] = reading{Temperature: r.Temperature, Humidity: r.Humidity, CO2: r.CO2, Pressure: r.Pressure, UpdatedAt: r.UpdatedAt}
+	}
+	return rows, nil
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	auditCollection = "audit"
+	// auditErrorSize is how much of a failed call's response is kept
+	auditErrorSize = 512
+	// auditTimeout bounds writing a record once the call is answered
+	auditTimeout = 5 * time.Second
+)
+
+// auditRecord is one call of the write API: who made it, with which
+// credential, what it sent and how it turned out. Credentials are
+// identified by the start of their hash, never stored.
+type auditRecord struct {
+	At     time.Time `bson:"at" json:"at"`
+	Action string    `bson:"action" json:"action"`
+	Method string    `bson:"method" json:"method"`
+	Path   string    `bson:"path" json:"path"`
+	// Client is the caller's address, behind any trusted proxies
+	Client string `bson:"client" json:"client"`
+	// Key identifies the API key, device credential or provisioning
+	// token presented, and Device the device it belongs to
+	Key    string `bson:"key,omitempty" json:"key,omitempty"`
+	Device string `bson:"device,omitempty" json:"device,omitempty"`
+	// Summary describes the payload, such as how many readings of which
+	// sensors it carried
+	Summary map[string]any `bson:"summary,omitempty" json:"summary,omitempty"`
+	// Status is the HTTP status answered, or Code the gRPC one, and
+	// Error what was wrong when the call failed
+	Status int    `bson:"status,omitempty" json:"status,omitempty"`
+	Code   string `bson:"code,omitempty" json:"code,omitempty"`
+	Error  string `bson:"error,omitempty" json:"error,omitempty"`
+	Millis int64  `bson:"millis" json:"millis"`
+}
+
+func auditTrail(client *mongo.Client) *mongo.Collection {
+	return client.Database(readingsDatabase).Collection(auditCollection)
+}
+
+// ensureAuditIndexes indexes the audit trail by time, and by device for
+// following one.
+func ensureAuditIndexes(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection(auditCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "at", Value: -1}}},
+		{Keys: bson.D{{Key: "device", Value: 1}, {Key: "at", Value: -1}}},
+	})
+	if err != nil {
+		return fmt.Errorf("indexing %s: %w", auditCollection, err)
+	}
+	return nil
+}
+
+// credentialID identifies a credential in audit records and listings
+// without revealing it.
+func credentialID(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return hashSecret(secret)[:shareIDLength]
+}
+
+type auditContextKey struct{}
+
+// contextAudit returns the record of the call being audited, or nil.
+func contextAudit(ctx context.Context) *auditRecord {
+	rec, _ := ctx.Value(auditContextKey{}).(*auditRecord)
+	return rec
+}
+
+// auditIdentify records the credential a call presented, and the device
+// it belongs to.
+func auditIdentify(ctx context.Context, secret string, d *deviceInfo) {
+	if rec := contextAudit(ctx); rec != nil {
+		rec.Key = credentialID(secret)
+		if d != nil {
+			rec.Device = d.ID
+		}
+	}
+}
+
+// note adds to the summary of a record. A nil record keeps nothing.
+func (rec *auditRecord) note(key string, value any) {
+	if rec == nil {
+		return
+	}
+	if rec.Summary == nil {
+		rec.Summary = map[string]any{}
+	}
+	rec.Summary[key] = value
+}
+
+// auditNote adds to the summary of the call being audited.
+func auditNote(ctx context.Context, key string, value any) {
+	contextAudit(ctx).note(key, value)
+}
+
+// auditReadings summarises the readings a call carried: how many, of
+// which sensors, and the times they span.
+func auditReadings(ctx context.Context, rs []reading) {
+	if len(rs) == 0 {
+		return
+	}
+	sensors := make([]string, 0, len(rs))
+	from, to := rs[0].UpdatedAt, rs[0].UpdatedAt
+	for _, r := range rs {
+		sensors = append(sensors, r.SensorID)
+		if r.UpdatedAt.Before(from) {
+			from = r.UpdatedAt
+		}
+		if r.UpdatedAt.After(to) {
+			to = r.UpdatedAt
+		}
+	}
+	slices.Sort(sensors)
+	auditNote(ctx, "readings", len(rs))
+	auditNote(ctx, "sensors", slices.Compact(sensors))
+	auditNote(ctx, "from", from)
+	auditNote(ctx, "to", to)
+}
+
+// auditWriter keeps the status of a response, and the start of its body
+// when it is an error.
+type auditWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *auditWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.status >= 400 && w.body.Len() < auditErrorSize {
+		w.body.Write(b[:min(len(b), auditErrorSize-w.body.Len())])
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *auditWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// auditError reads what went wrong from an error response written with
+// writeError, or a list of problems, or takes it as it is.
+func auditError(body []byte) string {
+	var resp struct {
+		Error  string   `json:"error"`
+		Errors []string `json:"errors"`
+	}
+	if json.Unmarshal(body, &resp) == nil && (resp.Error != "" || len(resp.Errors) > 0) {
+		return cmp.Or(resp.Error, strings.Join(resp.Errors, "; "))
+	}
+	return strings.TrimSpace(string(body))
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// audited records every call of next in the audit trail as action,
+// whether it succeeds, fails or is refused. Handlers, and requireAPIKey
+// before them, fill in who made it and what it carried.
+func (s *server) audited(action string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &auditRecord{At: start, Action: action, Method: r.Method, Path: r.URL.Path, Client: clientIP(r)}
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		aw := &auditWriter{ResponseWriter: w}
+		next.ServeHTTP(aw, r.WithContext(context.WithValue(r.Context(), auditContextKey{}, rec)))
+
+		rec.Status = cmp.Or(aw.status, http.StatusOK)
+		if rec.Status >= 400 {
+			rec.Error = auditError(aw.body.Bytes())
+		}
+		if body.n > 0 {
+			rec.note("bytes", body.n)
+		}
+		rec.Millis = time.Since(start).Milliseconds()
+		s.writeAudit(context.WithoutCancel(r.Context()), rec)
+	})
+}
+
+// writeAudit stores a record. The call has been answered by then, so a
+// failure can only be logged.
+func (s *server) writeAudit(ctx context.Context, rec *auditRecord) {
+	if s.audit == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, auditTimeout)
+	defer cancel()
+	if _, err := s.audit.InsertOne(ctx, rec); err != nil {
+		log.Printf("Error writing audit record of %s %s from %s: %v", rec.Method, rec.Path, rec.Client, err)
+	}
+}
+
+// runAudit lists the audit trail of the write API, the latest last.
+func runAudit(args []string) (err error) {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	since := fs.Duration("since", 24*time.Hour, "list the calls of this long ago on")
+	device := fs.String("device", "", "list only the calls of this device")
+	key := fs.String("key", "", "list only the calls with this credential ID")
+	failed := fs.Bool("failed", false, "list only the calls that failed or were refused")
+	limit := fs.Int64("limit", 1000, "list at most this many of the latest calls")
+	asJSON := fs.Bool("json", false, "print the records as JSON lines")
+	fs.Parse(args)
+
+	ctx, stop := commandContext()
+	defer stop()
+	connectCtx, cancel := context.WithTimeout(ctx, mongoTimeouts.connect)
+	client, err := connectMongo(connectCtx, "")
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if rerr := mongoClients.release(ctx, client); err == nil {
+			err = rerr
+		}
+	}()
+
+	filter := bson.M{"at": bson.M{"$gte": time.Now().Add(-*since)}}
+	if *device != "" {
+		filter["device"] = *device
+	}
+	if *key != "" {
+		filter["key"] = *key
+	}
+	if *failed {
+		filter["$or"] = bson.A{bson.M{"status": bson.M{"$gte": 400}}, bson.M{"code": bson.M{"$exists": true, "$ne": "OK"}}}
+	}
+	cursor, err := auditTrail(client).Find(ctx, filter, options.Find().SetSort(bson.M{"at": -1}).SetLimit(*limit))
+	if err != nil {
+		return err
+	}
+	var records []auditRecord
+	if err := cursor.All(ctx, &records); err != nil {
+		return err
+	}
+	slices.Reverse(records)
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		for _, rec := range records {
+			if err := enc.Encode(rec); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	loc, err := time.LoadLocation(reportTimezone)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tCLIENT\tKEY\tDEVICE\tACTION\tOUTCOME\tSUMMARY")
+	for _, rec := range records {
+		outcome := cmp.Or(rec.Code, fmt.Sprint(rec.Status))
+		if rec.Error != "" {
+			outcome += " " + rec.Error
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			rec.At.In(loc).Format(time.DateTime), rec.Client, cmp.Or(rec.Key, "-"), cmp.Or(rec.Device, "-"),
+			rec.Action, outcome, auditSummary(rec.Summary))
+	}
+	return w.Flush()
+}
+
+// auditSummary formats a summary as key=value pairs, in key order.
+func auditSummary(summary map[string]any) string {
+	keys := make([]string, 0, len(summary))
+	for k := range summary {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		v := summary[k]
+		switch v := v.(type) {
+		case bson.A:
+			vs := make([]string, len(v))
+			for j, e := range v {
+				vs[j] = fmt.Sprint(e)
+			}
+			parts[i] = k + "=" + strings.Join(vs, ",")
+			continue
+		case primitive.DateTime:
+			parts[i] = k + "=" + v.Time().UTC().Format(time.RFC3339)
+			continue
+		}
+		parts[i] = fmt.Sprintf("%s=%v", k, v)
+	}
+	if len(parts) == 0 {
+		return "-"
+	}
+	return strings.Join(parts, " ")
+}
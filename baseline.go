@@ -0,0 +1,372 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// baselineMinWeeks is the fewest earlier weeks with readings a period
+// needs before it is compared with them.
+const baselineMinWeeks = 2
+
+// deviation is a sensor's average over an hour or day that strayed from
+// its baseline, the same hour or weekday of the weeks before or its
+// seasonal baseline.
+type deviation struct {
+	sensor string
+	key    string
+	metric string
+	value  float64
+	// baseline is the median of the earlier weeks, and weeks how many
+	// of them had readings; for a seasonal baseline, it is the typical
+	// value and weeks is 0
+	baseline float64
+	weeks    int
+	// score is how many robust standard deviations value is from baseline
+	score float64
+}
+
+// runAnomalies compares each hour or day of a sensor with the same
+// hour or weekday of the previous weeks, in reportTimezone, and lists
+// those that differ by more than the threshold, such as a room that
+// didn't cool down when the air conditioning failed. With -baseline
+// seasonal, hours are compared with the sensor's seasonal baseline
+// instead, which knows that July is humid.
+func runAnomalies(args []string) (err error) {
+	if len(args) > 0 && args[0] == "baselines" {
+		return runAnomalyBaselines(args[1:])
+	}
+	fs := flag.NewFlagSet("anomalies", flag.ExitOnError)
+	format := fs.String("format", "text", "output format: text or csv")
+	start := fs.String("start", "", "check from this date, YYYY-MM-DD (default yesterday)")
+	end := fs.String("end", "", "check up to this date, YYYY-MM-DD, exclusive (default today)")
+	sensorList := fs.String("sensor", "", "comma-separated sensor IDs to include (default all)")
+	by := fs.String("by", "hour", "compare each hour or each day")
+	baseline := fs.String("baseline", "weeks", "compare with the previous weeks, or the seasonal baseline of the hour (see anomalies baselines)")
+	weeks := fs.Int("weeks", 4, "how many previous weeks make the baseline")
+	threshold := fs.Float64("threshold", 3, "report periods more than this many robust standard deviations from the baseline")
+	cluster := fs.String("cluster", "", "cluster from CLUSTERS_FILE to read, or a MongoDB URI (default MONGO_CLUSTER, or MONGO_URI)")
+	fs.Parse(args)
+	sensors := splitList(*sensorList)
+	if *format != "text" && *format != "csv" {
+		return fmt.Errorf("unknown format %q (expected text or csv)", *format)
+	}
+	if *by != "hour" && *by != "day" {
+		return fmt.Errorf("unknown -by %q (expected hour or day)", *by)
+	}
+	switch *baseline {
+	case "weeks":
+	case "seasonal":
+		if *by != "hour" {
+			return errors.New("-baseline seasonal compares hours only")
+		}
+	default:
+		return fmt.Errorf("unknown -baseline %q (expected weeks or seasonal)", *baseline)
+	}
+	if *weeks < baselineMinWeeks {
+		return fmt.Errorf("-weeks must be at least %d", baselineMinWeeks)
+	}
+	if *threshold <= 0 {
+		return errors.New("-threshold must be positive")
+	}
+	loc, err := time.LoadLocation(reportTimezone)
+	if err != nil {
+		return err
+	}
+	now := time.Now().In(loc)
+	to := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	from := to.AddDate(0, 0, -1)
+	if *start != "" {
+		if from, err = time.ParseInLocation(time.DateOnly, *start, loc); err != nil {
+			return fmt.Errorf("-start: %w", err)
+		}
+	}
+	if *end != "" {
+		if to, err = time.ParseInLocation(time.DateOnly, *end, loc); err != nil {
+			return fmt.Errorf("-end: %w", err)
+		}
+	}
+	if !to.After(from) {
+		return errors.New("-end must be after -start")
+	}
+
+	ctx, stop := commandContext()
+	defer stop()
+	connectCtx, cancel := context.WithTimeout(ctx, mongoTimeouts.connect)
+	client, err := connectMongo(connectCtx, *cluster)
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if rerr := mongoClients.release(ctx, client); err == nil {
+			err = rerr
+		}
+	}()
+	store, err := openReadingStore(ctx, client)
+	if err != nil {
+		return err
+	}
+	defer store.close()
+	cold, err := newColdStore()
+	if err != nil {
+		return err
+	}
+	cal, err := loadCalibration(ctx, sensorRegistry(client))
+	if err != nil {
+		return err
+	}
+	registry, err := loadSensors(ctx, sensorRegistry(client))
+	if err != nil {
+		return err
+	}
+
+	// The baseline reaches back whole weeks before the range, unless
+	// it is the stored seasonal one
+	historyFrom := from.AddDate(0, 0, -7*(*weeks))
+	if *baseline == "seasonal" {
+		historyFrom = from
+	}
+	buckets, err := store.hourlyAverages(ctx, historyFrom, to, reportTimezone, sensors, cal)
+	if err != nil {
+		return err
+	}
+	tiers := client.Database(readingsDatabase).Collection(tiersCollection)
+	if buckets, err = federate(ctx, cold, tiers, historyFrom, to, sensors, cal, buckets, hourlyKey(loc)); err != nil {
+		return err
+	}
+	layout := time.DateTime
+	if *by == "day" {
+		buckets, layout = dailyFromHourly(buckets), time.DateOnly
+	}
+
+	var deviations []deviation
+	period := "hour"
+	if *by == "day" {
+		period = "weekday"
+	}
+	against := fmt.Sprintf("the same %s of the previous %d weeks", period, *weeks)
+	if *baseline == "seasonal" {
+		library, err := loadBaselines(ctx, client.Database(readingsDatabase).Collection(baselinesCollection), sensors)
+		if err != nil {
+			return err
+		}
+		if len(library) == 0 {
+			return errors.New("no seasonal baselines yet; run anomalies baselines or serve")
+		}
+		deviations = compareWithSeasonal(buckets, library, from.In(loc).Format(layout), to.In(loc).Format(layout), loc, *threshold)
+		against = "the seasonal baseline of the hour"
+	} else {
+		deviations = compareWithBaseline(buckets, from.In(loc).Format(layout), to.In(loc).Format(layout), layout, loc, *weeks, *threshold)
+	}
+	slices.SortFunc(deviations, func(a, b deviation) int {
+		return cmp.Or(
+			cmp.Compare(a.key, b.key),
+			cmp.Compare(sensorName(registry, a.sensor), sensorName(registry, b.sensor)),
+			cmp.Compare(slices.Index(baselineMetrics, a.metric), slices.Index(baselineMetrics, b.metric)),
+		)
+	})
+	if *format == "csv" {
+		return printDeviationsCSV(deviations, registry)
+	}
+	return printDeviations(deviations, registry, *by, against, *threshold, loc)
+}
+
+// baselineMetrics are the metrics compared with their baseline.
+var baselineMetrics = []string{"temperature", "humidity", "co2", "pressure"}
+
+// compareWithBaseline returns the metrics of buckets keyed in [fromKey,
+// toKey) that are more than threshold robust standard deviations from
+// the median of the same key 1 to weeks weeks earlier. Keys are local
+// times in layout. The spread is at least outlierFloor, as for the
+// report's outliers, since a few weeks of a steady room barely vary.
+func compareWithBaseline(buckets []bucketAvg[string], fromKey, toKey, layout string, loc *time.Location, weeks int, threshold float64) []deviation {
+	type group struct{ key, sensor string }
+	byGroup := make(map[group]bucketAvg[string], len(buckets))
+	for _, b := range buckets {
+		byGroup[group{b.Key, b.Sensor}] = b
+	}
+
+	var out []deviation
+	for _, b := range buckets {
+		if b.Key < fromKey || b.Key >= toKey {
+			continue
+		}
+		t, err := time.ParseInLocation(layout, b.Key, loc)
+		if err != nil {
+			continue
+		}
+		// Going back by calendar days keeps the local hour across DST
+		var earlier []bucketAvg[string]
+		for w := 1; w <= weeks; w++ {
+			if e, ok := byGroup[group{t.AddDate(0, 0, -7*w).Format(layout), b.Sensor}]; ok {
+				earlier = append(earlier, e)
+			}
+		}
+		for _, metric := range baselineMetrics {
+			v, ok := bucketMetric(b, metric)
+			if !ok {
+				continue
+			}
+			var values []float64
+			for _, e := range earlier {
+				if ev, ok := bucketMetric(e, metric); ok {
+					values = append(values, ev)
+				}
+			}
+			if len(values) < baselineMinWeeks {
+				continue
+			}
+			med := median(values)
+			deviations := make([]float64, len(values))
+			for i, ev := range values {
+				deviations[i] = math.Abs(ev - med)
+			}
+			spread := max(1.4826*median(deviations), outlierFloor[metric])
+			if score := (v - med) / spread; math.Abs(score) > threshold {
+				out = append(out, deviation{sensor: b.Sensor, key: b.Key, metric: metric, value: v, baseline: med, weeks: len(values), score: score})
+			}
+		}
+	}
+	return out
+}
+
+// compareWithSeasonal is compareWithBaseline against the seasonal
+// baselines of library, for hourly buckets. Hours whose baseline has
+// too little history are skipped.
+func compareWithSeasonal(buckets []bucketAvg[string], library baselineLibrary, fromKey, toKey string, loc *time.Location, threshold float64) []deviation {
+	var out []deviation
+	for _, b := range buckets {
+		if b.Key < fromKey || b.Key >= toKey {
+			continue
+		}
+		t, err := time.ParseInLocation(time.DateTime, b.Key, loc)
+		if err != nil {
+			continue
+		}
+		for _, metric := range baselineMetrics {
+			v, ok := bucketMetric(b, metric)
+			if !ok {
+				continue
+			}
+			typical, spread, ok := library.at(b.Sensor, metric, t)
+			if !ok {
+				continue
+			}
+			if score := (v - typical) / max(spread, outlierFloor[metric]); math.Abs(score) > threshold {
+				out = append(out, deviation{sensor: b.Sensor, key: b.Key, metric: metric, value: v, baseline: typical, score: score})
+			}
+		}
+	}
+	return out
+}
+
+// bucketMetric returns one metric of b, if b has it.
+func bucketMetric[K cmp.Ordered](b bucketAvg[K], metric string) (float64, bool) {
+	switch metric {
+	case "temperature":
+		return b.Temperature, b.Count > 0
+	case "humidity":
+		return b.Humidity, b.Count > 0
+	case "co2":
+		if b.CO2 != nil && b.CO2Count > 0 {
+			return *b.CO2, true
+		}
+	case "pressure":
+		if b.Pressure != nil && b.PressureCount > 0 {
+			return *b.Pressure, true
+		}
+	}
+	return 0, false
+}
+
+// dailyFromHourly combines hourly buckets keyed by local time into
+// daily ones keyed by local date, weighting each hour by its readings.
+func dailyFromHourly(hourly []bucketAvg[string]) []bucketAvg[string] {
+	type group struct{ day, sensor string }
+	byGroup := map[group]*bucketAvg[string]{}
+	for _, b := range hourly {
+		g := group{b.Key[:len(time.DateOnly)], b.Sensor}
+		day, ok := byGroup[g]
+		if !ok {
+			day = &bucketAvg[string]{Key: g.day, Sensor: b.Sensor}
+			byGroup[g] = day
+		}
+		n, m := float64(day.Count), float64(b.Count)
+		if n+m > 0 {
+			day.Temperature = (day.Temperature*n + b.Temperature*m) / (n + m)
+			day.Humidity = (day.Humidity*n + b.Humidity*m) / (n + m)
+		}
+		day.Count += b.Count
+		day.CO2 = mergeAvg(day.CO2, day.CO2Count, b.CO2, b.CO2Count)
+		day.CO2Count += b.CO2Count
+		day.Pressure = mergeAvg(day.Pressure, day.PressureCount, b.Pressure, b.PressureCount)
+		day.PressureCount += b.PressureCount
+	}
+	out := make([]bucketAvg[string], 0, len(byGroup))
+	for _, day := range byGroup {
+		out = append(out, *day)
+	}
+	slices.SortFunc(out, func(a, b bucketAvg[string]) int {
+		return cmp.Or(cmp.Compare(a.Key, b.Key), cmp.Compare(a.Sensor, b.Sensor))
+	})
+	return out
+}
+
+// printDeviations lists deviations from the baseline described by
+// against, such as "the same hour of the previous 4 weeks".
+func printDeviations(deviations []deviation, registry map[string]sensorInfo, by, against string, threshold float64, loc *time.Location) error {
+	column := "HOUR"
+	if by == "day" {
+		column = "DAY"
+	}
+	if len(deviations) == 0 {
+		fmt.Printf("Nothing more than %g standard deviations from %s.\n", threshold, against)
+		return nil
+	}
+	fmt.Printf("More than %g standard deviations from %s (%s):\n", threshold, against, loc)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "SENSOR\t%s\tMETRIC\tAVERAGE\tBASELINE\tDEVIATION\n", column)
+	for _, d := range deviations {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%.2f\t%.2f\t%+.1f\n", sensorName(registry, d.sensor), d.key, d.metric, d.value, d.baseline, d.score)
+	}
+	return w.Flush()
+}
+
+func printDeviationsCSV(deviations []deviation, registry map[string]sensorInfo) error {
+	w := csv.NewWriter(os.Stdout)
+	w.Write([]string{"sensor_id", "sensor_name", "period", "metric", "average", "baseline", "baseline_weeks", "deviation"})
+	for _, d := range deviations {
+		w.Write([]string{
+			d.sensor,
+			sensorName(registry, d.sensor),
+			d.key,
+			d.metric,
+			strconv.FormatFloat(d.value, 'f', 2, 64),
+			strconv.FormatFloat(d.baseline, 'f', 2, 64),
+			baselineWeeksField(d.weeks),
+			strconv.FormatFloat(d.score, 'f', 2, 64),
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// baselineWeeksField is the baseline_weeks column, empty for seasonal
+// baselines, which aren't made of a number of weeks.
+func baselineWeeksField(weeks int) string {
+	if weeks == 0 {
+		return ""
+	}
+	return strconv.Itoa(weeks)
+}
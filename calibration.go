@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// sensorOffsets are calibration corrections added to a sensor's raw
+// readings, in the units the sensor reports.
+type sensorOffsets struct {
+	Temperature float64 `json:"temperature"`
+	Humidity    float64 `json:"humidity"`
+}
+
+// calibration maps sensor IDs to their offsets. Readings are stored as
+// reported and corrected at query time, so offsets can be revised
+// without rewriting history.
+type calibration map[string]sensorOffsets
+
+// loadCalibration collects the offsets in the sensor registry. Entries
+// in the JSON file named by CALIBRATION_FILE, keyed by sensor ID, take
+// precedence, e.g. {"attic": {"temperature": -1.1}}.
+func loadCalibration(ctx context.Context, sensors *mongo.Collection) (calibration, error) {
+	registry, err := loadSensors(ctx, sensors)
+	if err != nil {
+		return nil, err
+	}
+	cal := calibration{}
+	for id, s := range registry {
+		if s.TemperatureOffset != 0 || s.HumidityOffset != 0 {
+			cal[id] = sensorOffsets{Temperature: s.TemperatureOffset, Humidity: s.HumidityOffset}
+		}
+	}
+
+	path := os.Getenv("CALIBRATION_FILE")
+	if path == "" {
+		return cal, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file calibration
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	maps.Copy(cal, file)
+	return cal, nil
+}
+
+// fields returns an $addFields document that applies the offsets to
+// temperature and humidity according to each reading's sensorId.
+func (c calibration) fields() bson.M {
+	if len(c) == 0 {
+		return bson.M{"temperature": "$temperature", "humidity": "$humidity"}
+	}
+	ids := make([]string, 0, len(c))
+	for id := range c {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	var temps, hums bson.A
+	for _, id := range ids {
+		is := bson.M{"$eq": bson.A{"$sensorId", id}}
+		temps = append(temps, bson.M{"case": is, "then": c[id].Temperature})
+		hums = append(hums, bson.M{"case": is, "then": c[id].Humidity})
+	}
+	return bson.M{
+		"temperature": bson.M{"$add": bson.A{"$temperature", bson.M{"$switch": bson.M{"branches": temps, "default": 0}}}},
+		"humidity":    bson.M{"$add": bson.A{"$humidity", bson.M{"$switch": bson.M{"branches": hums, "default": 0}}}},
+	}
+}
+
+// apply corrects archived rows in place.
+func (c calibration) apply(rows []coldReading) {
+	if len(c) == 0 {
+		return
+	}
+	for i := range rows {
+		o := c[rows[i].SensorID]
+		rows[i].Temperature += o.Temperature
+		rows[i].Humidity += o.Humidity
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Charts are small enough to attach to a chat message
+const (
+	chartWidth  = 480
+	chartHeight = 160
+	chartPad    = 8
+
+	// chartWindow is how much history alert charts show
+	chartWindow = 6 * time.Hour
+
+	// Bounds of the size of charts requested with width and height
+	chartMinSide   = 64
+	chartMaxWidth  = 1920
+	chartMaxHeight = 1080
+)
+
+var (
+	chartGrid        = color.RGBA{0xe0, 0xe0, 0xe0, 0xff}
+	chartTemperature = color.RGBA{0xd6, 0x27, 0x28, 0xff}
+	chartHumidity    = color.RGBA{0x1f, 0x77, 0xb4, 0xff}
+)
+
+// sensorChart renders a PNG of one sensor's temperature and humidity in
+// [from, to).
+func (s *server) sensorChart(ctx context.Context, sensor string, from, to time.Time) ([]byte, error) {
+	return s.sizedSensorChart(ctx, sensor, from, to, chartWidth, chartHeight)
+}
+
+// sizedSensorChart renders a sensor's chart width by height pixels, with
+// days starting at midnight in reportTimezone.
+func (s *server) sizedSensorChart(ctx context.Context, sensor string, from, to time.Time, width, height int) ([]byte, error) {
+	loc, err := time.LoadLocation(reportTimezone)
+	if err != nil {
+		return nil, err
+	}
+	from, to = from.In(loc), to.In(loc)
+	// About one bucket every four pixels
+	interval := max(to.Sub(from).Milliseconds()/int64(width/4), time.Minute.Milliseconds())
+	buckets, err := s.intervalAverages(ctx, from, to, interval, []string{sensor})
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, drawChart(buckets, interval, from, to, width, height)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// drawChart plots temperature in red and humidity in blue, each scaled
+// to its own range, over hourly grid lines, or daily ones at midnight
+// in from's location for ranges of more than two days. Lines break
+// where buckets are missing.
+func drawChart(buckets []bucketAvg[int64], interval int64, from, to time.Time, width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+
+	span := float64(to.Sub(from).Milliseconds())
+	x := func(ms int64) int {
+		return chartPad + int(float64(ms-from.UnixMilli())/span*float64(width-2*chartPad))
+	}
+	if to.Sub(from) > 48*time.Hour {
+		for t := time.Date(from.Year(), from.Month(), from.Day()+1, 0, 0, 0, 0, from.Location()); t.Before(to); t = t.AddDate(0, 0, 1) {
+			chartVLine(img, x(t.UnixMilli()), chartGrid)
+		}
+	} else {
+		for t := from.Truncate(time.Hour).Add(time.Hour); t.Before(to); t = t.Add(time.Hour) {
+			chartVLine(img, x(t.UnixMilli()), chartGrid)
+		}
+	}
+
+	series := func(value func(bucketAvg[int64]) float64, c color.Color) {
+		if len(buckets) == 0 {
+			return
+		}
+		lo, hi := value(buckets[0]), value(buckets[0])
+		for _, b := range buckets {
+			lo, hi = min(lo, value(b)), max(hi, value(b))
+		}
+		y := func(v float64) int {
+			if hi == lo {
+				return height / 2
+			}
+			return chartPad + int((hi-v)/(hi-lo)*float64(height-2*chartPad))
+		}
+		// Buckets are keyed by their start; plot them at their middle
+		for i, b := range buckets {
+			x1, y1 := x(b.Key+interval/2), y(value(b))
+			if i == 0 || b.Key-buckets[i-1].Key > 2*interval {
+				img.Set(x1, y1, c)
+				continue
+			}
+			prev := buckets[i-1]
+			chartLine(img, x(prev.Key+interval/2), y(value(prev)), x1, y1, c)
+		}
+	}
+	series(func(b bucketAvg[int64]) float64 { return b.Humidity }, chartHumidity)
+	series(func(b bucketAvg[int64]) float64 { return b.Temperature }, chartTemperature)
+	return img
+}
+
+func chartVLine(img *image.RGBA, x int, c color.Color) {
+	for y := 0; y < img.Bounds().Dy(); y++ {
+		img.Set(x, y, c)
+	}
+}
+
+// chartLine draws from (x0, y0) to (x1, y1), two pixels thick.
+func chartLine(img *image.RGBA, x0, y0, x1, y1 int, c color.Color) {
+	steps := max(x1-x0, x0-x1, y1-y0, y0-y1, 1)
+	for i := 0; i <= steps; i++ {
+		x := x0 + (x1-x0)*i/steps
+		y := y0 + (y1-y0)*i/steps
+		img.Set(x, y, c)
+		img.Set(x, y+1, c)
+	}
+}
+
+// handleSensorChart serves a PNG chart of one sensor. from and to are
+// Unix milliseconds, as in Grafana links, and default to the last six
+// hours; range, such as 24h, charts the time up to now instead, as an
+// embedded chart would. width and height size it in pixels.
+func (s *server) handleSensorChart(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	to := time.Now()
+	from := to.Add(-chartWindow)
+	if v := q.Get("range"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("range: not a positive duration: %q", v))
+			return
+		}
+		from = to.Add(-d)
+	}
+	for name, t := range map[string]*time.Time{"from": &from, "to": &to} {
+		v := q.Get(name)
+		if v == "" {
+			continue
+		}
+		ms, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("%s: not Unix milliseconds: %q", name, v))
+			return
+		}
+		*t = time.UnixMilli(ms)
+	}
+	if !from.Before(to) {
+		writeError(w, http.StatusBadRequest, errors.New("from must be before to"))
+		return
+	}
+	width, height, err := chartSize(q)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	data, err := s.sizedSensorChart(r.Context(), r.PathValue("id"), from, to, width, height)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(data)
+}
+
+// chartSize reads a chart's width and height from a query, defaulting to
+// the size of alert charts.
+func chartSize(q url.Values) (width, height int, err error) {
+	width, height = chartWidth, chartHeight
+	for _, p := range []struct {
+		name string
+		v    *int
+		max  int
+	}{{"width", &width, chartMaxWidth}, {"height", &height, chartMaxHeight}} {
+		v := q.Get(p.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < chartMinSide || n > p.max {
+			return 0, 0, fmt.Errorf("%s must be a whole number of pixels from %d to %d, not %q", p.name, chartMinSide, p.max, v)
+		}
+		*p.v = n
+	}
+	return width, height, nil
+}
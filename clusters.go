@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+)
+
+// clusterConfig is one named deployment in the CLUSTERS_FILE.
+type clusterConfig struct {
+	// URI may refer to environment variables as $VAR or ${VAR}, or be
+	// a secret reference such as vault://secret/prod#uri, so that
+	// credentials can stay out of the file
+	URI string `json:"uri" yaml:"uri"`
+	// TLS sets the cluster's TLS options, over the MONGO_TLS variables
+	TLS mongoTLS `json:"tls" yaml:"tls"`
+}
+
+// loadClusters reads the JSON file named by CLUSTERS_FILE, which names
+// the deployments commands can be pointed at, e.g.
+// {"prod": {"uri": "${PROD_MONGO_URI}"}, "archive": {"uri": "mongodb://archive:27017"}},
+// or else takes the clusters of the -config file.
+func loadClusters() (map[string]clusterConfig, error) {
+	path := os.Getenv("CLUSTERS_FILE")
+	var clusters map[string]clusterConfig
+	switch {
+	case path != "":
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &clusters); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	case configClusters != nil:
+		path, clusters = "mongo.clusters", maps.Clone(configClusters)
+	default:
+		return nil, configError{errors.New("CLUSTERS_FILE not set in environment")}
+	}
+	for name, c := range clusters {
+		if c.URI = os.ExpandEnv(c.URI); c.URI == "" {
+			return nil, fmt.Errorf("%s: cluster %q has no uri", path, name)
+		}
+		if isSecretRef(c.URI) {
+			uri, err := readSecret(c.URI)
+			if err != nil {
+				return nil, fmt.Errorf("%s: cluster %q: %w", path, name, err)
+			}
+			c.URI = uri
+		}
+		clusters[name] = c
+	}
+	return clusters, nil
+}
+
+// clusterURI returns the URI of the named cluster. Without a name it is
+// the cluster named by MONGO_CLUSTER, or else MONGO_URI. Anything
+// containing "://" or a "sqlite:" path is taken to be a URI already, so
+// flags accept either.
+func clusterURI(name string) (string, error) {
+	if name == "" {
+		if name = os.Getenv("MONGO_CLUSTER"); name == "" {
+			uri := os.Getenv("MONGO_URI")
+			if uri == "" {
+				return "", configError{errors.New("MONGO_URI not set in environment")}
+			}
+			return uri, nil
+		}
+	}
+	if isSecretRef(name) {
+		return readSecret(name)
+	}
+	if !isClusterName(name) {
+		return name, nil
+	}
+	clusters, err := loadClusters()
+	if err != nil {
+		return "", fmt.Errorf("cluster %q: %w", name, err)
+	}
+	c, ok := clusters[name]
+	if !ok {
+		names := make([]string, 0, len(clusters))
+		for n := range clusters {
+			names = append(names, n)
+		}
+		slices.Sort(names)
+		return "", fmt.Errorf("unknown cluster %q (expected one of %s)", name, strings.Join(names, ", "))
+	}
+	return c.URI, nil
+}
+
+// isClusterName reports whether a -cluster flag names a cluster rather
+// than giving a URI.
+func isClusterName(name string) bool {
+	return !strings.Contains(name, "://") && !strings.HasPrefix(name, "sqlite:")
+}
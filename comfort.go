@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Mold risk levels, from how many hours in a row a sensor has been at or
+// above the humidity mold grows at
+const (
+	moldRiskNone     = "none"
+	moldRiskLow      = "low"
+	moldRiskModerate = "moderate"
+	moldRiskHigh     = "high"
+)
+
+// Spores germinate after a few days of damp, so the risk rises with the
+// length of a damp spell rather than with any single reading.
+const (
+	moldModerateHours = 48
+	moldHighHours     = 7 * 24
+)
+
+// moldLookback is how far before an export damp spells are traced back,
+// so one that began earlier counts in full.
+const moldLookback = moldHighHours * time.Hour
+
+// comfort are the comfort and mold-risk indices of an hour.
+type comfort struct {
+	// Humidex is how hot the air feels, in Celsius
+	Humidex float64
+	// VPD is the vapour pressure deficit in kPa, how far the air is from
+	// saturation
+	VPD float64
+	// MoldHours is how many hours in a row the humidity has been at or
+	// above the critical humidity for mold
+	MoldHours int
+	MoldRisk  string
+}
+
+// comfortOf works out the indices of a temperature in Celsius and a
+// relative humidity, with the length of the damp spell so far.
+func comfortOf(celsius, humidity float64, moldHours int) comfort {
+	return comfort{
+		Humidex:   humidex(celsius, humidity),
+		VPD:       vapourPressureDeficit(celsius, humidity),
+		MoldHours: moldHours,
+		MoldRisk:  moldRisk(moldHours),
+	}
+}
+
+// saturationPressure is the saturation vapour pressure of water in hPa,
+// by the same Magnus formula as dewPoint.
+func saturationPressure(celsius float64) float64 {
+	const b, c = 17.62, 243.12
+	return 6.112 * math.Exp(b*celsius/(c+celsius))
+}
+
+// humidex is Environment Canada's humidex.
+func humidex(celsius, humidity float64) float64 {
+	return celsius + 5.0/9*(humidity/100*saturationPressure(celsius)-10)
+}
+
+// vapourPressureDeficit is the difference between how much water the air
+// could hold and how much it does, in kPa.
+func vapourPressureDeficit(celsius, humidity float64) float64 {
+	return saturationPressure(celsius) * (1 - min(humidity, 100)/100) / 10
+}
+
+// moldCriticalHumidity is the relative humidity above which mold grows on
+// wood and similar building materials, by the VTT model of Hukka and
+// Viitanen: 80% from 20°C, rising steeply as it gets colder. Nothing
+// grows at or below freezing.
+func moldCriticalHumidity(celsius float64) float64 {
+	switch {
+	case celsius <= 0:
+		return math.Inf(1)
+	case celsius >= 20:
+		return 80
+	}
+	return -0.00267*celsius*celsius*celsius + 0.160*celsius*celsius - 3.13*celsius + 100
+}
+
+// moldRisk is the risk level of a damp spell of hours.
+func moldRisk(hours int) string {
+	switch {
+	case hours >= moldHighHours:
+		return moldRiskHigh
+	case hours >= moldModerateHours:
+		return moldRiskModerate
+	case hours > 0:
+		return moldRiskLow
+	}
+	return moldRiskNone
+}
+
+// moldDwell tracks each sensor's damp spell, hour by hour. Hours without
+// readings neither lengthen nor end a spell.
+type moldDwell map[string]int
+
+// add records an hour of a sensor, returning the length of its damp
+// spell.
+func (d moldDwell) add(sensor string, celsius, humidity float64) int {
+	if humidity >= moldCriticalHumidity(celsius) {
+		d[sensor]++
+	} else {
+		d[sensor] = 0
+	}
+	return d[sensor]
+}
+
+// moldDwellBefore traces the damp spells of each sensor up to from
+// through the hourly averages of the moldLookback before it.
+func moldDwellBefore(ctx context.Context, client *mongo.Client, store readingStore, cold *coldStore, from time.Time, sensors []string, registry map[string]sensorInfo, loc *time.Location) (moldDwell, error) {
+	cal, err := loadCalibration(ctx, sensorRegistry(client))
+	if err != nil {
+		return nil, err
+	}
+	start := from.Add(-moldLookback)
+	buckets, err := store.hourlyAverages(ctx, start, from, reportTimezone, sensors, cal)
+	if err != nil {
+		return nil, err
+	}
+	tiers := client.Database(readingsDatabase).Collection(tiersCollection)
+	if buckets, err = federate(ctx, cold, tiers, start, from, sensors, cal, buckets, hourlyKey(loc)); err != nil {
+		return nil, err
+	}
+	dwell := moldDwell{}
+	for _, b := range buckets {
+		if b.Count > 0 {
+			dwell.add(b.Sensor, sensorCelsius(registry, b.Sensor, b.Temperature), b.Humidity)
+		}
+	}
+	return dwell, nil
+}
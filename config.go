@@ -0,0 +1,479 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/yaml.v3"
+)
+
+// configFile is a YAML file of settings given with -config, instead of
+// or as well as env files. Each setting stands for the environment
+// variable named by its env tag, which overrides it when set, so
+// secrets can stay in the environment. Settings tagged "flag" are true
+// or false, for variables that only need to be set. Sensors and alert
+// rules live in MongoDB, where config apply writes them.
+type configFile struct {
+	Timezone        string `yaml:"timezone" env:"REPORT_TIMEZONE"`
+	Storage         string `yaml:"storage" env:"STORAGE"`
+	Weighting       string `yaml:"weighting" env:"AVERAGE_WEIGHTING"`
+	CalibrationFile string `yaml:"calibration_file" env:"CALIBRATION_FILE"`
+	RunTimeout      string `yaml:"run_timeout" env:"RUN_TIMEOUT"`
+	Mongo           struct {
+		URI          string `yaml:"uri" env:"MONGO_URI"`
+		Cluster      string `yaml:"cluster" env:"MONGO_CLUSTER"`
+		ClustersFile string `yaml:"clusters_file" env:"CLUSTERS_FILE"`
+		// Clusters are named deployments, as in a CLUSTERS_FILE, which
+		// takes their place when set
+		Clusters map[string]clusterConfig `yaml:"clusters"`
+		Retry    struct {
+			Attempts string `yaml:"attempts" env:"MONGO_RETRY_ATTEMPTS"`
+			Backoff  string `yaml:"backoff" env:"MONGO_RETRY_BACKOFF"`
+		} `yaml:"retry"`
+		Timeouts struct {
+			Connect string `yaml:"connect" env:"MONGO_CONNECT_TIMEOUT"`
+			Query   string `yaml:"query" env:"MONGO_QUERY_TIMEOUT"`
+		} `yaml:"timeouts"`
+		// TLS applies to every connection, and DestTLS to transfer and
+		// ping destinations, unless a cluster sets its own
+		TLS struct {
+			CAFile   string `yaml:"ca_file" env:"MONGO_TLS_CA_FILE"`
+			CertFile string `yaml:"cert_file" env:"MONGO_TLS_CERT_FILE"`
+			KeyFile  string `yaml:"key_file" env:"MONGO_TLS_KEY_FILE"`
+			Insecure string `yaml:"insecure" env:"MONGO_TLS_INSECURE,flag"`
+		} `yaml:"tls"`
+		DestTLS struct {
+			CAFile   string `yaml:"ca_file" env:"MONGO_DEST_TLS_CA_FILE"`
+			CertFile string `yaml:"cert_file" env:"MONGO_DEST_TLS_CERT_FILE"`
+			KeyFile  string `yaml:"key_file" env:"MONGO_DEST_TLS_KEY_FILE"`
+			Insecure string `yaml:"insecure" env:"MONGO_DEST_TLS_INSECURE,flag"`
+		} `yaml:"dest_tls"`
+	} `yaml:"mongo"`
+	Postgres struct {
+		URI string `yaml:"uri" env:"POSTGRES_URI"`
+	} `yaml:"postgres"`
+	Readings struct {
+		TTL        string `yaml:"ttl" env:"READINGS_TTL"`
+		TimeSeries string `yaml:"timeseries" env:"READINGS_TIMESERIES"`
+	} `yaml:"readings"`
+	Export struct {
+		CRLF string `yaml:"crlf" env:"EXPORT_CRLF,flag"`
+	} `yaml:"export"`
+	Serve struct {
+		Listen           string `yaml:"listen" env:"LISTEN_ADDR"`
+		PublicURL        string `yaml:"public_url" env:"PUBLIC_URL"`
+		GRPCAddr         string `yaml:"grpc_addr" env:"GRPC_ADDR"`
+		APIKeys          string `yaml:"api_keys" env:"API_KEYS"`
+		UploadDir        string `yaml:"upload_dir" env:"UPLOAD_DIR"`
+		UploadSigningKey string `yaml:"upload_signing_key" env:"UPLOAD_SIGNING_KEY"`
+		StormWebhook     string `yaml:"storm_webhook" env:"STORM_WEBHOOK"`
+		TrustedProxies   string `yaml:"trusted_proxies" env:"TRUSTED_PROXIES"`
+		PublicPages      string `yaml:"public_pages" env:"PUBLIC_PAGES,flag"`
+	} `yaml:"serve"`
+	Ingest struct {
+		WALDir         string `yaml:"wal_dir" env:"INGEST_WAL_DIR"`
+		DeviceKeysFile string `yaml:"device_keys_file" env:"DEVICE_KEYS_FILE"`
+		SerialDevice   string `yaml:"serial_device" env:"SERIAL_DEVICE"`
+		MQTT           struct {
+			Broker   string `yaml:"broker" env:"MQTT_BROKER"`
+			Topics   string `yaml:"topics" env:"MQTT_TOPICS"`
+			ClientID string `yaml:"client_id" env:"MQTT_CLIENT_ID"`
+			Username string `yaml:"username" env:"MQTT_USERNAME"`
+			Password string `yaml:"password" env:"MQTT_PASSWORD"`
+		} `yaml:"mqtt"`
+		HomeAssistant struct {
+			URL     string `yaml:"url" env:"HA_URL"`
+			Token   string `yaml:"token" env:"HA_TOKEN"`
+			Sensors string `yaml:"sensors" env:"HA_SENSORS"`
+		} `yaml:"home_assistant"`
+		Netatmo struct {
+			ClientID     string `yaml:"client_id" env:"NETATMO_CLIENT_ID"`
+			ClientSecret string `yaml:"client_secret" env:"NETATMO_CLIENT_SECRET"`
+			RefreshToken string `yaml:"refresh_token" env:"NETATMO_REFRESH_TOKEN"`
+		} `yaml:"netatmo"`
+		SensorPush struct {
+			Email    string `yaml:"email" env:"SENSORPUSH_EMAIL"`
+			Password string `yaml:"password" env:"SENSORPUSH_PASSWORD"`
+		} `yaml:"sensorpush"`
+	} `yaml:"ingest"`
+	Tier struct {
+		Bucket    string `yaml:"bucket" env:"TIER_BUCKET"`
+		Endpoint  string `yaml:"endpoint" env:"TIER_ENDPOINT"`
+		Region    string `yaml:"region" env:"TIER_REGION"`
+		AccessKey string `yaml:"access_key" env:"TIER_ACCESS_KEY"`
+		SecretKey string `yaml:"secret_key" env:"TIER_SECRET_KEY"`
+		Prefix    string `yaml:"prefix" env:"TIER_PREFIX"`
+		Insecure  string `yaml:"insecure" env:"TIER_INSECURE,flag"`
+		CacheDir  string `yaml:"cache_dir" env:"TIER_CACHE_DIR"`
+	} `yaml:"tier"`
+	Outdoor struct {
+		Location             string `yaml:"location" env:"OUTDOOR_LOCATION"`
+		OpenWeatherMapAPIKey string `yaml:"openweathermap_api_key" env:"OPENWEATHERMAP_API_KEY"`
+	} `yaml:"outdoor"`
+	Sinks struct {
+		Influx struct {
+			URI    string `yaml:"uri" env:"INFLUX_URI"`
+			Bucket string `yaml:"bucket" env:"INFLUX_BUCKET"`
+			Token  string `yaml:"token" env:"INFLUX_TOKEN"`
+		} `yaml:"influx"`
+		RemoteWrite struct {
+			URL   string `yaml:"url" env:"REMOTE_WRITE_URL"`
+			Token string `yaml:"token" env:"REMOTE_WRITE_TOKEN"`
+		} `yaml:"remote_write"`
+		Alerts struct {
+			Webhook          string `yaml:"webhook" env:"ALERT_WEBHOOK"`
+			Slack            string `yaml:"slack" env:"ALERT_SLACK_WEBHOOK"`
+			Discord          string `yaml:"discord" env:"ALERT_DISCORD_WEBHOOK"`
+			PagerDuty        string `yaml:"pagerduty_routing_key" env:"PAGERDUTY_ROUTING_KEY"`
+			OpsgenieAPIKey   string `yaml:"opsgenie_api_key" env:"OPSGENIE_API_KEY"`
+			OpsgenieAPIURL   string `yaml:"opsgenie_api_url" env:"OPSGENIE_API_URL"`
+			TelegramBotToken string `yaml:"telegram_bot_token" env:"TELEGRAM_BOT_TOKEN"`
+			TelegramChatIDs  string `yaml:"telegram_chat_ids" env:"TELEGRAM_CHAT_IDS"`
+			Template         string `yaml:"template" env:"ALERT_TEMPLATE"`
+			ChartURL         string `yaml:"chart_url" env:"ALERT_CHART_URL"`
+		} `yaml:"alerts"`
+	} `yaml:"sinks"`
+	Update struct {
+		Repo        string `yaml:"repo" env:"UPDATE_REPO"`
+		PublicKey   string `yaml:"public_key" env:"UPDATE_PUBLIC_KEY"`
+		GitHubToken string `yaml:"github_token" env:"GITHUB_TOKEN"`
+	} `yaml:"update"`
+	// Env sets any other variable; the settings above win over it
+	Env map[string]string `yaml:"env"`
+
+	Sensors []configSensor `yaml:"sensors"`
+	Alerts  []configAlert  `yaml:"alerts"`
+}
+
+// configSensor is a sensor to register, as with sensors add.
+type configSensor struct {
+	ID                string  `yaml:"id"`
+	Name              string  `yaml:"name"`
+	Location          string  `yaml:"location"`
+	Unit              string  `yaml:"unit"`
+	TemperatureOffset float64 `yaml:"temperature_offset"`
+	HumidityOffset    float64 `yaml:"humidity_offset"`
+}
+
+// configAlert is an alert rule, as with alerts add.
+type configAlert struct {
+	Name      string        `yaml:"name"`
+	Condition string        `yaml:"condition"`
+	Unit      string        `yaml:"unit"`
+	Sensors   []string      `yaml:"sensors"`
+	Template  string        `yaml:"template"`
+	Cooldown  time.Duration `yaml:"cooldown"`
+	Severity  string        `yaml:"severity"`
+}
+
+// configClusters are the clusters of the -config file, used when
+// CLUSTERS_FILE isn't set.
+var configClusters map[string]clusterConfig
+
+// readConfig reads a config file, rejecting settings it doesn't know so
+// a misspelt one isn't silently ignored.
+func readConfig(path string) (*configFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasSuffix(path, ".toml") {
+		return nil, fmt.Errorf("%s: TOML isn't supported; write the config as YAML", path)
+	}
+	var c configFile
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	err = dec.Decode(&c)
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		// The types are anonymous structs, too long to be of help
+		for i, e := range typeErr.Errors {
+			if field, _, ok := strings.Cut(e, " not found in type "); ok {
+				typeErr.Errors[i] = strings.Replace(field, "field ", "unknown setting ", 1)
+			}
+		}
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &c, nil
+}
+
+// vars returns the environment variables c's settings stand for,
+// leaving out those it doesn't set.
+func (c *configFile) vars() (map[string]string, error) {
+	vars := map[string]string{}
+	for k, v := range c.Env {
+		vars[k] = v
+	}
+	return vars, settingVars(reflect.ValueOf(c).Elem(), "", vars)
+}
+
+// settingVars adds the variables of the settings in the struct v to
+// vars, by their env tags. prefix is v's path in the file, for errors.
+func settingVars(v reflect.Value, prefix string, vars map[string]string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f, fv := t.Field(i), v.Field(i)
+		key := prefix + strings.Split(f.Tag.Get("yaml"), ",")[0]
+		name, kind, _ := strings.Cut(f.Tag.Get("env"), ",")
+		switch {
+		case fv.Kind() == reflect.Struct:
+			if err := settingVars(fv, key+".", vars); err != nil {
+				return err
+			}
+		case name == "" || fv.String() == "":
+		case kind == "flag":
+			on, err := strconv.ParseBool(fv.String())
+			if err != nil {
+				return fmt.Errorf("%s must be true or false, not %q", key, fv.String())
+			}
+			if on {
+				vars[name] = "1"
+			} else {
+				delete(vars, name)
+			}
+		default:
+			vars[name] = fv.String()
+		}
+	}
+	return nil
+}
+
+// applyConfig sets the variables of the config file at path that the
+// environment doesn't, and returns the file.
+func applyConfig(path string) (*configFile, error) {
+	c, err := readConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	vars, err := c.vars()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for k, v := range vars {
+		if _, set := os.LookupEnv(k); !set {
+			os.Setenv(k, v)
+		}
+	}
+	configClusters = c.Mongo.Clusters
+	return c, nil
+}
+
+// runConfig checks or applies the -config file.
+func runConfig(args []string, path string) error {
+	if len(args) == 0 || (args[0] != "validate" && args[0] != "apply") {
+		return usageError("usage: [-config FILE] config validate|apply [FILE]")
+	}
+	if len(args) > 2 {
+		return usageError(fmt.Sprintf("usage: config %s [FILE]", args[0]))
+	}
+	if len(args) == 2 {
+		path = args[1]
+	}
+	if path == "" {
+		return usageError("no config file: give one as -config FILE or after the command")
+	}
+	c, err := applyConfig(path)
+	if err != nil {
+		return configError{err}
+	}
+	problems := validateConfig(c)
+	if args[0] == "validate" || len(problems) > 0 {
+		return reportConfig(path, c, problems)
+	}
+	return applyConfigRegistry(c)
+}
+
+// validateConfig checks the settings in effect, whether from the file
+// or the environment overriding it, and the file's sensors and alert
+// rules, as the commands using them would.
+func validateConfig(c *configFile) []string {
+	var problems []string
+	check := func(err error) {
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	check(configureTimezone())
+	check(configureMongoRetry())
+	check(configureTimeouts())
+	for _, prefix := range []string{"MONGO", "MONGO_DEST"} {
+		if _, err := envMongoTLS(prefix).config(); err != nil {
+			check(fmt.Errorf("%s_TLS: %w", prefix, err))
+		}
+	}
+	if err := checkWeighting(envOr("AVERAGE_WEIGHTING", weightingSample)); err != nil {
+		check(fmt.Errorf("AVERAGE_WEIGHTING: %w", err))
+	}
+	switch storage := os.Getenv("STORAGE"); storage {
+	case "", "mongo":
+	case "postgres":
+		if os.Getenv("POSTGRES_URI") == "" {
+			check(errors.New("STORAGE is postgres but POSTGRES_URI isn't set"))
+		}
+	default:
+		check(fmt.Errorf("unknown STORAGE %q (expected mongo or postgres)", storage))
+	}
+	if _, err := clusterURI(""); err != nil {
+		check(err)
+	}
+	for name, cl := range c.Mongo.Clusters {
+		if cl.URI == "" {
+			check(fmt.Errorf("mongo.clusters: cluster %q has no uri", name))
+		}
+	}
+	if v := os.Getenv("READINGS_TTL"); v != "" {
+		if d, err := time.ParseDuration(v); err != nil || d < 0 {
+			check(fmt.Errorf("READINGS_TTL must be a duration, not %q", v))
+		}
+	}
+	if _, err := parseTrustedProxies(os.Getenv("TRUSTED_PROXIES")); err != nil {
+		check(fmt.Errorf("TRUSTED_PROXIES: %w", err))
+	}
+	if _, err := parseAlertTemplate(os.Getenv("ALERT_TEMPLATE")); err != nil {
+		check(fmt.Errorf("ALERT_TEMPLATE: %w", err))
+	}
+
+	ids := map[string]bool{}
+	for i, s := range c.Sensors {
+		switch {
+		case s.ID == "":
+			check(fmt.Errorf("sensors[%d]: id is required", i))
+		case ids[s.ID]:
+			check(fmt.Errorf("sensors[%d]: sensor %q is listed twice", i, s.ID))
+		}
+		ids[s.ID] = true
+		if s.Unit != "" && s.Unit != unitFahrenheit && s.Unit != unitCelsius {
+			check(fmt.Errorf("sensors[%d]: unit must be F or C, not %q", i, s.Unit))
+		}
+	}
+	names := map[string]bool{}
+	for i, a := range c.Alerts {
+		where := fmt.Sprintf("alerts[%d]", i)
+		if a.Name != "" {
+			where = "alert " + a.Name
+		}
+		switch {
+		case a.Name == "":
+			check(fmt.Errorf("%s: name is required", where))
+		case names[a.Name]:
+			check(fmt.Errorf("%s: listed twice", where))
+		}
+		names[a.Name] = true
+		if _, _, err := parseAlertCondition(a.Condition); err != nil {
+			check(fmt.Errorf("%s: condition: %w", where, err))
+		}
+		if a.Unit != "" && a.Unit != unitFahrenheit && a.Unit != unitCelsius {
+			check(fmt.Errorf("%s: unit must be F or C, not %q", where, a.Unit))
+		}
+		if a.Severity != "" {
+			if err := checkSeverity(a.Severity); err != nil {
+				check(fmt.Errorf("%s: %w", where, err))
+			}
+		}
+		if a.Cooldown < 0 {
+			check(fmt.Errorf("%s: cooldown must not be negative", where))
+		}
+		if _, err := parseAlertTemplate(a.Template); err != nil {
+			check(fmt.Errorf("%s: template: %w", where, err))
+		}
+	}
+	return problems
+}
+
+// reportConfig prints what the config file sets and its problems, and
+// fails if there are any.
+func reportConfig(path string, c *configFile, problems []string) error {
+	vars, _ := c.vars()
+	var overridden []string
+	for k, v := range vars {
+		if os.Getenv(k) != v {
+			overridden = append(overridden, k)
+		}
+	}
+	slices.Sort(overridden)
+	fmt.Printf("%s: %d settings, %d clusters, %d sensors, %d alert rules\n", path, len(vars), len(c.Mongo.Clusters), len(c.Sensors), len(c.Alerts))
+	if len(overridden) > 0 {
+		fmt.Printf("Overridden by the environment: %s\n", strings.Join(overridden, ", "))
+	}
+	if len(problems) == 0 {
+		fmt.Println("No problems found.")
+		return nil
+	}
+	for _, p := range problems {
+		fmt.Println("  " + p)
+	}
+	return configError{fmt.Errorf("%s: %d problems", path, len(problems))}
+}
+
+// applyConfigRegistry registers the config file's sensors and writes its
+// alert rules, updating those that exist. Sensors and rules not in the
+// file are left as they are.
+func applyConfigRegistry(c *configFile) (err error) {
+	if err := configureMongoRetry(); err != nil {
+		return configError{err}
+	}
+	if err := configureTimeouts(); err != nil {
+		return configError{err}
+	}
+	ctx, stop := commandContext()
+	defer stop()
+	connectCtx, cancel := context.WithTimeout(ctx, mongoTimeouts.connect)
+	client, err := connectMongo(connectCtx, "")
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if rerr := mongoClients.release(ctx, client); err == nil {
+			err = rerr
+		}
+	}()
+
+	upsert := options.Update().SetUpsert(true)
+	for _, s := range c.Sensors {
+		set := bson.M{
+			"name":              cmp.Or(s.Name, s.ID),
+			"temperatureUnit":   cmp.Or(s.Unit, unitFahrenheit),
+			"temperatureOffset": s.TemperatureOffset,
+			"humidityOffset":    s.HumidityOffset,
+		}
+		if s.Location != "" {
+			set["location"] = s.Location
+		}
+		update := bson.M{"$set": set, "$setOnInsert": bson.M{"createdAt": time.Now()}}
+		if _, err := sensorRegistry(client).UpdateOne(ctx, bson.M{"_id": s.ID}, update, upsert); err != nil {
+			return fmt.Errorf("sensor %s: %w", s.ID, err)
+		}
+	}
+	for _, a := range c.Alerts {
+		set := bson.M{
+			"condition": a.Condition,
+			"unit":      cmp.Or(a.Unit, unitFahrenheit),
+			"sensors":   a.Sensors,
+			"template":  a.Template,
+			"cooldown":  a.Cooldown,
+			"severity":  cmp.Or(a.Severity, severityWarning),
+		}
+		update := bson.M{"$set": set, "$setOnInsert": bson.M{"createdAt": time.Now()}}
+		if _, err := alertRules(client).UpdateOne(ctx, bson.M{"_id": a.Name}, update, upsert); err != nil {
+			return fmt.Errorf("alert rule %s: %w", a.Name, err)
+		}
+	}
+	log.Printf("Applied %d sensors and %d alert rules", len(c.Sensors), len(c.Alerts))
+	return nil
+}
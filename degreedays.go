@@ -0,0 +1,271 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// Ways of working out degree days
+const (
+	// degreeDaysMean compares each day's mean temperature with the base
+	degreeDaysMean = "mean"
+	// degreeDaysHourly adds up how far each hour was from the base, which
+	// counts a day that was cold at night and warm in the afternoon for
+	// both heating and cooling
+	degreeDaysHourly = "hourly"
+)
+
+// degreeDays are the heating and cooling degree days of a sensor over a
+// day or month.
+type degreeDays struct {
+	sensor string
+	// period is the local date, or the month as 2006-01
+	period  string
+	heating float64
+	cooling float64
+	// mean is the average of the hourly averages in Celsius, and hours
+	// how many hours had readings
+	mean  float64
+	hours int
+	days  int
+}
+
+// runStats dispatches to the statistic named by the first argument.
+func runStats(args []string) error {
+	if len(args) == 0 {
+		return usageError("usage: stats degree-days|heatmap|histogram|profile [flags]")
+	}
+	switch args[0] {
+	case "degree-days":
+		return runDegreeDays(args[1:])
+	case "heatmap":
+		return runHeatmap(args[1:])
+	case "histogram":
+		return runHistogram(args[1:])
+	case "profile":
+		return runProfile(args[1:])
+	default:
+		return usageError(fmt.Sprintf("unknown statistic %q (expected degree-days, heatmap, histogram or profile)", args[0]))
+	}
+}
+
+// runDegreeDays reports the heating and cooling degree days (HDD and
+// CDD) of each sensor per day or month in reportTimezone, to set against
+// energy bills. They are usually taken from an outdoor sensor.
+func runDegreeDays(args []string) (err error) {
+	fs := flag.NewFlagSet("stats degree-days", flag.ExitOnError)
+	format := fs.String("format", "text", "output format: text or csv")
+	start := fs.String("start", "", "report from this date, YYYY-MM-DD (default the first of last month)")
+	end := fs.String("end", "", "report up to this date, YYYY-MM-DD, exclusive (default the first of this month)")
+	sensorList := fs.String("sensor", "", "comma-separated sensor IDs to include (default all)")
+	by := fs.String("by", "day", "total per day or month")
+	base := fs.Float64("base", 18, "base temperature in °C below which a day needs heating")
+	coolingBase := fs.Float64("cooling-base", 18, "base temperature in °C above which a day needs cooling (default -base)")
+	method := fs.String("method", degreeDaysMean, "mean (from each day's mean temperature) or hourly (summing each hour's difference)")
+	cluster := fs.String("cluster", "", "cluster from CLUSTERS_FILE to read, or a MongoDB URI (default MONGO_CLUSTER, or MONGO_URI)")
+	fs.Parse(args)
+	sensors := splitList(*sensorList)
+	coolingSet := false
+	fs.Visit(func(f *flag.Flag) { coolingSet = coolingSet || f.Name == "cooling-base" })
+	if !coolingSet {
+		*coolingBase = *base
+	}
+	if *format != "text" && *format != "csv" {
+		return fmt.Errorf("unknown format %q (expected text or csv)", *format)
+	}
+	if *by != "day" && *by != "month" {
+		return fmt.Errorf("unknown -by %q (expected day or month)", *by)
+	}
+	if *method != degreeDaysMean && *method != degreeDaysHourly {
+		return fmt.Errorf("unknown -method %q (expected mean or hourly)", *method)
+	}
+	if *coolingBase < *base {
+		return errors.New("-cooling-base must not be below -base")
+	}
+	loc, err := time.LoadLocation(reportTimezone)
+	if err != nil {
+		return err
+	}
+	now := time.Now().In(loc)
+	to := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, loc)
+	from := to.AddDate(0, -1, 0)
+	if *start != "" {
+		if from, err = time.ParseInLocation(time.DateOnly, *start, loc); err != nil {
+			return fmt.Errorf("-start: %w", err)
+		}
+	}
+	if *end != "" {
+		if to, err = time.ParseInLocation(time.DateOnly, *end, loc); err != nil {
+			return fmt.Errorf("-end: %w", err)
+		}
+	}
+	if !to.After(from) {
+		return errors.New("-end must be after -start")
+	}
+
+	ctx, stop := commandContext()
+	defer stop()
+	connectCtx, cancel := context.WithTimeout(ctx, mongoTimeouts.connect)
+	client, err := connectMongo(connectCtx, *cluster)
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if rerr := mongoClients.release(ctx, client); err == nil {
+			err = rerr
+		}
+	}()
+	store, err := openReadingStore(ctx, client)
+	if err != nil {
+		return err
+	}
+	defer store.close()
+	cold, err := newColdStore()
+	if err != nil {
+		return err
+	}
+	cal, err := loadCalibration(ctx, sensorRegistry(client))
+	if err != nil {
+		return err
+	}
+	registry, err := loadSensors(ctx, sensorRegistry(client))
+	if err != nil {
+		return err
+	}
+
+	buckets, err := store.hourlyAverages(ctx, from, to, reportTimezone, sensors, cal)
+	if err != nil {
+		return err
+	}
+	tiers := client.Database(readingsDatabase).Collection(tiersCollection)
+	if buckets, err = federate(ctx, cold, tiers, from, to, sensors, cal, buckets, hourlyKey(loc)); err != nil {
+		return err
+	}
+	days := dailyDegreeDays(buckets, registry, *base, *coolingBase, *method)
+	if *by == "month" {
+		days = monthlyDegreeDays(days)
+	}
+	if *format == "csv" {
+		return printDegreeDaysCSV(days, registry)
+	}
+	return printDegreeDays(days, registry, *by, *base, *coolingBase, *method, loc)
+}
+
+// dailyDegreeDays works out the degree days of each sensor and local
+// day from hourly averages keyed by local time, in Celsius. Every hour
+// with readings counts the same, however many readings it had.
+func dailyDegreeDays(hourly []bucketAvg[string], registry map[string]sensorInfo, base, coolingBase float64, method string) []degreeDays {
+	type group struct{ day, sensor string }
+	byGroup := map[group]*degreeDays{}
+	// sums are each day's hourly temperatures, then its hourly degree days
+	sums := map[group]*[3]float64{}
+	for _, b := range hourly {
+		if b.Count == 0 {
+			continue
+		}
+		g := group{b.Key[:len(time.DateOnly)], b.Sensor}
+		d, ok := byGroup[g]
+		if !ok {
+			d = &degreeDays{sensor: b.Sensor, period: g.day, days: 1}
+			byGroup[g], sums[g] = d, &[3]float64{}
+		}
+		d.hours++
+		t := sensorCelsius(registry, b.Sensor, b.Temperature)
+		s := sums[g]
+		s[0] += t
+		s[1] += max(base-t, 0)
+		s[2] += max(t-coolingBase, 0)
+	}
+	out := make([]degreeDays, 0, len(byGroup))
+	for g, d := range byGroup {
+		s := sums[g]
+		d.mean = s[0] / float64(d.hours)
+		if method == degreeDaysHourly {
+			// Scale partial days up, as if the missing hours were alike
+			d.heating, d.cooling = s[1]/float64(d.hours), s[2]/float64(d.hours)
+		} else {
+			d.heating, d.cooling = max(base-d.mean, 0), max(d.mean-coolingBase, 0)
+		}
+		out = append(out, *d)
+	}
+	sortDegreeDays(out)
+	return out
+}
+
+// monthlyDegreeDays totals daily degree days per month.
+func monthlyDegreeDays(daily []degreeDays) []degreeDays {
+	type group struct{ month, sensor string }
+	byGroup := map[group]*degreeDays{}
+	for _, d := range daily {
+		g := group{d.period[:len("2006-01")], d.sensor}
+		m, ok := byGroup[g]
+		if !ok {
+			m = &degreeDays{sensor: d.sensor, period: g.month}
+			byGroup[g] = m
+		}
+		m.heating += d.heating
+		m.cooling += d.cooling
+		m.mean = (m.mean*float64(m.hours) + d.mean*float64(d.hours)) / float64(m.hours+d.hours)
+		m.hours += d.hours
+		m.days += d.days
+	}
+	out := make([]degreeDays, 0, len(byGroup))
+	for _, m := range byGroup {
+		out = append(out, *m)
+	}
+	sortDegreeDays(out)
+	return out
+}
+
+func sortDegreeDays(days []degreeDays) {
+	slices.SortFunc(days, func(a, b degreeDays) int {
+		return cmp.Or(cmp.Compare(a.period, b.period), cmp.Compare(a.sensor, b.sensor))
+	})
+}
+
+func printDegreeDays(days []degreeDays, registry map[string]sensorInfo, by string, base, coolingBase float64, method string, loc *time.Location) error {
+	if len(days) == 0 {
+		fmt.Println("No readings in the range.")
+		return nil
+	}
+	column := "DAY"
+	if by == "month" {
+		column = "MONTH"
+	}
+	fmt.Printf("Degree days per %s (%s), heating below %g°C and cooling above %g°C, from %s temperatures:\n", by, loc, base, coolingBase, method)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "SENSOR\t%s\tHDD\tCDD\tMEAN °C\tHOURS\n", column)
+	for _, d := range days {
+		fmt.Fprintf(w, "%s\t%s\t%.1f\t%.1f\t%.2f\t%d\n", sensorName(registry, d.sensor), d.period, d.heating, d.cooling, d.mean, d.hours)
+	}
+	return w.Flush()
+}
+
+func printDegreeDaysCSV(days []degreeDays, registry map[string]sensorInfo) error {
+	w := csv.NewWriter(os.Stdout)
+	w.Write([]string{"sensor_id", "sensor_name", "period", "hdd", "cdd", "mean_temperature", "hours", "days"})
+	for _, d := range days {
+		w.Write([]string{
+			d.sensor,
+			sensorName(registry, d.sensor),
+			d.period,
+			strconv.FormatFloat(d.heating, 'f', 2, 64),
+			strconv.FormatFloat(d.cooling, 'f', 2, 64),
+			strconv.FormatFloat(d.mean, 'f', 2, 64),
+			strconv.Itoa(d.hours),
+			strconv.Itoa(d.days),
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Collections of the device registry
+const (
+	devicesCollection      = "devices"
+	provisioningCollection = "provisioning_tokens"
+)
+
+// Scopes of device credentials. The global API_KEYS have every scope.
+const (
+	// scopeIngest writes readings and bulk uploads
+	scopeIngest = "ingest"
+	// scopeRead reads reports and aggregates
+	scopeRead = "read"
+)
+
+var errInvalidToken = errors.New("provisioning token is invalid, used or expired")
+
+// deviceInfo is an enrolled sensor or gateway and the credential it was
+// issued. Only a hash of the credential is kept.
+type deviceInfo struct {
+	ID     string   `bson:"_id" json:"id"`
+	Name   string   `bson:"name" json:"name"`
+	Scopes []string `bson:"scopes" json:"scopes"`
+	// Sensors are the sensor IDs the device may write readings for, or
+	// any when empty
+	Sensors    []string   `bson:"sensors,omitempty" json:"sensors,omitempty"`
+	KeyHash    string     `bson:"keyHash" json:"-"`
+	EnrolledAt time.Time  `bson:"enrolledAt" json:"enrolledAt"`
+	RevokedAt  *time.Time `bson:"revokedAt,omitempty" json:"revokedAt,omitempty"`
+
+	// Firmware is the version the device last reported, since
+	// FirmwareSince, and FirmwareHistory every version it reported
+	Firmware        string           `bson:"firmware,omitempty" json:"firmware,omitempty"`
+	FirmwareSince   time.Time        `bson:"firmwareSince,omitempty" json:"firmwareSince,omitempty"`
+	FirmwareHistory []firmwareChange `bson:"firmwareHistory,omitempty" json:"firmwareHistory,omitempty"`
+}
+
+// can reports whether the device's credential has scope.
+func (d *deviceInfo) can(scope string) bool {
+	return slices.Contains(d.Scopes, scope)
+}
+
+// allows reports whether the device may write readings for sensor. A nil
+// device is a global API key, which may write any.
+func (d *deviceInfo) allows(sensor string) bool {
+	return d == nil || len(d.Sensors) == 0 || slices.Contains(d.Sensors, sensor)
+}
+
+// provisioningToken is a one-time token a new device exchanges for its
+// credential. It is stored by hash, and lapses unused at ExpiresAt.
+type provisioningToken struct {
+	Hash      string     `bson:"_id"`
+	Device    string     `bson:"device"`
+	Name      string     `bson:"name"`
+	Scopes    []string   `bson:"scopes"`
+	Sensors   []string   `bson:"sensors,omitempty"`
+	CreatedAt time.Time  `bson:"createdAt"`
+	ExpiresAt time.Time  `bson:"expiresAt"`
+	UsedAt    *time.Time `bson:"usedAt,omitempty"`
+}
+
+// deviceEnrolled is the response to an enrollment, the only time the
+// credential is shown.
+type deviceEnrolled struct {
+	DeviceID string   `json:"device_id"`
+	APIKey   string   `json:"api_key"`
+	Scopes   []string `json:"scopes"`
+	Sensors  []string `json:"sensors,omitempty"`
+}
+
+func deviceRegistry(client *mongo.Client) *mongo.Collection {
+	return client.Database(readingsDatabase).Collection(devicesCollection)
+}
+
+func provisioningTokens(client *mongo.Client) *mongo.Collection {
+	return client.Database(readingsDatabase).Collection(provisioningCollection)
+}
+
+// newSecret returns a random secret for a token or credential.
+func newSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// hashSecret is how tokens and credentials are stored and looked up.
+// They are random, so an unsalted hash is enough.
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// ensureDeviceIndexes indexes devices by credential and lets MongoDB
+// delete provisioning tokens once they lapse.
+func ensureDeviceIndexes(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection(devicesCollection).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "keyHash", Value: 1}},
+	})
+	if err != nil {
+		return fmt.Errorf("indexing %s: %w", devicesCollection, err)
+	}
+	_, err = db.Collection(provisioningCollection).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		return fmt.Errorf("indexing %s: %w", provisioningCollection, err)
+	}
+	return nil
+}
+
+// deviceByKey returns the active device whose credential is key, or nil.
+func (s *server) deviceByKey(ctx context.Context, key string) (*deviceInfo, error) {
+	if key == "" {
+		return nil, nil
+	}
+	var d deviceInfo
+	err := s.devices.FindOne(ctx, bson.M{"keyHash": hashSecret(key), "revokedAt": bson.M{"$exists": false}}).Decode(&d)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+type deviceContextKey struct{}
+
+// contextDevice returns the device a request authenticated as, or nil
+// for a global API key.
+func contextDevice(ctx context.Context) *deviceInfo {
+	d, _ := ctx.Value(deviceContextKey{}).(*deviceInfo)
+	return d
+}
+
+// enroll exchanges a provisioning token for a new credential of its
+// device, using up the token, and records the firmware it reports.
+// Enrolling a device again replaces its credential, e.g. for a gateway
+// that was reflashed.
+func (s *server) enroll(ctx context.Context, token, firmware string) (deviceEnrolled, error) {
+	now := time.Now()
+	var t provisioningToken
+	err := s.provisioning.FindOneAndUpdate(ctx,
+		bson.M{"_id": hashSecret(token), "usedAt": bson.M{"$exists": false}, "expiresAt": bson.M{"$gt": now}},
+		bson.M{"$set": bson.M{"usedAt": now}},
+	).Decode(&t)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return deviceEnrolled{}, errInvalidToken
+	}
+	if err != nil {
+		return deviceEnrolled{}, err
+	}
+	key, err := newSecret()
+	if err != nil {
+		return deviceEnrolled{}, err
+	}
+	d := deviceInfo{ID: t.Device, Name: t.Name, Scopes: t.Scopes, Sensors: t.Sensors, KeyHash: hashSecret(key), EnrolledAt: now}
+	// Set rather than replace, to keep the firmware history
+	_, err = s.devices.UpdateOne(ctx, bson.M{"_id": d.ID}, bson.M{
+		"$set":   bson.M{"name": d.Name, "scopes": d.Scopes, "sensors": d.Sensors, "keyHash": d.KeyHash, "enrolledAt": d.EnrolledAt},
+		"$unset": bson.M{"revokedAt": ""},
+	}, options.Update().SetUpsert(true))
+	if err != nil {
+		return deviceEnrolled{}, err
+	}
+	log.Printf("Enrolled device %s (%s) with scopes %s", d.ID, d.Name, strings.Join(d.Scopes, ","))
+	s.firmware.record(ctx, d.ID, firmware)
+	return deviceEnrolled{DeviceID: d.ID, APIKey: key, Scopes: d.Scopes, Sensors: d.Sensors}, nil
+}
+
+// handleEnroll exchanges the provisioning token in the body, as
+// {"token": "...", "firmware": "..."}, for the device's credential. The
+// token is the request's authorisation. The firmware may also be given
+// in the firmwareHeader.
+func (s *server) handleEnroll(w http.ResponseWriter, r *http.Request) {
+	body, err := readBody(w, r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	var req struct {
+		Token    string `json:"token"`
+		Firmware string `json:"firmware"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil || req.Token == "" {
+		writeError(w, http.StatusBadRequest, errors.New(`body must be {"token": "..."}`))
+		return
+	}
+	auditIdentify(r.Context(), req.Token, nil)
+	enrolled, err := s.enroll(r.Context(), req.Token, cmp.Or(req.Firmware, r.Header.Get(firmwareHeader)))
+	if errors.Is(err, errInvalidToken) {
+		log.Printf("Rejected an enrollment with an invalid token from %s", clientIP(r))
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	auditNote(r.Context(), "enrolled", enrolled.DeviceID)
+	writeJSON(w, http.StatusCreated, enrolled)
+}
+
+// runDevices manages device enrollment.
+func runDevices(args []string) (err error) {
+	if len(args) == 0 {
+		return usageError("usage: devices token|list|status|revoke [flags]")
+	}
+
+	ctx, stop := commandContext()
+	defer stop()
+	connectCtx, cancel := context.WithTimeout(ctx, mongoTimeouts.connect)
+	client, err := connectMongo(connectCtx, "")
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if rerr := mongoClients.release(ctx, client); err == nil {
+			err = rerr
+		}
+	}()
+
+	switch args[0] {
+	case "token":
+		return createProvisioningToken(ctx, client, args[1:])
+	case "list":
+		return listDevices(ctx, deviceRegistry(client), args[1:])
+	case "status":
+		return runDevicesStatus(ctx, deviceRegistry(client), args[1:])
+	case "revoke":
+		if len(args) != 2 {
+			return usageError("usage: devices revoke ID")
+		}
+		res, err := deviceRegistry(client).UpdateOne(ctx, bson.M{"_id": args[1]}, bson.M{"$set": bson.M{"revokedAt": time.Now()}})
+		if err != nil {
+			return err
+		}
+		if res.MatchedCount == 0 {
+			return fmt.Errorf("no device %q enrolled", args[1])
+		}
+		log.Printf("Revoked the credential of device %s", args[1])
+		return nil
+	default:
+		return usageError(fmt.Sprintf("unknown devices command %q (expected token, list, status or revoke)", args[0]))
+	}
+}
+
+// createProvisioningToken issues a one-time token for a device and prints
+// it, to be entered on the device or baked into its image.
+func createProvisioningToken(ctx context.Context, client *mongo.Client, args []string) error {
+	fs := flag.NewFlagSet("devices token", flag.ExitOnError)
+	id := fs.String("id", "", "device ID to enroll (required)")
+	name := fs.String("name", "", "friendly name (defaults to the ID)")
+	scopes := fs.String("scopes", scopeIngest, "comma-separated scopes of the credential: ingest and read")
+	sensors := fs.String("sensors", "", "comma-separated sensor IDs the device may write readings for (default any)")
+	ttl := fs.Duration("ttl", 24*time.Hour, "how long the token can be used")
+	fs.Parse(args)
+
+	if *id == "" {
+		return errors.New("-id is required")
+	}
+	list := splitList(*scopes)
+	if len(list) == 0 {
+		return errors.New("-scopes must name at least one scope")
+	}
+	for _, scope := range list {
+		if scope != scopeIngest && scope != scopeRead {
+			return fmt.Errorf("unknown scope %q (expected ingest or read)", scope)
+		}
+	}
+	if *ttl <= 0 {
+		return errors.New("-ttl must be positive")
+	}
+	if *name == "" {
+		*name = *id
+	}
+	if err := ensureDeviceIndexes(ctx, client.Database(readingsDatabase)); err != nil {
+		return err
+	}
+	token, err := newSecret()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	t := provisioningToken{
+		Hash:      hashSecret(token),
+		Device:    *id,
+		Name:      *name,
+		Scopes:    list,
+		Sensors:   splitList(*sensors),
+		CreatedAt: now,
+		ExpiresAt: now.Add(*ttl),
+	}
+	if _, err := provisioningTokens(client).InsertOne(ctx, t); err != nil {
+		return err
+	}
+	log.Printf("Token for %s valid until %s; exchange it with POST /api/devices/enroll", *id, t.ExpiresAt.Format(time.DateTime))
+	fmt.Println(token)
+	return nil
+}
+
+func listDevices(ctx context.Context, coll *mongo.Collection, args []string) error {
+	fs := flag.NewFlagSet("devices list", flag.ExitOnError)
+	all := fs.Bool("all", false, "include revoked devices")
+	fs.Parse(args)
+
+	filter := bson.M{}
+	if !*all {
+		filter["revokedAt"] = bson.M{"$exists": false}
+	}
+	cursor, err := coll.Find(ctx, filter, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return err
+	}
+	var list []deviceInfo
+	if err := cursor.All(ctx, &list); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tSCOPES\tSENSORS\tFIRMWARE\tENROLLED\tSTATUS")
+	for _, d := range list {
+		status := "active"
+		if d.RevokedAt != nil {
+			status = "revoked " + d.RevokedAt.Format("2006-01-02")
+		}
+		sensors := "any"
+		if len(d.Sensors) > 0 {
+			sensors = strings.Join(d.Sensors, ",")
+		}
+		enrolled := "-"
+		if !d.EnrolledAt.IsZero() {
+			enrolled = d.EnrolledAt.Format("2006-01-02")
+		} else if d.KeyHash == "" {
+			status = "not enrolled"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			d.ID, d.Name, strings.Join(d.Scopes, ","), sensors, cmp.Or(d.Firmware, "-"), enrolled, status)
+	}
+	return w.Flush()
+}
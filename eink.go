@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// Sizes of e-ink bitmaps. The default is a common 2.9" panel.
+const (
+	einkWidth     = 296
+	einkHeight    = 128
+	einkMaxWidth  = 1600
+	einkMaxHeight = 1200
+	// einkMaxAge is how long displays are told they may keep a payload
+	einkMaxAge = 5 * time.Minute
+)
+
+// einkPalette is black on white, which PNG encodes one bit a pixel.
+var einkPalette = color.Palette{color.White, color.Black}
+
+// einkSensor is one sensor's conditions, formatted for a display that
+// only prints them. Temperatures carry their unit as C or F, since
+// small display fonts seldom have a degree sign.
+type einkSensor struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Temperature string `json:"temp"`
+	Humidity    string `json:"hum"`
+	// The lowest and highest of the last 24 hours
+	TempMin string `json:"temp_min"`
+	TempMax string `json:"temp_max"`
+	HumMin  string `json:"hum_min"`
+	HumMax  string `json:"hum_max"`
+	// At is the local time of the reading, and Stale is set when it is
+	// older than statusStale
+	At    string `json:"at"`
+	Stale bool   `json:"stale,omitempty"`
+}
+
+// einkSensors gathers the conditions of sensors, or of every sensor that
+// reported in the last week when sensors is empty.
+func (s *server) einkSensors(r *http.Request, sensors []string) ([]einkSensor, error) {
+	ctx := r.Context()
+	latest, err := s.flowLatest(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(sensors) > 0 {
+		latest = slices.DeleteFunc(latest, func(l flowLatest) bool { return !slices.Contains(sensors, l.SensorID) })
+	}
+	now := time.Now()
+	stats, err := s.flowStats(ctx, now.Add(-24*time.Hour), now, sensors)
+	if err != nil {
+		return nil, err
+	}
+	registry, err := loadSensors(ctx, s.sensors)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := time.LoadLocation(reportTimezone)
+	if err != nil {
+		return nil, err
+	}
+
+	out := []einkSensor{}
+	for _, l := range latest {
+		unit := "C"
+		if registry[l.SensorID].TemperatureUnit == unitFahrenheit {
+			unit = "F"
+		}
+		e := einkSensor{
+			ID:          l.SensorID,
+			Name:        l.Name,
+			Temperature: strconv.FormatFloat(l.Temperature, 'f', 1, 64) + unit,
+			Humidity:    strconv.FormatFloat(l.Humidity, 'f', 0, 64) + "%",
+			At:          l.UpdatedAt.In(loc).Format("15:04"),
+			Stale:       now.Sub(l.UpdatedAt) > statusStale,
+		}
+		if i := slices.IndexFunc(stats, func(st flowStats) bool { return st.SensorID == l.SensorID }); i >= 0 && stats[i].Count > 0 {
+			st := stats[i]
+			e.TempMin = strconv.FormatFloat(st.TemperatureMin, 'f', 1, 64) + unit
+			e.TempMax = strconv.FormatFloat(st.TemperatureMax, 'f', 1, 64) + unit
+			e.HumMin = strconv.FormatFloat(st.HumidityMin, 'f', 0, 64) + "%"
+			e.HumMax = strconv.FormatFloat(st.HumidityMax, 'f', 0, 64) + "%"
+		}
+		out = append(out, e)
+	}
+	return out, nil
+}
+
+// handleEink serves the current conditions and 24-hour range of
+// ?sensor= (default every sensor) for low-power e-ink displays, as
+// compact JSON, or drawn for the display as a one-bit PNG or PBM
+// (format=png or pbm) of width by height pixels. Responses carry an
+// ETag, so a display that sends If-None-Match is told 304 Not Modified
+// and can skip refreshing its panel while nothing changed.
+func (s *server) handleEink(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	format := q.Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "png" && format != "pbm" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unknown format %q (expected json, png or pbm)", format))
+		return
+	}
+	width, height := einkWidth, einkHeight
+	for _, p := range []struct {
+		name string
+		v    *int
+		max  int
+	}{{"width", &width, einkMaxWidth}, {"height", &height, einkMaxHeight}} {
+		v := q.Get(p.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < chartMinSide || n > p.max {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("%s must be a whole number of pixels from %d to %d, not %q", p.name, chartMinSide, p.max, v))
+			return
+		}
+		*p.v = n
+	}
+
+	sensors, err := s.einkSensors(r, splitList(q.Get("sensor")))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	var body []byte
+	contentType := "application/json"
+	switch format {
+	case "json":
+		body, err = json.Marshal(map[string]any{"sensors": sensors})
+	case "png":
+		var buf bytes.Buffer
+		err = png.Encode(&buf, drawEink(sensors, width, height))
+		body, contentType = buf.Bytes(), "image/png"
+	case "pbm":
+		body, contentType = einkPBM(drawEink(sensors, width, height)), "image/x-portable-bitmap"
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(einkMaxAge.Seconds())))
+	if strings.Contains(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(body)
+}
+
+// drawEink lays the sensors out in rows, each with its temperature as
+// large as fits and its name, humidity and 24-hour range beside it in
+// the 7×13 font. A stale reading's time follows the name.
+func drawEink(sensors []einkSensor, width, height int) *image.Paletted {
+	img := image.NewPaletted(image.Rect(0, 0, width, height), einkPalette)
+	if len(sensors) == 0 {
+		einkText(img, 4, 4, "No recent readings", 1)
+		return img
+	}
+	const pad, line = 4, 13
+	rowHeight := height / len(sensors)
+	for i, e := range sensors {
+		top := i * rowHeight
+		if i > 0 {
+			for x := 0; x < width; x++ {
+				img.SetColorIndex(x, top, 1)
+			}
+		}
+		// The temperature scaled to the row, leaving room for the text
+		// beside it, which takes up to 15 characters
+		text := width - 15*7 - 3*pad
+		scale := max(1, min((rowHeight-2*pad)/line, text/(len(e.Temperature)*7)))
+		einkText(img, pad, top+(rowHeight-scale*line)/2, e.Temperature, scale)
+
+		x := 2*pad + len(e.Temperature)*7*scale
+		name := e.Name
+		if e.Stale {
+			name += " " + e.At + "!"
+		}
+		lines := []string{name, e.Humidity}
+		if e.TempMin != "" {
+			lines = append(lines, e.TempMin+"-"+e.TempMax, e.HumMin+"-"+e.HumMax)
+		}
+		// As many lines as fit, the name first
+		lines = lines[:max(1, min(len(lines), (rowHeight-pad)/line))]
+		y := top + (rowHeight-len(lines)*line)/2
+		for _, l := range lines {
+			einkText(img, x, y, l, 1)
+			y += line
+		}
+	}
+	return img
+}
+
+// einkText draws s in black in the 7×13 font with its top left at
+// (x, y), each pixel scaled to scale by scale.
+func einkText(img *image.Paletted, x, y int, s string, scale int) {
+	face := basicfont.Face7x13
+	glyphs := image.NewAlpha(image.Rect(0, 0, len(s)*face.Advance, face.Height))
+	d := font.Drawer{Dst: glyphs, Src: image.Opaque, Face: face, Dot: fixed.P(0, face.Ascent)}
+	d.DrawString(s)
+	b := glyphs.Bounds()
+	for gy := b.Min.Y; gy < b.Max.Y; gy++ {
+		for gx := b.Min.X; gx < b.Max.X; gx++ {
+			if glyphs.AlphaAt(gx, gy).A < 0x80 {
+				continue
+			}
+			for dy := 0; dy < scale; dy++ {
+				for dx := 0; dx < scale; dx++ {
+					if p := image.Pt(x+gx*scale+dx, y+gy*scale+dy); p.In(img.Rect) {
+						img.SetColorIndex(p.X, p.Y, 1)
+					}
+				}
+			}
+		}
+	}
+}
+
+// einkPBM encodes img as a binary PBM, whose rows of bits, black set
+// and most significant first, are what display drivers draw.
+func einkPBM(img *image.Paletted) []byte {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "P4\n%d %d\n", w, h)
+	row := make([]byte, (w+7)/8)
+	for y := 0; y < h; y++ {
+		clear(row)
+		for x := 0; x < w; x++ {
+			if img.ColorIndexAt(x, y) == 1 {
+				row[x/8] |= 0x80 >> (x % 8)
+			}
+		}
+		buf.Write(row)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// embedRefresh is how often an embedded chart reloads by default.
+const embedRefresh = 5 * time.Minute
+
+var embedHTML = template.Must(template.New("embed").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+{{if .Refresh}}<meta http-equiv="refresh" content="{{.Refresh}}">
+{{end}}<title>{{.Name}}</title>
+<style>
+body { font-family: sans-serif; margin: 0; font-size: 14px; }
+p { margin: 0.25em 0; }
+img { display: block; max-width: 100%; height: auto; }
+</style>
+</head>
+<body>
+<p><strong>{{.Name}}</strong> {{with .Latest}}{{.}}{{else}}no recent readings{{end}}</p>
+<img src="{{.Chart}}" alt="{{.Name}}, {{.Range}}" width="{{.Width}}" height="{{.Height}}">
+<p><small>Last {{.Range}}: temperature in red, humidity in blue</small></p>
+</body>
+</html>
+`))
+
+// handleEmbed serves a small page of one sensor's latest reading and its
+// chart over the last range (24h by default), for an iframe in a wiki or
+// status page. The page reloads every refresh, 5m by default or never
+// when 0; width and height size the chart as for chart.png, which can be
+// embedded on its own with range instead.
+func (s *server) handleEmbed(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	sensor := r.PathValue("id")
+	span := q.Get("range")
+	if span == "" {
+		span = "24h"
+	}
+	if d, err := time.ParseDuration(span); err != nil || d <= 0 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("range: not a positive duration: %q", span))
+		return
+	}
+	refresh := embedRefresh
+	if v := q.Get("refresh"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("refresh: not a duration: %q", v))
+			return
+		}
+		if d > 0 && d < time.Minute {
+			writeError(w, http.StatusBadRequest, errors.New("refresh must be at least 1m"))
+			return
+		}
+		refresh = d
+	}
+	width, height, err := chartSize(q)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	latest, err := s.flowLatest(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	registry, err := loadSensors(r.Context(), s.sensors)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	chart := url.Values{
+		"range":  {span},
+		"width":  {strconv.Itoa(width)},
+		"height": {strconv.Itoa(height)},
+	}
+	data := struct {
+		Name, Latest, Range, Chart string
+		Refresh, Width, Height     int
+	}{
+		Name:  sensorName(registry, sensor),
+		Range: span,
+		// Relative to the page, so the link works behind any proxy
+		Chart:   "../api/sensors/" + url.PathEscape(sensor) + "/chart.png?" + chart.Encode(),
+		Refresh: int(refresh.Seconds()),
+		Width:   width,
+		Height:  height,
+	}
+	if i := slices.IndexFunc(latest, func(l flowLatest) bool { return l.SensorID == sensor }); i >= 0 {
+		l := latest[i]
+		unit := "°C"
+		if registry[sensor].TemperatureUnit == unitFahrenheit {
+			unit = "°F"
+		}
+		data.Latest = fmt.Sprintf("%.1f%s, %.0f%% humidity, %s ago", l.Temperature, unit, l.Humidity, roughDuration(time.Since(l.UpdatedAt)))
+	}
+	var buf bytes.Buffer
+	if err := embedHTML.Execute(&buf, data); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
+}
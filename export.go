@@ -0,0 +1,670 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"temphums_go/pipeline"
+)
+
+// reportTimezone is the zone whose local hours the export groups by,
+// set by REPORT_TIMEZONE.
+var reportTimezone = "America/Chicago"
+
+// configureTimezone reads reportTimezone from the environment.
+func configureTimezone() error {
+	v := os.Getenv("REPORT_TIMEZONE")
+	if v == "" {
+		return nil
+	}
+	if _, err := time.LoadLocation(v); err != nil {
+		return fmt.Errorf("REPORT_TIMEZONE: %w", err)
+	}
+	reportTimezone = v
+	return nil
+}
+
+// runExport prints the hourly temperature and humidity averages of
+// yesterday, or of the days given, for each sensor or rolled up by
+// location. -format sqlite archives them with the raw readings instead.
+func runExport(args []string) (err error) {
+	crlfDefault, err := envFlag("EXPORT_CRLF")
+	if err != nil {
+		return err
+	}
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", "text", "output format: text, csv, influx (line protocol) or sqlite (a database file named by -out)")
+	start := fs.String("start", "", "export from this date, YYYY-MM-DD (default yesterday)")
+	end := fs.String("end", "", "export up to this date, YYYY-MM-DD, exclusive (default the day after -start)")
+	outPath := fs.String("out", "", "write to this file instead of standard output, created with its directory if missing; the database file with -format sqlite")
+	crlf := fs.Bool("crlf", crlfDefault, "end text and CSV lines with CRLF, as Windows tools expect")
+	sensorList := fs.String("sensor", "", "comma-separated sensor IDs to include (default all)")
+	groupBy := fs.String("group-by", "sensor", "group averages by sensor or location (every room, floor and building)")
+	weighting := fs.String("weighting", envOr("AVERAGE_WEIGHTING", weightingSample), "how hourly averages are taken: sample (each reading counts once) or time (each reading counts for as long as it stood)")
+	resampleStep := fs.Duration("resample", 0, "print the raw readings resampled to this step, e.g. 5m, instead of hourly averages")
+	fill := fs.String("fill", "", "fill the hours a sensor has no readings in: null (empty row), previous or interpolate (default leave them out); with -resample, how grid points are filled: linear (the default) or hold")
+	maxGap := fs.Duration("max-gap", offlineAfter, "longest gap between readings -resample fills across")
+	precision := fs.String("precision", "", "decimals per column, e.g. temperature=1,humidity=0 (default temperature=2,humidity=2,co2=0,pressure=1,humidex=1,vpd=2)")
+	roundingMode := fs.String("rounding", roundHalfUp, "how ties are rounded: half-up (away from zero) or half-even (banker's)")
+	withAnomalies := fs.Bool("anomalies", true, "end the text report with the day's alerts, outliers, gaps and offline periods")
+	influxURI := fs.String("influx-uri", os.Getenv("INFLUX_URI"), "also write the averages to InfluxDB 2 at this influx+http(s)://HOST?org=ORG URI")
+	influxBucket := fs.String("influx-bucket", os.Getenv("INFLUX_BUCKET"), "InfluxDB bucket to write to")
+	measurement := fs.String("measurement", "temphums_hourly", "measurement of influx points")
+	remoteWrite := fs.String("remote-write", os.Getenv("REMOTE_WRITE_URL"), "also push the averages to this prom+http(s):// Prometheus remote-write endpoint")
+	filterOutliers := fs.Bool("filter-outliers", false, "drop implausible readings and spikes before averaging")
+	plausible := fs.String("plausible", "", "with -filter-outliers, bounds per metric, e.g. temperature=-40:140,humidity=0:100 (default temperature=-60:160,humidity=0:100)")
+	outlierWindow := fs.Int("outlier-window", 3, "with -filter-outliers, how many readings either side the Hampel filter compares each one with")
+	outlierThreshold := fs.Float64("outlier-threshold", 3, "with -filter-outliers, how many robust standard deviations from the window's median count as a spike")
+	dump := fs.Bool("dump-pipeline", false, "print the MongoDB aggregation pipeline of the hourly averages as extended JSON instead of running it")
+	createIndexes := fs.Bool("create-indexes", false, "create missing indexes of the readings first, with the READINGS_TTL expiry (see ensure-indexes)")
+	cluster := fs.String("cluster", "", "cluster from CLUSTERS_FILE to read, or a MongoDB URI (default MONGO_CLUSTER, or MONGO_URI)")
+	outdoor := fs.String("outdoor", "", "add each hour's outdoor temperature and humidity from this weather provider: open-meteo or openweathermap (needs OPENWEATHERMAP_API_KEY)")
+	outdoorLocation := fs.String("outdoor-location", os.Getenv("OUTDOOR_LOCATION"), "latitude,longitude of the outdoor weather, e.g. 52.37,4.89")
+	withComfort := fs.Bool("comfort", false, "add each hour's humidex, vapour pressure deficit and mold risk, from how long the humidity has stayed high")
+	vsTypical := fs.Bool("vs-typical", false, "add how far each hour's humidity and temperature were from the sensor's seasonal baseline, and their percentile rank")
+	fs.Parse(args)
+	sensors := splitList(*sensorList)
+	if *format != "text" && *format != "csv" && *format != "influx" && *format != "sqlite" {
+		return fmt.Errorf("unknown format %q (expected text, csv, influx or sqlite)", *format)
+	}
+	if *format == "sqlite" && *outPath == "" {
+		return errors.New("-format sqlite needs an -out file")
+	}
+	if *crlf && (*format == "influx" || *format == "sqlite") {
+		return errors.New("-crlf applies to text and csv output")
+	}
+
+	// Default to yesterday
+	now := time.Now()
+	from := time.Date(now.Year(), now.Month(), now.Day()-1, 0, 0, 0, 0, now.Location())
+	if *start != "" {
+		if from, err = time.ParseInLocation(time.DateOnly, *start, time.Local); err != nil {
+			return fmt.Errorf("-start: %w", err)
+		}
+	}
+	to := from.AddDate(0, 0, 1)
+	if *end != "" {
+		if to, err = time.ParseInLocation(time.DateOnly, *end, time.Local); err != nil {
+			return fmt.Errorf("-end: %w", err)
+		}
+	}
+	if !to.After(from) {
+		return errors.New("-end must be after -start")
+	}
+	if *groupBy != "sensor" && *groupBy != "location" {
+		return fmt.Errorf("unknown grouping %q (expected sensor or location)", *groupBy)
+	}
+	if *resampleStep != 0 {
+		if *resampleStep < time.Second {
+			return errors.New("-resample must be at least 1s")
+		}
+		if *format != "text" && *format != "csv" {
+			return fmt.Errorf("-resample prints text or csv, not %s", *format)
+		}
+		switch *fill {
+		case "", fillInterpolate:
+			*fill = fillLinear
+		case fillPrevious:
+			*fill = fillHold
+		}
+		if err := checkFill(*fill); err != nil {
+			return fmt.Errorf("-fill: %w", err)
+		}
+	} else if *fill != "" {
+		if *fill, err = checkHourFill(*fill); err != nil {
+			return fmt.Errorf("-fill: %w", err)
+		}
+		if *format != "text" && *format != "csv" {
+			return fmt.Errorf("-fill prints text or csv, not %s", *format)
+		}
+		if *groupBy == "location" {
+			return errors.New("-fill fills each sensor's hours; it can't be combined with -group-by location")
+		}
+	}
+	rnd, err := parseRounding(*precision, *roundingMode)
+	if err != nil {
+		return err
+	}
+	if err := checkWeighting(*weighting); err != nil {
+		return fmt.Errorf("-weighting: %w", err)
+	}
+	var filter *outlierFilter
+	if *filterOutliers {
+		if *resampleStep != 0 {
+			return errors.New("-filter-outliers applies to hourly averages, not -resample")
+		}
+		if filter, err = parseOutlierFilter(*plausible, *outlierWindow, *outlierThreshold); err != nil {
+			return fmt.Errorf("-filter-outliers: %w", err)
+		}
+	}
+	if *dump && (*resampleStep != 0 || *weighting == weightingTime || *filterOutliers) {
+		return errors.New("-dump-pipeline shows the hourly aggregation; -resample, time weighting and -filter-outliers read the raw readings instead")
+	}
+	if *remoteWrite != "" && *groupBy == "location" {
+		// Series carry a location label to aggregate by instead
+		return errors.New("-remote-write pushes per-sensor averages; it can't be combined with -group-by location")
+	}
+	var weather weatherSource
+	if *outdoor != "" {
+		if (*format != "text" && *format != "csv") || *resampleStep != 0 {
+			return errors.New("-outdoor adds columns to text and csv hourly averages")
+		}
+		if *outdoorLocation == "" {
+			return errors.New("-outdoor needs -outdoor-location or OUTDOOR_LOCATION")
+		}
+		if weather, err = newWeatherSource(*outdoor, *outdoorLocation); err != nil {
+			return fmt.Errorf("-outdoor: %w", err)
+		}
+	}
+	if *withComfort && ((*format != "text" && *format != "csv") || *resampleStep != 0 || *groupBy == "location") {
+		return errors.New("-comfort adds columns to text and csv hourly averages per sensor")
+	}
+	if *vsTypical && ((*format != "text" && *format != "csv") || *resampleStep != 0 || *groupBy == "location") {
+		return errors.New("-vs-typical adds columns to text and csv hourly averages per sensor")
+	}
+	var influx *influxWriter
+	if *influxURI != "" {
+		if *influxBucket == "" {
+			return errors.New("-influx-uri needs -influx-bucket or INFLUX_BUCKET")
+		}
+		if influx, err = newInfluxWriter(*influxURI, *influxBucket, *measurement); err != nil {
+			return err
+		}
+	}
+
+	// Define the context and timeout for the connection
+	ctx, stop := commandContext()
+	defer stop()
+	connectCtx, cancel := context.WithTimeout(ctx, mongoTimeouts.connect)
+	client, err := connectMongo(connectCtx, *cluster)
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if rerr := mongoClients.release(ctx, client); err == nil {
+			err = rerr
+		}
+	}()
+	if *createIndexes {
+		if err := ensureIndexes(ctx, client, readingsTTL()); err != nil {
+			return err
+		}
+	}
+
+	store, err := openReadingStore(ctx, client)
+	if err != nil {
+		return err
+	}
+	defer store.close()
+
+	// -format sqlite writes the -out file itself
+	out, closeOut := io.Writer(os.Stdout), func() error { return nil }
+	if *format != "sqlite" {
+		if out, closeOut, err = createOutput(*outPath, *crlf); err != nil {
+			return err
+		}
+	}
+	defer func() {
+		if cerr := closeOut(); err == nil {
+			err = cerr
+		}
+	}()
+
+	cold, err := newColdStore()
+	if err != nil {
+		return err
+	}
+
+	if *dump {
+		if _, ok := store.(*mongoStore); !ok {
+			return errors.New("-dump-pipeline needs the MongoDB store, not STORAGE=" + os.Getenv("STORAGE"))
+		}
+		cal, err := loadCalibration(ctx, sensorRegistry(client))
+		if err != nil {
+			return err
+		}
+		data, err := pipeline.ExtJSON(hourlyPipeline(from, to, reportTimezone, sensors, cal))
+		if err != nil {
+			return err
+		}
+		// The rest happens in Go, after the aggregation
+		log.Printf("Pipeline for %s.%s; archived readings are merged in afterwards", readingsDatabase, readingsCollection)
+		_, err = out.Write(data)
+		return err
+	}
+
+	if *resampleStep != 0 {
+		// Read a gap's length either side so the ends can be filled
+		history, err := readHistory(ctx, store, client, cold, from.Add(-*maxGap), to.Add(*maxGap), sensors)
+		if err != nil {
+			return err
+		}
+		cal, err := loadCalibration(ctx, sensorRegistry(client))
+		if err != nil {
+			return err
+		}
+		registry, err := loadSensors(ctx, sensorRegistry(client))
+		if err != nil {
+			return err
+		}
+		// Times print in the report's zone, like the hourly averages
+		loc, err := time.LoadLocation(reportTimezone)
+		if err != nil {
+			return err
+		}
+		return printResampled(out, *format, resample(history, cal, from, to, *resampleStep, *maxGap, *fill), registry, loc, rnd)
+	}
+
+	rep, err := buildReport(ctx, client, store, cold, from, to, sensors, *groupBy, *weighting, *withAnomalies && *format == "text", filter)
+	if err != nil {
+		return err
+	}
+	if rep.filtered != nil {
+		log.Printf("Outliers: %s", rep.filtered)
+	}
+
+	if *format == "sqlite" {
+		history, err := readHistory(ctx, store, client, cold, from, to, sensors)
+		if err != nil {
+			return err
+		}
+		return writeSQLiteArchive(ctx, *outPath, history, rep)
+	}
+
+	if *remoteWrite != "" {
+		rw, err := newRemoteWriter(*remoteWrite, "temphums_hourly", rep.registry)
+		if err != nil {
+			return err
+		}
+		averages := make([]reading, len(rep.sensors))
+		for i, b := range rep.sensors {
+			hour, err := time.ParseInLocation(time.DateTime, b.Key, rep.loc)
+			if err != nil {
+				return err
+			}
+			averages[i] = reading{SensorID: b.Sensor, Temperature: b.Temperature, Humidity: b.Humidity, CO2: b.CO2, Pressure: b.Pressure, UpdatedAt: hour}
+		}
+		if err := rw.push(ctx, averages); err != nil {
+			return err
+		}
+		log.Printf("Pushed %d hourly averages to %s", len(averages), rw)
+	}
+
+	if *format == "influx" || influx != nil {
+		var points bytes.Buffer
+		if *groupBy == "location" {
+			err = locationPoints(&points, *measurement, rep.locations, rep.loc)
+		} else {
+			err = sensorPoints(&points, *measurement, rep.sensors, rep.registry, rep.loc)
+		}
+		if err != nil {
+			return err
+		}
+		if influx != nil {
+			if err := influx.post(ctx, points.Bytes()); err != nil {
+				return err
+			}
+			log.Printf("Wrote %d points to %s", bytes.Count(points.Bytes(), []byte("\n")), influx)
+		}
+		if *format == "influx" {
+			_, err := out.Write(points.Bytes())
+			return err
+		}
+	}
+
+	var outside map[string]outdoorConditions
+	if weather != nil {
+		if outside, err = outdoorByHour(ctx, weather, from, to, rep.loc); err != nil {
+			return err
+		}
+	}
+	if *groupBy == "location" {
+		if err := printLocationAverages(out, *format, rep.locations, outside, rnd); err != nil {
+			return err
+		}
+	} else {
+		results := rep.sensors
+		if *fill != "" {
+			results = fillHours(results, expectedSensors(rep.registry, sensors, results, from, to), from, to, time.Now(), rep.loc, *fill)
+		}
+		var dwell moldDwell
+		if *withComfort {
+			if dwell, err = moldDwellBefore(ctx, client, store, cold, from, sensors, rep.registry, rep.loc); err != nil {
+				return err
+			}
+		}
+		var typical *typicalHours
+		if *vsTypical {
+			library, err := loadBaselines(ctx, client.Database(readingsDatabase).Collection(baselinesCollection), sensors)
+			if err != nil {
+				return err
+			}
+			if len(library) == 0 {
+				log.Print("No seasonal baselines yet; run anomalies baselines or serve to compare with them")
+			}
+			typical = &typicalHours{library, rep.loc}
+		}
+		if err := printSensorAverages(out, *format, results, rep.registry, outside, dwell, typical, rnd); err != nil {
+			return err
+		}
+	}
+	if *withAnomalies && *format == "text" {
+		fmt.Fprintln(out)
+		printAnomalies(out, rep.anomalies, rep.registry, rep.loc)
+	}
+	return nil
+}
+
+// dayAnomalies finds the anomalies in the readings of [from, to) and
+// replays them through the alert rules to see when they fired.
+func dayAnomalies(ctx context.Context, client *mongo.Client, store readingStore, cold *coldStore, cal calibration, registry map[string]sensorInfo, from, to time.Time) ([]anomaly, error) {
+	history, err := readHistory(ctx, store, client, cold, from, to, nil)
+	if err != nil {
+		return nil, err
+	}
+	e := &alertEngine{
+		readings: store,
+		rules:    alertRules(client),
+		sensors:  sensorRegistry(client),
+		state:    map[alertKey]*alertState{},
+		latest:   map[string]reading{},
+		drill:    true,
+	}
+	if e.template, err = parseAlertTemplate(""); err != nil {
+		return nil, err
+	}
+	if err := e.reload(ctx); err != nil {
+		return nil, err
+	}
+	for _, r := range history {
+		e.evaluate(ctx, r)
+	}
+	anomalies := alertAnomalies(alertEpisodes(e.events, to), e.compiled)
+	return append(anomalies, findAnomalies(history, cal, registry, from, to)...), nil
+}
+
+// printSensorAverages prints hourly averages per sensor, with the
+// outdoor weather of each hour unless outdoor is nil, the comfort
+// indices unless dwell is nil, and the comparison with the seasonal
+// baseline unless typical is nil. dwell carries the damp spells from
+// before the first hour, and is updated hour by hour.
+func printSensorAverages(out io.Writer, format string, results []bucketAvg[string], registry map[string]sensorInfo, outdoor map[string]outdoorConditions, dwell moldDwell, typical *typicalHours, rnd outputRounding) error {
+	switch format {
+	case "text":
+		for _, result := range results {
+			if math.IsNaN(result.Temperature) {
+				// An hour -fill had nothing to fill from
+				fmt.Fprintf(out, "Hour: %s, Sensor: %s, no data%s\n", result.Key, sensorName(registry, result.Sensor), outdoorText(outdoor, result.Key, sensorUnit(registry, result.Sensor), rnd))
+				continue
+			}
+			fmt.Fprintf(out, "Hour: %s, Sensor: %s, Avg Humidity: %s, Avg Temperature: %s%s%s%s%s\n",
+				result.Key, sensorName(registry, result.Sensor), rnd.format("humidity", result.Humidity), rnd.format("temperature", result.Temperature),
+				airQualityText(result.CO2, result.Pressure, rnd), comfortText(dwell, result, registry, rnd), typical.text(result, rnd), outdoorText(outdoor, result.Key, sensorUnit(registry, result.Sensor), rnd))
+		}
+		return nil
+	case "csv":
+		w := csv.NewWriter(out)
+		w.Write(outdoorColumns(outdoor, typical.columns(comfortColumns(dwell, []string{"hour", "sensor_id", "sensor_name", "avg_humidity", "avg_temperature", "avg_co2", "avg_pressure"}))))
+		for _, result := range results {
+			var humidity, temperature string
+			if !math.IsNaN(result.Temperature) {
+				humidity, temperature = rnd.format("humidity", result.Humidity), rnd.format("temperature", result.Temperature)
+			}
+			w.Write(outdoorValues(outdoor, result.Key, sensorUnit(registry, result.Sensor), rnd, typical.values(result, rnd, comfortValues(dwell, result, registry, rnd, []string{
+				result.Key,
+				result.Sensor,
+				sensorName(registry, result.Sensor),
+				humidity,
+				temperature,
+				rnd.optional("co2", result.CO2),
+				rnd.optional("pressure", result.Pressure),
+			}))))
+		}
+		w.Flush()
+		return w.Error()
+	}
+	return nil
+}
+
+// sensorPoints writes hourly averages per sensor as line protocol, each
+// point at the start of its hour in loc.
+func sensorPoints(buf *bytes.Buffer, measurement string, results []bucketAvg[string], registry map[string]sensorInfo, loc *time.Location) error {
+	for _, result := range results {
+		hour, err := time.ParseInLocation(time.DateTime, result.Key, loc)
+		if err != nil {
+			return err
+		}
+		writeInfluxPoint(buf, measurement, []string{"sensor", result.Sensor, "name", registry[result.Sensor].Name}, []influxField{
+			{"temperature", &result.Temperature},
+			{"humidity", &result.Humidity},
+			{"co2", result.CO2},
+			{"pressure", result.Pressure},
+		}, hour)
+	}
+	return nil
+}
+
+// locationPoints writes hourly averages per location as line protocol,
+// each point at the start of its hour in loc.
+func locationPoints(buf *bytes.Buffer, measurement string, results []locationAvg, loc *time.Location) error {
+	for _, result := range results {
+		hour, err := time.ParseInLocation(time.DateTime, result.Key, loc)
+		if err != nil {
+			return err
+		}
+		writeInfluxPoint(buf, measurement, []string{"location", result.Location, "level", strconv.Itoa(result.Level)}, []influxField{
+			{"temperature", &result.Temperature},
+			{"humidity", &result.Humidity},
+			{"co2", result.CO2},
+			{"pressure", result.Pressure},
+		}, hour)
+	}
+	return nil
+}
+
+// airQualityText describes the optional metrics of a text export line,
+// or returns "" for sensors that report neither.
+func airQualityText(co2, pressure *float64, rnd outputRounding) string {
+	var s string
+	if co2 != nil {
+		s += ", Avg CO2: " + rnd.format("co2", *co2)
+	}
+	if pressure != nil {
+		s += ", Avg Pressure: " + rnd.format("pressure", *pressure)
+	}
+	return s
+}
+
+// printLocationAverages prints hourly averages rolled up by location,
+// with the outdoor weather of each hour unless outdoor is nil.
+func printLocationAverages(out io.Writer, format string, results []locationAvg, outdoor map[string]outdoorConditions, rnd outputRounding) error {
+	switch format {
+	case "text":
+		for _, result := range results {
+			fmt.Fprintf(out, "Hour: %s, Location: %s, Sensors: %d, Avg Humidity: %s, Avg Temperature: %s%s%s\n",
+				result.Key, result.Location, result.Sensors, rnd.format("humidity", result.Humidity), rnd.format("temperature", result.Temperature),
+				airQualityText(result.CO2, result.Pressure, rnd), outdoorText(outdoor, result.Key, unitCelsius, rnd))
+		}
+		return nil
+	case "csv":
+		w := csv.NewWriter(out)
+		w.Write(outdoorColumns(outdoor, []string{"hour", "location", "level", "sensors", "avg_humidity", "avg_temperature", "avg_co2", "avg_pressure"}))
+		for _, result := range results {
+			w.Write(outdoorValues(outdoor, result.Key, unitCelsius, rnd, []string{
+				result.Key,
+				result.Location,
+				strconv.Itoa(result.Level),
+				strconv.Itoa(result.Sensors),
+				rnd.format("humidity", result.Humidity),
+				rnd.format("temperature", result.Temperature),
+				rnd.optional("co2", result.CO2),
+				rnd.optional("pressure", result.Pressure),
+			}))
+		}
+		w.Flush()
+		return w.Error()
+	}
+	return nil
+}
+
+// comfortText describes the comfort indices of an hour for a text export
+// line, or returns "" without -comfort.
+func comfortText(dwell moldDwell, result bucketAvg[string], registry map[string]sensorInfo, rnd outputRounding) string {
+	if dwell == nil {
+		return ""
+	}
+	celsius := sensorCelsius(registry, result.Sensor, result.Temperature)
+	c := comfortOf(celsius, result.Humidity, dwell.add(result.Sensor, celsius, result.Humidity))
+	return fmt.Sprintf(", Humidex: %s, VPD: %s kPa, Mold Risk: %s (%dh)", rnd.format("humidex", c.Humidex), rnd.format("vpd", c.VPD), c.MoldRisk, c.MoldHours)
+}
+
+// comfortColumns adds the comfort columns to a CSV header with -comfort.
+func comfortColumns(dwell moldDwell, header []string) []string {
+	if dwell == nil {
+		return header
+	}
+	return append(header, "humidex", "vpd_kpa", "mold_hours", "mold_risk")
+}
+
+// comfortValues adds the comfort indices of an hour to a CSV row with
+// -comfort, leaving them empty for hours -fill had nothing to fill from.
+func comfortValues(dwell moldDwell, result bucketAvg[string], registry map[string]sensorInfo, rnd outputRounding, row []string) []string {
+	if dwell == nil {
+		return row
+	}
+	if math.IsNaN(result.Temperature) {
+		return append(row, "", "", "", "")
+	}
+	celsius := sensorCelsius(registry, result.Sensor, result.Temperature)
+	c := comfortOf(celsius, result.Humidity, dwell.add(result.Sensor, celsius, result.Humidity))
+	return append(row, rnd.format("humidex", c.Humidex), rnd.format("vpd", c.VPD), strconv.Itoa(c.MoldHours), c.MoldRisk)
+}
+
+// typicalMetrics are the metrics -vs-typical compares, in column order.
+var typicalMetrics = []string{"humidity", "temperature"}
+
+// typicalHours compares hourly averages, keyed by local time in loc,
+// with the seasonal baselines of their sensors, for -vs-typical.
+type typicalHours struct {
+	baselines baselineLibrary
+	loc       *time.Location
+}
+
+// versus compares one metric of an hour with its baseline.
+func (t *typicalHours) versus(result bucketAvg[string], metric string) (delta, rank float64, ok bool) {
+	v, ok := bucketMetric(result, metric)
+	if !ok || math.IsNaN(v) {
+		return 0, 0, false
+	}
+	hour, err := time.ParseInLocation(time.DateTime, result.Key, t.loc)
+	if err != nil {
+		return 0, 0, false
+	}
+	return t.baselines.versus(result.Sensor, metric, hour, v)
+}
+
+// text describes how an hour compares with its baseline for a text
+// export line, or returns "" without -vs-typical.
+func (t *typicalHours) text(result bucketAvg[string], rnd outputRounding) string {
+	if t == nil {
+		return ""
+	}
+	var s string
+	for _, metric := range typicalMetrics {
+		delta, rank, ok := t.versus(result, metric)
+		if !ok {
+			continue
+		}
+		s += fmt.Sprintf(", %s vs Typical: %s (P%.0f)", strings.ToUpper(metric[:1])+metric[1:], signed(rnd.format(metric, delta)), rank)
+	}
+	if s == "" {
+		return ", vs Typical: no baseline"
+	}
+	return s
+}
+
+// columns adds the comparison columns to a CSV header with -vs-typical.
+func (t *typicalHours) columns(header []string) []string {
+	if t == nil {
+		return header
+	}
+	for _, metric := range typicalMetrics {
+		header = append(header, metric+"_vs_typical", metric+"_typical_rank")
+	}
+	return header
+}
+
+// values adds how an hour compares with its baseline to a CSV row with
+// -vs-typical, leaving metrics without a baseline for the hour empty.
+func (t *typicalHours) values(result bucketAvg[string], rnd outputRounding, row []string) []string {
+	if t == nil {
+		return row
+	}
+	for _, metric := range typicalMetrics {
+		delta, rank, ok := t.versus(result, metric)
+		if !ok {
+			row = append(row, "", "")
+			continue
+		}
+		row = append(row, signed(rnd.format(metric, delta)), strconv.FormatFloat(rank, 'f', 0, 64))
+	}
+	return row
+}
+
+// signed marks a formatted difference that isn't negative with "+".
+func signed(s string) string {
+	if strings.HasPrefix(s, "-") {
+		return s
+	}
+	return "+" + s
+}
+
+// outdoorText describes the outdoor weather of an hour for a text export
+// line, its temperature in unit, or returns "" without -outdoor.
+func outdoorText(outdoor map[string]outdoorConditions, hour, unit string, rnd outputRounding) string {
+	if outdoor == nil {
+		return ""
+	}
+	c, ok := outdoor[hour]
+	if !ok {
+		return ", Outdoor: no data"
+	}
+	return ", Outdoor Humidity: " + rnd.format("humidity", c.Humidity) + ", Outdoor Temperature: " + rnd.format("temperature", c.temperatureIn(unit)) + unit
+}
+
+// outdoorColumns adds the outdoor weather columns to a CSV header with
+// -outdoor.
+func outdoorColumns(outdoor map[string]outdoorConditions, header []string) []string {
+	if outdoor == nil {
+		return header
+	}
+	return append(header, "outdoor_temp", "outdoor_humidity", "outdoor_temp_unit")
+}
+
+// outdoorValues adds the outdoor weather of an hour to a CSV row with
+// -outdoor, its temperature in unit, leaving it empty where the provider
+// has none.
+func outdoorValues(outdoor map[string]outdoorConditions, hour, unit string, rnd outputRounding, row []string) []string {
+	if outdoor == nil {
+		return row
+	}
+	c, ok := outdoor[hour]
+	if !ok {
+		return append(row, "", "", unit)
+	}
+	return append(row, rnd.format("temperature", c.temperatureIn(unit)), rnd.format("humidity", c.Humidity), unit)
+}
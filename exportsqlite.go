@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+)
+
+// writeSQLiteArchive writes a range's raw readings, its hourly averages
+// and the sensor registry to tables of a SQLite file for offline
+// analysis. Rows already there for the same keys are replaced, so
+// overlapping ranges can be archived to one file.
+func writeSQLiteArchive(ctx context.Context, path string, history []reading, rep *report) error {
+	w, err := openSQLWriter(ctx, "sqlite", path, "readings")
+	if err != nil {
+		return err
+	}
+	defer w.db.Close()
+	// Readings are stored uncorrected, as in the database; the sensors
+	// table has the offsets
+	if err := w.insert(ctx, history, nil); err != nil {
+		return err
+	}
+
+	tx, err := w.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS sensors (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		location TEXT,
+		temperature_unit TEXT,
+		temperature_offset REAL NOT NULL,
+		humidity_offset REAL NOT NULL,
+		retired_at TEXT
+	)`)
+	if err != nil {
+		return err
+	}
+	for _, s := range rep.registry {
+		var retired *string
+		if s.RetiredAt != nil {
+			at := s.RetiredAt.UTC().Format(sqliteTime)
+			retired = &at
+		}
+		_, err := tx.ExecContext(ctx, `INSERT OR REPLACE INTO sensors VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			s.ID, s.Name, s.Location, s.TemperatureUnit, s.TemperatureOffset, s.HumidityOffset, retired)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Averages are calibrated and keyed by local hour, as exported
+	table := "hourly_averages"
+	if rep.groupBy == "location" {
+		table = "hourly_location_averages"
+		_, err = tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS hourly_location_averages (
+			hour TEXT NOT NULL,
+			location TEXT NOT NULL,
+			level INTEGER NOT NULL,
+			sensors INTEGER NOT NULL,
+			readings INTEGER NOT NULL,
+			avg_humidity REAL NOT NULL,
+			avg_temperature REAL NOT NULL,
+			avg_co2 REAL,
+			avg_pressure REAL,
+			PRIMARY KEY (hour, location)
+		)`)
+		if err != nil {
+			return err
+		}
+		for _, l := range rep.locations {
+			_, err := tx.ExecContext(ctx, `INSERT OR REPLACE INTO hourly_location_averages VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				l.Key, l.Location, l.Level, l.Sensors, l.Count, l.Humidity, l.Temperature, l.CO2, l.Pressure)
+			if err != nil {
+				return err
+			}
+		}
+	} else {
+		_, err = tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS hourly_averages (
+			hour TEXT NOT NULL,
+			sensor_id TEXT NOT NULL,
+			readings INTEGER NOT NULL,
+			avg_humidity REAL NOT NULL,
+			avg_temperature REAL NOT NULL,
+			avg_co2 REAL,
+			avg_pressure REAL,
+			PRIMARY KEY (hour, sensor_id)
+		)`)
+		if err != nil {
+			return err
+		}
+		for _, b := range rep.sensors {
+			_, err := tx.ExecContext(ctx, `INSERT OR REPLACE INTO hourly_averages VALUES (?, ?, ?, ?, ?, ?, ?)`,
+				b.Key, b.Sensor, b.Count, b.Humidity, b.Temperature, b.CO2, b.Pressure)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("writing %s: %w", path, err)
+	}
+	log.Printf("Archived %d readings and %d hourly averages to %s (tables readings, %s and sensors)",
+		len(history), len(rep.sensors)+len(rep.locations), path, table)
+	return nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// firmwareHeader is the HTTP header, and in lower case the gRPC metadata,
+// in which devices report their firmware or agent version. Collectors
+// publishing over MQTT send it as the payload's "firmware" instead.
+const firmwareHeader = "X-Firmware-Version"
+
+// maxFirmwareLength bounds a reported version, as devices send it unchecked.
+const maxFirmwareLength = 64
+
+// firmwareChange is when a device was first seen on a version.
+type firmwareChange struct {
+	Version string    `bson:"version" json:"version"`
+	Since   time.Time `bson:"since" json:"since"`
+}
+
+// firmwareUpdate is a device's move from one version to another, from
+// being "" for its first.
+type firmwareUpdate struct {
+	device, from string
+	to           firmwareChange
+}
+
+// firmwareRecorder keeps the firmware versions of devices in the device
+// registry, with the history of their changes. Versions already recorded
+// are remembered, so only a change costs a write.
+type firmwareRecorder struct {
+	devices *mongo.Collection
+	mu      sync.Mutex
+	seen    map[string]string
+}
+
+func newFirmwareRecorder(devices *mongo.Collection) *firmwareRecorder {
+	return &firmwareRecorder{devices: devices, seen: map[string]string{}}
+}
+
+// record notes that device reported version. Devices that aren't
+// enrolled, such as sensors publishing over MQTT, are added to the
+// registry without a credential.
+func (f *firmwareRecorder) record(ctx context.Context, device, version string) {
+	version = strings.TrimSpace(version)
+	if f == nil || device == "" || version == "" {
+		return
+	}
+	if len(version) > maxFirmwareLength {
+		version = version[:maxFirmwareLength]
+	}
+	f.mu.Lock()
+	known := f.seen[device] == version
+	f.mu.Unlock()
+	if known {
+		return
+	}
+
+	now := time.Now()
+	_, err := f.devices.UpdateOne(ctx,
+		bson.M{"_id": device, "firmware": bson.M{"$ne": version}},
+		bson.M{
+			"$set":         bson.M{"firmware": version, "firmwareSince": now},
+			"$push":        bson.M{"firmwareHistory": firmwareChange{Version: version, Since: now}},
+			"$setOnInsert": bson.M{"name": device},
+		},
+		options.Update().SetUpsert(true),
+	)
+	// A device already on the version doesn't match, so the upsert
+	// collides with it
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		log.Printf("Recording the firmware of %s: %v", device, err)
+		return
+	}
+	if err == nil {
+		log.Printf("Device %s reports firmware %s", device, version)
+	}
+	f.mu.Lock()
+	f.seen[device] = version
+	f.mu.Unlock()
+}
+
+// runDevicesStatus reports how many devices run each firmware version,
+// and the updates of the last -days, to set against changes in data
+// quality.
+func runDevicesStatus(ctx context.Context, coll *mongo.Collection, args []string) error {
+	fs := flag.NewFlagSet("devices status", flag.ExitOnError)
+	days := fs.Int("days", 30, "list the firmware updates of this many days")
+	fs.Parse(args)
+
+	cursor, err := coll.Find(ctx, bson.M{"revokedAt": bson.M{"$exists": false}}, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return err
+	}
+	var list []deviceInfo
+	if err := cursor.All(ctx, &list); err != nil {
+		return err
+	}
+	if len(list) == 0 {
+		fmt.Println("No devices.")
+		return nil
+	}
+
+	type share struct {
+		version string
+		devices []string
+		// since is when the first device moved to the version
+		since time.Time
+	}
+	byVersion := map[string]*share{}
+	var updates []firmwareUpdate
+	cutoff := time.Now().AddDate(0, 0, -*days)
+	for _, d := range list {
+		version := cmp.Or(d.Firmware, "(unknown)")
+		sh, ok := byVersion[version]
+		if !ok {
+			sh = &share{version: version}
+			byVersion[version] = sh
+		}
+		sh.devices = append(sh.devices, d.ID)
+		if !d.FirmwareSince.IsZero() && (sh.since.IsZero() || d.FirmwareSince.Before(sh.since)) {
+			sh.since = d.FirmwareSince
+		}
+		for i, c := range d.FirmwareHistory {
+			if c.Since.Before(cutoff) {
+				continue
+			}
+			u := firmwareUpdate{device: d.ID, to: c}
+			if i > 0 {
+				u.from = d.FirmwareHistory[i-1].Version
+			}
+			updates = append(updates, u)
+		}
+	}
+	shares := make([]*share, 0, len(byVersion))
+	for _, sh := range byVersion {
+		shares = append(shares, sh)
+	}
+	slices.SortFunc(shares, func(a, b *share) int {
+		return cmp.Or(cmp.Compare(len(b.devices), len(a.devices)), cmp.Compare(a.version, b.version))
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FIRMWARE\tDEVICES\tSHARE\tSINCE\tIDS")
+	for _, sh := range shares {
+		since := ""
+		if !sh.since.IsZero() {
+			since = sh.since.Local().Format(time.DateTime)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%.0f%%\t%s\t%s\n", sh.version, len(sh.devices), 100*float64(len(sh.devices))/float64(len(list)), since, strings.Join(sh.devices, ","))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Printf("\nFirmware updates in the last %d days:\n", *days)
+	if len(updates) == 0 {
+		fmt.Println("None.")
+		return nil
+	}
+	slices.SortFunc(updates, func(a, b firmwareUpdate) int { return a.to.Since.Compare(b.to.Since) })
+	w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "AT\tDEVICE\tFROM\tTO")
+	for _, u := range updates {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", u.to.Since.Local().Format(time.DateTime), u.device, cmp.Or(u.from, "-"), u.to.Version)
+	}
+	return w.Flush()
+}
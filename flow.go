@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// The flow API offers flat, snake_case shapes for low-code tools such
+// as Node-RED and n8n. Its fields are only ever added to, never renamed
+// or removed, so flows built on it keep working.
+
+// flowLatestWindow is how far back the latest reading of a sensor is
+// looked for.
+const flowLatestWindow = 7 * 24 * time.Hour
+
+// flowMaxHours bounds the range of flow stats.
+const flowMaxHours = 31 * 24
+
+// flowLatest is a sensor's latest calibrated reading.
+type flowLatest struct {
+	SensorID    string    `json:"sensor_id"`
+	Name        string    `json:"name"`
+	Location    string    `json:"location,omitempty"`
+	Temperature float64   `json:"temperature"`
+	Humidity    float64   `json:"humidity"`
+	CO2         *float64  `json:"co2,omitempty"`
+	Pressure    *float64  `json:"pressure,omitempty"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	// AgeSeconds is how long ago the reading was taken
+	AgeSeconds int64 `json:"age_seconds"`
+	// Humidex is in Celsius, whatever the sensor's unit
+	Humidex float64 `json:"humidex"`
+	VPD     float64 `json:"vpd_kpa"`
+}
+
+// flowStats summarises a sensor's calibrated readings over a range.
+type flowStats struct {
+	SensorID        string    `json:"sensor_id"`
+	Name            string    `json:"name"`
+	From            time.Time `json:"from"`
+	To              time.Time `json:"to"`
+	Count           int       `json:"count"`
+	TemperatureMin  float64   `json:"temperature_min"`
+	TemperatureMax  float64   `json:"temperature_max"`
+	TemperatureAvg  float64   `json:"temperature_avg"`
+	TemperatureLast float64   `json:"temperature_last"`
+	HumidityMin     float64   `json:"humidity_min"`
+	HumidityMax     float64   `json:"humidity_max"`
+	HumidityAvg     float64   `json:"humidity_avg"`
+	HumidityLast    float64   `json:"humidity_last"`
+	CO2Avg          *float64  `json:"co2_avg,omitempty"`
+	PressureAvg     *float64  `json:"pressure_avg,omitempty"`
+	// MoldHours is how many hours in a row, up to the end of the range,
+	// the hourly humidity has been at or above the critical humidity for
+	// mold, and MoldHoursMax the longest such spell in the range
+	MoldHours    int    `json:"mold_hours"`
+	MoldHoursMax int    `json:"mold_hours_max"`
+	MoldRisk     string `json:"mold_risk"`
+}
+
+// flowReading is one reading posted by a flow. Timestamp is RFC 3339
+// text or Unix milliseconds, and defaults to the time it was received.
+type flowReading struct {
+	SensorID    string    `json:"sensor_id"`
+	Temperature *float64  `json:"temperature"`
+	Humidity    *float64  `json:"humidity"`
+	CO2         *float64  `json:"co2,omitempty"`
+	Pressure    *float64  `json:"pressure,omitempty"`
+	Timestamp   *flowTime `json:"timestamp,omitempty"`
+}
+
+// flowTime accepts either an RFC 3339 string or Unix milliseconds,
+// which is what Node-RED's Date.now() gives.
+type flowTime struct{ time.Time }
+
+func (t *flowTime) UnmarshalJSON(data []byte) error {
+	if ms, err := strconv.ParseInt(string(data), 10, 64); err == nil {
+		t.Time = time.UnixMilli(ms).UTC()
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return errors.New("timestamp must be RFC 3339 text or Unix milliseconds")
+	}
+	parsed, err := time.Parse(time.RFC3339, s)
+	t.Time = parsed
+	return err
+}
+
+func (t flowTime) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.Time)
+}
+
+// flowStored is the response to posted readings.
+type flowStored struct {
+	Stored int `json:"stored"`
+}
+
+// flowLatest returns each sensor's latest calibrated reading from the
+// last week, ordered by sensor ID.
+func (s *server) flowLatest(ctx context.Context) ([]flowLatest, error) {
+	latest, err := s.store.latest(ctx, time.Now().Add(-flowLatestWindow))
+	if err != nil {
+		return nil, err
+	}
+	registry, err := loadSensors(ctx, s.sensors)
+	if err != nil {
+		return nil, err
+	}
+	cal, err := loadCalibration(ctx, s.sensors)
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(latest, func(a, b reading) int { return cmp.Compare(a.SensorID, b.SensorID) })
+	out := []flowLatest{}
+	for _, rd := range latest {
+		o := cal[rd.SensorID]
+		t, h := rd.Temperature+o.Temperature, rd.Humidity+o.Humidity
+		c := comfortOf(sensorCelsius(registry, rd.SensorID, t), h, 0)
+		out = append(out, flowLatest{
+			SensorID:    rd.SensorID,
+			Name:        sensorName(registry, rd.SensorID),
+			Location:    registry[rd.SensorID].Location,
+			Temperature: t,
+			Humidity:    h,
+			CO2:         rd.CO2,
+			Pressure:    rd.Pressure,
+			UpdatedAt:   rd.UpdatedAt,
+			AgeSeconds:  int64(time.Since(rd.UpdatedAt).Seconds()),
+			Humidex:     c.Humidex,
+			VPD:         c.VPD,
+		})
+	}
+	return out, nil
+}
+
+// handleFlowLatest returns the latest reading of ?sensor=, or of every
+// sensor that reported in the last week as an array.
+func (s *server) handleFlowLatest(w http.ResponseWriter, r *http.Request) {
+	sensor := r.URL.Query().Get("sensor")
+	out, err := s.flowLatest(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if sensor == "" {
+		writeJSON(w, http.StatusOK, out)
+		return
+	}
+	i := slices.IndexFunc(out, func(l flowLatest) bool { return l.SensorID == sensor })
+	if i < 0 {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no reading from %s in the last %s", sensor, flowLatestWindow))
+		return
+	}
+	writeJSON(w, http.StatusOK, out[i])
+}
+
+// flowStats summarises each sensor's calibrated readings in [from, to),
+// from both tiers, limited to the given sensors unless sensors is
+// empty, ordered by sensor ID.
+func (s *server) flowStats(ctx context.Context, from, to time.Time, sensors []string) ([]flowStats, error) {
+	history, err := readHistory(ctx, s.store, s.client, s.cold, from, to, sensors)
+	if err != nil {
+		return nil, err
+	}
+	registry, err := loadSensors(ctx, s.sensors)
+	if err != nil {
+		return nil, err
+	}
+	cal, err := loadCalibration(ctx, s.sensors)
+	if err != nil {
+		return nil, err
+	}
+
+	type totals struct {
+		temperature, humidity, co2, pressure float64
+		co2Count, pressureCount              int
+		// hour is the hour being averaged for the mold spells, with its sums
+		hour              time.Time
+		hourTemp, hourHum float64
+		hourCount         int
+	}
+	dwell := moldDwell{}
+	// endHour adds the hour being averaged to the sensor's damp spell
+	endHour := func(st *flowStats, sum *totals) {
+		if sum.hourCount == 0 {
+			return
+		}
+		n := float64(sum.hourCount)
+		st.MoldHours = dwell.add(st.SensorID, sensorCelsius(registry, st.SensorID, sum.hourTemp/n), sum.hourHum/n)
+		st.MoldHoursMax = max(st.MoldHoursMax, st.MoldHours)
+		sum.hourTemp, sum.hourHum, sum.hourCount = 0, 0, 0
+	}
+	bySensor := map[string]*flowStats{}
+	sums := map[string]*totals{}
+	var order []string
+	for _, rd := range history {
+		o := cal[rd.SensorID]
+		t, h := rd.Temperature+o.Temperature, rd.Humidity+o.Humidity
+		st, ok := bySensor[rd.SensorID]
+		if !ok {
+			st = &flowStats{SensorID: rd.SensorID, Name: sensorName(registry, rd.SensorID), From: from, To: to,
+				TemperatureMin: t, TemperatureMax: t, HumidityMin: h, HumidityMax: h}
+			bySensor[rd.SensorID], sums[rd.SensorID] = st, &totals{}
+			order = append(order, rd.SensorID)
+		}
+		sum := sums[rd.SensorID]
+		st.Count++
+		st.TemperatureMin, st.TemperatureMax = min(st.TemperatureMin, t), max(st.TemperatureMax, t)
+		st.HumidityMin, st.HumidityMax = min(st.HumidityMin, h), max(st.HumidityMax, h)
+		st.TemperatureLast, st.HumidityLast = t, h
+		sum.temperature += t
+		sum.humidity += h
+		// History is oldest first, so a sensor's hours come in order
+		if hour := rd.UpdatedAt.Truncate(time.Hour); !hour.Equal(sum.hour) {
+			endHour(st, sum)
+			sum.hour = hour
+		}
+		sum.hourTemp += t
+		sum.hourHum += h
+		sum.hourCount++
+		if rd.CO2 != nil {
+			sum.co2 += *rd.CO2
+			sum.co2Count++
+		}
+		if rd.Pressure != nil {
+			sum.pressure += *rd.Pressure
+			sum.pressureCount++
+		}
+	}
+	slices.Sort(order)
+	out := []flowStats{}
+	for _, id := range order {
+		st, sum := bySensor[id], sums[id]
+		endHour(st, sum)
+		st.MoldRisk = moldRisk(st.MoldHours)
+		st.TemperatureAvg = sum.temperature / float64(st.Count)
+		st.HumidityAvg = sum.humidity / float64(st.Count)
+		if sum.co2Count > 0 {
+			avg := sum.co2 / float64(sum.co2Count)
+			st.CO2Avg = &avg
+		}
+		if sum.pressureCount > 0 {
+			avg := sum.pressure / float64(sum.pressureCount)
+			st.PressureAvg = &avg
+		}
+		out = append(out, *st)
+	}
+	return out, nil
+}
+
+// handleFlowStats summarises the last ?hours= (default 24) of ?sensor=,
+// or of every sensor as an array. Mold spells are traced within those
+// hours only, so ?hours=168 or more shows a risk building over days.
+func (s *server) handleFlowStats(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	sensor := q.Get("sensor")
+	hours := 24
+	if v := q.Get("hours"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > flowMaxHours {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("hours must be a whole number from 1 to %d", flowMaxHours))
+			return
+		}
+		hours = n
+	}
+	to := time.Now().UTC()
+	from := to.Add(-time.Duration(hours) * time.Hour)
+	var sensors []string
+	if sensor != "" {
+		sensors = []string{sensor}
+	}
+	out, err := s.flowStats(r.Context(), from, to, sensors)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if sensor == "" {
+		writeJSON(w, http.StatusOK, out)
+		return
+	}
+	if len(out) == 0 {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no readings from %s in the last %d hours", sensor, hours))
+		return
+	}
+	writeJSON(w, http.StatusOK, out[0])
+}
+
+// handleFlowReadings stores one flow reading or an array of them. A
+// ?sensor= parameter fills in sensor_id where it's missing, so a flow
+// can post a bare msg.payload.
+func (s *server) handleFlowReadings(w http.ResponseWriter, r *http.Request) {
+	body, err := readBody(w, r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	var items []flowReading
+	if bytes.HasPrefix(bytes.TrimSpace(body), []byte("[")) {
+		err = json.Unmarshal(body, &items)
+	} else {
+		items = make([]flowReading, 1)
+		err = json.Unmarshal(body, &items[0])
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if len(items) == 0 {
+		writeError(w, http.StatusBadRequest, errors.New("no readings in request"))
+		return
+	}
+	if len(items) > maxIngestBatch {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("at most %d readings per request", maxIngestBatch))
+		return
+	}
+
+	now := time.Now()
+	device := contextDevice(r.Context())
+	docs := make([]reading, 0, len(items))
+	var problems []string
+	for i, item := range items {
+		p := readingPayload{SensorID: item.SensorID, Temperature: item.Temperature, Humidity: item.Humidity, CO2: item.CO2, Pressure: item.Pressure}
+		if p.SensorID == "" {
+			p.SensorID = r.URL.Query().Get("sensor")
+		}
+		if item.Timestamp != nil {
+			p.UpdatedAt = &item.Timestamp.Time
+		}
+		rd, err := p.reading(now)
+		if err == nil && !device.allows(rd.SensorID) {
+			err = fmt.Errorf("device %s may not write readings for sensor %q", device.ID, rd.SensorID)
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("reading %d: %v", i, err))
+			continue
+		}
+		docs = append(docs, rd)
+	}
+	auditNote(r.Context(), "received", len(items))
+	if len(problems) > 0 {
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]any{"errors": problems})
+		return
+	}
+	auditReadings(r.Context(), docs)
+	if err := s.store.insert(r.Context(), docs); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, flowStored{Stored: len(docs)})
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// dayGaps are the local hours of one day a sensor has no readings in.
+type dayGaps struct {
+	sensor string
+	day    string
+	// hours are the starts of the missing hours, in order
+	hours []time.Time
+}
+
+// runGaps lists sensors that have gone quiet, then the hours each
+// sensor missed per day, in reportTimezone.
+func runGaps(args []string) (err error) {
+	fs := flag.NewFlagSet("gaps", flag.ExitOnError)
+	format := fs.String("format", "text", "output format: text or csv (missing hours only)")
+	start := fs.String("start", "", "report from this date, YYYY-MM-DD (default 7 days ago)")
+	end := fs.String("end", "", "report up to this date, YYYY-MM-DD, exclusive (default tomorrow)")
+	sensorList := fs.String("sensor", "", "comma-separated sensor IDs to include (default all)")
+	window := fs.Duration("stale-after", 15*time.Minute, "flag sensors without a reading for this long")
+	cluster := fs.String("cluster", "", "cluster from CLUSTERS_FILE to read, or a MongoDB URI (default MONGO_CLUSTER, or MONGO_URI)")
+	fs.Parse(args)
+	sensors := splitList(*sensorList)
+	if *format != "text" && *format != "csv" {
+		return fmt.Errorf("unknown format %q (expected text or csv)", *format)
+	}
+	if *window <= 0 {
+		return errors.New("-stale-after must be positive")
+	}
+	loc, err := time.LoadLocation(reportTimezone)
+	if err != nil {
+		return err
+	}
+	now := time.Now().In(loc)
+	to := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, loc)
+	from := to.AddDate(0, 0, -8)
+	if *start != "" {
+		if from, err = time.ParseInLocation(time.DateOnly, *start, loc); err != nil {
+			return fmt.Errorf("-start: %w", err)
+		}
+	}
+	if *end != "" {
+		if to, err = time.ParseInLocation(time.DateOnly, *end, loc); err != nil {
+			return fmt.Errorf("-end: %w", err)
+		}
+	}
+	if !to.After(from) {
+		return errors.New("-end must be after -start")
+	}
+
+	ctx, stop := commandContext()
+	defer stop()
+	connectCtx, cancel := context.WithTimeout(ctx, mongoTimeouts.connect)
+	client, err := connectMongo(connectCtx, *cluster)
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if rerr := mongoClients.release(ctx, client); err == nil {
+			err = rerr
+		}
+	}()
+	store, err := openReadingStore(ctx, client)
+	if err != nil {
+		return err
+	}
+	defer store.close()
+	cold, err := newColdStore()
+	if err != nil {
+		return err
+	}
+	registry, err := loadSensors(ctx, sensorRegistry(client))
+	if err != nil {
+		return err
+	}
+
+	// Only which hours have readings matters, so calibration doesn't
+	hourly, err := store.hourlyAverages(ctx, from, to, reportTimezone, sensors, nil)
+	if err != nil {
+		return err
+	}
+	tiers := client.Database(readingsDatabase).Collection(tiersCollection)
+	if hourly, err = federate(ctx, cold, tiers, from, to, sensors, nil, hourly, hourlyKey(loc)); err != nil {
+		return err
+	}
+	latest, err := store.latest(ctx, now.AddDate(0, 0, -30))
+	if err != nil {
+		return err
+	}
+	last := map[string]time.Time{}
+	for _, r := range latest {
+		last[r.SensorID] = r.UpdatedAt
+	}
+
+	gaps := missingHours(hourly, registry, sensors, from, to, now, loc)
+	if *format == "csv" {
+		return printGapsCSV(gaps, registry)
+	}
+	// Sensors retired by now aren't expected to report any more
+	var stale []string
+	for _, id := range expectedSensors(registry, sensors, nil, now, now) {
+		if now.Sub(last[id]) >= *window {
+			stale = append(stale, id)
+		}
+	}
+	return printGaps(gaps, stale, last, registry, *window, now, loc)
+}
+
+// expectedSensors are the sensors that should report in [from, to):
+// the registered ones not retired by then, and any that did report,
+// limited to the given sensors unless sensors is empty.
+func expectedSensors(registry map[string]sensorInfo, sensors []string, hourly []bucketAvg[string], from, to time.Time) []string {
+	ids := map[string]bool{}
+	for id, s := range registry {
+		if !s.CreatedAt.After(to) && (s.RetiredAt == nil || s.RetiredAt.After(from)) {
+			ids[id] = true
+		}
+	}
+	for _, b := range hourly {
+		ids[b.Sensor] = true
+	}
+	var out []string
+	for id := range ids {
+		if len(sensors) == 0 || slices.Contains(sensors, id) {
+			out = append(out, id)
+		}
+	}
+	slices.SortFunc(out, func(a, b string) int {
+		return cmp.Or(cmp.Compare(sensorName(registry, a), sensorName(registry, b)), cmp.Compare(a, b))
+	})
+	return out
+}
+
+// missingHours returns, per sensor and local day, the hours in [from,
+// min(to, now)) without a bucket in hourly. A registered sensor is only
+// expected to report between being added and retired.
+func missingHours(hourly []bucketAvg[string], registry map[string]sensorInfo, sensors []string, from, to, now time.Time, loc *time.Location) []dayGaps {
+	type hourSensor struct{ hour, sensor string }
+	present := map[hourSensor]bool{}
+	for _, b := range hourly {
+		present[hourSensor{b.Key, b.Sensor}] = true
+	}
+	if now.Before(to) {
+		to = now
+	}
+	bucket := hourBucket(loc)
+	var out []dayGaps
+	for _, id := range expectedSensors(registry, sensors, hourly, from, to) {
+		s, registered := registry[id]
+		var day *dayGaps
+		for h := from; h.Before(to); h = nextHour(h, loc) {
+			key, end := bucket(h)
+			if present[hourSensor{key, id}] {
+				continue
+			}
+			if registered && (!end.After(s.CreatedAt) || s.RetiredAt != nil && !h.Before(*s.RetiredAt)) {
+				continue
+			}
+			date := h.In(loc).Format(time.DateOnly)
+			if day == nil || day.day != date {
+				out = append(out, dayGaps{sensor: id, day: date})
+				day = &out[len(out)-1]
+			}
+			day.hours = append(day.hours, h)
+		}
+	}
+	return out
+}
+
+// nextHour returns the start of the local hour after the one starting
+// at h. It steps in absolute time, so DST days have 23 or 25 hours,
+// but the hour repeated when clocks go back is one hourly bucket and so
+// is skipped.
+func nextHour(h time.Time, loc *time.Location) time.Time {
+	bucket := hourBucket(loc)
+	key, end := bucket(h)
+	if again, after := bucket(end); again == key {
+		return after
+	}
+	return end
+}
+
+// ranges prints the missing hours as runs such as "02:00-05:00, 14:00-15:00".
+func (d dayGaps) ranges(loc *time.Location) string {
+	var runs []string
+	for i := 0; i < len(d.hours); {
+		j := i + 1
+		for j < len(d.hours) && d.hours[j].Equal(nextHour(d.hours[j-1], loc)) {
+			j++
+		}
+		first := d.hours[i].In(loc)
+		last := nextHour(d.hours[j-1], loc).In(loc)
+		end := last.Format("15:04")
+		if last.Day() != first.Day() {
+			end = "24:00"
+		}
+		runs = append(runs, first.Format("15:04")+"-"+end)
+		i = j
+	}
+	return strings.Join(runs, ", ")
+}
+
+func printGaps(gaps []dayGaps, stale []string, last map[string]time.Time, registry map[string]sensorInfo, window time.Duration, now time.Time, loc *time.Location) error {
+	if len(stale) == 0 {
+		fmt.Printf("Every sensor has reported in the last %s.\n", roughDuration(window))
+	} else {
+		fmt.Printf("No reading for %s or more:\n", roughDuration(window))
+		for _, id := range stale {
+			if t, ok := last[id]; ok {
+				fmt.Printf("  %s: last reading %s ago, %s\n", sensorName(registry, id), roughDuration(now.Sub(t)), t.In(loc).Format(time.DateTime))
+			} else {
+				fmt.Printf("  %s: no reading in the last 30 days\n", sensorName(registry, id))
+			}
+		}
+	}
+	fmt.Println()
+	if len(gaps) == 0 {
+		fmt.Println("No missing hours.")
+		return nil
+	}
+	fmt.Printf("Missing hours (%s):\n", loc)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SENSOR\tDAY\tMISSING\tHOURS")
+	for _, d := range gaps {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", sensorName(registry, d.sensor), d.day, len(d.hours), d.ranges(loc))
+	}
+	return w.Flush()
+}
+
+func printGapsCSV(gaps []dayGaps, registry map[string]sensorInfo) error {
+	w := csv.NewWriter(os.Stdout)
+	w.Write([]string{"sensor_id", "sensor_name", "day", "missing_hours", "hours"})
+	for _, d := range gaps {
+		hours := make([]string, len(d.hours))
+		for i, h := range d.hours {
+			hours[i] = h.Format(time.RFC3339)
+		}
+		w.Write([]string{d.sensor, sensorName(registry, d.sensor), d.day, strconv.Itoa(len(d.hours)), strings.Join(hours, " ")})
+	}
+	w.Flush()
+	return w.Error()
+}
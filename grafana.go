@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// grafanaMetrics are the targets offered to Grafana's query editor. A
+// metric averages every sensor; "metric:sensorId" picks a single one.
+// pressure_tendency is the change in pressure over the previous three
+// hours.
+var grafanaMetrics = []string{"temperature", "humidity", "co2", "pressure", "pressure_tendency"}
+
+// grafanaQuery is the body Grafana posts to /query.
+type grafanaQuery struct {
+	Range struct {
+		From time.Time `json:"from"`
+		To   time.Time `json:"to"`
+	} `json:"range"`
+	IntervalMs    int64 `json:"intervalMs"`
+	MaxDataPoints int64 `json:"maxDataPoints"`
+	Targets       []struct {
+		Target string `json:"target"`
+		RefID  string `json:"refId"`
+	} `json:"targets"`
+}
+
+// grafanaSeries is one time series in the /query response. Each
+// datapoint is a [value, unix milliseconds] pair.
+type grafanaSeries struct {
+	Target     string       `json:"target"`
+	Datapoints [][2]float64 `json:"datapoints"`
+}
+
+// handleGrafanaSearch lists the metrics matching the typed prefix, as
+// text/value pairs so per-sensor targets show the sensor's friendly name.
+func (s *server) handleGrafanaSearch(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Target string `json:"target"`
+	}
+	// An empty body is allowed and means "list everything"
+	json.NewDecoder(r.Body).Decode(&req)
+
+	ids, err := s.store.sensorIDs(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	registry, err := loadSensors(r.Context(), s.sensors)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	type option struct {
+		Text  string `json:"text"`
+		Value string `json:"value"`
+	}
+	metrics := []option{}
+	for _, m := range grafanaMetrics {
+		candidates := []option{{Text: m, Value: m}}
+		for _, id := range ids {
+			candidates = append(candidates, option{Text: m + ": " + sensorName(registry, id), Value: m + ":" + id})
+		}
+		for _, c := range candidates {
+			if strings.HasPrefix(c.Value, req.Target) || strings.HasPrefix(c.Text, req.Target) {
+				metrics = append(metrics, c)
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, metrics)
+}
+
+// handleGrafanaQuery returns the averaged readings for each target,
+// bucketed by the interval Grafana picked for the panel.
+func (s *server) handleGrafanaQuery(w http.ResponseWriter, r *http.Request) {
+	var req grafanaQuery
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if !req.Range.From.Before(req.Range.To) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("range from %s is not before to %s", req.Range.From, req.Range.To))
+		return
+	}
+	for _, t := range req.Targets {
+		metric, _, _ := strings.Cut(t.Target, ":")
+		if !slices.Contains(grafanaMetrics, metric) {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("unknown target %q", t.Target))
+			return
+		}
+	}
+
+	// Fall back to spreading maxDataPoints over the range when Grafana
+	// doesn't send an interval, and never go below one second.
+	interval := req.IntervalMs
+	if interval <= 0 && req.MaxDataPoints > 0 {
+		interval = req.Range.To.Sub(req.Range.From).Milliseconds() / req.MaxDataPoints
+	}
+	interval = max(interval, 1000)
+
+	// Targets for the same sensor share one aggregation, except that the
+	// tendency also needs the window before the range
+	type aggregation struct {
+		sensor   string
+		tendency bool
+	}
+	byAggregation := make(map[aggregation][]bucketAvg[int64])
+	series := make([]grafanaSeries, 0, len(req.Targets))
+	for _, t := range req.Targets {
+		metric, sensor, _ := strings.Cut(t.Target, ":")
+		agg := aggregation{sensor, metric == "pressure_tendency"}
+		buckets, ok := byAggregation[agg]
+		if !ok {
+			var sensors []string
+			if sensor != "" {
+				sensors = []string{sensor}
+			}
+			from := req.Range.From
+			if agg.tendency {
+				from = from.Add(-pressureTendencyWindow)
+			}
+			var err error
+			buckets, err = s.intervalAverages(r.Context(), from, req.Range.To, interval, sensors)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			byAggregation[agg] = buckets
+		}
+
+		s := grafanaSeries{Target: t.Target, Datapoints: make([][2]float64, 0, len(buckets))}
+		if agg.tendency {
+			for _, p := range pressureTendency(buckets, interval) {
+				if p[1] >= float64(req.Range.From.UnixMilli()-interval) {
+					s.Datapoints = append(s.Datapoints, p)
+				}
+			}
+			series = append(series, s)
+			continue
+		}
+		for _, b := range buckets {
+			var v *float64
+			switch metric {
+			case "temperature":
+				v = &b.Temperature
+			case "humidity":
+				v = &b.Humidity
+			case "co2":
+				v = b.CO2
+			case "pressure":
+				v = b.Pressure
+			}
+			// Buckets without CO2 or pressure readings are left as gaps
+			if v != nil {
+				s.Datapoints = append(s.Datapoints, [2]float64{*v, float64(b.Key)})
+			}
+		}
+		series = append(series, s)
+	}
+	writeJSON(w, http.StatusOK, series)
+}
+
+// handleGrafanaAnnotations satisfies the datasource contract; there are
+// no annotations to report.
+func (s *server) handleGrafanaAnnotations(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, []any{})
+}
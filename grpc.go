@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"temphums_go/temphumspb"
+)
+
+//go:generate buf generate
+
+// grpcService implements the Temphums gRPC service on the same state as
+// the HTTP server. The stubs are generated from proto/ with buf generate.
+type grpcService struct {
+	temphumspb.UnimplementedTemphumsServer
+	s *server
+}
+
+// newGRPCServer returns a gRPC server requiring an API key or device
+// credential on every call. Keepalive pings are allowed so gateways
+// notice dead links quickly.
+func (s *server) newGRPCServer() *grpc.Server {
+	gs := grpc.NewServer(
+		grpc.UnaryInterceptor(func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp any, err error) {
+			ctx, done := s.grpcAudit(ctx, info.FullMethod)
+			defer func() { done(err) }()
+			ctx, err = s.grpcAuth(ctx, info.FullMethod)
+			if err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+			ctx, done := s.grpcAudit(ss.Context(), info.FullMethod)
+			defer func() { done(err) }()
+			ctx, err = s.grpcAuth(ctx, info.FullMethod)
+			if err != nil {
+				return err
+			}
+			return handler(srv, deviceStream{ss, ctx})
+		}),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             10 * time.Second,
+			PermitWithoutStream: true,
+		}),
+	)
+	temphumspb.RegisterTemphumsServer(gs, &grpcService{s: s})
+	return gs
+}
+
+// grpcAudited names the methods that write, whose calls are audited.
+var grpcAudited = map[string]string{
+	temphumspb.Temphums_SubmitReading_FullMethodName:  "submit reading",
+	temphumspb.Temphums_StreamReadings_FullMethodName: "stream readings",
+}
+
+// grpcAudit starts the audit record of a call of method, when it writes,
+// and returns the function that stores it once the call ends with err.
+func (s *server) grpcAudit(ctx context.Context, method string) (context.Context, func(error)) {
+	action, ok := grpcAudited[method]
+	if !ok {
+		return ctx, func(error) {}
+	}
+	start := time.Now()
+	rec := &auditRecord{At: start, Action: action, Method: "gRPC", Path: method}
+	if p, ok := peer.FromContext(ctx); ok {
+		rec.Client = p.Addr.String()
+		if host, _, err := net.SplitHostPort(rec.Client); err == nil {
+			rec.Client = host
+		}
+	}
+	return context.WithValue(ctx, auditContextKey{}, rec), func(err error) {
+		st := status.Convert(err)
+		rec.Code, rec.Error = st.Code().String(), st.Message()
+		rec.Millis = time.Since(start).Milliseconds()
+		s.writeAudit(context.WithoutCancel(ctx), rec)
+	}
+}
+
+// deviceStream is a server stream carrying the device it authenticated
+// as in its context.
+type deviceStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s deviceStream) Context() context.Context { return s.ctx }
+
+// grpcAuth checks the x-api-key or bearer authorization metadata, which
+// may be a device credential with the scope of method. The device is
+// returned in the context, and the firmware it reports recorded.
+func (s *server) grpcAuth(ctx context.Context, method string) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	var key string
+	if v := md.Get("x-api-key"); len(v) > 0 {
+		key = v[0]
+	}
+	if v := md.Get("authorization"); len(v) > 0 && strings.HasPrefix(v[0], "Bearer ") {
+		key = strings.TrimPrefix(v[0], "Bearer ")
+	}
+	auditIdentify(ctx, key, nil)
+	if s.validAPIKey(key) {
+		return ctx, nil
+	}
+	d, err := s.deviceByKey(ctx, key)
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	if d == nil {
+		return nil, status.Error(codes.Unauthenticated, "missing or invalid API key")
+	}
+	auditIdentify(ctx, key, d)
+	scope := scopeIngest
+	if method == temphumspb.Temphums_QueryAggregates_FullMethodName {
+		scope = scopeRead
+	}
+	if !d.can(scope) {
+		return nil, status.Errorf(codes.PermissionDenied, "device %s is not enrolled with the %s scope", d.ID, scope)
+	}
+	if v := md.Get(strings.ToLower(firmwareHeader)); len(v) > 0 {
+		s.firmware.record(ctx, d.ID, v[0])
+	}
+	return context.WithValue(ctx, deviceContextKey{}, d), nil
+}
+
+func (g *grpcService) SubmitReading(ctx context.Context, req *temphumspb.SubmitReadingRequest) (*temphumspb.SubmitReadingResponse, error) {
+	r, err := readingFromProto(req.GetReading(), time.Now())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if d := contextDevice(ctx); !d.allows(r.SensorID) {
+		return nil, status.Errorf(codes.PermissionDenied, "device %s may not write readings for sensor %q", d.ID, r.SensorID)
+	}
+	auditReadings(ctx, []reading{r})
+	if err := g.s.upsertReading(ctx, r); err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	return &temphumspb.SubmitReadingResponse{}, nil
+}
+
+func (g *grpcService) StreamReadings(stream temphumspb.Temphums_StreamReadingsServer) error {
+	// A stream is audited as a whole, once it ends
+	var stored, rejected int
+	defer func() {
+		auditNote(stream.Context(), "readings", stored)
+		auditNote(stream.Context(), "rejected", rejected)
+	}()
+	for {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		ack := &temphumspb.StreamReadingsResponse{Seq: req.GetSeq()}
+		r, err := readingFromProto(req.GetReading(), time.Now())
+		if d := contextDevice(stream.Context()); err == nil && !d.allows(r.SensorID) {
+			err = fmt.Errorf("device %s may not write readings for sensor %q", d.ID, r.SensorID)
+		}
+		if err != nil {
+			ack.Error = err.Error()
+			rejected++
+		} else if err := g.s.upsertReading(stream.Context(), r); err != nil {
+			// Storage failures end the stream; unacked readings get resent
+			return status.Error(codes.Unavailable, err.Error())
+		} else {
+			stored++
+		}
+		if err := stream.Send(ack); err != nil {
+			return err
+		}
+	}
+}
+
+func (g *grpcService) QueryAggregates(ctx context.Context, req *temphumspb.QueryAggregatesRequest) (*temphumspb.QueryAggregatesResponse, error) {
+	if req.GetFrom() == nil || req.GetTo() == nil {
+		return nil, status.Error(codes.InvalidArgument, "from and to are required")
+	}
+	from, to := req.GetFrom().AsTime(), req.GetTo().AsTime()
+	if !from.Before(to) {
+		return nil, status.Error(codes.InvalidArgument, "from must be before to")
+	}
+	interval := time.Hour
+	if req.GetInterval() != nil {
+		interval = max(req.GetInterval().AsDuration(), time.Second)
+	}
+
+	buckets, err := g.s.intervalAverages(ctx, from, to, interval.Milliseconds(), req.GetSensorIds())
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	resp := &temphumspb.QueryAggregatesResponse{}
+	for _, b := range buckets {
+		resp.Aggregates = append(resp.Aggregates, &temphumspb.Aggregate{
+			Start:          timestamppb.New(time.UnixMilli(b.Key)),
+			AvgTemperature: b.Temperature,
+			AvgHumidity:    b.Humidity,
+			Count:          b.Count,
+			AvgCo2:         b.CO2,
+			AvgPressure:    b.Pressure,
+		})
+	}
+	return resp, nil
+}
+
+// readingFromProto validates a protobuf reading like any other payload.
+func readingFromProto(pr *temphumspb.Reading, received time.Time) (reading, error) {
+	if pr == nil {
+		return reading{}, errors.New("reading is required")
+	}
+	t, h := pr.GetTemperature(), pr.GetHumidity()
+	p := readingPayload{Temperature: &t, Humidity: &h, CO2: pr.Co2, Pressure: pr.Pressure}
+	if pr.GetUpdatedAt() != nil {
+		ts := pr.GetUpdatedAt().AsTime()
+		p.UpdatedAt = &ts
+	}
+	r, err := p.reading(received)
+	r.SensorID = pr.GetSensorId()
+	return r, err
+}
+
+// upsertReading stores r unless a reading from the same sensor at the
+// same time already exists, which makes retried writes harmless.
+func (s *server) upsertReading(ctx context.Context, r reading) error {
+	return s.store.upsert(ctx, r)
+}
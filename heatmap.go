@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"html"
+	"html/template"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Daily statistics a heatmap can show
+const (
+	heatmapAvg = "avg"
+	heatmapMax = "max"
+)
+
+// Heatmap geometry: one row of cells per month and one column per day
+// of the month, with a block of rows per sensor
+const (
+	heatmapCell   = 14
+	heatmapGap    = 2
+	heatmapPad    = 8
+	heatmapLabel  = 64
+	heatmapHeader = 28
+	heatmapLegend = 36
+)
+
+var heatmapMissing = color.RGBA{0xee, 0xee, 0xee, 0xff}
+
+// heatmapPalettes are the colour stops of each value, from low to high:
+// dry to damp in blues, and cold to hot from blue through white to red.
+var heatmapPalettes = map[string][]color.RGBA{
+	"humidity": {
+		{0xf7, 0xfb, 0xff, 0xff},
+		{0x9e, 0xca, 0xe1, 0xff},
+		{0x42, 0x92, 0xc6, 0xff},
+		{0x08, 0x30, 0x6b, 0xff},
+	},
+	"temperature": {
+		{0x21, 0x66, 0xac, 0xff},
+		{0xf7, 0xf7, 0xf7, 0xff},
+		{0xb2, 0x18, 0x2b, 0xff},
+	},
+}
+
+// heatmapSensor is one sensor's daily values, keyed by local date.
+type heatmapSensor struct {
+	id, name string
+	days     map[string]float64
+}
+
+// heatmap is a calendar of daily values, coloured on one scale for all
+// sensors so they can be compared.
+type heatmap struct {
+	title   string
+	value   string
+	unit    string
+	sensors []heatmapSensor
+	// months are the first days of the months shown, and from and to the
+	// days within them that are
+	months   []time.Time
+	from, to time.Time
+	lo, hi   float64
+}
+
+// runHeatmap renders a calendar heatmap of each sensor's daily average
+// or maximum humidity or temperature in reportTimezone, a compact way to
+// spot seasonal problems such as a basement that is damp all summer.
+func runHeatmap(args []string) (err error) {
+	fs := flag.NewFlagSet("stats heatmap", flag.ExitOnError)
+	format := fs.String("format", "svg", "output format: svg, png (without labels) or html")
+	outPath := fs.String("out", "", "write to this file instead of standard output")
+	start := fs.String("start", "", "show from this date, YYYY-MM-DD (default the first of the month a year ago)")
+	end := fs.String("end", "", "show up to this date, YYYY-MM-DD, exclusive (default the first of next month)")
+	sensorList := fs.String("sensor", "", "comma-separated sensor IDs to include (default all)")
+	value := fs.String("value", "humidity", "value to show: humidity or temperature (in °C)")
+	stat := fs.String("stat", heatmapAvg, "daily statistic: avg (mean of the hourly averages) or max (highest hourly average)")
+	lo := fs.Float64("min", 0, "value at the low end of the colour scale (default the lowest day)")
+	hi := fs.Float64("max", 0, "value at the high end of the colour scale (default the highest day)")
+	cluster := fs.String("cluster", "", "cluster from CLUSTERS_FILE to read, or a MongoDB URI (default MONGO_CLUSTER, or MONGO_URI)")
+	fs.Parse(args)
+	sensors := splitList(*sensorList)
+	var loSet, hiSet bool
+	fs.Visit(func(f *flag.Flag) {
+		loSet = loSet || f.Name == "min"
+		hiSet = hiSet || f.Name == "max"
+	})
+	if *format != "svg" && *format != "png" && *format != "html" {
+		return fmt.Errorf("unknown format %q (expected svg, png or html)", *format)
+	}
+	if _, ok := heatmapPalettes[*value]; !ok {
+		return fmt.Errorf("unknown -value %q (expected humidity or temperature)", *value)
+	}
+	if *stat != heatmapAvg && *stat != heatmapMax {
+		return fmt.Errorf("unknown -stat %q (expected avg or max)", *stat)
+	}
+	if loSet && hiSet && *hi <= *lo {
+		return errors.New("-max must be above -min")
+	}
+	loc, err := time.LoadLocation(reportTimezone)
+	if err != nil {
+		return err
+	}
+	now := time.Now().In(loc)
+	to := time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, loc)
+	from := to.AddDate(-1, 0, 0)
+	if *start != "" {
+		if from, err = time.ParseInLocation(time.DateOnly, *start, loc); err != nil {
+			return fmt.Errorf("-start: %w", err)
+		}
+	}
+	if *end != "" {
+		if to, err = time.ParseInLocation(time.DateOnly, *end, loc); err != nil {
+			return fmt.Errorf("-end: %w", err)
+		}
+	}
+	if !to.After(from) {
+		return errors.New("-end must be after -start")
+	}
+
+	ctx, stop := commandContext()
+	defer stop()
+	connectCtx, cancel := context.WithTimeout(ctx, mongoTimeouts.connect)
+	client, err := connectMongo(connectCtx, *cluster)
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if rerr := mongoClients.release(ctx, client); err == nil {
+			err = rerr
+		}
+	}()
+	store, err := openReadingStore(ctx, client)
+	if err != nil {
+		return err
+	}
+	defer store.close()
+	cold, err := newColdStore()
+	if err != nil {
+		return err
+	}
+	cal, err := loadCalibration(ctx, sensorRegistry(client))
+	if err != nil {
+		return err
+	}
+	registry, err := loadSensors(ctx, sensorRegistry(client))
+	if err != nil {
+		return err
+	}
+
+	buckets, err := store.hourlyAverages(ctx, from, to, reportTimezone, sensors, cal)
+	if err != nil {
+		return err
+	}
+	tiers := client.Database(readingsDatabase).Collection(tiersCollection)
+	if buckets, err = federate(ctx, cold, tiers, from, to, sensors, cal, buckets, hourlyKey(loc)); err != nil {
+		return err
+	}
+	h := newHeatmap(buckets, registry, *value, *stat, from, to)
+	if len(h.sensors) == 0 {
+		return errors.New("no readings in the range")
+	}
+	if loSet {
+		h.lo = *lo
+	}
+	if hiSet {
+		h.hi = *hi
+	}
+
+	var data []byte
+	switch *format {
+	case "svg":
+		data = []byte(h.svg())
+	case "png":
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, h.image()); err != nil {
+			return err
+		}
+		data = buf.Bytes()
+	case "html":
+		if data, err = h.html(); err != nil {
+			return err
+		}
+	}
+	out, closeOut, err := createOutput(*outPath, false)
+	if err != nil {
+		return err
+	}
+	if _, err := out.Write(data); err != nil {
+		closeOut()
+		return err
+	}
+	return closeOut()
+}
+
+// newHeatmap works out each sensor's daily statistic from hourly
+// averages keyed by local time, temperatures in Celsius, over the days
+// in [from, to).
+func newHeatmap(hourly []bucketAvg[string], registry map[string]sensorInfo, value, stat string, from, to time.Time) *heatmap {
+	h := &heatmap{value: value, unit: "%", from: from, to: to, lo: math.Inf(1), hi: math.Inf(-1)}
+	if value == "temperature" {
+		h.unit = "°C"
+	}
+	statName := "Average"
+	if stat == heatmapMax {
+		statName = "Highest"
+	}
+	h.title = fmt.Sprintf("%s daily %s, %s to %s", statName, value, from.Format(time.DateOnly), to.AddDate(0, 0, -1).Format(time.DateOnly))
+	for m := time.Date(from.Year(), from.Month(), 1, 0, 0, 0, 0, from.Location()); m.Before(to); m = m.AddDate(0, 1, 0) {
+		h.months = append(h.months, m)
+	}
+
+	type group struct{ day, sensor string }
+	sums := map[group]float64{}
+	hours := map[group]int{}
+	for _, b := range hourly {
+		if b.Count == 0 {
+			continue
+		}
+		v := b.Humidity
+		if value == "temperature" {
+			v = sensorCelsius(registry, b.Sensor, b.Temperature)
+		}
+		g := group{b.Key[:len(time.DateOnly)], b.Sensor}
+		if n, ok := hours[g]; ok && stat == heatmapMax {
+			sums[g] = max(sums[g], v)
+			hours[g] = n + 1
+			continue
+		}
+		sums[g] += v
+		hours[g]++
+	}
+	bySensor := map[string]*heatmapSensor{}
+	for g, v := range sums {
+		if stat == heatmapAvg {
+			v /= float64(hours[g])
+		}
+		s, ok := bySensor[g.sensor]
+		if !ok {
+			s = &heatmapSensor{id: g.sensor, name: sensorName(registry, g.sensor), days: map[string]float64{}}
+			bySensor[g.sensor] = s
+		}
+		s.days[g.day] = v
+		h.lo, h.hi = min(h.lo, v), max(h.hi, v)
+	}
+	for _, s := range bySensor {
+		h.sensors = append(h.sensors, *s)
+	}
+	slices.SortFunc(h.sensors, func(a, b heatmapSensor) int {
+		return cmp.Or(cmp.Compare(a.name, b.name), cmp.Compare(a.id, b.id))
+	})
+	return h
+}
+
+// color is the colour of v on the heatmap's scale.
+func (h *heatmap) color(v float64) color.RGBA {
+	stops := heatmapPalettes[h.value]
+	f := 0.5
+	if h.hi > h.lo {
+		f = min(max((v-h.lo)/(h.hi-h.lo), 0), 1)
+	}
+	f *= float64(len(stops) - 1)
+	i := min(int(f), len(stops)-2)
+	a, b := stops[i], stops[i+1]
+	mix := func(x, y uint8) uint8 { return uint8(float64(x) + (float64(y)-float64(x))*(f-float64(i))) }
+	return color.RGBA{mix(a.R, b.R), mix(a.G, b.G), mix(a.B, b.B), 0xff}
+}
+
+// size is the width and height of the heatmap in pixels.
+func (h *heatmap) size() (int, int) {
+	width := 2*heatmapPad + heatmapLabel + 31*(heatmapCell+heatmapGap)
+	return width, 2*heatmapPad + len(h.sensors)*h.blockHeight() + heatmapLegend
+}
+
+// blockHeight is the height of one sensor's calendar, with its heading.
+func (h *heatmap) blockHeight() int {
+	return heatmapHeader + len(h.months)*(heatmapCell+heatmapGap) + heatmapPad
+}
+
+// cells calls fn with the position of each day shown of the sensor with
+// index s, and the sensor's value that day if it has one.
+func (h *heatmap) cells(s int, fn func(x, y int, day time.Time, v float64, ok bool)) {
+	top := heatmapPad + s*h.blockHeight() + heatmapHeader
+	for m, month := range h.months {
+		for d := month; d.Month() == month.Month(); d = d.AddDate(0, 0, 1) {
+			if d.Before(h.from) || !d.Before(h.to) {
+				continue
+			}
+			v, ok := h.sensors[s].days[d.Format(time.DateOnly)]
+			fn(heatmapPad+heatmapLabel+(d.Day()-1)*(heatmapCell+heatmapGap), top+m*(heatmapCell+heatmapGap), d, v, ok)
+		}
+	}
+}
+
+// image draws the heatmap without labels, as the standard library has
+// no fonts: a block of months per sensor, in order of name, with the
+// colour scale along the bottom.
+func (h *heatmap) image() *image.RGBA {
+	width, height := h.size()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+	fill := func(x, y, w, hgt int, c color.Color) {
+		draw.Draw(img, image.Rect(x, y, x+w, y+hgt), image.NewUniform(c), image.Point{}, draw.Src)
+	}
+	for s := range h.sensors {
+		h.cells(s, func(x, y int, _ time.Time, v float64, ok bool) {
+			c := heatmapMissing
+			if ok {
+				c = h.color(v)
+			}
+			fill(x, y, heatmapCell, heatmapCell, c)
+		})
+	}
+	x0, y0 := heatmapPad+heatmapLabel, height-heatmapPad-heatmapCell
+	span := width - x0 - heatmapPad
+	for i := 0; i < span; i++ {
+		fill(x0+i, y0, 1, heatmapCell, h.color(h.lo+(h.hi-h.lo)*float64(i)/float64(span-1)))
+	}
+	return img
+}
+
+// svg draws the heatmap with month and day labels, and the date and
+// value of each day as its tooltip.
+func (h *heatmap) svg() string {
+	width, height := h.size()
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="sans-serif" font-size="9">`+"\n", width, height, width, height)
+	fmt.Fprintf(&b, "<title>%s</title>\n", html.EscapeString(h.title))
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" fill="#fff"/>`+"\n", width, height)
+	rgb := func(c color.RGBA) string { return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B) }
+	for s, sensor := range h.sensors {
+		top := heatmapPad + s*h.blockHeight()
+		fmt.Fprintf(&b, `<text x="%d" y="%d" font-size="12" font-weight="bold">%s</text>`+"\n", heatmapPad, top+12, html.EscapeString(sensor.name))
+		for d := 1; d <= 31; d++ {
+			fmt.Fprintf(&b, `<text x="%d" y="%d" text-anchor="middle">%d</text>`+"\n", heatmapPad+heatmapLabel+(d-1)*(heatmapCell+heatmapGap)+heatmapCell/2, top+heatmapHeader-4, d)
+		}
+		for m, month := range h.months {
+			fmt.Fprintf(&b, `<text x="%d" y="%d">%s</text>`+"\n", heatmapPad, top+heatmapHeader+m*(heatmapCell+heatmapGap)+heatmapCell-3, month.Format("Jan 2006"))
+		}
+		h.cells(s, func(x, y int, day time.Time, v float64, ok bool) {
+			c, tip := heatmapMissing, day.Format(time.DateOnly)+": no readings"
+			if ok {
+				c, tip = h.color(v), fmt.Sprintf("%s: %.1f%s", day.Format(time.DateOnly), v, h.unit)
+			}
+			fmt.Fprintf(&b, `<rect x="%d" y="%d" width="%d" height="%d" fill="%s"><title>%s</title></rect>`+"\n", x, y, heatmapCell, heatmapCell, rgb(c), html.EscapeString(tip))
+		})
+	}
+
+	// The colour scale, labelled with its ends
+	stops := heatmapPalettes[h.value]
+	b.WriteString(`<defs><linearGradient id="scale">`)
+	for i, c := range stops {
+		fmt.Fprintf(&b, `<stop offset="%d%%" stop-color="%s"/>`, 100*i/(len(stops)-1), rgb(c))
+	}
+	b.WriteString("</linearGradient></defs>\n")
+	x0, y0 := heatmapPad+heatmapLabel, height-heatmapPad-heatmapCell
+	fmt.Fprintf(&b, `<rect x="%d" y="%d" width="%d" height="%d" fill="url(#scale)"/>`+"\n", x0, y0, width-x0-heatmapPad, heatmapCell)
+	fmt.Fprintf(&b, `<text x="%d" y="%d">%.1f%s</text>`+"\n", x0, y0-3, h.lo, html.EscapeString(h.unit))
+	fmt.Fprintf(&b, `<text x="%d" y="%d" text-anchor="end">%.1f%s</text>`+"\n", width-heatmapPad, y0-3, h.hi, html.EscapeString(h.unit))
+	b.WriteString("</svg>\n")
+	return b.String()
+}
+
+var heatmapHTML = template.Must(template.New("heatmap").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>Generated {{.Generated}}. Days are in {{.Zone}}; hover over a day for its value, and grey days had no readings.</p>
+{{.SVG}}
+</body>
+</html>
+`))
+
+// html renders the heatmap as a standalone HTML page, with the SVG
+// inline.
+func (h *heatmap) html() ([]byte, error) {
+	data := struct {
+		Title, Generated, Zone string
+		SVG                    template.HTML
+	}{
+		Title:     h.title,
+		Generated: time.Now().In(h.from.Location()).Format("2006-01-02 15:04 MST"),
+		Zone:      reportTimezone,
+		SVG:       template.HTML(h.svg()),
+	}
+	var buf bytes.Buffer
+	err := heatmapHTML.Execute(&buf, data)
+	return buf.Bytes(), err
+}
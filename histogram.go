@@ -0,0 +1,219 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// histogramBarWidth is the length of the text output's longest bar.
+const histogramBarWidth = 40
+
+// histogramBin counts the hours a sensor's metric spent in [from, to).
+type histogramBin struct {
+	sensor, metric string
+	from, to       float64
+	hours          int
+	// share is the fraction of the sensor's hours with readings
+	share float64
+}
+
+// runHistogram reports how each sensor's temperature and humidity were
+// distributed over a range: how many hours their hourly averages spent
+// in each bin, to see how often conditions sit near the edges of a
+// comfort band.
+func runHistogram(args []string) (err error) {
+	fs := flag.NewFlagSet("stats histogram", flag.ExitOnError)
+	format := fs.String("format", "text", "output format: text or csv")
+	start := fs.String("start", "", "report from this date, YYYY-MM-DD (default 30 days ago)")
+	end := fs.String("end", "", "report up to this date, YYYY-MM-DD, exclusive (default today)")
+	sensorList := fs.String("sensor", "", "comma-separated sensor IDs to include (default all)")
+	metricList := fs.String("metric", "temperature,humidity", "comma-separated metrics: temperature, humidity")
+	tempBin := fs.Float64("temperature-bin", 1, "width of the temperature bins, in the sensor's unit")
+	humBin := fs.Float64("humidity-bin", 5, "width of the humidity bins, in percent")
+	cluster := fs.String("cluster", "", "cluster from CLUSTERS_FILE to read, or a MongoDB URI (default MONGO_CLUSTER, or MONGO_URI)")
+	fs.Parse(args)
+	sensors := splitList(*sensorList)
+	if *format != "text" && *format != "csv" {
+		return fmt.Errorf("unknown format %q (expected text or csv)", *format)
+	}
+	widths := map[string]float64{}
+	for _, m := range splitList(*metricList) {
+		switch m {
+		case "temperature":
+			widths[m] = *tempBin
+		case "humidity":
+			widths[m] = *humBin
+		default:
+			return fmt.Errorf("unknown metric %q (expected temperature or humidity)", m)
+		}
+	}
+	if len(widths) == 0 {
+		return errors.New("-metric names no metrics")
+	}
+	if *tempBin <= 0 || *humBin <= 0 {
+		return errors.New("bin widths must be positive")
+	}
+	loc, err := time.LoadLocation(reportTimezone)
+	if err != nil {
+		return err
+	}
+	now := time.Now().In(loc)
+	to := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	from := to.AddDate(0, 0, -30)
+	if *start != "" {
+		if from, err = time.ParseInLocation(time.DateOnly, *start, loc); err != nil {
+			return fmt.Errorf("-start: %w", err)
+		}
+	}
+	if *end != "" {
+		if to, err = time.ParseInLocation(time.DateOnly, *end, loc); err != nil {
+			return fmt.Errorf("-end: %w", err)
+		}
+	}
+	if !to.After(from) {
+		return errors.New("-end must be after -start")
+	}
+
+	ctx, stop := commandContext()
+	defer stop()
+	connectCtx, cancel := context.WithTimeout(ctx, mongoTimeouts.connect)
+	client, err := connectMongo(connectCtx, *cluster)
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if rerr := mongoClients.release(ctx, client); err == nil {
+			err = rerr
+		}
+	}()
+	store, err := openReadingStore(ctx, client)
+	if err != nil {
+		return err
+	}
+	defer store.close()
+	cold, err := newColdStore()
+	if err != nil {
+		return err
+	}
+	cal, err := loadCalibration(ctx, sensorRegistry(client))
+	if err != nil {
+		return err
+	}
+	registry, err := loadSensors(ctx, sensorRegistry(client))
+	if err != nil {
+		return err
+	}
+
+	buckets, err := store.hourlyAverages(ctx, from, to, reportTimezone, sensors, cal)
+	if err != nil {
+		return err
+	}
+	tiers := client.Database(readingsDatabase).Collection(tiersCollection)
+	if buckets, err = federate(ctx, cold, tiers, from, to, sensors, cal, buckets, hourlyKey(loc)); err != nil {
+		return err
+	}
+	bins := histogram(buckets, widths)
+	if *format == "csv" {
+		return printHistogramCSV(bins, registry)
+	}
+	return printHistogram(bins, registry, from, to, loc)
+}
+
+// histogram bins the hourly averages of each sensor and metric by the
+// metric's width in widths, with bins aligned to multiples of it. Bins
+// between a sensor's lowest and highest are listed even when empty, so
+// the distribution's shape shows.
+func histogram(hourly []bucketAvg[string], widths map[string]float64) []histogramBin {
+	type group struct{ sensor, metric string }
+	counts := map[group]map[int]int{}
+	hours := map[string]int{}
+	for _, b := range hourly {
+		if b.Count == 0 {
+			continue
+		}
+		hours[b.Sensor]++
+		for metric, width := range widths {
+			v := b.Temperature
+			if metric == "humidity" {
+				v = b.Humidity
+			}
+			g := group{b.Sensor, metric}
+			if counts[g] == nil {
+				counts[g] = map[int]int{}
+			}
+			// Nudged, so 20.3 falls in [20.3, 20.4) rather than just below
+			counts[g][int(math.Floor(v/width+1e-9))]++
+		}
+	}
+	var out []histogramBin
+	for g, c := range counts {
+		lo, hi := math.MaxInt, math.MinInt
+		for i := range c {
+			lo, hi = min(lo, i), max(hi, i)
+		}
+		// Rounded, so a width of 0.1 has an edge at 0.3 rather than
+		// 0.30000000000000004
+		width := widths[g.metric]
+		edge := func(i int) float64 { return math.Round(float64(i)*width*1e9) / 1e9 }
+		for i := lo; i <= hi; i++ {
+			out = append(out, histogramBin{
+				sensor: g.sensor, metric: g.metric,
+				from: edge(i), to: edge(i + 1),
+				hours: c[i], share: float64(c[i]) / float64(hours[g.sensor]),
+			})
+		}
+	}
+	slices.SortFunc(out, func(a, b histogramBin) int {
+		return cmp.Or(cmp.Compare(a.sensor, b.sensor), cmp.Compare(b.metric, a.metric), cmp.Compare(a.from, b.from))
+	})
+	return out
+}
+
+func printHistogram(bins []histogramBin, registry map[string]sensorInfo, from, to time.Time, loc *time.Location) error {
+	if len(bins) == 0 {
+		fmt.Println("No readings in the range.")
+		return nil
+	}
+	fmt.Printf("Hours in each range of the hourly averages (%s), %s to %s:\n", loc, from.Format(time.DateOnly), to.AddDate(0, 0, -1).Format(time.DateOnly))
+	most := 0
+	for _, b := range bins {
+		most = max(most, b.hours)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SENSOR\tMETRIC\tFROM\tTO\tHOURS\tSHARE\t")
+	for _, b := range bins {
+		bar := strings.Repeat("#", (b.hours*histogramBarWidth+most-1)/most)
+		fmt.Fprintf(w, "%s\t%s\t%g\t%g\t%d\t%.1f%%\t%s\n", sensorName(registry, b.sensor), b.metric, b.from, b.to, b.hours, 100*b.share, bar)
+	}
+	return w.Flush()
+}
+
+func printHistogramCSV(bins []histogramBin, registry map[string]sensorInfo) error {
+	w := csv.NewWriter(os.Stdout)
+	w.Write([]string{"sensor_id", "sensor_name", "metric", "from", "to", "hours", "share"})
+	for _, b := range bins {
+		w.Write([]string{
+			b.sensor,
+			sensorName(registry, b.sensor),
+			b.metric,
+			strconv.FormatFloat(b.from, 'f', -1, 64),
+			strconv.FormatFloat(b.to, 'f', -1, 64),
+			strconv.Itoa(b.hours),
+			strconv.FormatFloat(b.share, 'f', 4, 64),
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// haSensor maps a pair of Home Assistant entities onto one sensor ID.
+type haSensor struct {
+	ID                string
+	TemperatureEntity string
+	HumidityEntity    string
+}
+
+// haSensorFlags collects repeated -sensor id=temperature_entity,humidity_entity flags.
+type haSensorFlags []haSensor
+
+func (f *haSensorFlags) String() string { return fmt.Sprint(*f) }
+
+func (f *haSensorFlags) Set(v string) error {
+	id, entities, ok := strings.Cut(v, "=")
+	temp, hum, ok2 := strings.Cut(entities, ",")
+	if !ok || !ok2 || id == "" || temp == "" || hum == "" {
+		return fmt.Errorf("invalid sensor mapping %q (want id=sensor.temperature,sensor.humidity)", v)
+	}
+	*f = append(*f, haSensor{ID: id, TemperatureEntity: temp, HumidityEntity: hum})
+	return nil
+}
+
+// runIngestHomeAssistant polls Home Assistant's REST API for the mapped
+// temperature and humidity entities and stores a reading per sensor on
+// every interval.
+func runIngestHomeAssistant(args []string) error {
+	var sensors haSensorFlags
+	fs := flag.NewFlagSet("ingest homeassistant", flag.ExitOnError)
+	baseURL := fs.String("url", envOr("HA_URL", "http://homeassistant.local:8123"), "Home Assistant base URL")
+	interval := fs.Duration("interval", time.Minute, "polling interval")
+	fs.Var(&sensors, "sensor", "sensor mapping id=temperature_entity,humidity_entity (repeatable)")
+	fs.Parse(args)
+
+	// Mappings can also come from HA_SENSORS, separated by semicolons
+	for _, m := range strings.Split(os.Getenv("HA_SENSORS"), ";") {
+		if m = strings.TrimSpace(m); m != "" {
+			if err := sensors.Set(m); err != nil {
+				return err
+			}
+		}
+	}
+	if len(sensors) == 0 {
+		return errors.New("no sensors mapped (use -sensor or HA_SENSORS)")
+	}
+	token := os.Getenv("HA_TOKEN")
+	if token == "" {
+		return configError{errors.New("HA_TOKEN not set in environment")}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	connectCtx, cancel := context.WithTimeout(ctx, mongoTimeouts.connect)
+	client, err := connectMongo(connectCtx, "")
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := mongoClients.release(context.Background(), client); err != nil {
+			log.Print(err)
+		}
+	}()
+	coll := readings(client)
+
+	ha := &haClient{baseURL: strings.TrimRight(*baseURL, "/"), token: token, http: &http.Client{Timeout: 10 * time.Second}}
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		now := time.Now()
+		var docs []any
+		for _, s := range sensors {
+			r, err := ha.reading(ctx, s, now)
+			if err != nil {
+				log.Printf("Skipping %s: %v", s.ID, err)
+				continue
+			}
+			docs = append(docs, r)
+		}
+		if len(docs) > 0 {
+			if _, err := coll.InsertMany(ctx, docs); err != nil && ctx.Err() == nil {
+				log.Printf("Error inserting readings: %v", err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// haClient is a minimal client for Home Assistant's REST API.
+type haClient struct {
+	baseURL string
+	token   string
+	http    *http.Client
+}
+
+// reading fetches the current state of both entities of s.
+func (c *haClient) reading(ctx context.Context, s haSensor, now time.Time) (reading, error) {
+	temp, err := c.state(ctx, s.TemperatureEntity)
+	if err != nil {
+		return reading{}, err
+	}
+	hum, err := c.state(ctx, s.HumidityEntity)
+	if err != nil {
+		return reading{}, err
+	}
+	p := readingPayload{Temperature: &temp, Humidity: &hum}
+	r, err := p.reading(now)
+	r.SensorID = s.ID
+	return r, err
+}
+
+// state returns the numeric state of entity.
+func (c *haClient) state(ctx context.Context, entity string) (float64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/api/states/"+entity, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("%s: %s", entity, resp.Status)
+	}
+
+	var body struct {
+		State string `json:"state"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return 0, fmt.Errorf("%s: %w", entity, err)
+	}
+	// "unavailable" and "unknown" fail here, skipping the sensor this round
+	v, err := strconv.ParseFloat(body.State, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s has non-numeric state %q", entity, body.State)
+	}
+	return v, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"time"
+)
+
+// How export -fill fills hours a sensor has no readings in. null prints
+// an empty row, previous repeats the last hour with readings and
+// interpolate draws a straight line between the hours either side.
+const (
+	fillNull        = "null"
+	fillPrevious    = "previous"
+	fillInterpolate = "interpolate"
+)
+
+// checkHourFill returns the hour fill method for -fill, also taking
+// the resampling names hold and linear.
+func checkHourFill(fill string) (string, error) {
+	switch fill {
+	case fillNull, fillPrevious, fillInterpolate:
+		return fill, nil
+	case fillHold:
+		return fillPrevious, nil
+	case fillLinear:
+		return fillInterpolate, nil
+	}
+	return "", fmt.Errorf("unknown fill %q (expected null, previous or interpolate)", fill)
+}
+
+// fillHours returns hourly results with a row for every local hour in
+// [from, to) of each of the given sensors, up to now, ordered by hour
+// then sensor as hourlyAverages orders them. Made-up rows have a count
+// of zero, and a NaN temperature and humidity where there is nothing to
+// fill them from.
+func fillHours(results []bucketAvg[string], sensors []string, from, to, now time.Time, loc *time.Location, fill string) []bucketAvg[string] {
+	if now.Before(to) {
+		to = now
+	}
+	// Keys sort in time order, and the hour repeated when clocks go
+	// back is one key, as it is one bucket
+	var hours []string
+	for h := from; h.Before(to); h = nextHour(h, loc) {
+		hours = append(hours, h.In(loc).Format(time.DateTime))
+	}
+	sensors = slices.Clone(sensors)
+	slices.Sort(sensors)
+	grid := make(map[string][]*bucketAvg[string], len(sensors))
+	for _, id := range sensors {
+		grid[id] = make([]*bucketAvg[string], len(hours))
+	}
+	for i := range results {
+		b := &results[i]
+		if row, ok := grid[b.Sensor]; ok {
+			if j, found := slices.BinarySearch(hours, b.Key); found {
+				row[j] = b
+			}
+		}
+	}
+
+	out := make([]bucketAvg[string], 0, len(hours)*len(sensors))
+	for i, hour := range hours {
+		for _, id := range sensors {
+			row := grid[id]
+			if row[i] != nil {
+				out = append(out, *row[i])
+				continue
+			}
+			filled := bucketAvg[string]{Key: hour, Sensor: id, Temperature: math.NaN(), Humidity: math.NaN()}
+			prev, next := i-1, i+1
+			for prev >= 0 && row[prev] == nil {
+				prev--
+			}
+			for next < len(row) && row[next] == nil {
+				next++
+			}
+			switch {
+			case fill == fillPrevious && prev >= 0:
+				p := row[prev]
+				filled.Temperature, filled.Humidity, filled.CO2, filled.Pressure = p.Temperature, p.Humidity, p.CO2, p.Pressure
+			case fill == fillInterpolate && prev >= 0 && next < len(row):
+				p, n := row[prev], row[next]
+				f := float64(i-prev) / float64(next-prev)
+				filled.Temperature = p.Temperature + (n.Temperature-p.Temperature)*f
+				filled.Humidity = p.Humidity + (n.Humidity-p.Humidity)*f
+				filled.CO2 = lerpOptional(p.CO2, n.CO2, f)
+				filled.Pressure = lerpOptional(p.Pressure, n.Pressure, f)
+			}
+			out = append(out, filled)
+		}
+	}
+	return out
+}
+
+// lerpOptional interpolates a fraction f of the way from a to b, or
+// returns nil if either is missing.
+func lerpOptional(a, b *float64, f float64) *float64 {
+	if a == nil || b == nil {
+		return nil
+	}
+	v := *a + (*b-*a)*f
+	return &v
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// importBatch is how many readings an importer writes per bulk request.
+const importBatch = 1000
+
+// importStateCollection remembers how far incremental importers have
+// synced.
+const importStateCollection = "import_state"
+
+// runImport dispatches to the importer named by the first argument.
+func runImport(args []string) error {
+	if len(args) == 0 {
+		return usageError("usage: import sensorpush|govee|aranet|netatmo|file [flags]")
+	}
+	switch args[0] {
+	case "sensorpush":
+		return runImportSensorPush(args[1:])
+	case "govee", "aranet":
+		return runImportAppExport(args[0], args[1:])
+	case "netatmo":
+		return runImportNetatmo(args[1:])
+	case "file":
+		return runImportFile(args[1:])
+	default:
+		return usageError(fmt.Sprintf("unknown importer %q (expected sensorpush, govee, aranet, netatmo or file)", args[0]))
+	}
+}
+
+// importReadings stores rows unless a reading from the same sensor at
+// the same time already exists, so an interrupted import can simply be
+// run again. It returns how many readings were new.
+func importReadings(ctx context.Context, coll *mongo.Collection, rows []reading) (int64, error) {
+	typ, err := collectionType(ctx, coll)
+	if err != nil {
+		return 0, err
+	}
+	var inserted int64
+	for start := 0; start < len(rows); start += importBatch {
+		batch := rows[start:min(start+importBatch, len(rows))]
+		if typ == "timeseries" {
+			n, err := insertMissing(ctx, coll, batch)
+			inserted += n
+			if err != nil {
+				return inserted, err
+			}
+			continue
+		}
+		models := make([]mongo.WriteModel, len(batch))
+		for i, r := range batch {
+			models[i] = mongo.NewUpdateOneModel().
+				SetFilter(r.key()).
+				SetUpdate(bson.M{"$setOnInsert": r}).
+				SetUpsert(true)
+		}
+		res, err := coll.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+		if err != nil {
+			return inserted, err
+		}
+		inserted += res.UpsertedCount
+	}
+	return inserted, nil
+}
+
+// registerImportedSensor adds a sensor found by an importer to the
+// registry, leaving sensors that are already registered untouched.
+func registerImportedSensor(ctx context.Context, coll *mongo.Collection, id, name, unit string) error {
+	s := sensorInfo{ID: id, Name: name, TemperatureUnit: unit, CreatedAt: time.Now()}
+	if _, err := coll.InsertOne(ctx, s); err != nil && !mongo.IsDuplicateKeyError(err) {
+		return err
+	} else if err == nil {
+		log.Printf("Registered sensor %s (%s)", id, name)
+	}
+	return nil
+}
+
+// importCursor is the saved progress of an incremental importer or a
+// transfer, keyed by importer and source, e.g. a device ID.
+type importCursor struct {
+	Key      string    `bson:"_id"`
+	SyncedTo time.Time `bson:"syncedTo,omitempty"`
+	// LastID orders records that share the SyncedTo time
+	LastID any `bson:"lastId,omitempty"`
+	// Token holds credentials the source rotates
+	Token string `bson:"token,omitempty"`
+	// ResumeToken is the position in a followed change stream
+	ResumeToken bson.Raw  `bson:"resumeToken,omitempty"`
+	UpdatedAt   time.Time `bson:"updatedAt"`
+}
+
+func importState(client *mongo.Client) *mongo.Collection {
+	return client.Database(readingsDatabase).Collection(importStateCollection)
+}
+
+// loadImportCursor returns the saved cursor for key, or an empty one.
+func loadImportCursor(ctx context.Context, coll *mongo.Collection, key string) (importCursor, error) {
+	cur := importCursor{Key: key}
+	err := coll.FindOne(ctx, bson.M{"_id": key}).Decode(&cur)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return cur, nil
+	}
+	return cur, err
+}
+
+func saveImportCursor(ctx context.Context, coll *mongo.Collection, cur importCursor) error {
+	cur.UpdatedAt = time.Now()
+	_, err := coll.ReplaceOne(ctx, bson.M{"_id": cur.Key}, cur, options.Replace().SetUpsert(true))
+	return err
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// runImportFile loads readings from CSV or NDJSON files, such as the
+// history of another logger, into MongoDB. CSV columns are detected and
+// confirmed like tier register's, and the keys of NDJSON objects are
+// mapped the same way, defaulting to the fields of the write API.
+// Readings that are already stored, or repeated in the files, are
+// skipped, so an interrupted import can simply be run again.
+func runImportFile(args []string) (err error) {
+	choice := mappingChoice{columns: csvMapFlags{}}
+	fs := flag.NewFlagSet("import file", flag.ExitOnError)
+	parseModeFlag := parseModeFlags(fs)
+	fs.Var(choice.columns, "map", "CSV column or JSON key for a field, as field=column (repeatable)")
+	fs.StringVar(&choice.tempUnit, "temp-unit", "", "temperature unit, C or F (default: detect in CSV, C in NDJSON)")
+	fs.StringVar(&choice.humScale, "hum-scale", "", "humidity scale, percent or fraction (default: detect in CSV, percent in NDJSON)")
+	fs.StringVar(&choice.timezone, "timezone", "", "IANA zone of times that don't carry one (default UTC)")
+	fs.StringVar(&choice.timeFormat, "time-format", "", "time format as a Go layout, e.g. \"01/02/2006 15:04\" (default: detect)")
+	template := fs.String("template", "", "use the mapping saved under this name instead of detecting one")
+	saveAs := fs.String("save-template", "", "save the confirmed CSV mapping under this name")
+	yes := fs.Bool("yes", false, "accept the detected CSV mapping without asking")
+	sensorID := fs.String("sensor", "", "sensor ID of readings without one, registered if it isn't yet")
+	name := fs.String("name", "", "friendly name when registering -sensor (defaults to the ID)")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return usageError("usage: import file [-strict|-lenient] [-template NAME] [-map field=column] [-sensor ID] FILE.csv|FILE.ndjson ...")
+	}
+	mode, err := parseModeFlag()
+	if err != nil {
+		return err
+	}
+	for _, path := range fs.Args() {
+		if !isCSV(path) && !isNDJSON(path) {
+			return fmt.Errorf("%s: unsupported file type %q (expected .csv, .ndjson, .jsonl or .json)", path, filepath.Ext(path))
+		}
+	}
+	if fi, err := os.Stdin.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 && !*yes {
+		choice.prompt = bufio.NewReader(os.Stdin)
+	}
+
+	ctx, stop := commandContext()
+	defer stop()
+	connectCtx, cancel := context.WithTimeout(ctx, mongoTimeouts.connect)
+	client, err := connectMongo(connectCtx, "")
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if rerr := mongoClients.release(ctx, client); err == nil {
+			err = rerr
+		}
+	}()
+	templates := importTemplates(client)
+	if *template != "" {
+		m, err := loadTemplate(ctx, templates, *template)
+		if err != nil {
+			return err
+		}
+		choice.template = &m
+	}
+	if *sensorID != "" {
+		if err := registerImportedSensor(ctx, sensorRegistry(client), *sensorID, cmp.Or(*name, *sensorID), unitCelsius); err != nil {
+			return err
+		}
+	}
+
+	// Repeats are common where one logger's exports overlap
+	type key struct {
+		sensor string
+		at     int64
+	}
+	seen := map[key]bool{}
+	var total, repeated int64
+	for _, path := range fs.Args() {
+		var res csvResult
+		if isCSV(path) {
+			m, err := choice.forFile(path)
+			if err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+			log.Printf("%s: mapping %s", path, m)
+			if *saveAs != "" {
+				if err := saveTemplate(ctx, templates, *saveAs, m); err != nil {
+					return err
+				}
+				log.Printf("Saved mapping as template %q", *saveAs)
+			}
+			if res, err = readLegacyFile(path, mode, &m); err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+		} else {
+			var m csvMapping
+			if choice.template != nil {
+				m = *choice.template
+			}
+			m, err := choice.override(m)
+			if err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+			if res, err = readNDJSONFile(path, mode, m); err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+		}
+		for _, w := range res.warnings {
+			log.Printf("%s: %s", path, w)
+		}
+		if len(res.rejects) > 0 {
+			rejectsPath := path + ".rejects.csv"
+			if err := writeRejects(rejectsPath, res.rejects); err != nil {
+				return err
+			}
+			log.Printf("%s: rejected %d rows (see %s)", path, len(res.rejects), rejectsPath)
+		}
+
+		rows := make([]reading, 0, len(res.rows))
+		for _, r := range res.rows {
+			r.SensorID = cmp.Or(r.SensorID, *sensorID)
+			k := key{r.SensorID, r.UpdatedAt.UnixMilli()}
+			if seen[k] {
+				repeated++
+				continue
+			}
+			seen[k] = true
+			rows = append(rows, reading{SensorID: r.SensorID, Temperature: r.Temperature, Humidity: r.Humidity, CO2: r.CO2, Pressure: r.Pressure, UpdatedAt: r.UpdatedAt})
+		}
+		n, err := importReadings(ctx, readings(client), rows)
+		total += n
+		if err != nil {
+			return err
+		}
+		log.Printf("%s: imported %d new readings of %d", path, n, len(rows))
+	}
+	if repeated > 0 {
+		log.Printf("Skipped %d readings repeated in the files", repeated)
+	}
+	log.Printf("Imported %d new readings", total)
+	return nil
+}
+
+func isNDJSON(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".ndjson", ".jsonl", ".json":
+		return true
+	}
+	return false
+}
+
+// readNDJSONFile parses one JSON object per line. Its keys are treated
+// as the header of a CSV, so mapping finds fields the same way, and
+// lines are rejected or coerced according to mode as rows would be.
+// Times may be strings or Unix seconds.
+func readNDJSONFile(path string, mode parseMode, mapping csvMapping) (csvResult, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return csvResult{}, err
+	}
+
+	// Objects may leave out optional fields, so the header is every key
+	// seen, in order of appearance
+	type line struct {
+		n      int
+		raw    string
+		fields map[string]string
+		err    error
+	}
+	var lines []line
+	var header []string
+	known := map[string]bool{}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(nil, 1<<20)
+	for n := 1; sc.Scan(); n++ {
+		raw := bytes.TrimSpace(sc.Bytes())
+		if len(raw) == 0 {
+			continue
+		}
+		l := line{n: n, raw: string(raw)}
+		l.fields, l.err = jsonFields(raw)
+		keys := make([]string, 0, len(l.fields))
+		for k := range l.fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if !known[k] {
+				known[k] = true
+				header = append(header, k)
+			}
+		}
+		lines = append(lines, l)
+	}
+	if err := sc.Err(); err != nil {
+		return csvResult{}, err
+	}
+	if len(lines) == 0 {
+		return csvResult{}, nil
+	}
+
+	rows, err := newRecordRows(header, mode, mapping)
+	if err != nil {
+		return csvResult{}, err
+	}
+	var res csvResult
+	rec := make([]string, len(header))
+	for _, l := range lines {
+		err := l.err
+		if err == nil {
+			for i, k := range header {
+				rec[i] = l.fields[k]
+			}
+			var row coldReading
+			row, err = rows.parse(rec)
+			for _, w := range rows.warnings {
+				res.warnings = append(res.warnings, fmt.Sprintf("line %d: %s", l.n, w))
+			}
+			if err == nil {
+				res.rows = append(res.rows, row)
+				continue
+			}
+		}
+		if mode == parseStrict {
+			return csvResult{}, fmt.Errorf("line %d: %w", l.n, err)
+		}
+		res.rejects = append(res.rejects, csvReject{Line: l.n, Row: []string{l.raw}, Err: err})
+	}
+	return res, nil
+}
+
+// jsonFields returns the top-level values of a JSON object as text:
+// strings as they are, numbers as written and null as empty.
+func jsonFields(raw []byte) (map[string]string, error) {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return nil, err
+	}
+	fields := make(map[string]string, len(obj))
+	for k, v := range obj {
+		var s string
+		switch {
+		case string(v) == "null":
+		case json.Unmarshal(v, &s) == nil:
+		default:
+			s = string(v)
+		}
+		fields[k] = s
+	}
+	return fields, nil
+}
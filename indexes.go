@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// byTimeIndex is the index on updatedAt alone, which is also the one
+// that expires readings when they have a TTL.
+const byTimeIndex = "updatedAt_1"
+
+// runEnsureIndexes creates the indexes queries rely on.
+func runEnsureIndexes(args []string) (err error) {
+	fs := flag.NewFlagSet("ensure-indexes", flag.ExitOnError)
+	ttl := fs.Duration("ttl", readingsTTL(), "delete raw readings this long after they were taken, e.g. 8760h (disabled when 0)")
+	cluster := fs.String("cluster", "", "cluster from CLUSTERS_FILE to index, or a MongoDB URI (default MONGO_CLUSTER, or MONGO_URI)")
+	fs.Parse(args)
+	if *ttl < 0 {
+		return errors.New("-ttl must not be negative")
+	}
+
+	ctx, stop := commandContext()
+	defer stop()
+	connectCtx, cancel := context.WithTimeout(ctx, mongoTimeouts.connect)
+	client, err := connectMongo(connectCtx, *cluster)
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if rerr := mongoClients.release(ctx, client); err == nil {
+			err = rerr
+		}
+	}()
+	return ensureIndexes(ctx, client, *ttl)
+}
+
+// readingsTTL is the expiry of raw readings set by READINGS_TTL, used
+// by ensure-indexes and -create-indexes. It is 0, no expiry, when unset
+// or not a duration.
+func readingsTTL() time.Duration {
+	v := os.Getenv("READINGS_TTL")
+	if v == "" {
+		return 0
+	}
+	ttl, err := time.ParseDuration(v)
+	if err != nil || ttl < 0 {
+		log.Printf("READINGS_TTL %q is not a duration; readings won't expire", v)
+		return 0
+	}
+	return ttl
+}
+
+// ensureIndexes creates the indexes of the readings and summaries
+// collections, and sets the readings' expiry if ttl isn't 0.
+func ensureIndexes(ctx context.Context, client *mongo.Client, ttl time.Duration) error {
+	db := client.Database(readingsDatabase)
+	if err := ensureReadingIndexes(ctx, db.Collection(readingsCollection), ttl); err != nil {
+		return err
+	}
+	// retention looks summaries up by period and start
+	_, err := db.Collection(summariesCollection).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "period", Value: 1}, {Key: "start", Value: 1}},
+	})
+	if err != nil {
+		return fmt.Errorf("indexing %s: %w", summariesCollection, err)
+	}
+	if err := ensureDeviceIndexes(ctx, db); err != nil {
+		return err
+	}
+	if err := ensureShareIndexes(ctx, db); err != nil {
+		return err
+	}
+	return ensureAuditIndexes(ctx, db)
+}
+
+// ensureReadingIndexes creates the indexes of a readings collection:
+// updatedAt for date ranges over all sensors, which aggregations and
+// transfers read, and sensorId with updatedAt for those limited to some
+// sensors and for upserts by natural key. Creating an index that
+// exists does nothing, so it is safe to run every time.
+//
+// With a ttl, readings are deleted by MongoDB that long after they were
+// taken. An existing expiry is changed in place, but without a ttl it is
+// left alone, as the index would have to be dropped and rebuilt.
+// Time-series collections can't have TTL indexes, so their expiry is
+// set on the collection instead.
+func ensureReadingIndexes(ctx context.Context, coll *mongo.Collection, ttl time.Duration) error {
+	specs, err := coll.Database().ListCollectionSpecifications(ctx, bson.M{"name": coll.Name(), "type": "timeseries"})
+	if err != nil {
+		return fmt.Errorf("inspecting %s: %w", coll.Name(), err)
+	}
+	if len(specs) > 0 {
+		if err := setTimeSeriesExpiry(ctx, coll, specs[0].Options, ttl); err != nil {
+			return err
+		}
+		return createReadingIndexes(ctx, coll, options.Index().SetName(byTimeIndex))
+	}
+	return ensureRegularIndexes(ctx, coll, ttl)
+}
+
+// setTimeSeriesExpiry sets the expiry of a time-series collection with
+// the given options, leaving it alone without a ttl like
+// ensureReadingIndexes.
+func setTimeSeriesExpiry(ctx context.Context, coll *mongo.Collection, opts bson.Raw, ttl time.Duration) error {
+	seconds := int64(ttl.Seconds())
+	expiry, ok := opts.Lookup("expireAfterSeconds").AsInt64OK()
+	switch {
+	case ttl > 0 && (!ok || expiry != seconds):
+		err := coll.Database().RunCommand(ctx, bson.D{
+			{Key: "collMod", Value: coll.Name()},
+			{Key: "expireAfterSeconds", Value: seconds},
+		}).Err()
+		if err != nil {
+			return fmt.Errorf("setting the expiry of %s: %w", coll.Name(), err)
+		}
+		log.Printf("Readings in %s now expire after %s", coll.Name(), ttl)
+	case ttl == 0 && ok:
+		log.Printf("Readings in %s still expire after %s; run collMod with expireAfterSeconds \"off\" to keep them", coll.Name(), time.Duration(expiry)*time.Second)
+	}
+	return nil
+}
+
+// ensureRegularIndexes is ensureReadingIndexes for a regular collection.
+func ensureRegularIndexes(ctx context.Context, coll *mongo.Collection, ttl time.Duration) error {
+	specs, err := coll.Indexes().ListSpecifications(ctx)
+	if err != nil {
+		return fmt.Errorf("listing indexes of %s: %w", coll.Name(), err)
+	}
+	seconds := int32(min(ttl.Seconds(), math.MaxInt32))
+	byTime := options.Index().SetName(byTimeIndex)
+	if ttl > 0 {
+		byTime.SetExpireAfterSeconds(seconds)
+	}
+	for _, s := range specs {
+		if s.Name != byTimeIndex {
+			continue
+		}
+		switch expiry := s.ExpireAfterSeconds; {
+		case ttl > 0 && (expiry == nil || *expiry != seconds):
+			err := coll.Database().RunCommand(ctx, bson.D{
+				{Key: "collMod", Value: coll.Name()},
+				{Key: "index", Value: bson.D{{Key: "name", Value: byTimeIndex}, {Key: "expireAfterSeconds", Value: seconds}}},
+			}).Err()
+			if err != nil {
+				return fmt.Errorf("setting the expiry of %s: %w", coll.Name(), err)
+			}
+			log.Printf("Readings in %s now expire after %s", coll.Name(), ttl)
+		case ttl == 0 && expiry != nil:
+			log.Printf("Readings in %s still expire after %s; drop index %s to keep them", coll.Name(), time.Duration(*expiry)*time.Second, byTimeIndex)
+			byTime.SetExpireAfterSeconds(*expiry)
+		}
+	}
+	return createReadingIndexes(ctx, coll, byTime)
+}
+
+// createReadingIndexes creates the indexes of ensureReadingIndexes, with
+// byTime the options of the one on updatedAt.
+func createReadingIndexes(ctx context.Context, coll *mongo.Collection, byTime *options.IndexOptions) error {
+	names, err := coll.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "updatedAt", Value: 1}}, Options: byTime},
+		{Keys: bson.D{{Key: "sensorId", Value: 1}, {Key: "updatedAt", Value: 1}}},
+	})
+	if err != nil {
+		return fmt.Errorf("indexing %s: %w", coll.Name(), err)
+	}
+	log.Printf("Indexes of %s: %v", coll.Name(), names)
+	return nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// errInfluxReadBack is returned where a transfer would read InfluxDB.
+var errInfluxReadBack = errors.New("reading back from InfluxDB is not supported")
+
+// Line protocol escapes these in measurements and tag values
+var (
+	influxMeasurement = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxTag         = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+)
+
+// influxWriter writes points to an InfluxDB 2 bucket as line protocol.
+// As a transfer destination it writes one point per reading tagged with
+// its sensor. Points with the same tags and time replace each other.
+type influxWriter struct {
+	endpoint    string
+	token       string
+	measurement string
+	http        *http.Client
+}
+
+// newInfluxWriter writes to the bucket of an influx+http(s)://HOST?org=ORG
+// URI, authenticating with INFLUX_TOKEN.
+func newInfluxWriter(uri, bucket, measurement string) (*influxWriter, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	org := u.Query().Get("org")
+	if org == "" {
+		return nil, errors.New("InfluxDB URI needs ?org=")
+	}
+	token := os.Getenv("INFLUX_TOKEN")
+	if token == "" {
+		return nil, configError{errors.New("INFLUX_TOKEN not set in environment")}
+	}
+	u.Scheme = strings.TrimPrefix(u.Scheme, "influx+")
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v2/write"
+	u.RawQuery = url.Values{"org": {org}, "bucket": {bucket}, "precision": {"ms"}}.Encode()
+	return &influxWriter{
+		endpoint:    u.String(),
+		token:       token,
+		measurement: measurement,
+		http:        &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (w *influxWriter) String() string {
+	u, _ := url.Parse(w.endpoint)
+	return "influx:" + u.Host + "/" + u.Query().Get("bucket") + "." + w.measurement
+}
+
+func (w *influxWriter) write(ctx context.Context, records []bson.M) error {
+	var body bytes.Buffer
+	for _, record := range records {
+		r, err := recordReading(record)
+		if err != nil {
+			return err
+		}
+		writeInfluxPoint(&body, w.measurement, []string{"sensor", r.SensorID}, []influxField{
+			{"temperature", &r.Temperature},
+			{"humidity", &r.Humidity},
+			{"co2", r.CO2},
+			{"pressure", r.Pressure},
+		}, r.UpdatedAt)
+	}
+	return w.post(ctx, body.Bytes())
+}
+
+// post sends lines of line protocol to the bucket.
+func (w *influxWriter) post(ctx context.Context, lines []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.endpoint, bytes.NewReader(lines))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Token "+w.token)
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	resp, err := w.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("influxdb: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// influxField is a field of a point, left out when value is nil.
+type influxField struct {
+	key   string
+	value *float64
+}
+
+// writeInfluxPoint appends one line of line protocol, in milliseconds,
+// to buf. tags alternates keys and values; empty values are left out.
+func writeInfluxPoint(buf *bytes.Buffer, measurement string, tags []string, fields []influxField, at time.Time) {
+	buf.WriteString(influxMeasurement.Replace(measurement))
+	for i := 0; i+1 < len(tags); i += 2 {
+		if tags[i+1] != "" {
+			buf.WriteString("," + tags[i] + "=" + influxTag.Replace(tags[i+1]))
+		}
+	}
+	sep := " "
+	for _, f := range fields {
+		if f.value != nil {
+			buf.WriteString(sep + f.key + "=" + strconv.FormatFloat(*f.value, 'f', -1, 64))
+			sep = ","
+		}
+	}
+	fmt.Fprintf(buf, " %d\n", at.UnixMilli())
+}
+
+func (w *influxWriter) missing(context.Context, []bson.M) (int64, error) {
+	return 0, errInfluxReadBack
+}
+
+func (w *influxWriter) digest(context.Context, time.Time, time.Time) (map[string]dayDigest, error) {
+	return nil, errInfluxReadBack
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"time"
+)
+
+// runIngest dispatches to the ingestion mode named by the first argument.
+func runIngest(args []string) error {
+	if len(args) == 0 {
+		return usageError("usage: ingest mqtt|homeassistant|serial|keygen|seal [flags]")
+	}
+	switch args[0] {
+	case "mqtt":
+		return runIngestMQTT(args[1:])
+	case "homeassistant":
+		return runIngestHomeAssistant(args[1:])
+	case "serial":
+		return runIngestSerial(args[1:])
+	case "keygen":
+		return runIngestKeygen(args[1:])
+	case "seal":
+		return runIngestSeal(args[1:])
+	default:
+		return usageError(fmt.Sprintf("unknown ingest mode %q (expected mqtt, homeassistant, serial, keygen or seal)", args[0]))
+	}
+}
+
+// readingPayload is the JSON shape sensors send. The timestamp is
+// optional and defaults to the time the payload was received. CO2 (ppm)
+// and pressure (hPa) are optional.
+type readingPayload struct {
+	SensorID    string     `json:"sensorId"`
+	Temperature *float64   `json:"temperature"`
+	Humidity    *float64   `json:"humidity"`
+	CO2         *float64   `json:"co2"`
+	Pressure    *float64   `json:"pressure"`
+	UpdatedAt   *time.Time `json:"updatedAt"`
+	// Firmware is the version of the device's firmware or agent, recorded
+	// in the device registry rather than with the reading
+	Firmware string `json:"firmware,omitempty"`
+}
+
+// reading validates the payload and converts it to a stored reading.
+func (p readingPayload) reading(received time.Time) (reading, error) {
+	if p.Temperature == nil {
+		return reading{}, errors.New("temperature is required")
+	}
+	if p.Humidity == nil {
+		return reading{}, errors.New("humidity is required")
+	}
+	// Wide enough for either unit, narrow enough to catch garbage
+	if t := *p.Temperature; math.IsNaN(t) || t < -100 || t > 200 {
+		return reading{}, fmt.Errorf("temperature %v out of range", t)
+	}
+	if h := *p.Humidity; math.IsNaN(h) || h < 0 || h > 100 {
+		return reading{}, fmt.Errorf("humidity %v out of range", h)
+	}
+	if c := p.CO2; c != nil && (math.IsNaN(*c) || *c < 0 || *c > 10000) {
+		return reading{}, fmt.Errorf("co2 %v out of range", *c)
+	}
+	// Sea-level pressure never leaves 870–1085 hPa; allow for altitude
+	if pr := p.Pressure; pr != nil && (math.IsNaN(*pr) || *pr < 300 || *pr > 1100) {
+		return reading{}, fmt.Errorf("pressure %v out of range", *pr)
+	}
+	r := reading{SensorID: p.SensorID, Temperature: *p.Temperature, Humidity: *p.Humidity, CO2: p.CO2, Pressure: p.Pressure, UpdatedAt: received}
+	if p.UpdatedAt != nil {
+		if p.UpdatedAt.After(received.Add(time.Hour)) {
+			return reading{}, fmt.Errorf("updatedAt %s is in the future", p.UpdatedAt.Format(time.RFC3339))
+		}
+		r.UpdatedAt = *p.UpdatedAt
+	}
+	return r, nil
+}
+
+// batchWriter buffers readings and inserts them in batches, flushing
+// when the batch is full or the flush interval passes.
+type batchWriter struct {
+	store    readingStore
+	size     int
+	interval time.Duration
+	in       chan queuedReading
+	stopped  chan struct{}
+	// wal, when set, keeps readings on disk until they are inserted, and
+	// failed batches are retried instead of dropped
+	wal *readingWAL
+}
+
+// queuedReading is a reading waiting for its batch, with the segment of
+// the write-ahead log it is in.
+type queuedReading struct {
+	r   reading
+	seg int
+}
+
+func newBatchWriter(store readingStore, size int, interval time.Duration) *batchWriter {
+	return &batchWriter{
+		store:    store,
+		size:     size,
+		interval: interval,
+		in:       make(chan queuedReading, size),
+		stopped:  make(chan struct{}),
+	}
+}
+
+// add queues r for insertion, blocking while a full batch is written.
+// With a write-ahead log, r is on disk when add returns. Readings added
+// after run has returned are dropped.
+func (b *batchWriter) add(r reading) {
+	q := queuedReading{r: r}
+	if b.wal != nil {
+		var err error
+		if q.seg, err = b.wal.append(r); err != nil {
+			log.Printf("Error writing to the write-ahead log: %v", err)
+		}
+	}
+	select {
+	case b.in <- q:
+	case <-b.stopped:
+	}
+}
+
+// run writes batches until ctx is done, then flushes what is left.
+func (b *batchWriter) run(ctx context.Context) {
+	defer close(b.stopped)
+	var batch []queuedReading
+	// retry holds readings recovered from the write-ahead log or left by
+	// failed batches, which are upserted as some may be stored already
+	var retry []queuedReading
+	if b.wal != nil {
+		for i, r := range b.wal.recovered {
+			retry = append(retry, queuedReading{r: r, seg: b.wal.recoveredSegs[i]})
+		}
+	}
+	// failed holds off writing full batches until the next tick
+	failed := false
+	flush := func() {
+		// Use a fresh context so the final flush survives shutdown
+		insertCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if len(retry) > 0 {
+			n := 0
+			for _, q := range retry {
+				if err := b.store.upsert(insertCtx, q.r); err != nil {
+					log.Printf("Error writing %d readings held in the write-ahead log: %v", len(retry)-n, err)
+					break
+				}
+				n++
+			}
+			b.wal.done(segments(retry[:n]))
+			if retry = retry[n:]; len(retry) > 0 {
+				failed = true
+				return
+			}
+			log.Printf("Wrote %d readings held in the write-ahead log", n)
+		}
+		failed = false
+		if len(batch) == 0 {
+			return
+		}
+		rs := make([]reading, len(batch))
+		for i, q := range batch {
+			rs[i] = q.r
+		}
+		if err := b.store.insert(insertCtx, rs); err != nil {
+			log.Printf("Error inserting %d readings: %v", len(batch), err)
+			if b.wal != nil {
+				retry, failed = append(retry, batch...), true
+			}
+		} else {
+			log.Printf("Inserted %d readings", len(batch))
+			if b.wal != nil {
+				b.wal.done(segments(batch))
+			}
+		}
+		batch = batch[:0]
+	}
+
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case q := <-b.in:
+			batch = append(batch, q)
+			if len(batch) >= b.size && !failed {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-ctx.Done():
+			// Pick up anything queued before the shutdown
+			for {
+				select {
+				case q := <-b.in:
+					batch = append(batch, q)
+				default:
+					flush()
+					if n := len(retry) + len(batch); n > 0 {
+						log.Printf("Keeping %d readings in the write-ahead log for the next run", n)
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+// segments returns the write-ahead log segments of queued readings.
+func segments(qs []queuedReading) []int {
+	segs := make([]int, len(qs))
+	for i, q := range qs {
+		segs[i] = q.seg
+	}
+	return segs
+}
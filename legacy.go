@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// legacyKeyPrefix marks tier ranges that point at a registered local
+// file rather than an archive in the bucket.
+const legacyKeyPrefix = "file://"
+
+// runTierRegister records existing CSV or Parquet exports as cold
+// ranges, making them queryable through the API and export without
+// inserting them into MongoDB.
+func runTierRegister(args []string) (err error) {
+	choice := mappingChoice{columns: csvMapFlags{}}
+	fs := flag.NewFlagSet("tier register", flag.ExitOnError)
+	parseModeFlag := parseModeFlags(fs)
+	fs.Var(choice.columns, "map", "CSV column for a field, as field=column (repeatable)")
+	fs.StringVar(&choice.tempUnit, "temp-unit", "", "CSV temperature unit, C or F (default: detect)")
+	fs.StringVar(&choice.humScale, "hum-scale", "", "CSV humidity scale, percent or fraction (default: detect)")
+	fs.StringVar(&choice.timezone, "timezone", "", "IANA zone of CSV times that don't carry one (default UTC)")
+	fs.StringVar(&choice.timeFormat, "time-format", "", "CSV time format as a Go layout, e.g. \"01/02/2006 15:04\" (default: detect)")
+	template := fs.String("template", "", "use the CSV mapping saved under this name instead of detecting one")
+	saveAs := fs.String("save-template", "", "save the confirmed CSV mapping under this name")
+	yes := fs.Bool("yes", false, "accept the detected CSV mapping without asking")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return usageError("usage: tier register [-strict|-lenient] [-template NAME] [-map field=column] FILE.csv|FILE.parquet ...")
+	}
+	mode, err := parseModeFlag()
+	if err != nil {
+		return err
+	}
+	// Ask for confirmation only when someone is there to answer
+	if fi, err := os.Stdin.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 && !*yes {
+		choice.prompt = bufio.NewReader(os.Stdin)
+	}
+
+	ctx, stop := commandContext()
+	defer stop()
+	connectCtx, cancel := context.WithTimeout(ctx, mongoTimeouts.connect)
+	client, err := connectMongo(connectCtx, "")
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if rerr := mongoClients.release(ctx, client); err == nil {
+			err = rerr
+		}
+	}()
+	coll := readings(client)
+	tiers := client.Database(readingsDatabase).Collection(tiersCollection)
+	templates := importTemplates(client)
+	if *template != "" {
+		m, err := loadTemplate(ctx, templates, *template)
+		if err != nil {
+			return err
+		}
+		choice.template = &m
+	}
+
+	for _, name := range fs.Args() {
+		path, err := filepath.Abs(name)
+		if err != nil {
+			return err
+		}
+		var mapping *csvMapping
+		if isCSV(path) {
+			m, err := choice.forFile(path)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			log.Printf("%s: mapping %s", name, m)
+			if *saveAs != "" {
+				if err := saveTemplate(ctx, templates, *saveAs, m); err != nil {
+					return err
+				}
+				log.Printf("Saved mapping as template %q", *saveAs)
+			}
+			mapping = &m
+		}
+		res, err := readLegacyFile(path, mode, mapping)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		for _, w := range res.warnings {
+			log.Printf("%s: %s", name, w)
+		}
+		rows := res.rows
+		if len(res.rejects) > 0 {
+			rejectsPath := path + ".rejects.csv"
+			if err := writeRejects(rejectsPath, res.rejects); err != nil {
+				return err
+			}
+			log.Printf("%s: accepted %d rows, rejected %d (see %s)", name, len(rows), len(res.rejects), rejectsPath)
+		} else {
+			log.Printf("%s: accepted %d rows", name, len(rows))
+		}
+		if len(rows) == 0 {
+			log.Printf("Skipping %s: no readings", name)
+			continue
+		}
+
+		from, to := rows[0].UpdatedAt, rows[0].UpdatedAt
+		for _, r := range rows {
+			if r.UpdatedAt.Before(from) {
+				from = r.UpdatedAt
+			}
+			if r.UpdatedAt.After(to) {
+				to = r.UpdatedAt
+			}
+		}
+		// Ranges are half-open, so step just past the last reading
+		to = to.Add(time.Millisecond)
+
+		// Queries add both tiers together, so overlap means double counting
+		filter := bson.M{"updatedAt": bson.M{"$gte": from, "$lt": to}}
+		if n, err := coll.CountDocuments(ctx, filter); err != nil {
+			return err
+		} else if n > 0 {
+			log.Printf("Warning: MongoDB already holds %d readings between %s and %s; they will be counted alongside %s",
+				n, from.Format(time.RFC3339), to.Format(time.RFC3339), name)
+		}
+
+		key := legacyKeyPrefix + path
+		record := tierRange{Key: key, From: from, To: to, Count: int64(len(rows)), TieredAt: time.Now(), ParseMode: mode.String(), Mapping: mapping}
+		if _, err := tiers.ReplaceOne(ctx, bson.M{"_id": key}, record, options.Replace().SetUpsert(true)); err != nil {
+			return err
+		}
+		log.Printf("Registered %s: %d readings from %s to %s", name, len(rows), from.Format(time.RFC3339), to.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// mappingChoice settles the CSV mapping of each file registered.
+type mappingChoice struct {
+	// template, when set, replaces detection
+	template *csvMapping
+	// the remaining fields override individual choices
+	columns    csvMapFlags
+	tempUnit   string
+	humScale   string
+	timezone   string
+	timeFormat string
+	// prompt reads the user's confirmation; nil accepts the mapping
+	prompt *bufio.Reader
+}
+
+// forFile returns the mapping for a CSV file: the template or detected
+// mapping, with flag overrides applied, confirmed by the user if there
+// is one to ask.
+func (c mappingChoice) forFile(path string) (csvMapping, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return csvMapping{}, err
+	}
+	defer f.Close()
+	header, err := csv.NewReader(f).Read()
+	if err != nil {
+		return csvMapping{}, err
+	}
+
+	var m csvMapping
+	if c.template != nil {
+		m = *c.template
+	} else {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return csvMapping{}, err
+		}
+		var notes []string
+		if m, notes, err = detectCSVMapping(f); err != nil {
+			return csvMapping{}, err
+		}
+		for _, n := range notes {
+			log.Printf("%s: %s", filepath.Base(path), n)
+		}
+	}
+	if m, err = c.override(m); err != nil {
+		return csvMapping{}, err
+	}
+
+	if c.prompt != nil {
+		if m, err = confirmCSVMapping(c.prompt, os.Stdout, header, m); err != nil {
+			return csvMapping{}, err
+		}
+	}
+	if _, err := m.resolve(header); err != nil {
+		return csvMapping{}, err
+	}
+	return m, nil
+}
+
+// override applies the choices made with flags to m.
+func (c mappingChoice) override(m csvMapping) (csvMapping, error) {
+	m.Columns = maps.Clone(m.Columns)
+	if m.Columns == nil {
+		m.Columns = map[string]string{}
+	}
+	maps.Copy(m.Columns, c.columns)
+	m.TemperatureUnit = cmp.Or(c.tempUnit, m.TemperatureUnit)
+	m.HumidityScale = cmp.Or(c.humScale, m.HumidityScale)
+	m.Timezone = cmp.Or(c.timezone, m.Timezone)
+	m.TimeFormat = cmp.Or(c.timeFormat, m.TimeFormat)
+	return m, m.validate()
+}
+
+func isCSV(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".csv")
+}
+
+// readLegacyFile loads a CSV or Parquet export, chosen by extension.
+// Bad CSV rows are handled according to mode, and a nil mapping reads
+// the CSV layout this tool exports.
+func readLegacyFile(path string, mode parseMode, mapping *csvMapping) (csvResult, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".parquet":
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return csvResult{}, err
+		}
+		rows, err := parquet.Read[coldReading](bytes.NewReader(data), int64(len(data)))
+		return csvResult{rows: rows}, err
+	case ".csv":
+		f, err := os.Open(path)
+		if err != nil {
+			return csvResult{}, err
+		}
+		defer f.Close()
+		var m csvMapping
+		if mapping != nil {
+			m = *mapping
+		}
+		return readCSVReadings(f, mode, m)
+	default:
+		return csvResult{}, fmt.Errorf("unsupported file type %q (expected .csv or .parquet)", filepath.Ext(path))
+	}
+}
+
+// csvReject is a CSV row that could not be parsed.
+type csvReject struct {
+	Line int
+	Row  []string
+	Err  error
+}
+
+// writeRejects writes rejected rows as CSV with their line numbers and
+// reasons, followed by the original fields.
+func writeRejects(path string, rejects []csvReject) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"line", "error", "row"})
+	for _, rej := range rejects {
+		w.Write([]string{strconv.Itoa(rej.Line), rej.Err.Error(), strings.Join(rej.Row, ",")})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// csvColumns maps accepted header names to reading fields.
+var csvColumns = map[string]string{
+	"updatedat":    "time",
+	"timestamp":    "time",
+	"time":         "time",
+	"temperature":  "temperature",
+	"temp":         "temperature",
+	"humidity":     "humidity",
+	"hum":          "humidity",
+	"sensorid":     "sensor",
+	"sensor_id":    "sensor",
+	"sensor":       "sensor",
+	"co2":          "co2",
+	"co2_ppm":      "co2",
+	"pressure":     "pressure",
+	"pressure_hpa": "pressure",
+}
+
+// csvTimeLayouts are tried in order unless a mapping names a format.
+var csvTimeLayouts = []string{time.RFC3339Nano, "2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02 15:04"}
+
+// csvResult is the outcome of reading a readings CSV.
+type csvResult struct {
+	rows    []coldReading
+	rejects []csvReject
+	// warnings describe lenient coercions, prefixed with their line
+	warnings []string
+}
+
+// readCSVReadings parses a CSV with timestamp, temperature and humidity
+// columns, plus an optional sensor column, located through mapping.
+// Rows that fail to parse are returned as rejects, unless mode is
+// strict, in which case the first one is an error.
+func readCSVReadings(r io.Reader, mode parseMode, mapping csvMapping) (csvResult, error) {
+	rows, err := newCSVRows(r, mode, mapping)
+	if err != nil {
+		return csvResult{}, err
+	}
+	var res csvResult
+	for {
+		row, rec, err := rows.next()
+		if err == io.EOF {
+			return res, nil
+		}
+		for _, w := range rows.warnings {
+			res.warnings = append(res.warnings, fmt.Sprintf("line %d: %s", rows.line, w))
+		}
+		if err != nil {
+			if mode == parseStrict {
+				return csvResult{}, fmt.Errorf("line %d: %w", rows.line, err)
+			}
+			res.rejects = append(res.rejects, csvReject{Line: rows.line, Row: rec, Err: err})
+			continue
+		}
+		res.rows = append(res.rows, row)
+	}
+}
+
+// csvRows reads a readings CSV row by row, so callers can report bad
+// rows individually and carry on.
+type csvRows struct {
+	cr      *csv.Reader
+	idx     map[string]int
+	mode    parseMode
+	mapping csvMapping
+	loc     *time.Location
+
+	// line is the line number of the row last returned by next, and
+	// warnings the lenient coercions applied to it
+	line     int
+	warnings []string
+}
+
+func newCSVRows(r io.Reader, mode parseMode, mapping csvMapping) (*csvRows, error) {
+	cr := csv.NewReader(r)
+	// Column counts are checked per row instead of failing the file
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, err
+	}
+	c, err := newRecordRows(header, mode, mapping)
+	if err != nil {
+		return nil, err
+	}
+	c.cr = cr
+	return c, nil
+}
+
+// newRecordRows returns a csvRows that only parses records laid out
+// like header, for other formats to convert theirs into.
+func newRecordRows(header []string, mode parseMode, mapping csvMapping) (*csvRows, error) {
+	idx, err := mapping.resolve(header)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := mapping.location()
+	if err != nil {
+		return nil, err
+	}
+	return &csvRows{idx: idx, mode: mode, mapping: mapping, loc: loc}, nil
+}
+
+// next returns the next row and its raw fields, or io.EOF at the end.
+// After an error the line field still names the offending row.
+func (c *csvRows) next() (coldReading, []string, error) {
+	c.warnings = c.warnings[:0]
+	rec, err := c.cr.Read()
+	if err == io.EOF {
+		return coldReading{}, nil, err
+	}
+	if err != nil {
+		if pe, ok := err.(*csv.ParseError); ok {
+			c.line = pe.StartLine
+		}
+		return coldReading{}, rec, err
+	}
+	c.line, _ = c.cr.FieldPos(0)
+	row, err := c.parse(rec)
+	return row, rec, err
+}
+
+// parse reads a record with the columns of the header into a reading.
+func (c *csvRows) parse(rec []string) (coldReading, error) {
+	c.warnings = c.warnings[:0]
+	var row coldReading
+	field := func(name string) (string, error) {
+		i := c.idx[name]
+		if i >= len(rec) {
+			return "", fmt.Errorf("missing %s", name)
+		}
+		return strings.TrimSpace(rec[i]), nil
+	}
+	v, err := field("time")
+	if err == nil {
+		row.UpdatedAt, err = parseCSVTime(v, c.mapping.TimeFormat, c.loc)
+	}
+	number := func(name string, dst *float64) {
+		if err != nil {
+			return
+		}
+		if v, err = field(name); err != nil {
+			return
+		}
+		var warning string
+		if *dst, warning, err = c.mode.number(v); warning != "" {
+			c.warnings = append(c.warnings, name+": "+warning)
+		}
+	}
+	number("temperature", &row.Temperature)
+	number("humidity", &row.Humidity)
+	if i, ok := c.idx["sensor"]; ok && i < len(rec) {
+		row.SensorID = strings.TrimSpace(rec[i])
+	}
+	// CO2 and pressure are optional, even in rows of a CSV that has them
+	optional := func(name string) *float64 {
+		i, ok := c.idx[name]
+		if err != nil || !ok || i >= len(rec) || strings.TrimSpace(rec[i]) == "" {
+			return nil
+		}
+		var v float64
+		number(name, &v)
+		return &v
+	}
+	row.CO2 = optional("co2")
+	row.Pressure = optional("pressure")
+	if err == nil {
+		c.mapping.normalise(&row)
+		// Apply the same plausibility checks as live ingestion
+		p := readingPayload{Temperature: &row.Temperature, Humidity: &row.Humidity, CO2: row.CO2, Pressure: row.Pressure, UpdatedAt: &row.UpdatedAt}
+		_, err = p.reading(time.Now())
+	}
+	if err != nil {
+		return coldReading{}, err
+	}
+	return row, nil
+}
+
+// parseCSVTime reads v with format, or else each of csvTimeLayouts.
+// Times without a zone are in loc.
+func parseCSVTime(v, format string, loc *time.Location) (time.Time, error) {
+	v = strings.TrimSpace(v)
+	layouts := csvTimeLayouts
+	if format != "" {
+		layouts = []string{format}
+	}
+	for _, layout := range layouts {
+		if t, err := time.ParseInLocation(layout, v, loc); err == nil {
+			return t, nil
+		}
+	}
+	// Fall back to Unix seconds
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(secs, 0).UTC(), nil
+	}
+	return time.Time{}, fmt.Errorf("unrecognised timestamp %q", v)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// liveHub tails the reading store and fans new readings out to
+// every connected live client.
+type liveHub struct {
+	mu   sync.Mutex
+	subs map[chan reading]struct{}
+}
+
+func newLiveHub() *liveHub {
+	return &liveHub{subs: make(map[chan reading]struct{})}
+}
+
+// subscribe registers a new client. The returned function must be
+// called once the client goes away.
+func (h *liveHub) subscribe() (<-chan reading, func()) {
+	ch := make(chan reading, 16)
+	h.mu.Lock()
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch, func() {
+		h.mu.Lock()
+		delete(h.subs, ch)
+		h.mu.Unlock()
+	}
+}
+
+// publish hands r to every subscriber, dropping it for clients that
+// are too slow to keep up rather than stalling the change stream.
+func (h *liveHub) publish(r reading) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- r:
+		default:
+		}
+	}
+}
+
+// run publishes each reading added to store until ctx is done. MongoDB
+// change streams need a replica set, so failures are logged and retried
+// instead of taking the rest of the server down.
+func (h *liveHub) run(ctx context.Context, store readingStore) {
+	for {
+		err := store.watch(ctx, h.publish)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Live change stream stopped: %v (retrying in 10s)", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(10 * time.Second):
+		}
+	}
+}
+
+var wsUpgrader = websocket.Upgrader{
+	// The live dashboard is usually served from a different origin
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// handleLiveWS streams every new reading to the client as a JSON text
+// message until either side closes the connection.
+func (s *server) handleLiveWS(w http.ResponseWriter, r *http.Request) {
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already replied to the client
+		return
+	}
+	defer conn.Close()
+
+	ch, unsubscribe := s.live.subscribe()
+	defer unsubscribe()
+
+	// Drain incoming frames so pongs and the close handshake are seen
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(30 * time.Second)
+	defer ping.Stop()
+	for {
+		select {
+		case <-closed:
+			return
+		case rd := <-ch:
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := conn.WriteJSON(rd); err != nil {
+				return
+			}
+		case <-ping.C:
+			deadline := time.Now().Add(10 * time.Second)
+			if err := conn.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// handleEvents is the Server-Sent Events counterpart of handleLiveWS,
+// emitting each new reading as a "reading" event.
+func (s *server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Stop nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ch, unsubscribe := s.live.subscribe()
+	defer unsubscribe()
+
+	// Comment lines keep idle proxies from closing the connection
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case rd := <-ch:
+			data, err := json.Marshal(rd)
+			if err != nil {
+				log.Printf("Error encoding event: %v", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: reading\ndata: %s\n\n", data); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := io.WriteString(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+)
+
+// unassignedLocation groups sensors that have no location.
+const unassignedLocation = "(unassigned)"
+
+// locationLevels splits a location such as "HQ/Floor 2/Kitchen" into its
+// roll-up levels, from the building down: "HQ", "HQ/Floor 2",
+// "HQ/Floor 2/Kitchen".
+func locationLevels(location string) []string {
+	var parts []string
+	for _, p := range strings.Split(location, "/") {
+		if p = strings.TrimSpace(p); p != "" {
+			parts = append(parts, p)
+		}
+	}
+	if len(parts) == 0 {
+		return []string{unassignedLocation}
+	}
+	levels := make([]string, len(parts))
+	for i := range parts {
+		levels[i] = strings.Join(parts[:i+1], "/")
+	}
+	return levels
+}
+
+// locationAvg is the average of every reading under a location in one
+// group, such as an hour.
+type locationAvg struct {
+	Key         string
+	Location    string
+	Level       int
+	Sensors     int
+	Temperature float64
+	Humidity    float64
+	Count       int64
+
+	CO2           *float64
+	CO2Count      int64
+	Pressure      *float64
+	PressureCount int64
+}
+
+// rollUp averages per-sensor buckets over each level of the location
+// hierarchy, so rooms, floors and buildings are reported side by side.
+// Buckets are weighted by their reading counts.
+func rollUp(buckets []bucketAvg[string], registry map[string]sensorInfo) []locationAvg {
+	type group struct{ key, location string }
+	byGroup := map[group]*locationAvg{}
+	for _, b := range buckets {
+		for depth, loc := range locationLevels(registry[b.Sensor].Location) {
+			g := group{b.Key, loc}
+			avg, ok := byGroup[g]
+			if !ok {
+				avg = &locationAvg{Key: b.Key, Location: loc, Level: depth + 1}
+				byGroup[g] = avg
+			}
+			n, m := float64(avg.Count), float64(b.Count)
+			if n+m > 0 {
+				avg.Temperature = (avg.Temperature*n + b.Temperature*m) / (n + m)
+				avg.Humidity = (avg.Humidity*n + b.Humidity*m) / (n + m)
+			}
+			avg.Count += b.Count
+			avg.CO2 = mergeAvg(avg.CO2, avg.CO2Count, b.CO2, b.CO2Count)
+			avg.CO2Count += b.CO2Count
+			avg.Pressure = mergeAvg(avg.Pressure, avg.PressureCount, b.Pressure, b.PressureCount)
+			avg.PressureCount += b.PressureCount
+			avg.Sensors++
+		}
+	}
+	out := make([]locationAvg, 0, len(byGroup))
+	for _, avg := range byGroup {
+		out = append(out, *avg)
+	}
+	slices.SortFunc(out, func(a, b locationAvg) int {
+		return cmp.Or(cmp.Compare(a.Key, b.Key), cmp.Compare(a.Location, b.Location))
+	})
+	return out
+}
@@ -1,117 +1,239 @@
 package main
 
 import (
-	"context"
+	"errors"
 	"fmt"
 	"log"
+	"maps"
 	"os"
-	"time"
+	"slices"
+	"strconv"
+	"strings"
 
 	"github.com/joho/godotenv"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// Exit codes, so scripts and service managers can tell failures apart
+const (
+	// exitFailure is any failure not listed below
+	exitFailure = 1
+	// exitUsage is a bad command line, as the flag package exits with
+	exitUsage = 2
+	// exitConfig is a missing or invalid environment or env file
+	exitConfig = 3
+	// exitUnavailable is a database that couldn't be reached
+	exitUnavailable = 4
+)
+
+// usageError is an error in how a command was invoked.
+type usageError string
+
+func (e usageError) Error() string { return string(e) }
+
+// configError is an error in the configuration, such as a missing
+// setting or an env file that can't be read.
+type configError struct{ err error }
+
+func (e configError) Error() string { return e.err.Error() }
+func (e configError) Unwrap() error { return e.err }
+
 func main() {
-	// Load environment variables from .env file
-	err := godotenv.Load(".env")
-	if err != nil {
-		log.Fatalf("Error loading .env file: %v", err)
+	if err := run(os.Args[1:]); err != nil {
+		log.Print(err)
+		os.Exit(exitCode(err))
 	}
+}
 
-	// Load environment variables from .env.local file (overrides .env)
-	err = godotenv.Overload(".env.local")
-	if err != nil {
-		log.Fatalf("Error loading .env.local file: %v", err)
+// exitCode is the exit status of a command that failed with err.
+func exitCode(err error) int {
+	var usage usageError
+	var config configError
+	switch {
+	case errors.As(err, &usage):
+		return exitUsage
+	case errors.As(err, &config):
+		return exitConfig
+	case mongo.IsTimeout(err), mongo.IsNetworkError(err):
+		// Including a server selection that timed out
+		return exitUnavailable
 	}
+	return exitFailure
+}
 
-	// Get the MongoDB URI from environment variables
-	mongoURI := os.Getenv("MONGO_URI")
-	if mongoURI == "" {
-		log.Fatal("MONGO_URI not set in environment")
+// run loads the environment and runs the command named by the first
+// argument. Commands return their errors rather than exit, so their
+// deferred cleanup, such as disconnecting from MongoDB, always runs.
+func run(args []string) error {
+	g, args, err := parseGlobalFlags(args)
+	if err != nil {
+		return usageError(err.Error())
+	}
+	// The first non-flag argument selects the command; with none given
+	// we keep the original behaviour of printing yesterday's averages.
+	cmd := "export"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+	switch {
+	case len(g.envFiles) > 0:
+		if err := loadEnvFiles(g.envFiles); err != nil {
+			return configError{err}
+		}
+	case !g.noDotenv:
+		if err := loadDotenv(); err != nil {
+			return configError{err}
+		}
 	}
 
-	// Define the context and timeout for the connection
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	// Set client options
-	clientOptions := options.Client().ApplyURI(mongoURI)
-
-	// Connect to MongoDB
-	client, err := mongo.Connect(ctx, clientOptions)
-	if err != nil {
-		log.Fatal(err)
+	if cmd == "config" {
+		// Which reports the problems of the config file itself
+		return runConfig(args, g.config)
 	}
-	defer func() {
-		if err := client.Disconnect(ctx); err != nil {
-			log.Fatal(err)
+
+	// The environment, including env files, overrides the config file
+	if g.config != "" {
+		if _, err := applyConfig(g.config); err != nil {
+			return configError{err}
 		}
-	}()
-
-	// Select the collection
-	coll := client.Database("ts").Collection("temphums")
-
-	// Calculate the start and end times for yesterday
-	now := time.Now()
-	yesterdayStart := time.Date(now.Year(), now.Month(), now.Day()-1, 0, 0, 0, 0, now.Location())
-	yesterdayEnd := yesterdayStart.Add(24 * time.Hour)
-
-	// Define the aggregation pipeline
-	pipeline := mongo.Pipeline{
-		{{
-			"$match", bson.D{
-				{"updatedAt", bson.D{{"$gte", yesterdayStart}, {"$lt", yesterdayEnd}}},
-			},
-		}},
-		{{
-			"$addFields", bson.D{
-				{"localHour", bson.D{
-					{"$dateToString", bson.D{
-						{"format", "%Y-%m-%d %H:00:00"},
-						{"date", bson.D{{"$toDate", "$updatedAt"}}},
-						{"timezone", "America/Chicago"},
-					}},
-				}},
-			},
-		}},
-		{{
-			"$group", bson.D{
-				{"_id", "$localHour"},
-				{"avgHumidity", bson.D{{"$avg", bson.D{{"$round", bson.A{"$humidity", 2}}}}}},
-				{"avgTemperature", bson.D{{"$avg", bson.D{{"$round", bson.A{"$temperature", 2}}}}}},
-			},
-		}},
-		{{
-			"$sort", bson.D{
-				{"_id", 1},
-			},
-		}},
-	}
-
-	// Perform the aggregation
-	cursor, err := coll.Aggregate(ctx, pipeline)
-	if err != nil {
-		log.Fatal(err)
 	}
-	defer cursor.Close(ctx)
+	// Credentials can be kept in a secrets manager rather than on disk
+	if err := resolveSecrets(); err != nil {
+		return err
+	}
+	if err := configureTimezone(); err != nil {
+		return configError{err}
+	}
+	if err := configureMongoRetry(); err != nil {
+		return configError{err}
+	}
+	if err := configureTimeouts(); err != nil {
+		return configError{err}
+	}
+
+	switch cmd {
+	case "export":
+		return runExport(args)
+	case "serve":
+		return runServe(args)
+	case "tier":
+		return runTier(args)
+	case "ingest":
+		return runIngest(args)
+	case "sensors":
+		return runSensors(args)
+	case "devices":
+		return runDevices(args)
+	case "shares":
+		return runShares(args)
+	case "audit":
+		return runAudit(args)
+	case "import":
+		return runImport(args)
+	case "transfer":
+		return runTransfer(args)
+	case "alerts":
+		return runAlerts(args)
+	case "gaps":
+		return runGaps(args)
+	case "anomalies":
+		return runAnomalies(args)
+	case "retention":
+		return runRetention(args)
+	case "ensure-indexes":
+		return runEnsureIndexes(args)
+	case "migrate-timeseries":
+		return runMigrateTimeSeries(args)
+	case "systemd-unit":
+		return runSystemdUnit(args)
+	case "self-update":
+		return runSelfUpdate(args)
+	case "stats":
+		return runStats(args)
+	case "ping":
+		return runPing(args)
+	default:
+		return usageError(fmt.Sprintf("Unknown command %q (expected export, serve, tier, ingest, sensors, devices, shares, audit, import, transfer, alerts, gaps, anomalies, retention, ensure-indexes, migrate-timeseries, systemd-unit, self-update, stats, ping or config)", cmd))
+	}
+}
 
-	// Iterate through the cursor and print the results
-	for cursor.Next(ctx) {
-		var result struct {
-			ID             string  `bson:"_id"`
-			AvgHumidity    float64 `bson:"avgHumidity"`
-			AvgTemperature float64 `bson:"avgTemperature"`
+// globalFlags are the flags every command takes, which must be handled
+// before any command reads its flag defaults from the environment.
+type globalFlags struct {
+	// envFiles are the -env-file flags, which can be repeated
+	envFiles []string
+	// config is the last -config flag
+	config string
+	// noDotenv is set by -no-dotenv, which skips .env and .env.local
+	noDotenv bool
+}
+
+// parseGlobalFlags takes the global flags out of args, wherever they
+// are, and returns the rest.
+func parseGlobalFlags(args []string) (g globalFlags, rest []string, err error) {
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--" {
+			return g, append(rest, args[i:]...), nil
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(args[i], "-"), "=")
+		if !strings.HasPrefix(args[i], "-") || !slices.Contains([]string{"env-file", "config", "no-dotenv"}, name) {
+			rest = append(rest, args[i])
+			continue
 		}
-		if err := cursor.Decode(&result); err != nil {
-			log.Fatal(err)
+		if name == "no-dotenv" {
+			g.noDotenv = true
+			if hasValue {
+				if g.noDotenv, err = strconv.ParseBool(value); err != nil {
+					return globalFlags{}, nil, fmt.Errorf("invalid value %q for flag -no-dotenv", value)
+				}
+			}
+			continue
 		}
-		fmt.Printf("Hour: %s, Avg Humidity: %.2f, Avg Temperature: %.2f\n", result.ID, result.AvgHumidity, result.AvgTemperature)
+		if !hasValue {
+			if i++; i == len(args) {
+				return globalFlags{}, nil, fmt.Errorf("flag needs an argument: -%s", name)
+			}
+			value = args[i]
+		}
+		if name == "config" {
+			g.config = value
+		} else {
+			g.envFiles = append(g.envFiles, value)
+		}
+	}
+	return g, rest, nil
+}
+
+// loadDotenv loads .env, then .env.local over it, skipping either when
+// it is missing, as in a container given its variables directly.
+// Variables already in the environment win over .env, but not over
+// .env.local.
+func loadDotenv() error {
+	if err := godotenv.Load(".env"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("Error loading .env file: %w", err)
 	}
+	if err := godotenv.Overload(".env.local"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("Error loading .env.local file: %w", err)
+	}
+	return nil
+}
 
-	// Check for any errors encountered during iteration
-	if err := cursor.Err(); err != nil {
-		log.Fatal(err)
+// loadEnvFiles sets the variables of the given env files, later files
+// overriding earlier ones. Unlike .env.local, they don't override the
+// environment the command was started with.
+func loadEnvFiles(files []string) error {
+	vars := map[string]string{}
+	for _, f := range files {
+		fileVars, err := godotenv.Read(f)
+		if err != nil {
+			return fmt.Errorf("loading %s: %w", f, err)
+		}
+		maps.Copy(vars, fileVars)
+	}
+	for k, v := range vars {
+		if _, set := os.LookupEnv(k); !set {
+			os.Setenv(k, v)
+		}
 	}
+	return nil
 }
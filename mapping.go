@@ -0,0 +1,502 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// importTemplatesCollection holds CSV mappings saved for reuse.
+const importTemplatesCollection = "import_templates"
+
+// csvFields are the reading fields a CSV column can be mapped to.
+var csvFields = []string{"time", "temperature", "humidity", "sensor", "co2", "pressure"}
+
+// optionalCSVFields need not be present in every CSV.
+var optionalCSVFields = []string{"sensor", "co2", "pressure"}
+
+// Units accepted in a csvMapping
+const (
+	unitCelsius     = "C"
+	unitFahrenheit  = "F"
+	humidityPercent = "percent"
+	// humidityFraction is relative humidity as 0–1 rather than 0–100
+	humidityFraction = "fraction"
+)
+
+// csvMapping says which column holds each field of a third-party CSV
+// and which units and time format it uses. The zero value finds columns
+// by their usual names and reads Celsius, percent and UTC, as exported
+// by this tool.
+type csvMapping struct {
+	// Columns maps a field in csvFields to its header name
+	Columns         map[string]string `bson:"columns,omitempty"`
+	TemperatureUnit string            `bson:"temperatureUnit,omitempty"`
+	HumidityScale   string            `bson:"humidityScale,omitempty"`
+	// Timezone is the IANA zone of timestamps that don't carry one
+	Timezone string `bson:"timezone,omitempty"`
+	// TimeFormat is a Go reference-time layout; empty tries csvTimeLayouts
+	TimeFormat string `bson:"timeFormat,omitempty"`
+}
+
+// importTemplate is a mapping saved under a name, typically one per
+// vendor export format.
+type importTemplate struct {
+	Name      string     `bson:"_id"`
+	Mapping   csvMapping `bson:"mapping"`
+	UpdatedAt time.Time  `bson:"updatedAt"`
+}
+
+func importTemplates(client *mongo.Client) *mongo.Collection {
+	return client.Database(readingsDatabase).Collection(importTemplatesCollection)
+}
+
+// loadTemplate returns the mapping saved as name.
+func loadTemplate(ctx context.Context, coll *mongo.Collection, name string) (csvMapping, error) {
+	var t importTemplate
+	err := coll.FindOne(ctx, bson.M{"_id": name}).Decode(&t)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return csvMapping{}, fmt.Errorf("no import template %q", name)
+	}
+	return t.Mapping, err
+}
+
+// saveTemplate stores m as name, replacing any earlier version.
+func saveTemplate(ctx context.Context, coll *mongo.Collection, name string, m csvMapping) error {
+	t := importTemplate{Name: name, Mapping: m, UpdatedAt: time.Now()}
+	_, err := coll.ReplaceOne(ctx, bson.M{"_id": name}, t, options.Replace().SetUpsert(true))
+	return err
+}
+
+// validate checks the field names and units.
+func (m csvMapping) validate() error {
+	for field := range m.Columns {
+		if !slices.Contains(csvFields, field) {
+			return fmt.Errorf("unknown field %q (expected one of %s)", field, strings.Join(csvFields, ", "))
+		}
+	}
+	switch m.TemperatureUnit {
+	case "", unitCelsius, unitFahrenheit:
+	default:
+		return fmt.Errorf("unknown temperature unit %q (expected C or F)", m.TemperatureUnit)
+	}
+	switch m.HumidityScale {
+	case "", humidityPercent, humidityFraction:
+	default:
+		return fmt.Errorf("unknown humidity scale %q (expected percent or fraction)", m.HumidityScale)
+	}
+	_, err := m.location()
+	return err
+}
+
+// location returns the zone for timestamps without one.
+func (m csvMapping) location() (*time.Location, error) {
+	if m.Timezone == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(m.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("unknown timezone %q", m.Timezone)
+	}
+	return loc, nil
+}
+
+// resolve returns the index of each field's column in header. Fields
+// without an explicit column fall back to the usual names.
+func (m csvMapping) resolve(header []string) (map[string]int, error) {
+	idx := map[string]int{}
+	for i, h := range header {
+		if field, ok := csvColumns[strings.ToLower(strings.TrimSpace(h))]; ok {
+			idx[field] = i
+		}
+	}
+	for field, col := range m.Columns {
+		i := slices.IndexFunc(header, func(h string) bool {
+			return strings.EqualFold(strings.TrimSpace(h), strings.TrimSpace(col))
+		})
+		if i < 0 {
+			return nil, fmt.Errorf("no column %q for %s in header %v", col, field, header)
+		}
+		idx[field] = i
+	}
+	for _, field := range []string{"time", "temperature", "humidity"} {
+		if _, ok := idx[field]; !ok {
+			return nil, fmt.Errorf("no %s column in header %v", field, header)
+		}
+	}
+	return idx, nil
+}
+
+// normalise converts a row to Celsius and percent.
+func (m csvMapping) normalise(row *coldReading) {
+	if m.TemperatureUnit == unitFahrenheit {
+		row.Temperature = (row.Temperature - 32) * 5 / 9
+	}
+	if m.HumidityScale == humidityFraction {
+		row.Humidity *= 100
+	}
+}
+
+// String describes the mapping for confirmation prompts and logs.
+func (m csvMapping) String() string {
+	var b strings.Builder
+	for _, field := range csvFields {
+		col := m.Columns[field]
+		if col == "" {
+			col = "(none)"
+		}
+		fmt.Fprintf(&b, "%s=%q ", field, col)
+	}
+	fmt.Fprintf(&b, "temperature unit=%s humidity scale=%s timezone=%s time format=%q",
+		cmp.Or(m.TemperatureUnit, unitCelsius), cmp.Or(m.HumidityScale, humidityPercent),
+		cmp.Or(m.Timezone, "UTC"), cmp.Or(m.TimeFormat, "auto"))
+	return b.String()
+}
+
+// detectSampleRows is how many rows detectCSVMapping inspects.
+const detectSampleRows = 500
+
+// detectCSVMapping guesses the column mapping and units of a CSV from
+// its header and a sample of rows. Each guess comes with a note
+// explaining it, for the user to confirm.
+func detectCSVMapping(r io.Reader) (csvMapping, []string, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return csvMapping{}, nil, err
+	}
+
+	m := csvMapping{Columns: map[string]string{}}
+	var notes []string
+	for _, field := range csvFields {
+		if i := guessColumn(header, field); i >= 0 {
+			m.Columns[field] = strings.TrimSpace(header[i])
+		} else if !slices.Contains(optionalCSVFields, field) {
+			notes = append(notes, fmt.Sprintf("no column found for %s", field))
+		}
+	}
+
+	// Units named in the header win over guesses from the values
+	if col, ok := m.Columns["temperature"]; ok {
+		if unit := headerTemperatureUnit(col); unit != "" {
+			m.TemperatureUnit = unit
+			notes = append(notes, fmt.Sprintf("temperature unit %s from header %q", unit, col))
+		}
+	}
+
+	column := func(field string) int {
+		if m.Columns[field] == "" {
+			return -1
+		}
+		return slices.IndexFunc(header, func(h string) bool { return strings.TrimSpace(h) == m.Columns[field] })
+	}
+	timeCol, tempCol, humCol := column("time"), column("temperature"), column("humidity")
+
+	var times []string
+	var temps, hums []float64
+	var suffixF bool
+	for n := 0; n < detectSampleRows; n++ {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			continue
+		}
+		value := func(i int) (string, bool) {
+			if i < 0 || i >= len(rec) {
+				return "", false
+			}
+			return strings.TrimSpace(rec[i]), true
+		}
+		if v, ok := value(timeCol); ok {
+			times = append(times, v)
+		}
+		if v, ok := value(tempCol); ok {
+			if t, _, err := parseLenient.number(v); err == nil {
+				temps = append(temps, t)
+				suffixF = suffixF || strings.HasSuffix(strings.ToLower(v), "f")
+			}
+		}
+		if v, ok := value(humCol); ok {
+			if h, _, err := parseLenient.number(v); err == nil {
+				hums = append(hums, h)
+			}
+		}
+	}
+
+	if m.TemperatureUnit == "" && len(temps) > 0 {
+		slices.Sort(temps)
+		median := temps[len(temps)/2]
+		switch {
+		case suffixF:
+			m.TemperatureUnit = unitFahrenheit
+			notes = append(notes, "temperature unit F from values suffixed with F")
+		// Indoor and outdoor air rarely averages above 45°C, but
+		// commonly does above 45°F
+		case median > 45:
+			m.TemperatureUnit = unitFahrenheit
+			notes = append(notes, fmt.Sprintf("temperature unit F guessed from median %.1f", median))
+		default:
+			m.TemperatureUnit = unitCelsius
+			notes = append(notes, fmt.Sprintf("temperature unit C guessed from median %.1f", median))
+		}
+	}
+	if len(hums) > 0 {
+		if slices.Max(hums) <= 1 {
+			m.HumidityScale = humidityFraction
+			notes = append(notes, fmt.Sprintf("humidity scale fraction guessed from maximum %.2f", slices.Max(hums)))
+		} else {
+			m.HumidityScale = humidityPercent
+		}
+	}
+	// Exports such as Aranet4's name the date order in the header
+	dayFirst := strings.Contains(strings.ToLower(m.Columns["time"]), "dd/mm")
+	format, note := detectTimeFormat(times, dayFirst)
+	m.TimeFormat = format
+	if note != "" {
+		notes = append(notes, note)
+	}
+	return m, notes, nil
+}
+
+// csvTimeFormatGuesses are layouts common in vendor exports that
+// csvTimeLayouts doesn't cover. Month-first comes before day-first, so
+// ambiguous dates are read the US way unless the sample rules it out.
+var csvTimeFormatGuesses = []string{
+	"01/02/2006 15:04:05", "01/02/2006 15:04", "1/2/2006 15:04", "01/02/2006 03:04:05 PM", "1/2/2006 3:04 PM",
+	"02/01/2006 15:04:05", "02/01/2006 15:04", "2/1/2006 15:04",
+	"02.01.2006 15:04:05", "02.01.2006 15:04",
+	"2006/01/02 15:04:05", "2006/01/02 15:04",
+}
+
+// detectTimeFormat returns a layout that parses every sampled time, or
+// "" when the default layouts already do. dayFirst tries day-first
+// layouts before month-first ones.
+func detectTimeFormat(times []string, dayFirst bool) (string, string) {
+	if len(times) == 0 || !slices.ContainsFunc(times, func(v string) bool {
+		_, err := parseCSVTime(v, "", time.UTC)
+		return err != nil
+	}) {
+		return "", ""
+	}
+	guesses := csvTimeFormatGuesses
+	if dayFirst {
+		guesses = slices.Clone(guesses)
+		slices.SortStableFunc(guesses, func(a, b string) int {
+			isDayFirst := func(l string) bool { return strings.HasPrefix(l, "02/") || strings.HasPrefix(l, "2/") }
+			switch {
+			case isDayFirst(a) && !isDayFirst(b):
+				return -1
+			case isDayFirst(b) && !isDayFirst(a):
+				return 1
+			}
+			return 0
+		})
+	}
+	for _, layout := range guesses {
+		if !slices.ContainsFunc(times, func(v string) bool {
+			_, err := time.Parse(layout, v)
+			return err != nil
+		}) {
+			return layout, fmt.Sprintf("time format %q guessed from %q", layout, times[0])
+		}
+	}
+	return "", fmt.Sprintf("no known time format matches %q", times[0])
+}
+
+// csvColumnHints are substrings that identify a field in an unfamiliar
+// header, after the exact names in csvColumns.
+var csvColumnHints = map[string][]string{
+	"time":        {"time", "date", "observed", "recorded", "logged"},
+	"temperature": {"temp"},
+	"humidity":    {"hum", "rh"},
+	"sensor":      {"sensor", "device", "probe"},
+	"co2":         {"co2", "carbon"},
+	"pressure":    {"press"},
+}
+
+// guessColumn returns the index of the column most likely to hold
+// field, or -1.
+func guessColumn(header []string, field string) int {
+	if i := slices.IndexFunc(header, func(h string) bool {
+		return csvColumns[strings.ToLower(strings.TrimSpace(h))] == field
+	}); i >= 0 {
+		return i
+	}
+	return slices.IndexFunc(header, func(h string) bool {
+		h = strings.ToLower(h)
+		return slices.ContainsFunc(csvColumnHints[field], func(hint string) bool { return strings.Contains(h, hint) })
+	})
+}
+
+// headerTemperatureUnit recognises units in headers such as
+// "Temperature (°F)", "temp_f" or "Temperature Celsius".
+func headerTemperatureUnit(h string) string {
+	h = strings.ToLower(strings.TrimSpace(h))
+	switch {
+	case strings.Contains(h, "fahrenheit") || strings.Contains(h, "°f") ||
+		strings.HasSuffix(h, "(f)") || strings.HasSuffix(h, "_f") || strings.HasSuffix(h, " f"):
+		return unitFahrenheit
+	case strings.Contains(h, "celsius") || strings.Contains(h, "°c") ||
+		strings.HasSuffix(h, "(c)") || strings.HasSuffix(h, "_c") || strings.HasSuffix(h, " c"):
+		return unitCelsius
+	}
+	return ""
+}
+
+// confirmCSVMapping shows a detected mapping and lets the user accept
+// each choice with Enter or type a replacement.
+func confirmCSVMapping(in *bufio.Reader, out io.Writer, header []string, m csvMapping) (csvMapping, error) {
+	fmt.Fprintf(out, "Columns: %s\n", strings.Join(header, ", "))
+	ask := func(prompt, current string, valid func(string) bool) (string, error) {
+		for {
+			fmt.Fprintf(out, "%s [%s]: ", prompt, current)
+			line, err := in.ReadString('\n')
+			if err != nil && (err != io.EOF || line == "") {
+				return "", err
+			}
+			line = strings.TrimSpace(line)
+			if line == "" {
+				return current, nil
+			}
+			if valid(line) {
+				return line, nil
+			}
+			fmt.Fprintf(out, "%q is not valid here\n", line)
+		}
+	}
+
+	confirmed := csvMapping{Columns: map[string]string{}}
+	for _, field := range csvFields {
+		col, err := ask(field+" column (- for none)", cmp.Or(m.Columns[field], "-"), func(v string) bool {
+			return v == "-" || slices.ContainsFunc(header, func(h string) bool { return strings.EqualFold(strings.TrimSpace(h), v) })
+		})
+		if err != nil {
+			return csvMapping{}, err
+		}
+		if col != "-" {
+			confirmed.Columns[field] = col
+		}
+	}
+	var err error
+	confirmed.TemperatureUnit, err = ask("temperature unit (C or F)", cmp.Or(m.TemperatureUnit, unitCelsius), func(v string) bool {
+		return v == unitCelsius || v == unitFahrenheit
+	})
+	if err != nil {
+		return csvMapping{}, err
+	}
+	confirmed.HumidityScale, err = ask("humidity scale (percent or fraction)", cmp.Or(m.HumidityScale, humidityPercent), func(v string) bool {
+		return v == humidityPercent || v == humidityFraction
+	})
+	if err != nil {
+		return csvMapping{}, err
+	}
+	confirmed.Timezone, err = ask("timezone of times without one", cmp.Or(m.Timezone, "UTC"), func(v string) bool {
+		_, err := time.LoadLocation(v)
+		return err == nil
+	})
+	if err != nil {
+		return csvMapping{}, err
+	}
+	format, err := ask("time format as a Go layout (auto for the usual formats)", cmp.Or(m.TimeFormat, "auto"), func(v string) bool {
+		return v != ""
+	})
+	if err != nil {
+		return csvMapping{}, err
+	}
+	if format != "auto" {
+		confirmed.TimeFormat = format
+	}
+	return confirmed, nil
+}
+
+// csvMapFlags collects repeated -map field=column flags.
+type csvMapFlags map[string]string
+
+func (f csvMapFlags) String() string { return fmt.Sprint(map[string]string(f)) }
+
+func (f csvMapFlags) Set(v string) error {
+	field, col, ok := strings.Cut(v, "=")
+	if !ok || col == "" || !slices.Contains(csvFields, field) {
+		return fmt.Errorf("invalid column mapping %q (want field=column, field one of %s)", v, strings.Join(csvFields, ", "))
+	}
+	f[field] = col
+	return nil
+}
+
+// runTierTemplates lists, shows and deletes saved import templates.
+func runTierTemplates(args []string) (err error) {
+	if len(args) == 0 {
+		args = []string{"list"}
+	}
+
+	ctx, stop := commandContext()
+	defer stop()
+	connectCtx, cancel := context.WithTimeout(ctx, mongoTimeouts.connect)
+	client, err := connectMongo(connectCtx, "")
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if rerr := mongoClients.release(ctx, client); err == nil {
+			err = rerr
+		}
+	}()
+	coll := importTemplates(client)
+
+	switch args[0] {
+	case "list":
+		cursor, err := coll.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"_id": 1}))
+		if err != nil {
+			return err
+		}
+		var list []importTemplate
+		if err := cursor.All(ctx, &list); err != nil {
+			return err
+		}
+		for _, t := range list {
+			fmt.Printf("%s\t%s\n", t.Name, t.Mapping)
+		}
+		return nil
+	case "show":
+		if len(args) != 2 {
+			return usageError("usage: tier templates show NAME")
+		}
+		m, err := loadTemplate(ctx, coll, args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Println(m)
+		return nil
+	case "delete":
+		if len(args) != 2 {
+			return usageError("usage: tier templates delete NAME")
+		}
+		res, err := coll.DeleteOne(ctx, bson.M{"_id": args[1]})
+		if err != nil {
+			return err
+		}
+		if res.DeletedCount == 0 {
+			return fmt.Errorf("no import template %q", args[1])
+		}
+		log.Printf("Deleted template %s", args[1])
+		return nil
+	default:
+		return usageError(fmt.Sprintf("unknown templates command %q (expected list, show or delete)", args[0]))
+	}
+}
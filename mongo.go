@@ -0,0 +1,266 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// Database and collection holding the raw sensor readings.
+const (
+	readingsDatabase   = "ts"
+	readingsCollection = "temphums"
+)
+
+// connectMongo connects to the named cluster, or to the default one
+// when cluster is empty (see clusterURI). Release the client with
+// mongoClients.release.
+func connectMongo(ctx context.Context, cluster string) (*mongo.Client, error) {
+	mongoURI, err := clusterURI(cluster)
+	if err != nil {
+		return nil, err
+	}
+	return mongoClients.connect(ctx, mongoURI, clusterTLS(cluster))
+}
+
+// readings returns the raw readings collection.
+func readings(client *mongo.Client) *mongo.Collection {
+	return client.Database(readingsDatabase).Collection(readingsCollection)
+}
+
+// mongoClients shares the process's MongoDB clients.
+var mongoClients = &clientManager{clients: map[string]*managedClient{}}
+
+// clientManager hands out one client per URI, connected on first use
+// and disconnected when the last user releases it. Clients are safe for
+// concurrent use and pool their connections, so the server's handlers
+// and background jobs, or a transfer between databases of one cluster,
+// share a pool rather than each opening their own.
+type clientManager struct {
+	mu      sync.Mutex
+	clients map[string]*managedClient
+}
+
+type managedClient struct {
+	client *mongo.Client
+	// name identifies the cluster without the credentials in its URI
+	name string
+	refs int
+	pool poolStats
+}
+
+// poolStats counts the events of a client's connection pool.
+type poolStats struct {
+	open, inUse           atomic.Int64
+	checkouts, failures   atomic.Int64
+	created, closed       atomic.Int64
+	checkoutNanos, clears atomic.Int64
+}
+
+func (p *poolStats) event(e *event.PoolEvent) {
+	switch e.Type {
+	case event.ConnectionCreated:
+		p.created.Add(1)
+		p.open.Add(1)
+	case event.ConnectionClosed:
+		p.closed.Add(1)
+		p.open.Add(-1)
+	case event.GetSucceeded:
+		p.checkouts.Add(1)
+		p.inUse.Add(1)
+		p.checkoutNanos.Add(int64(e.Duration))
+	case event.GetFailed:
+		p.failures.Add(1)
+	case event.ConnectionReturned:
+		p.inUse.Add(-1)
+	case event.PoolCleared:
+		p.clears.Add(1)
+	}
+}
+
+// connect returns the client for uri with the TLS options t, connecting
+// if there is none yet.
+func (m *clientManager) connect(ctx context.Context, uri string, t mongoTLS) (*mongo.Client, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := uri
+	if t.set() {
+		key += "\x00" + fmt.Sprint(t)
+	}
+	if c, ok := m.clients[key]; ok {
+		c.refs++
+		return c.client, nil
+	}
+	tlsConfig, err := t.config()
+	if err != nil {
+		return nil, configError{err}
+	}
+	c := &managedClient{name: clusterName(uri), refs: 1}
+	// The URI's own connectTimeoutMS and serverSelectionTimeoutMS win
+	opts := options.Client().
+		SetConnectTimeout(mongoTimeouts.connect).
+		SetServerSelectionTimeout(mongoTimeouts.connect).
+		ApplyURI(uri).
+		SetPoolMonitor(&event.PoolMonitor{Event: c.pool.event})
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+	// Connect doesn't wait for the cluster, so holding the lock is cheap,
+	// but an Atlas URI's SRV record is looked up first, which can fail
+	client, err := retryMongo(ctx, "connect", func(ctx context.Context, _ int) (*mongo.Client, error) {
+		return mongo.Connect(ctx, opts)
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.client = client
+	m.clients[key] = c
+	return client, nil
+}
+
+// release gives up a client from connect, disconnecting it once no one
+// else is using it.
+func (m *clientManager) release(ctx context.Context, client *mongo.Client) error {
+	m.mu.Lock()
+	var last bool
+	for uri, c := range m.clients {
+		if c.client != client {
+			continue
+		}
+		c.refs--
+		if last = c.refs == 0; last {
+			delete(m.clients, uri)
+		}
+		break
+	}
+	m.mu.Unlock()
+	if !last {
+		return nil
+	}
+	return client.Disconnect(ctx)
+}
+
+// clusterName is the hosts of a MongoDB URI, for naming its client in
+// health checks and metrics.
+func clusterName(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Host == "" {
+		return "mongodb"
+	}
+	return u.Host
+}
+
+// clientHealth is the state of one shared client.
+type clientHealth struct {
+	Cluster string `json:"cluster"`
+	OK      bool   `json:"ok"`
+	Error   string `json:"error,omitempty"`
+	// PingMillis is how long the primary took to answer a ping
+	PingMillis       float64 `json:"pingMillis"`
+	Users            int     `json:"users"`
+	Open             int64   `json:"openConnections"`
+	InUse            int64   `json:"inUseConnections"`
+	Checkouts        int64   `json:"checkouts"`
+	CheckoutFailures int64   `json:"checkoutFailures"`
+	Created          int64   `json:"connectionsCreated"`
+	Closed           int64   `json:"connectionsClosed"`
+	PoolClears       int64   `json:"poolClears"`
+	// CheckoutMillis is the average wait for a pooled connection
+	CheckoutMillis float64 `json:"checkoutMillis"`
+}
+
+// health pings each client and reports it with its pool's figures,
+// ordered by cluster.
+func (m *clientManager) health(ctx context.Context) []clientHealth {
+	m.mu.Lock()
+	clients := make([]*managedClient, 0, len(m.clients))
+	users := map[*managedClient]int{}
+	for _, c := range m.clients {
+		clients = append(clients, c)
+		users[c] = c.refs
+	}
+	m.mu.Unlock()
+
+	out := make([]clientHealth, len(clients))
+	var wg sync.WaitGroup
+	for i, c := range clients {
+		h := clientHealth{
+			Cluster:          c.name,
+			Users:            users[c],
+			Open:             c.pool.open.Load(),
+			InUse:            c.pool.inUse.Load(),
+			Checkouts:        c.pool.checkouts.Load(),
+			CheckoutFailures: c.pool.failures.Load(),
+			Created:          c.pool.created.Load(),
+			Closed:           c.pool.closed.Load(),
+			PoolClears:       c.pool.clears.Load(),
+		}
+		if h.Checkouts > 0 {
+			h.CheckoutMillis = float64(c.pool.checkoutNanos.Load()) / float64(h.Checkouts) / 1e6
+		}
+		out[i] = h
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pingCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+			defer cancel()
+			start := time.Now()
+			if err := c.client.Ping(pingCtx, readpref.Primary()); err != nil {
+				out[i].Error = err.Error()
+				return
+			}
+			out[i].OK = true
+			out[i].PingMillis = float64(time.Since(start).Microseconds()) / 1000
+		}()
+	}
+	wg.Wait()
+	slices.SortFunc(out, func(a, b clientHealth) int { return cmp.Compare(a.Cluster, b.Cluster) })
+	return out
+}
+
+// monitor checks the clients every interval until ctx is done, logging
+// when a cluster stops answering and when it is back.
+func (m *clientManager) monitor(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	down := map[string]bool{}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, h := range m.health(ctx) {
+			if ctx.Err() != nil {
+				return
+			}
+			switch {
+			case !h.OK && !down[h.Cluster]:
+				log.Printf("MongoDB unreachable: %s", h)
+				down[h.Cluster] = true
+			case h.OK && down[h.Cluster]:
+				log.Printf("MongoDB back: %s", h)
+				delete(down, h.Cluster)
+			}
+		}
+	}
+}
+
+// String summarises a client's health for logs.
+func (h clientHealth) String() string {
+	if !h.OK {
+		return fmt.Sprintf("%s: %s", h.Cluster, h.Error)
+	}
+	return fmt.Sprintf("%s: ping %.1fms, %d of %d connections in use", h.Cluster, h.PingMillis, h.InUse, h.Open)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// mongoTLS are the TLS options of the connections to a MongoDB
+// deployment, for a self-hosted one whose certificates are issued by an
+// internal CA. The URI's tlsCAFile and tlsCertificateKeyFile options
+// still work; these take their place when set.
+type mongoTLS struct {
+	// CAFile is a PEM file of the CAs that server certificates are
+	// verified against, instead of the system's
+	CAFile string `json:"ca_file,omitempty" yaml:"ca_file"`
+	// CertFile and KeyFile are the client certificate and its key, for
+	// mutual TLS. KeyFile may be left out when CertFile holds both.
+	CertFile string `json:"cert_file,omitempty" yaml:"cert_file"`
+	KeyFile  string `json:"key_file,omitempty" yaml:"key_file"`
+	// Insecure skips verifying the server's certificate and host name
+	Insecure bool `json:"insecure,omitempty" yaml:"insecure"`
+}
+
+// set reports whether any option is.
+func (t mongoTLS) set() bool {
+	return t != mongoTLS{}
+}
+
+// or returns t with the options it leaves unset taken from fallback.
+func (t mongoTLS) or(fallback mongoTLS) mongoTLS {
+	if t.CAFile == "" {
+		t.CAFile = fallback.CAFile
+	}
+	if t.CertFile == "" {
+		t.CertFile, t.KeyFile = fallback.CertFile, fallback.KeyFile
+	}
+	t.Insecure = t.Insecure || fallback.Insecure
+	return t
+}
+
+// config builds the TLS configuration, or nil when no option is set and
+// the URI decides.
+func (t mongoTLS) config() (*tls.Config, error) {
+	if !t.set() {
+		return nil, nil
+	}
+	cfg := &tls.Config{InsecureSkipVerify: t.Insecure}
+	if t.CAFile != "" {
+		pem, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("TLS CA file: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("TLS CA file %s: no PEM certificates", t.CAFile)
+		}
+	}
+	switch {
+	case t.CertFile != "":
+		key := t.KeyFile
+		if key == "" {
+			key = t.CertFile
+		}
+		cert, err := tls.LoadX509KeyPair(t.CertFile, key)
+		if err != nil {
+			return nil, fmt.Errorf("TLS client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	case t.KeyFile != "":
+		return nil, errors.New("TLS key file given without a client certificate")
+	}
+	return cfg, nil
+}
+
+// envMongoTLS reads TLS options from the variables starting with prefix,
+// MONGO for every connection or MONGO_DEST for transfer destinations.
+func envMongoTLS(prefix string) mongoTLS {
+	return mongoTLS{
+		CAFile:   os.Getenv(prefix + "_TLS_CA_FILE"),
+		CertFile: os.Getenv(prefix + "_TLS_CERT_FILE"),
+		KeyFile:  os.Getenv(prefix + "_TLS_KEY_FILE"),
+		Insecure: os.Getenv(prefix+"_TLS_INSECURE") != "",
+	}
+}
+
+// mongoTLSFlags adds flags for the TLS options of one side of a command
+// that connects to two deployments, named with prefix, such as
+// -source-tls-ca-file, defaulting to the variables starting with env.
+func mongoTLSFlags(fs *flag.FlagSet, prefix, env, role string) *mongoTLS {
+	t := envMongoTLS(env)
+	fs.StringVar(&t.CAFile, prefix+"-tls-ca-file", t.CAFile, "PEM file of the CAs to verify the "+role+"'s certificate against (default "+env+"_TLS_CA_FILE)")
+	fs.StringVar(&t.CertFile, prefix+"-tls-cert-file", t.CertFile, "client certificate for mutual TLS with the "+role+", PEM (default "+env+"_TLS_CERT_FILE)")
+	fs.StringVar(&t.KeyFile, prefix+"-tls-key-file", t.KeyFile, "key of the client certificate, if not in its file (default "+env+"_TLS_KEY_FILE)")
+	fs.BoolVar(&t.Insecure, prefix+"-tls-insecure", t.Insecure, "don't verify the "+role+"'s certificate (default "+env+"_TLS_INSECURE)")
+	return &t
+}
+
+// clusterTLS returns the TLS options of a cluster as clusterURI names
+// it: those of its entry in CLUSTERS_FILE, with any it leaves unset
+// taken from the MONGO_TLS variables.
+func clusterTLS(name string) mongoTLS {
+	return clusterTLSOr(name, envMongoTLS("MONGO"))
+}
+
+// clusterTLSOr returns the TLS options of a cluster's entry in
+// CLUSTERS_FILE, with any it leaves unset taken from fallback.
+func clusterTLSOr(name string, fallback mongoTLS) mongoTLS {
+	if name == "" {
+		name = os.Getenv("MONGO_CLUSTER")
+	}
+	if name == "" || !isClusterName(name) {
+		return fallback
+	}
+	clusters, err := loadClusters()
+	if err != nil {
+		// clusterURI reports it
+		return fallback
+	}
+	return clusters[name].TLS.or(fallback)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// runIngestMQTT subscribes to the sensor topics and stores every
+// reading published on them until interrupted.
+func runIngestMQTT(args []string) error {
+	fs := flag.NewFlagSet("ingest mqtt", flag.ExitOnError)
+	broker := fs.String("broker", envOr("MQTT_BROKER", "tcp://localhost:1883"), "MQTT broker URL")
+	topics := fs.String("topics", envOr("MQTT_TOPICS", "home/+/temphum"), "comma-separated topic filters to subscribe to")
+	clientID := fs.String("client-id", envOr("MQTT_CLIENT_ID", "temphums-ingest"), "MQTT client ID")
+	qos := fs.Int("qos", 1, "subscription QoS")
+	batchSize := fs.Int("batch-size", 100, "readings per insert")
+	flushInterval := fs.Duration("flush-interval", 5*time.Second, "maximum time a reading waits before being inserted")
+	keysFile := fs.String("keys", os.Getenv("DEVICE_KEYS_FILE"), "JSON file of device keys to decrypt sealed payloads with (see ingest keygen)")
+	requireSealed := fs.Bool("require-sealed", false, "reject payloads that aren't sealed with a device key")
+	walDir := fs.String("wal", os.Getenv("INGEST_WAL_DIR"), "directory of a write-ahead log keeping readings until they are inserted, across restarts (disabled when empty)")
+	parseModeFlag := parseModeFlags(fs)
+	fs.Parse(args)
+	mode, err := parseModeFlag()
+	if err != nil {
+		return err
+	}
+
+	var keys deviceKeys
+	if *keysFile != "" {
+		if keys, err = loadDeviceKeys(*keysFile); err != nil {
+			return fmt.Errorf("-keys: %w", err)
+		}
+	} else if *requireSealed {
+		return errors.New("-require-sealed needs -keys or DEVICE_KEYS_FILE")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	connectCtx, cancel := context.WithTimeout(ctx, mongoTimeouts.connect)
+	client, err := connectMongo(connectCtx, "")
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := mongoClients.release(context.Background(), client); err != nil {
+			log.Print(err)
+		}
+	}()
+
+	store, err := openReadingStore(ctx, client)
+	if err != nil {
+		return err
+	}
+	defer store.close()
+
+	writer := newBatchWriter(store, *batchSize, *flushInterval)
+	if *walDir != "" {
+		if writer.wal, err = openWAL(*walDir); err != nil {
+			return fmt.Errorf("-wal: %w", err)
+		}
+		defer writer.wal.close()
+	}
+	go writer.run(ctx)
+	firmware := newFirmwareRecorder(deviceRegistry(client))
+
+	// In strict mode the first malformed message stops ingestion
+	malformed := make(chan error, 1)
+	handler := func(_ mqtt.Client, msg mqtt.Message) {
+		payload, device, err := openPayload(keys, msg.Payload(), *requireSealed)
+		var p readingPayload
+		var warnings []string
+		if err == nil {
+			p, warnings, err = mode.decodePayload(payload)
+		}
+		var r reading
+		if err == nil && device != "" {
+			// A sealed payload's time is sealed with it, so a relay can't
+			// replay it as a new reading
+			if p.UpdatedAt == nil {
+				err = errors.New("sealed payloads need an updatedAt")
+			}
+			if p.SensorID == "" {
+				p.SensorID = device
+			}
+		}
+		if err == nil {
+			r, err = p.reading(time.Now())
+		}
+		if err == nil {
+			// A sealed payload's device, or else the sensor itself
+			firmware.record(ctx, cmp.Or(device, r.SensorID), p.Firmware)
+		}
+		if err != nil {
+			if mode == parseStrict {
+				select {
+				case malformed <- fmt.Errorf("malformed message on %s: %w", msg.Topic(), err):
+				default:
+				}
+				return
+			}
+			log.Printf("Ignoring message on %s: %v", msg.Topic(), err)
+			return
+		}
+		for _, w := range warnings {
+			log.Printf("Message on %s: %s", msg.Topic(), w)
+		}
+		writer.add(r)
+	}
+
+	filters := make(map[string]byte)
+	for _, t := range splitList(*topics) {
+		filters[t] = byte(*qos)
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(*broker).
+		SetClientID(*clientID).
+		SetUsername(os.Getenv("MQTT_USERNAME")).
+		SetPassword(os.Getenv("MQTT_PASSWORD")).
+		SetAutoReconnect(true).
+		// Resubscribe after every (re)connect, since the session is clean
+		SetOnConnectHandler(func(c mqtt.Client) {
+			if token := c.SubscribeMultiple(filters, handler); token.Wait() && token.Error() != nil {
+				log.Printf("Error subscribing: %v", token.Error())
+				return
+			}
+			log.Printf("Subscribed to %s on %s", *topics, *broker)
+		}).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Printf("Connection to %s lost: %v", *broker, err)
+		})
+
+	mc := mqtt.NewClient(opts)
+	if token := mc.Connect(); token.Wait() && token.Error() != nil {
+		return fmt.Errorf("connecting to %s: %w", *broker, token.Error())
+	}
+
+	select {
+	case <-ctx.Done():
+	case err = <-malformed:
+	}
+	mc.Disconnect(250)
+	stop()
+	<-writer.stopped
+	return err
+}
+
+// openPayload decrypts a sealed payload with keys, returning the reading
+// payload and the device that sealed it. Plain payloads are passed
+// through, unless required is set.
+func openPayload(keys deviceKeys, data []byte, required bool) ([]byte, string, error) {
+	if !isSealed(data) {
+		if required {
+			return nil, "", errors.New("payload is not sealed")
+		}
+		return data, "", nil
+	}
+	if keys == nil {
+		return nil, "", errors.New("payload is sealed, but no -keys are set")
+	}
+	device, payload, err := keys.open(data)
+	return payload, device, err
+}
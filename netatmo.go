@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Netatmo API endpoints and limits
+const (
+	netatmoAPI      = "https://api.netatmo.com"
+	netatmoPage     = 1024
+	netatmoTokenKey = "netatmo:token"
+)
+
+// runImportNetatmo copies the history of every Netatmo weather station
+// module that measures temperature and humidity, then keeps syncing
+// new measurements with -watch. Each module remembers how far it has
+// been synced, so repeated runs only fetch what is new.
+func runImportNetatmo(args []string) error {
+	fs := flag.NewFlagSet("import netatmo", flag.ExitOnError)
+	start := fs.String("start", "", "first date to import for modules never synced before, YYYY-MM-DD (default 30 days ago)")
+	watch := fs.Duration("watch", 0, "keep syncing at this interval instead of exiting (Netatmo measures every 5 minutes)")
+	prefix := fs.String("prefix", "netatmo-", "prefix for the sensor IDs of imported readings")
+	fs.Parse(args)
+
+	nc := &netatmoClient{
+		clientID:     os.Getenv("NETATMO_CLIENT_ID"),
+		clientSecret: os.Getenv("NETATMO_CLIENT_SECRET"),
+		http:         &http.Client{Timeout: time.Minute},
+	}
+	if nc.clientID == "" || nc.clientSecret == "" {
+		return errors.New("NETATMO_CLIENT_ID and NETATMO_CLIENT_SECRET must be set")
+	}
+	since := time.Now().AddDate(0, 0, -30)
+	if *start != "" {
+		var err error
+		if since, err = time.Parse(time.DateOnly, *start); err != nil {
+			return fmt.Errorf("-start: %w", err)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	connectCtx, cancel := context.WithTimeout(ctx, mongoTimeouts.connect)
+	client, err := connectMongo(connectCtx, "")
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := mongoClients.release(context.Background(), client); err != nil {
+			log.Print(err)
+		}
+	}()
+	state := importState(client)
+
+	// Netatmo rotates refresh tokens, so the latest one is kept with the
+	// sync state and NETATMO_REFRESH_TOKEN only seeds the first run
+	saved, err := loadImportCursor(ctx, state, netatmoTokenKey)
+	if err != nil {
+		return err
+	}
+	nc.refreshToken = saved.Token
+	if nc.refreshToken == "" {
+		nc.refreshToken = os.Getenv("NETATMO_REFRESH_TOKEN")
+	}
+	if nc.refreshToken == "" {
+		return configError{errors.New("NETATMO_REFRESH_TOKEN not set in environment")}
+	}
+	nc.saveToken = func(token string) error {
+		return saveImportCursor(ctx, state, importCursor{Key: netatmoTokenKey, Token: token})
+	}
+
+	for {
+		if err := syncNetatmo(ctx, nc, client, *prefix, since); err != nil {
+			if *watch == 0 || ctx.Err() != nil {
+				return err
+			}
+			log.Printf("Netatmo sync failed: %v", err)
+		}
+		if *watch == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(*watch):
+		}
+	}
+}
+
+// syncNetatmo imports each module's measurements since it was last
+// synced, or since since for new modules.
+func syncNetatmo(ctx context.Context, nc *netatmoClient, client *mongo.Client, prefix string, since time.Time) error {
+	modules, err := nc.modules(ctx)
+	if err != nil {
+		return err
+	}
+	state := importState(client)
+	for _, m := range modules {
+		sensorID := prefix + strings.ReplaceAll(m.moduleID, ":", "")
+		if err := registerImportedSensor(ctx, sensorRegistry(client), sensorID, m.name, unitCelsius); err != nil {
+			return err
+		}
+		key := "netatmo:" + m.moduleID
+		cur, err := loadImportCursor(ctx, state, key)
+		if err != nil {
+			return err
+		}
+		from := since
+		if !cur.SyncedTo.IsZero() {
+			from = cur.SyncedTo.Add(time.Second)
+		}
+
+		var total int64
+		for {
+			rows, err := nc.measures(ctx, m, from)
+			if err != nil {
+				return fmt.Errorf("%s: %w", m.name, err)
+			}
+			if len(rows) == 0 {
+				break
+			}
+			for i := range rows {
+				rows[i].SensorID = sensorID
+			}
+			n, err := importReadings(ctx, readings(client), rows)
+			if err != nil {
+				return err
+			}
+			total += n
+			last := rows[len(rows)-1].UpdatedAt
+			if err := saveImportCursor(ctx, state, importCursor{Key: key, SyncedTo: last}); err != nil {
+				return err
+			}
+			if len(rows) < netatmoPage {
+				break
+			}
+			from = last.Add(time.Second)
+		}
+		log.Printf("%s (%s): imported %d new readings", m.name, sensorID, total)
+	}
+	return nil
+}
+
+// netatmoModule is a station module measuring temperature and humidity.
+// Indoor base stations are their own module.
+type netatmoModule struct {
+	deviceID string
+	moduleID string
+	name     string
+}
+
+// netatmoClient is a minimal client for the Netatmo weather API.
+type netatmoClient struct {
+	clientID, clientSecret string
+	refreshToken           string
+	accessToken            string
+	expires                time.Time
+	http                   *http.Client
+
+	// saveToken persists a rotated refresh token
+	saveToken func(string) error
+}
+
+// modules lists the temperature and humidity modules of every station
+// on the account.
+func (c *netatmoClient) modules(ctx context.Context) ([]netatmoModule, error) {
+	type module struct {
+		ID         string   `json:"_id"`
+		Type       string   `json:"type"`
+		ModuleName string   `json:"module_name"`
+		DataTypes  []string `json:"data_type"`
+	}
+	var body struct {
+		Devices []struct {
+			module
+			StationName string   `json:"station_name"`
+			Modules     []module `json:"modules"`
+		} `json:"devices"`
+	}
+	if err := c.get(ctx, "/api/getstationsdata", url.Values{}, &body); err != nil {
+		return nil, err
+	}
+	measures := func(m module) bool {
+		var temp, hum bool
+		for _, t := range m.DataTypes {
+			temp = temp || t == "Temperature"
+			hum = hum || t == "Humidity"
+		}
+		return temp && hum
+	}
+
+	var out []netatmoModule
+	for _, d := range body.Devices {
+		if measures(d.module) {
+			out = append(out, netatmoModule{deviceID: d.ID, moduleID: d.ID, name: d.StationName + " " + d.ModuleName})
+		}
+		for _, m := range d.Modules {
+			if measures(m) {
+				out = append(out, netatmoModule{deviceID: d.ID, moduleID: m.ID, name: d.StationName + " " + m.ModuleName})
+			}
+		}
+	}
+	return out, nil
+}
+
+// measures returns up to a page of readings of m from from onwards,
+// oldest first.
+func (c *netatmoClient) measures(ctx context.Context, m netatmoModule, from time.Time) ([]reading, error) {
+	q := url.Values{
+		"device_id":  {m.deviceID},
+		"scale":      {"max"},
+		"type":       {"temperature,humidity"},
+		"date_begin": {strconv.FormatInt(from.Unix(), 10)},
+		"limit":      {strconv.Itoa(netatmoPage)},
+		"optimize":   {"false"},
+		"real_time":  {"true"},
+	}
+	if m.moduleID != m.deviceID {
+		q.Set("module_id", m.moduleID)
+	}
+	// Unoptimised responses map Unix times to [temperature, humidity]
+	var body map[string][]*float64
+	if err := c.get(ctx, "/api/getmeasure", q, &body); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	rows := make([]reading, 0, len(body))
+	for ts, values := range body {
+		secs, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil || len(values) != 2 {
+			continue
+		}
+		at := time.Unix(secs, 0).UTC()
+		p := readingPayload{Temperature: values[0], Humidity: values[1], UpdatedAt: &at}
+		r, err := p.reading(now)
+		if err != nil {
+			log.Printf("%s: skipping measure at %s: %v", m.name, at.Format(time.RFC3339), err)
+			continue
+		}
+		rows = append(rows, r)
+	}
+	slices.SortFunc(rows, func(a, b reading) int { return a.UpdatedAt.Compare(b.UpdatedAt) })
+	return rows, nil
+}
+
+// get calls a Netatmo API endpoint and decodes the body field of the
+// response into out.
+func (c *netatmoClient) get(ctx context.Context, path string, q url.Values, out any) error {
+	if time.Now().After(c.expires) {
+		if err := c.refresh(ctx); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, netatmoAPI+path+"?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.accessToken)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", path, resp.Status)
+	}
+	var envelope struct {
+		Body json.RawMessage `json:"body"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return json.Unmarshal(envelope.Body, out)
+}
+
+// refresh exchanges the refresh token for a new access token, saving
+// the refresh token Netatmo issues in its place.
+func (c *netatmoClient) refresh(ctx context.Context) error {
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {c.refreshToken},
+		"client_id":     {c.clientID},
+		"client_secret": {c.clientSecret},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, netatmoAPI+"/oauth2/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("refreshing Netatmo token: %s", resp.Status)
+	}
+	var token struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return fmt.Errorf("refreshing Netatmo token: %w", err)
+	}
+	c.accessToken = token.AccessToken
+	// Refresh a minute early so requests never race the expiry
+	c.expires = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+	if token.RefreshToken != "" && token.RefreshToken != c.refreshToken {
+		c.refreshToken = token.RefreshToken
+		return c.saveToken(token.RefreshToken)
+	}
+	return nil
+}
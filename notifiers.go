@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// alertNotifier posts alert events to one webhook, shaped for whatever
+// receives them.
+type alertNotifier struct {
+	kind string
+	url  string
+	// body returns the JSON posted for an event
+	body func(alertEvent) any
+	// endpoint, when set, returns the URL an event is posted to
+	// instead of url
+	endpoint func(alertEvent) string
+	// header is added to each request, e.g. for an API key
+	header http.Header
+	// minSeverity, when set, skips events of less severe rules
+	minSeverity string
+}
+
+func (n alertNotifier) String() string { return n.kind }
+
+// webhookNotifier posts each event as it is, as alertEvent JSON.
+func webhookNotifier(url string) alertNotifier {
+	return alertNotifier{kind: "webhook", url: url, body: func(e alertEvent) any { return e }}
+}
+
+// slackNotifier posts to a Slack incoming webhook.
+func slackNotifier(url string) alertNotifier {
+	return alertNotifier{kind: "Slack", url: url, body: func(e alertEvent) any {
+		return map[string]string{"text": chatText(e, "<%s|chart>")}
+	}}
+}
+
+// discordMaxContent is the longest message a Discord webhook accepts.
+const discordMaxContent = 2000
+
+// discordNotifier posts to a Discord channel webhook.
+func discordNotifier(url string) alertNotifier {
+	return alertNotifier{kind: "Discord", url: url, body: func(e alertEvent) any {
+		return map[string]string{"content": truncate(chatText(e, "[chart](%s)"), discordMaxContent)}
+	}}
+}
+
+// alertNotifiers returns a notifier for each URL that is set.
+func alertNotifiers(webhook, slack, discord string) []alertNotifier {
+	var out []alertNotifier
+	if webhook != "" {
+		out = append(out, webhookNotifier(webhook))
+	}
+	if slack != "" {
+		out = append(out, slackNotifier(slack))
+	}
+	if discord != "" {
+		out = append(out, discordNotifier(discord))
+	}
+	return out
+}
+
+// chatText is the message of a chat notification: the templated
+// message, then the reading behind it and a link to its chart, if any.
+// link formats the chart URL in the chat's markup.
+func chatText(e alertEvent, link string) string {
+	var b strings.Builder
+	b.WriteString(e.Message)
+	if len(e.Values) > 0 {
+		b.WriteString("\n")
+		names := make([]string, 0, len(e.Values))
+		for name := range e.Values {
+			names = append(names, name)
+		}
+		// Temperature and humidity first, as everywhere else
+		order := []string{"temperature", "humidity", "dewpoint", "co2", "pressure"}
+		slices.SortFunc(names, func(a, b string) int {
+			ia, ib := slices.Index(order, a), slices.Index(order, b)
+			if ia < 0 {
+				ia = len(order)
+			}
+			if ib < 0 {
+				ib = len(order)
+			}
+			return ia - ib
+		})
+		for i, name := range names {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			fmt.Fprintf(&b, "%s %.1f", name, e.Values[name])
+			switch name {
+			case "temperature", "dewpoint":
+				b.WriteString("°" + e.Unit)
+			case "humidity":
+				b.WriteString("%")
+			}
+		}
+	}
+	if e.ChartURL != "" {
+		b.WriteString("\n")
+		fmt.Fprintf(&b, link, e.ChartURL)
+	}
+	return b.String()
+}
+
+// post sends event to the notifier's webhook.
+func (n alertNotifier) post(ctx context.Context, client *http.Client, event alertEvent) error {
+	data, err := json.Marshal(n.body(event))
+	if err != nil {
+		return err
+	}
+	target := n.url
+	if n.endpoint != nil {
+		target = n.endpoint(event)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	for name, values := range n.header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		// Webhook URLs can be secrets; keep them out of logs
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// deliver sends event through every notifier, carrying on past those
+// that fail.
+func (e *alertEngine) deliver(ctx context.Context, event alertEvent) error {
+	var errs []error
+	for _, n := range e.notifiers {
+		if n.minSeverity != "" && severityRank(event.Severity) < severityRank(n.minSeverity) {
+			continue
+		}
+		if err := n.post(ctx, e.http, event); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", n, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// staleRule names the alerts raised for sensors that stop reporting.
+const staleRule = "stale"
+
+// checkStale raises an alert for each registered sensor that hasn't
+// reported for staleAfter. Sensors not heard from since the engine
+// started count from then. The alert resolves with the sensor's next
+// reading, in resolveStale.
+func (e *alertEngine) checkStale(ctx context.Context, now time.Time) {
+	if e.staleAfter <= 0 {
+		return
+	}
+	for id, s := range e.registry {
+		if s.RetiredAt != nil || e.stale[id] {
+			continue
+		}
+		last := e.latest[id].UpdatedAt
+		if last.IsZero() {
+			last = e.started
+		}
+		if now.Sub(last) < e.staleAfter {
+			continue
+		}
+		e.stale[id] = true
+		e.notify(ctx, e.staleAlert(), id, alertContext{e: e}, now, "firing")
+	}
+}
+
+// resolveStale resolves the stale alert of r's sensor, if it has one.
+func (e *alertEngine) resolveStale(ctx context.Context, r reading) {
+	if !e.stale[r.SensorID] {
+		return
+	}
+	delete(e.stale, r.SensorID)
+	e.notify(ctx, e.staleAlert(), r.SensorID, alertContext{e: e}, r.UpdatedAt, "resolved")
+}
+
+// staleAlert is the rule stale alerts are reported under.
+func (e *alertEngine) staleAlert() compiledRule {
+	after := roughDuration(e.staleAfter)
+	if strings.HasSuffix(after, "h0m") {
+		after = strings.TrimSuffix(after, "0m")
+	}
+	return compiledRule{
+		alertRule: alertRule{Name: staleRule, Condition: "no reading for " + after, Severity: e.staleLevel},
+		tmpl:      e.template,
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// The OpenAPI spec is generated from the flow API's Go types, so its
+// schemas and examples can't drift from what the handlers send.
+
+// Examples of the flow API's shapes, as served in the spec.
+var (
+	exampleCO2         = 612.0
+	exampleLatestShape = flowLatest{
+		SensorID:    "basement",
+		Name:        "Basement",
+		Location:    "HQ/Basement",
+		Temperature: 64.8,
+		Humidity:    58.2,
+		CO2:         &exampleCO2,
+		UpdatedAt:   time.Date(2024, 5, 1, 14, 5, 0, 0, time.UTC),
+		AgeSeconds:  42,
+		Humidex:     19.4,
+		VPD:         0.87,
+	}
+	exampleStatsShape = flowStats{
+		SensorID:        "basement",
+		Name:            "Basement",
+		From:            time.Date(2024, 4, 30, 14, 0, 0, 0, time.UTC),
+		To:              time.Date(2024, 5, 1, 14, 0, 0, 0, time.UTC),
+		Count:           288,
+		TemperatureMin:  63.1,
+		TemperatureMax:  66.4,
+		TemperatureAvg:  64.7,
+		TemperatureLast: 64.8,
+		HumidityMin:     55.0,
+		HumidityMax:     61.3,
+		HumidityAvg:     58.0,
+		HumidityLast:    58.2,
+		CO2Avg:          &exampleCO2,
+		MoldRisk:        moldRiskNone,
+	}
+	exampleTemperature  = 64.8
+	exampleHumidity     = 58.2
+	exampleReadingShape = flowReading{
+		SensorID:    "basement",
+		Temperature: &exampleTemperature,
+		Humidity:    &exampleHumidity,
+		Timestamp:   &flowTime{time.Date(2024, 5, 1, 14, 5, 0, 0, time.UTC)},
+	}
+)
+
+// openAPISchema describes t from its json tags. Pointers and omitempty
+// fields are optional; every other field is required.
+func openAPISchema(t reflect.Type) map[string]any {
+	switch t {
+	case reflect.TypeOf(time.Time{}):
+		return map[string]any{"type": "string", "format": "date-time"}
+	case reflect.TypeOf(flowTime{}):
+		return map[string]any{"oneOf": []any{
+			map[string]any{"type": "string", "format": "date-time"},
+			map[string]any{"type": "integer", "description": "Unix milliseconds"},
+		}}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return openAPISchema(t.Elem())
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Int, reflect.Int64:
+		return map[string]any{"type": "integer"}
+	case reflect.Slice:
+		return map[string]any{"type": "array", "items": openAPISchema(t.Elem())}
+	case reflect.Struct:
+		properties := map[string]any{}
+		var required []string
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if name == "" || name == "-" {
+				continue
+			}
+			properties[name] = openAPISchema(f.Type)
+			if f.Type.Kind() != reflect.Pointer && !strings.Contains(opts, "omitempty") {
+				required = append(required, name)
+			}
+		}
+		schema := map[string]any{"type": "object", "properties": properties}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		return schema
+	}
+	return map[string]any{}
+}
+
+// flowOpenAPI returns the OpenAPI 3 description of the flow API.
+func flowOpenAPI() map[string]any {
+	ref := func(name string) map[string]any {
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	}
+	// Without ?sensor= each endpoint answers for every sensor
+	oneOrAll := func(schema string, example any, examples any) map[string]any {
+		return map[string]any{
+			"description": "The sensor's " + strings.ToLower(schema) + ", or an array for every sensor without ?sensor=",
+			"content": map[string]any{"application/json": map[string]any{
+				"schema": map[string]any{"oneOf": []any{ref(schema), map[string]any{"type": "array", "items": ref(schema)}}},
+				"examples": map[string]any{
+					"sensor": map[string]any{"value": example},
+					"all":    map[string]any{"value": examples},
+				},
+			}},
+		}
+	}
+	errorResponse := func(description string) map[string]any {
+		return map[string]any{
+			"description": description,
+			"content":     map[string]any{"application/json": map[string]any{"schema": ref("Error")}},
+		}
+	}
+	sensorParam := map[string]any{
+		"name": "sensor", "in": "query", "schema": map[string]any{"type": "string"},
+		"description": "sensor ID; all sensors when omitted",
+	}
+	// sensor_id may come from ?sensor= instead, while the pointers that let
+	// a missing temperature or humidity be told from zero must be present
+	readingSchema := openAPISchema(reflect.TypeOf(flowReading{}))
+	readingSchema["required"] = []string{"temperature", "humidity"}
+	security := []any{map[string]any{"apiKey": []any{}}, map[string]any{"bearer": []any{}}}
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":       "temphums flow API",
+			"version":     "1",
+			"description": "Flat shapes for Node-RED and n8n flows. Fields are only ever added, never renamed or removed. Temperatures and humidity are calibrated, in the units each sensor reports.",
+		},
+		"paths": map[string]any{
+			"/api/flow/latest": map[string]any{"get": map[string]any{
+				"summary":    "Latest reading",
+				"security":   security,
+				"parameters": []any{sensorParam},
+				"responses": map[string]any{
+					"200": oneOrAll("Latest", exampleLatestShape, []flowLatest{exampleLatestShape}),
+					"401": errorResponse("Missing or invalid API key"),
+					"404": errorResponse("No reading from the sensor in the last week"),
+				},
+			}},
+			"/api/flow/stats": map[string]any{"get": map[string]any{
+				"summary":  "Minimum, maximum, average and last values over the last hours",
+				"security": security,
+				"parameters": []any{sensorParam, map[string]any{
+					"name": "hours", "in": "query",
+					"schema": map[string]any{"type": "integer", "minimum": 1, "maximum": flowMaxHours, "default": 24},
+				}},
+				"responses": map[string]any{
+					"200": oneOrAll("Stats", exampleStatsShape, []flowStats{exampleStatsShape}),
+					"400": errorResponse("Invalid hours"),
+					"401": errorResponse("Missing or invalid API key"),
+					"404": errorResponse("No readings from the sensor in the range"),
+				},
+			}},
+			"/api/flow/readings": map[string]any{"post": map[string]any{
+				"summary":  "Store one reading or an array of them",
+				"security": security,
+				"parameters": []any{map[string]any{
+					"name": "sensor", "in": "query", "schema": map[string]any{"type": "string"},
+					"description": "sensor ID for readings without sensor_id",
+				}},
+				"requestBody": map[string]any{
+					"required": true,
+					"content": map[string]any{"application/json": map[string]any{
+						"schema":  map[string]any{"oneOf": []any{ref("Reading"), map[string]any{"type": "array", "items": ref("Reading"), "maxItems": maxIngestBatch}}},
+						"example": exampleReadingShape,
+					}},
+				},
+				"responses": map[string]any{
+					"201": map[string]any{
+						"description": "Stored",
+						"content": map[string]any{"application/json": map[string]any{
+							"schema":  ref("Stored"),
+							"example": flowStored{Stored: 1},
+						}},
+					},
+					"400": errorResponse("Malformed request"),
+					"401": errorResponse("Missing or invalid API key"),
+					"422": map[string]any{"description": "Readings that failed validation, one error each"},
+				},
+			}},
+		},
+		"components": map[string]any{
+			"schemas": map[string]any{
+				"Latest":  openAPISchema(reflect.TypeOf(flowLatest{})),
+				"Stats":   openAPISchema(reflect.TypeOf(flowStats{})),
+				"Reading": readingSchema,
+				"Stored":  openAPISchema(reflect.TypeOf(flowStored{})),
+				"Error": map[string]any{
+					"type":       "object",
+					"properties": map[string]any{"error": map[string]any{"type": "string"}},
+				},
+			},
+			"securitySchemes": map[string]any{
+				"apiKey": map[string]any{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+				"bearer": map[string]any{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+func (s *server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, flowOpenAPI())
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// defaultPlausible are the bounds outside which a temperature or
+// humidity can't be real, wide enough for sensors reporting in either
+// unit but not for the 998° a DHT sensor sometimes sends.
+var defaultPlausible = map[string][2]float64{
+	"temperature": {-60, 160},
+	"humidity":    {0, 100},
+}
+
+// outlierFilter drops readings before they are averaged: those outside
+// plausible bounds, then those a Hampel filter flags, i.e. more than
+// threshold robust standard deviations (1.4826 times the median
+// absolute deviation) from the median of the window readings either
+// side of them. The spread is at least outlierFloor, as for anomalies,
+// so a steady sensor's small wobbles stay.
+type outlierFilter struct {
+	bounds    map[string][2]float64
+	window    int
+	threshold float64
+}
+
+// outlierStats counts what a filter dropped.
+type outlierStats struct {
+	checked, outOfBounds, hampel int
+}
+
+func (s outlierStats) String() string {
+	return fmt.Sprintf("filtered %d of %d readings: %d outside plausible bounds, %d by the Hampel filter",
+		s.outOfBounds+s.hampel, s.checked, s.outOfBounds, s.hampel)
+}
+
+// parseOutlierFilter reads -plausible, a comma-separated list such as
+// "temperature=-40:140,humidity=5:100" overriding defaultPlausible,
+// with the Hampel window and threshold.
+func parseOutlierFilter(plausible string, window int, threshold float64) (*outlierFilter, error) {
+	f := &outlierFilter{bounds: map[string][2]float64{}, window: window, threshold: threshold}
+	if window < 1 {
+		return nil, fmt.Errorf("the outlier window must be at least 1 reading either side, not %d", window)
+	}
+	if threshold <= 0 {
+		return nil, fmt.Errorf("the outlier threshold must be positive, not %g", threshold)
+	}
+	for metric, b := range defaultPlausible {
+		f.bounds[metric] = b
+	}
+	for _, item := range splitList(plausible) {
+		metric, rng, ok := strings.Cut(item, "=")
+		metric = strings.ToLower(strings.TrimSpace(metric))
+		if _, known := defaultPlausible[metric]; !ok || !known {
+			return nil, fmt.Errorf("plausible %q: expected METRIC=MIN:MAX with metric temperature or humidity", item)
+		}
+		lo, hi, ok := strings.Cut(rng, ":")
+		low, err1 := strconv.ParseFloat(strings.TrimSpace(lo), 64)
+		high, err2 := strconv.ParseFloat(strings.TrimSpace(hi), 64)
+		if !ok || err1 != nil || err2 != nil || low >= high {
+			return nil, fmt.Errorf("plausible %q: expected METRIC=MIN:MAX with MIN below MAX", item)
+		}
+		f.bounds[metric] = [2]float64{low, high}
+	}
+	return f, nil
+}
+
+// filter returns history, oldest first, without its outliers. Bounds
+// and the Hampel filter look at the values as the sensors sent them.
+func (f *outlierFilter) filter(history []reading) ([]reading, outlierStats) {
+	stats := outlierStats{checked: len(history)}
+	bySensor := map[string][]int{}
+	plausible := make([]bool, len(history))
+	for i, r := range history {
+		if !f.plausible("temperature", r.Temperature) || !f.plausible("humidity", r.Humidity) {
+			stats.outOfBounds++
+			continue
+		}
+		plausible[i] = true
+		bySensor[r.SensorID] = append(bySensor[r.SensorID], i)
+	}
+
+	drop := make([]bool, len(history))
+	for _, idx := range bySensor {
+		for _, metric := range []string{"temperature", "humidity"} {
+			values := make([]float64, len(idx))
+			for j, i := range idx {
+				values[j] = history[i].Temperature
+				if metric == "humidity" {
+					values[j] = history[i].Humidity
+				}
+			}
+			for j, i := range idx {
+				if f.hampel(values, j, metric) {
+					drop[i] = true
+				}
+			}
+		}
+	}
+
+	out := make([]reading, 0, len(history))
+	for i, r := range history {
+		switch {
+		case !plausible[i]:
+		case drop[i]:
+			stats.hampel++
+		default:
+			out = append(out, r)
+		}
+	}
+	return out, stats
+}
+
+// plausible reports whether v is within the metric's bounds.
+func (f *outlierFilter) plausible(metric string, v float64) bool {
+	b := f.bounds[metric]
+	return !math.IsNaN(v) && v >= b[0] && v <= b[1]
+}
+
+// hampel reports whether values[j] is an outlier among the window
+// values either side of it.
+func (f *outlierFilter) hampel(values []float64, j int, metric string) bool {
+	window := values[max(0, j-f.window):min(len(values), j+f.window+1)]
+	if len(window) < 3 {
+		return false
+	}
+	m := median(window)
+	deviations := make([]float64, len(window))
+	for k, v := range window {
+		deviations[k] = math.Abs(v - m)
+	}
+	spread := max(1.4826*median(deviations), outlierFloor[metric])
+	return math.Abs(values[j]-m) > f.threshold*spread
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// crlfWriter ends lines with "\r\n" rather than "\n", for Windows tools
+// such as Notepad and older Excel that expect it. Lines already ending
+// with "\r\n" are left alone.
+type crlfWriter struct {
+	w io.Writer
+	// cr is set when the last byte written was '\r'
+	cr bool
+}
+
+func (c *crlfWriter) Write(p []byte) (int, error) {
+	out := make([]byte, 0, len(p)+len(p)/16)
+	for _, b := range p {
+		if b == '\n' && !c.cr {
+			out = append(out, '\r')
+		}
+		out = append(out, b)
+		c.cr = b == '\r'
+	}
+	if _, err := c.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// createOutput opens where a command's output goes: standard output if
+// path is empty or "-", or else the file at path, created along with its
+// directory. Paths may use either separator on Windows. Close the file
+// with the returned function, which reports errors writing it.
+func createOutput(path string, crlf bool) (io.Writer, func() error, error) {
+	var w io.Writer = os.Stdout
+	closeFn := func() error { return nil }
+	if path != "" && path != "-" {
+		path = filepath.Clean(filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return nil, nil, err
+		}
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		w, closeFn = f, f.Close
+	}
+	if crlf {
+		w = &crlfWriter{w: w}
+	}
+	return w, closeFn, nil
+}
+
+// cacheDir is the default directory for the files of name: under the
+// user's cache directory, %LocalAppData% on Windows and ~/.cache on
+// Linux, or under the temporary directory if there is none.
+func cacheDir(name string) string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), "temphums-"+name)
+	}
+	return filepath.Join(dir, "temphums", name)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Rule severities, least severe first. They are PagerDuty's; Opsgenie
+// priorities are mapped from them.
+const (
+	severityInfo     = "info"
+	severityWarning  = "warning"
+	severityError    = "error"
+	severityCritical = "critical"
+)
+
+var severities = []string{severityInfo, severityWarning, severityError, severityCritical}
+
+// checkSeverity returns an error unless s is a known severity.
+func checkSeverity(s string) error {
+	if !slices.Contains(severities, s) {
+		return fmt.Errorf("unknown severity %q (expected critical, error, warning or info)", s)
+	}
+	return nil
+}
+
+// severityRank orders severities, unknown ones as warnings.
+func severityRank(s string) int {
+	if i := slices.Index(severities, s); i >= 0 {
+		return i
+	}
+	return slices.Index(severities, severityWarning)
+}
+
+// severity returns the rule's severity, warning unless it has one.
+func (r alertRule) severity() string {
+	if r.Severity == "" {
+		return severityWarning
+	}
+	return r.Severity
+}
+
+// pagerDutyAPI is the PagerDuty Events API v2 endpoint.
+const pagerDutyAPI = "https://events.pagerduty.com/v2/enqueue"
+
+// dedupKey identifies an alert to a pager, so that its resolution
+// closes the incident its firing opened.
+func dedupKey(e alertEvent) string {
+	if e.SensorID == "" {
+		return "temphums:" + e.Rule
+	}
+	return "temphums:" + e.Rule + ":" + e.SensorID
+}
+
+// alertDetails are the event's fields worth showing on an incident.
+func alertDetails(e alertEvent) map[string]string {
+	details := map[string]string{"rule": e.Rule, "condition": e.Condition}
+	if e.SensorID != "" {
+		details["sensor"] = e.SensorID
+	}
+	if e.Location != "" {
+		details["location"] = e.Location
+	}
+	for name, v := range e.Values {
+		details[name] = fmt.Sprintf("%.1f", v)
+	}
+	return details
+}
+
+// truncate shortens s to at most n bytes, on a rune boundary.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	cut := n - 3
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut] + "..."
+}
+
+// pagerDutyNotifier triggers PagerDuty incidents through an Events API
+// v2 integration, resolving them when the alert resolves.
+func pagerDutyNotifier(routingKey, minSeverity string) alertNotifier {
+	return alertNotifier{kind: "PagerDuty", url: pagerDutyAPI, minSeverity: minSeverity, body: func(e alertEvent) any {
+		action := "trigger"
+		if e.State == "resolved" {
+			action = "resolve"
+		}
+		payload := map[string]any{
+			"summary":        truncate(e.Message, 1024),
+			"source":         cmp.Or(e.Name, e.SensorID, "temphums"),
+			"severity":       e.Severity,
+			"timestamp":      e.At.Format(time.RFC3339),
+			"group":          e.Rule,
+			"custom_details": alertDetails(e),
+		}
+		if e.Location != "" {
+			payload["component"] = e.Location
+		}
+		body := map[string]any{
+			"routing_key":  routingKey,
+			"event_action": action,
+			"dedup_key":    dedupKey(e),
+			"payload":      payload,
+		}
+		if e.ChartURL != "" {
+			body["links"] = []map[string]string{{"href": e.ChartURL, "text": "Chart"}}
+		}
+		return body
+	}}
+}
+
+// opsgenieAPI is Opsgenie's API in its US region; serve
+// -alert-opsgenie-api points elsewhere, e.g. https://api.eu.opsgenie.com.
+const opsgenieAPI = "https://api.opsgenie.com"
+
+// opsgeniePriority maps severities to Opsgenie priorities.
+var opsgeniePriority = map[string]string{
+	severityCritical: "P1",
+	severityError:    "P2",
+	severityWarning:  "P3",
+	severityInfo:     "P5",
+}
+
+// opsgenieNotifier creates Opsgenie alerts with an API integration key
+// and closes them when the alert resolves.
+func opsgenieNotifier(apiKey, api, minSeverity string) alertNotifier {
+	api = strings.TrimSuffix(api, "/")
+	return alertNotifier{
+		kind:        "Opsgenie",
+		url:         api + "/v2/alerts",
+		header:      http.Header{"Authorization": {"GenieKey " + apiKey}},
+		minSeverity: minSeverity,
+		endpoint: func(e alertEvent) string {
+			if e.State == "resolved" {
+				return api + "/v2/alerts/" + url.PathEscape(dedupKey(e)) + "/close?identifierType=alias"
+			}
+			return api + "/v2/alerts"
+		},
+		body: func(e alertEvent) any {
+			if e.State == "resolved" {
+				return map[string]string{"source": "temphums", "note": truncate(e.Message, 25000)}
+			}
+			description := e.Message
+			if e.ChartURL != "" {
+				description += "\n" + e.ChartURL
+			}
+			return map[string]any{
+				"message":     truncate(e.Message, 130),
+				"alias":       dedupKey(e),
+				"description": truncate(description, 15000),
+				"priority":    opsgeniePriority[e.Severity],
+				"source":      "temphums",
+				"entity":      cmp.Or(e.Name, e.SensorID),
+				"tags":        []string{e.Rule, e.Severity},
+				"details":     alertDetails(e),
+			}
+		},
+	}
+}
+
+// pagingNotifiers returns the pagers that are configured, each sent
+// only alerts at least as severe as minSeverity.
+func pagingNotifiers(pagerDuty, opsgenie, opsgenieURL, minSeverity string) ([]alertNotifier, error) {
+	if err := checkSeverity(minSeverity); err != nil {
+		return nil, err
+	}
+	var out []alertNotifier
+	if pagerDuty != "" {
+		out = append(out, pagerDutyNotifier(pagerDuty, minSeverity))
+	}
+	if opsgenie != "" {
+		out = append(out, opsgenieNotifier(opsgenie, opsgenieURL, minSeverity))
+	}
+	return out, nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseMode controls how malformed input is handled by imports and
+// ingestion.
+type parseMode int
+
+const (
+	// parseDefault rejects bad records individually and carries on.
+	parseDefault parseMode = iota
+	// parseStrict stops at the first bad record, for pipelines that
+	// must be exact.
+	parseStrict
+	// parseLenient coerces common mistakes such as comma decimals and
+	// trailing units, warning about each.
+	parseLenient
+)
+
+// parseModeFlags registers -strict and -lenient on fs. The returned
+// function reports the chosen mode once fs has been parsed.
+func parseModeFlags(fs *flag.FlagSet) func() (parseMode, error) {
+	strict := fs.Bool("strict", false, "stop at the first malformed record")
+	lenient := fs.Bool("lenient", false, "coerce comma decimals and trailing units, with warnings")
+	return func() (parseMode, error) {
+		switch {
+		case *strict && *lenient:
+			return parseDefault, errors.New("-strict and -lenient are mutually exclusive")
+		case *strict:
+			return parseStrict, nil
+		case *lenient:
+			return parseLenient, nil
+		}
+		return parseDefault, nil
+	}
+}
+
+// parseModeNamed maps the mode names used by the HTTP API.
+func parseModeNamed(name string) (parseMode, error) {
+	switch name {
+	case "", "default":
+		return parseDefault, nil
+	case "strict":
+		return parseStrict, nil
+	case "lenient":
+		return parseLenient, nil
+	}
+	return parseDefault, fmt.Errorf("unknown parsing mode %q (expected strict or lenient)", name)
+}
+
+func (m parseMode) String() string {
+	switch m {
+	case parseStrict:
+		return "strict"
+	case parseLenient:
+		return "lenient"
+	}
+	return "default"
+}
+
+// unitSuffixes are stripped from numbers in lenient mode, longest first.
+var unitSuffixes = []string{"%rh", "°f", "°c", "ppm", "hpa", "mbar", "rh", "%", "f", "c"}
+
+// number parses a decimal value. In lenient mode it also accepts a comma
+// as the decimal separator and a trailing unit such as "72F" or "45%",
+// returning a warning describing the coercion.
+func (m parseMode) number(s string) (float64, string, error) {
+	s = strings.TrimSpace(s)
+	v, err := strconv.ParseFloat(s, 64)
+	if err == nil || m != parseLenient {
+		return v, "", err
+	}
+
+	fixed := strings.ToLower(s)
+	for _, suffix := range unitSuffixes {
+		if strings.HasSuffix(fixed, suffix) {
+			fixed = strings.TrimSpace(strings.TrimSuffix(fixed, suffix))
+			break
+		}
+	}
+	if strings.Count(fixed, ",") == 1 && !strings.Contains(fixed, ".") {
+		fixed = strings.Replace(fixed, ",", ".", 1)
+	}
+	v, err2 := strconv.ParseFloat(fixed, 64)
+	if err2 != nil {
+		return 0, "", err
+	}
+	return v, fmt.Sprintf("coerced %q to %v", s, v), nil
+}
+
+// decodePayload unmarshals a JSON reading. Lenient mode additionally
+// accepts numbers sent as strings, coercing them like number does.
+func (m parseMode) decodePayload(data []byte) (readingPayload, []string, error) {
+	var p readingPayload
+	if m != parseLenient {
+		return p, nil, json.Unmarshal(data, &p)
+	}
+
+	var raw struct {
+		SensorID    string          `json:"sensorId"`
+		Temperature json.RawMessage `json:"temperature"`
+		Humidity    json.RawMessage `json:"humidity"`
+		CO2         json.RawMessage `json:"co2"`
+		Pressure    json.RawMessage `json:"pressure"`
+		UpdatedAt   *time.Time      `json:"updatedAt"`
+		Firmware    string          `json:"firmware"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return p, nil, err
+	}
+	p.SensorID, p.UpdatedAt, p.Firmware = raw.SensorID, raw.UpdatedAt, raw.Firmware
+
+	var warnings []string
+	for _, f := range []struct {
+		name string
+		raw  json.RawMessage
+		dst  **float64
+	}{
+		{"temperature", raw.Temperature, &p.Temperature},
+		{"humidity", raw.Humidity, &p.Humidity},
+		{"co2", raw.CO2, &p.CO2},
+		{"pressure", raw.Pressure, &p.Pressure},
+	} {
+		if len(f.raw) == 0 || string(f.raw) == "null" {
+			continue
+		}
+		var s string
+		if err := json.Unmarshal(f.raw, &s); err != nil {
+			// Not a string, so it must be a plain number
+			var v float64
+			if err := json.Unmarshal(f.raw, &v); err != nil {
+				return p, warnings, fmt.Errorf("%s: %w", f.name, err)
+			}
+			*f.dst = &v
+			continue
+		}
+		v, warning, err := m.number(s)
+		if err != nil {
+			return p, warnings, fmt.Errorf("%s: %w", f.name, err)
+		}
+		if warning == "" {
+			warning = fmt.Sprintf("coerced string %q to %v", s, v)
+		}
+		warnings = append(warnings, f.name+": "+warning)
+		*f.dst = &v
+	}
+	return p, warnings, nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"slices"
+	"text/tabwriter"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// sensorPercentilesCollection holds each sensor's percentiles, for alert
+// conditions relative to its own history.
+const sensorPercentilesCollection = "sensor_percentiles"
+
+// percentileMinHours is how many hourly averages a season needs before
+// its percentiles are trusted. Conditions on a season with fewer don't
+// fire.
+const percentileMinHours = 7 * 24
+
+// sensorPercentiles are the percentiles of one sensor's hourly averages
+// of a metric in one season.
+type sensorPercentiles struct {
+	ID     string `bson:"_id"`
+	Sensor string `bson:"sensor"`
+	Metric string `bson:"metric"`
+	Season string `bson:"season"`
+	// Values holds the percentiles from the 1st to the 99th, of
+	// temperature and dew point in Celsius
+	Values []float64 `bson:"values"`
+	Hours  int       `bson:"hours"`
+	// From and To are the range of the history they were computed from
+	From       time.Time `bson:"from"`
+	To         time.Time `bson:"to"`
+	ComputedAt time.Time `bson:"computedAt"`
+}
+
+// percentileKey identifies a sensor's percentiles of a metric in a
+// season.
+type percentileKey struct{ sensor, metric, season string }
+
+// season is the meteorological season of t in the northern hemisphere:
+// winter is December to February, whatever reportTimezone is.
+func season(t time.Time) string {
+	switch t.Month() {
+	case time.December, time.January, time.February:
+		return "winter"
+	case time.March, time.April, time.May:
+		return "spring"
+	case time.June, time.July, time.August:
+		return "summer"
+	}
+	return "autumn"
+}
+
+// percentiles returns the 1st to 99th percentiles of values, which it
+// sorts, interpolating between the closest ranks.
+func percentiles(values []float64) []float64 {
+	slices.Sort(values)
+	out := make([]float64, 99)
+	for p := 1; p <= 99; p++ {
+		pos := float64(p) / 100 * float64(len(values)-1)
+		lo := int(math.Floor(pos))
+		hi := min(lo+1, len(values)-1)
+		out[p-1] = values[lo] + (values[hi]-values[lo])*(pos-float64(lo))
+	}
+	return out
+}
+
+// percentileJob works out each sensor's percentiles per metric and
+// season from the hourly averages of the last days.
+type percentileJob struct {
+	client *mongo.Client
+	store  readingStore
+	cold   *coldStore
+	days   int
+}
+
+// runEvery works out and stores the percentiles every interval until
+// ctx is done.
+func (j *percentileJob) runEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if list, err := j.run(ctx, time.Now()); err != nil && ctx.Err() == nil {
+			log.Printf("Percentiles: %v", err)
+		} else if err == nil {
+			log.Printf("Percentiles: updated %d", len(list))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// run works out the percentiles of the days before now and replaces the
+// stored ones with them.
+func (j *percentileJob) run(ctx context.Context, now time.Time) ([]sensorPercentiles, error) {
+	loc, err := time.LoadLocation(reportTimezone)
+	if err != nil {
+		return nil, err
+	}
+	from := now.AddDate(0, 0, -j.days)
+	cal, err := loadCalibration(ctx, sensorRegistry(j.client))
+	if err != nil {
+		return nil, err
+	}
+	registry, err := loadSensors(ctx, sensorRegistry(j.client))
+	if err != nil {
+		return nil, err
+	}
+	buckets, err := j.store.hourlyAverages(ctx, from, now, reportTimezone, nil, cal)
+	if err != nil {
+		return nil, err
+	}
+	tiers := j.client.Database(readingsDatabase).Collection(tiersCollection)
+	if buckets, err = federate(ctx, j.cold, tiers, from, now, nil, cal, buckets, hourlyKey(loc)); err != nil {
+		return nil, err
+	}
+
+	values := map[percentileKey][]float64{}
+	for _, b := range buckets {
+		if b.Count == 0 || len(b.Key) < len("2006-01") {
+			continue
+		}
+		month, err := time.Parse("2006-01", b.Key[:len("2006-01")])
+		if err != nil {
+			continue
+		}
+		add := func(metric string, v float64) {
+			k := percentileKey{b.Sensor, metric, season(month)}
+			values[k] = append(values[k], v)
+		}
+		// In Celsius, unregistered sensors taken to report it as alerts
+		// take them
+		t := sensorCelsius(registry, b.Sensor, b.Temperature)
+		add("temperature", t)
+		add("humidity", b.Humidity)
+		if b.Humidity > 0 {
+			add("dewpoint", dewPoint(t, b.Humidity))
+		}
+		if b.CO2 != nil && b.CO2Count > 0 {
+			add("co2", *b.CO2)
+		}
+		if b.Pressure != nil && b.PressureCount > 0 {
+			add("pressure", *b.Pressure)
+		}
+	}
+	var list []sensorPercentiles
+	for k, vs := range values {
+		if len(vs) < percentileMinHours {
+			continue
+		}
+		list = append(list, sensorPercentiles{
+			ID:     k.sensor + "/" + k.metric + "/" + k.season,
+			Sensor: k.sensor, Metric: k.metric, Season: k.season,
+			Values: percentiles(vs), Hours: len(vs),
+			From: from, To: now, ComputedAt: time.Now(),
+		})
+	}
+	slices.SortFunc(list, func(a, b sensorPercentiles) int { return cmp.Compare(a.ID, b.ID) })
+
+	coll := j.client.Database(readingsDatabase).Collection(sensorPercentilesCollection)
+	if len(list) > 0 {
+		models := make([]mongo.WriteModel, len(list))
+		for i, p := range list {
+			models[i] = mongo.NewReplaceOneModel().SetFilter(bson.M{"_id": p.ID}).SetReplacement(p).SetUpsert(true)
+		}
+		if _, err := coll.BulkWrite(ctx, models); err != nil {
+			return nil, err
+		}
+	}
+	// Percentiles of seasons that no longer have enough history go
+	ids := make([]string, len(list))
+	for i, p := range list {
+		ids[i] = p.ID
+	}
+	if _, err := coll.DeleteMany(ctx, bson.M{"_id": bson.M{"$nin": ids}}); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// loadPercentiles reads the stored percentiles.
+func loadPercentiles(ctx context.Context, coll *mongo.Collection) (map[percentileKey][]float64, error) {
+	cursor, err := coll.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	var list []sensorPercentiles
+	if err := cursor.All(ctx, &list); err != nil {
+		return nil, err
+	}
+	out := make(map[percentileKey][]float64, len(list))
+	for _, p := range list {
+		if len(p.Values) == 99 {
+			out[percentileKey{p.Sensor, p.Metric, p.Season}] = p.Values
+		}
+	}
+	return out, nil
+}
+
+// runAlertsPercentiles works out and stores the percentiles now, rather
+// than waiting for serve to, and prints some of them.
+func runAlertsPercentiles(ctx context.Context, client *mongo.Client, args []string) error {
+	fs := flag.NewFlagSet("alerts percentiles", flag.ExitOnError)
+	days := fs.Int("days", 365, "work percentiles out from this many days of history")
+	fs.Parse(args)
+	if *days < 1 {
+		return usageError("usage: alerts percentiles [-days N]")
+	}
+	store, err := openReadingStore(ctx, client)
+	if err != nil {
+		return err
+	}
+	defer store.close()
+	cold, err := newColdStore()
+	if err != nil {
+		return err
+	}
+	job := &percentileJob{client: client, store: store, cold: cold, days: *days}
+	list, err := job.run(ctx, time.Now())
+	if err != nil {
+		return err
+	}
+	if len(list) == 0 {
+		fmt.Printf("No season of any sensor has %d hours of readings yet.\n", percentileMinHours)
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SENSOR\tMETRIC\tSEASON\tHOURS\tP1\tP50\tP95\tP99")
+	for _, p := range list {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%.1f\t%.1f\t%.1f\t%.1f\n", p.Sensor, p.Metric, p.Season, p.Hours, p.Values[0], p.Values[49], p.Values[94], p.Values[98])
+	}
+	return w.Flush()
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// Outcomes of a ping check
+const (
+	pingOK   = "ok"
+	pingWarn = "warn"
+	pingFail = "FAIL"
+	pingSkip = "skipped"
+)
+
+// pingCheck is the outcome of one check of a deployment.
+type pingCheck struct {
+	name, status, detail string
+}
+
+// pingIndexes are the indexes of a readings collection that
+// ensure-indexes creates, by their keys.
+var pingIndexes = [][]string{{"updatedAt"}, {"sensorId", "updatedAt"}}
+
+// runPing checks that the source and, if given, destination deployments
+// can be reached and logged into, and that their readings collections
+// exist with the indexes queries rely on, for setting up a new
+// environment. It fails if any check does.
+func runPing(args []string) error {
+	fs := flag.NewFlagSet("ping", flag.ExitOnError)
+	source := fs.String("source", "", "cluster from CLUSTERS_FILE to check, or a MongoDB URI (default MONGO_CLUSTER, or MONGO_URI)")
+	dest := fs.String("dest", "", "destination cluster or MongoDB URI to check as well, as given to transfer")
+	db := fs.String("db", readingsDatabase, "database of the readings")
+	coll := fs.String("collection", readingsCollection, "collection of the readings")
+	timeout := fs.Duration("timeout", 10*time.Second, "give up on a deployment that doesn't answer in this long")
+	sourceTLS := mongoTLSFlags(fs, "source", "MONGO", "source")
+	destTLS := mongoTLSFlags(fs, "dest", "MONGO_DEST", "destination")
+	fs.Parse(args)
+
+	type target struct {
+		role, cluster string
+		tls           mongoTLS
+	}
+	targets := []target{{"source", *source, clusterTLSOr(*source, *sourceTLS)}}
+	if *dest != "" {
+		targets = append(targets, target{"destination", *dest, clusterTLSOr(*dest, *destTLS)})
+	}
+	failed, total := 0, 0
+	for i, t := range targets {
+		if i > 0 {
+			fmt.Println()
+		}
+		name := t.cluster
+		uri, err := clusterURI(t.cluster)
+		if err == nil {
+			name = clusterName(uri)
+		}
+		fmt.Printf("%s %s:\n", t.role, name)
+		var checks []pingCheck
+		switch {
+		case err != nil:
+			checks = []pingCheck{{"configuration", pingFail, err.Error()}}
+		case !strings.HasPrefix(uri, "mongodb://") && !strings.HasPrefix(uri, "mongodb+srv://"):
+			checks = []pingCheck{{"connection", pingSkip, "not a MongoDB URI"}}
+		default:
+			ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+			checks = pingMongo(ctx, uri, t.tls, *db, *coll)
+			cancel()
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "  CHECK\tSTATUS\tDETAIL")
+		for _, c := range checks {
+			fmt.Fprintf(w, "  %s\t%s\t%s\n", c.name, c.status, c.detail)
+			total++
+			if c.status == pingFail {
+				failed++
+			}
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, total)
+	}
+	return nil
+}
+
+// pingMongo runs the checks of one MongoDB deployment, stopping at the
+// first that the others depend on.
+func pingMongo(ctx context.Context, uri string, t mongoTLS, db, coll string) (checks []pingCheck) {
+	client, err := mongoClients.connect(ctx, uri, t)
+	if err != nil {
+		return []pingCheck{{"connection", pingFail, err.Error()}}
+	}
+	defer func() {
+		if err := mongoClients.release(context.Background(), client); err != nil {
+			checks = append(checks, pingCheck{"disconnect", pingWarn, err.Error()})
+		}
+	}()
+
+	start := time.Now()
+	if err := client.Ping(ctx, readpref.Primary()); err != nil {
+		return []pingCheck{{"connection", pingFail, err.Error()}}
+	}
+	checks = append(checks, pingCheck{"connection", pingOK, fmt.Sprintf("primary answered in %s", time.Since(start).Round(time.Millisecond))})
+
+	var build struct {
+		Version string `bson:"version"`
+	}
+	if err := client.Database("admin").RunCommand(ctx, bson.D{{Key: "buildInfo", Value: 1}}).Decode(&build); err == nil {
+		checks = append(checks, pingCheck{"server", pingOK, "MongoDB " + build.Version})
+	}
+
+	var status struct {
+		AuthInfo struct {
+			Users []struct {
+				User string `bson:"user"`
+				DB   string `bson:"db"`
+			} `bson:"authenticatedUsers"`
+		} `bson:"authInfo"`
+	}
+	if err := client.Database("admin").RunCommand(ctx, bson.D{{Key: "connectionStatus", Value: 1}}).Decode(&status); err != nil {
+		checks = append(checks, pingCheck{"authentication", pingFail, err.Error()})
+	} else if len(status.AuthInfo.Users) == 0 {
+		checks = append(checks, pingCheck{"authentication", pingWarn, "not logged in; fine without access control"})
+	} else {
+		users := make([]string, len(status.AuthInfo.Users))
+		for i, u := range status.AuthInfo.Users {
+			users[i] = u.User + "@" + u.DB
+		}
+		checks = append(checks, pingCheck{"authentication", pingOK, "as " + strings.Join(users, ", ")})
+	}
+
+	// Listing collections needs the rights the commands do, so a failure
+	// here is usually a user without access to the database
+	name := db + "." + coll
+	specs, err := client.Database(db).ListCollectionSpecifications(ctx, bson.M{"name": coll})
+	switch {
+	case err != nil:
+		return append(checks, pingCheck{"collection", pingFail, fmt.Sprintf("listing %s: %v", db, err)})
+	case len(specs) == 0:
+		return append(checks, pingCheck{"collection", pingFail, name + " doesn't exist"})
+	}
+	kind := specs[0].Type
+	if count, err := client.Database(db).Collection(coll).EstimatedDocumentCount(ctx); err == nil {
+		checks = append(checks, pingCheck{"collection", pingOK, fmt.Sprintf("%s, %s, about %d documents", name, kind, count)})
+	} else {
+		checks = append(checks, pingCheck{"collection", pingOK, fmt.Sprintf("%s, %s", name, kind)})
+	}
+	return append(checks, pingReadingIndexes(ctx, client.Database(db).Collection(coll))...)
+}
+
+// pingReadingIndexes checks that a readings collection has pingIndexes.
+func pingReadingIndexes(ctx context.Context, coll *mongo.Collection) []pingCheck {
+	specs, err := coll.Indexes().ListSpecifications(ctx)
+	if err != nil {
+		return []pingCheck{{"indexes", pingFail, err.Error()}}
+	}
+	have := map[string]bool{}
+	for _, s := range specs {
+		elems, err := s.KeysDocument.Elements()
+		if err != nil {
+			continue
+		}
+		keys := make([]string, len(elems))
+		for i, e := range elems {
+			keys[i] = e.Key()
+		}
+		have[strings.Join(keys, ",")] = true
+	}
+	var checks []pingCheck
+	for _, keys := range pingIndexes {
+		name := "index " + strings.Join(keys, ", ")
+		if have[strings.Join(keys, ",")] {
+			checks = append(checks, pingCheck{name, pingOK, "present"})
+		} else {
+			checks = append(checks, pingCheck{name, pingWarn, "missing; run ensure-indexes"})
+		}
+	}
+	return checks
+}
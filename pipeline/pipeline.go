@@ -0,0 +1,168 @@
+// Package pipeline builds MongoDB aggregation pipelines from the few
+// stages temphums uses, so that queries read as what they compute
+// rather than as nested documents.
+//
+//	p := pipeline.New().
+//		Match(filter).
+//		Derive(bson.D{{Key: "day", Value: pipeline.DateString("%Y-%m-%d", "$updatedAt", tz)}}).
+//		Bucket("$day").
+//		Stats(pipeline.Avg("temperature", "$temperature"), pipeline.Count("count")).
+//		Sort("_id").
+//		Pipeline()
+package pipeline
+
+import (
+	"bytes"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Builder appends stages to a pipeline. Its methods return the builder
+// so that stages can be chained.
+type Builder struct {
+	stages mongo.Pipeline
+}
+
+// New returns an empty pipeline.
+func New() *Builder {
+	return &Builder{}
+}
+
+// Pipeline returns the stages built so far.
+func (b *Builder) Pipeline() mongo.Pipeline {
+	return append(mongo.Pipeline(nil), b.stages...)
+}
+
+func (b *Builder) stage(name string, value any) *Builder {
+	b.stages = append(b.stages, bson.D{{Key: name, Value: value}})
+	return b
+}
+
+// Match keeps the documents that match filter ($match).
+func (b *Builder) Match(filter any) *Builder {
+	return b.stage("$match", filter)
+}
+
+// Derive sets fields to expressions of each document ($addFields),
+// replacing fields of the same name. The expressions all see the
+// document as it was before the stage.
+func (b *Builder) Derive(fields any) *Builder {
+	return b.stage("$addFields", fields)
+}
+
+// Bucket groups the documents by the key expression, which becomes the
+// _id of each group ($group). A nil key makes a single group. Stats
+// adds what is computed over each group.
+func (b *Builder) Bucket(key any) *Builder {
+	return b.stage("$group", bson.D{{Key: "_id", Value: key}})
+}
+
+// Stats adds accumulators to the preceding Bucket. It panics if the
+// last stage isn't a Bucket, as that is a mistake in the query rather
+// than in its input.
+func (b *Builder) Stats(stats ...Stat) *Builder {
+	n := len(b.stages)
+	if n == 0 || b.stages[n-1][0].Key != "$group" {
+		panic("pipeline: Stats must follow Bucket")
+	}
+	group := b.stages[n-1][0].Value.(bson.D)
+	for _, s := range stats {
+		group = append(group, bson.E(s))
+	}
+	b.stages[n-1][0].Value = group
+	return b
+}
+
+// Sort orders the documents by the given fields, ascending unless a
+// field is prefixed with "-" ($sort).
+func (b *Builder) Sort(fields ...string) *Builder {
+	var order bson.D
+	for _, f := range fields {
+		dir := 1
+		if name, ok := strings.CutPrefix(f, "-"); ok {
+			f, dir = name, -1
+		}
+		order = append(order, bson.E{Key: f, Value: dir})
+	}
+	return b.stage("$sort", order)
+}
+
+// Stat is an output field of a Bucket and the accumulator computing it.
+type Stat bson.E
+
+func accumulate(name, op string, expr any) Stat {
+	return Stat{Key: name, Value: bson.D{{Key: op, Value: expr}}}
+}
+
+// Avg averages expr over the group. Documents where it is missing or
+// not a number are skipped, and the average is null if there are none.
+func Avg(name string, expr any) Stat { return accumulate(name, "$avg", expr) }
+
+// Sum adds up expr over the group.
+func Sum(name string, expr any) Stat { return accumulate(name, "$sum", expr) }
+
+// Min is the least value of expr in the group.
+func Min(name string, expr any) Stat { return accumulate(name, "$min", expr) }
+
+// Max is the greatest value of expr in the group.
+func Max(name string, expr any) Stat { return accumulate(name, "$max", expr) }
+
+// Last is expr of the group's last document, in the order they arrive.
+func Last(name string, expr any) Stat { return accumulate(name, "$last", expr) }
+
+// Count counts the documents in the group.
+func Count(name string) Stat { return Sum(name, 1) }
+
+// CountNumbers counts the documents in the group where expr is a
+// number, the ones an Avg of it takes in.
+func CountNumbers(name string, expr any) Stat {
+	return Sum(name, bson.D{{Key: "$cond", Value: bson.A{bson.D{{Key: "$isNumber", Value: expr}}, 1, 0}}})
+}
+
+// EpochMillis is the date expr as milliseconds since the Unix epoch.
+// expr may also be a string or number that converts to a date.
+func EpochMillis(expr any) bson.D {
+	return bson.D{{Key: "$toLong", Value: bson.D{{Key: "$toDate", Value: expr}}}}
+}
+
+// Floor rounds the number expr down to a multiple of step, which
+// buckets epoch milliseconds into intervals aligned to the epoch.
+func Floor(expr any, step int64) bson.D {
+	return bson.D{{Key: "$subtract", Value: bson.A{expr, bson.D{{Key: "$mod", Value: bson.A{expr, step}}}}}}
+}
+
+// DateString formats the date expr with a $dateToString format such as
+// "%Y-%m-%d %H:00:00", in the IANA time zone tz, or UTC if tz is empty.
+func DateString(format string, expr any, tz string) bson.D {
+	spec := bson.D{
+		{Key: "format", Value: format},
+		{Key: "date", Value: bson.D{{Key: "$toDate", Value: expr}}},
+	}
+	if tz != "" {
+		spec = append(spec, bson.E{Key: "timezone", Value: tz})
+	}
+	return bson.D{{Key: "$dateToString", Value: spec}}
+}
+
+// ExtJSON renders a pipeline as relaxed MongoDB Extended JSON, an array
+// with one stage per line, for EJSON.parse in mongosh or Compass's
+// pipeline import. Dates print as {"$date": "..."}.
+func ExtJSON(p mongo.Pipeline) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString("[")
+	for i, stage := range p {
+		data, err := bson.MarshalExtJSON(stage, false, false)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		buf.WriteString("\n  ")
+		buf.Write(data)
+	}
+	buf.WriteString("\n]\n")
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,132 @@
+package pipeline
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// extJSON renders a pipeline as relaxed extended JSON, one stage per
+// line, which is easier to compare and read than nested documents.
+func extJSON(t *testing.T, p mongo.Pipeline) string {
+	t.Helper()
+	var lines []string
+	for _, stage := range p {
+		data, err := bson.MarshalExtJSON(stage, false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, string(data))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func check(t *testing.T, b *Builder, want ...string) {
+	t.Helper()
+	if got := extJSON(t, b.Pipeline()); got != strings.Join(want, "\n") {
+		t.Errorf("got\n%s\nwant\n%s", got, strings.Join(want, "\n"))
+	}
+}
+
+func TestEmpty(t *testing.T) {
+	if p := New().Pipeline(); len(p) != 0 {
+		t.Errorf("got %d stages, want none", len(p))
+	}
+}
+
+func TestStages(t *testing.T) {
+	b := New().
+		Match(bson.D{{Key: "sensorId", Value: "a"}}).
+		Derive(bson.D{{Key: "temperature", Value: bson.D{{Key: "$add", Value: bson.A{"$temperature", 1}}}}}).
+		Bucket("$sensorId").
+		Stats(Avg("temperature", "$temperature"), Count("count")).
+		Sort("_id")
+	check(t, b,
+		`{"$match":{"sensorId":"a"}}`,
+		`{"$addFields":{"temperature":{"$add":["$temperature",1]}}}`,
+		`{"$group":{"_id":"$sensorId","temperature":{"$avg":"$temperature"},"count":{"$sum":1}}}`,
+		`{"$sort":{"_id":1}}`,
+	)
+}
+
+func TestStatsAccumulate(t *testing.T) {
+	// Stats may be added in several calls, in order
+	b := New().Bucket(nil).
+		Stats(Min("low", "$t"), Max("high", "$t")).
+		Stats(Sum("total", "$t"), Last("latest", "$$ROOT"), CountNumbers("n", "$co2"))
+	check(t, b,
+		`{"$group":{"_id":null,"low":{"$min":"$t"},"high":{"$max":"$t"},"total":{"$sum":"$t"},"latest":{"$last":"$$ROOT"},"n":{"$sum":{"$cond":[{"$isNumber":"$co2"},1,0]}}}}`,
+	)
+}
+
+func TestStatsWithoutBucket(t *testing.T) {
+	for name, b := range map[string]*Builder{
+		"empty":       New(),
+		"after match": New().Match(bson.D{}),
+		"after sort":  New().Bucket("$a").Sort("_id"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("Stats didn't panic")
+				}
+			}()
+			b.Stats(Count("count"))
+		})
+	}
+}
+
+func TestSort(t *testing.T) {
+	check(t, New().Sort("_id", "-updatedAt", "sensorId"),
+		`{"$sort":{"_id":1,"updatedAt":-1,"sensorId":1}}`)
+}
+
+func TestExpressions(t *testing.T) {
+	b := New().Derive(bson.D{
+		{Key: "bucket", Value: Floor(EpochMillis("$updatedAt"), 300000)},
+		{Key: "hour", Value: DateString("%Y-%m-%d %H:00:00", "$updatedAt", "Europe/Istanbul")},
+		{Key: "day", Value: DateString("%Y-%m-%d", "$updatedAt", "")},
+	})
+	check(t, b,
+		`{"$addFields":{`+
+			`"bucket":{"$subtract":[{"$toLong":{"$toDate":"$updatedAt"}},{"$mod":[{"$toLong":{"$toDate":"$updatedAt"}},300000]}]},`+
+			`"hour":{"$dateToString":{"format":"%Y-%m-%d %H:00:00","date":{"$toDate":"$updatedAt"},"timezone":"Europe/Istanbul"}},`+
+			`"day":{"$dateToString":{"format":"%Y-%m-%d","date":{"$toDate":"$updatedAt"}}}}}`,
+	)
+}
+
+func TestPipelineIsACopy(t *testing.T) {
+	b := New().Match(bson.D{})
+	p := b.Pipeline()
+	b.Sort("_id")
+	if len(p) != 1 {
+		t.Errorf("earlier pipeline grew to %d stages", len(p))
+	}
+}
+
+func TestExtJSON(t *testing.T) {
+	from := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	p := New().
+		Match(bson.D{{Key: "updatedAt", Value: bson.D{{Key: "$gte", Value: from}}}}).
+		Bucket(nil).
+		Stats(Count("count")).
+		Pipeline()
+	got, err := ExtJSON(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `[
+  {"$match":{"updatedAt":{"$gte":{"$date":"2024-05-01T00:00:00Z"}}}},
+  {"$group":{"_id":null,"count":{"$sum":1}}}
+]
+`
+	if string(got) != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+	if got, _ := ExtJSON(nil); string(got) != "[\n]\n" {
+		t.Errorf("empty pipeline: got %q", got)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// pressureTendencyWindow is the period over which barometric tendency
+// is reported, as in synoptic weather observations.
+const pressureTendencyWindow = 3 * time.Hour
+
+// pressureTendency returns the change in average pressure of each
+// bucket since the bucket pressureTendencyWindow earlier, as
+// [change, unix milliseconds] pairs. Buckets must be sorted by key;
+// those without pressure, or without a reading a window earlier, are
+// skipped.
+func pressureTendency(buckets []bucketAvg[int64], interval int64) [][2]float64 {
+	window := pressureTendencyWindow.Milliseconds()
+	var out [][2]float64
+	for _, b := range buckets {
+		if b.Pressure == nil {
+			continue
+		}
+		// The window rarely falls on a bucket boundary, so take the
+		// bucket it falls in
+		i, found := slices.BinarySearchFunc(buckets, b.Key-window, func(e bucketAvg[int64], t int64) int {
+			return cmp.Compare(e.Key, t)
+		})
+		if !found {
+			i--
+		}
+		if i < 0 || buckets[i].Key <= b.Key-window-interval || buckets[i].Pressure == nil {
+			continue
+		}
+		out = append(out, [2]float64{*b.Pressure - *buckets[i].Pressure, float64(b.Key)})
+	}
+	return out
+}
+
+// stormWatch warns when a sensor's pressure falls by at least drop hPa
+// over pressureTendencyWindow, a sign of approaching storms. Each sensor
+// warns once until its tendency recovers.
+type stormWatch struct {
+	readings readingStore
+	sensors  *mongo.Collection
+	drop     float64
+	// webhook receives each warning as JSON when set
+	webhook string
+	http    *http.Client
+
+	warned map[string]bool
+}
+
+// stormWarning is the body posted to the storm webhook.
+type stormWarning struct {
+	SensorID string    `json:"sensorId,omitempty"`
+	Name     string    `json:"name,omitempty"`
+	Pressure float64   `json:"pressure"`
+	Change   float64   `json:"change"`
+	Window   string    `json:"window"`
+	At       time.Time `json:"at"`
+}
+
+// run checks each new reading from hub until ctx is done.
+func (w *stormWatch) run(ctx context.Context, hub *liveHub) {
+	ch, unsubscribe := hub.subscribe()
+	defer unsubscribe()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case r := <-ch:
+			if err := w.check(ctx, r); err != nil && ctx.Err() == nil {
+				log.Printf("Storm watch: %v", err)
+			}
+		}
+	}
+}
+
+// check compares r with the same sensor's reading a window earlier.
+func (w *stormWatch) check(ctx context.Context, r reading) error {
+	if r.Pressure == nil {
+		return nil
+	}
+	// Accept an earlier reading up to half an hour before the window,
+	// so sensors reporting every few minutes always have one
+	then := r.UpdatedAt.Add(-pressureTendencyWindow)
+	candidates, err := w.readings.find(ctx, then.Add(-30*time.Minute), then.Add(time.Millisecond), []string{r.SensorID})
+	if err != nil {
+		return err
+	}
+	var earlier *reading
+	for i := len(candidates) - 1; i >= 0 && earlier == nil; i-- {
+		if candidates[i].Pressure != nil {
+			earlier = &candidates[i]
+		}
+	}
+	if earlier == nil {
+		return nil
+	}
+
+	change := *r.Pressure - *earlier.Pressure
+	if change > -w.drop {
+		delete(w.warned, r.SensorID)
+		return nil
+	}
+	if w.warned[r.SensorID] {
+		return nil
+	}
+	w.warned[r.SensorID] = true
+
+	registry, err := loadSensors(ctx, w.sensors)
+	if err != nil {
+		return err
+	}
+	warning := stormWarning{
+		SensorID: r.SensorID,
+		Name:     registry[r.SensorID].Name,
+		Pressure: *r.Pressure,
+		Change:   change,
+		Window:   pressureTendencyWindow.String(),
+		At:       r.UpdatedAt,
+	}
+	log.Printf("Storm warning: %s pressure fell %.1f hPa in %s to %.1f hPa",
+		sensorName(registry, r.SensorID), -change, pressureTendencyWindow, *r.Pressure)
+	if w.webhook == "" {
+		return nil
+	}
+	return w.notify(ctx, warning)
+}
+
+func (w *stormWatch) notify(ctx context.Context, warning stormWarning) error {
+	data, err := json.Marshal(warning)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.webhook, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("storm webhook: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("storm webhook: %s", resp.Status)
+	}
+	return nil
+}
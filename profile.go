@@ -0,0 +1,191 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// hourProfile is a sensor's typical hour of the day: the averages of
+// that local hour across the days of a range.
+type hourProfile struct {
+	sensor string
+	hour   int
+	// temperature and humidity are the means of the hour's averages, and
+	// the min and max their lowest and highest
+	temperature, minTemperature, maxTemperature float64
+	humidity, minHumidity, maxHumidity          float64
+	// days is how many days had readings in the hour
+	days int
+}
+
+// runProfile reports each sensor's diurnal profile: the average of every
+// local hour of the day in reportTimezone across a range of days, such
+// as the typical 3pm temperature of last month.
+func runProfile(args []string) (err error) {
+	fs := flag.NewFlagSet("stats profile", flag.ExitOnError)
+	format := fs.String("format", "text", "output format: text or csv")
+	start := fs.String("start", "", "report from this date, YYYY-MM-DD (default 30 days ago)")
+	end := fs.String("end", "", "report up to this date, YYYY-MM-DD, exclusive (default today)")
+	sensorList := fs.String("sensor", "", "comma-separated sensor IDs to include (default all)")
+	cluster := fs.String("cluster", "", "cluster from CLUSTERS_FILE to read, or a MongoDB URI (default MONGO_CLUSTER, or MONGO_URI)")
+	fs.Parse(args)
+	sensors := splitList(*sensorList)
+	if *format != "text" && *format != "csv" {
+		return fmt.Errorf("unknown format %q (expected text or csv)", *format)
+	}
+	loc, err := time.LoadLocation(reportTimezone)
+	if err != nil {
+		return err
+	}
+	now := time.Now().In(loc)
+	to := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	from := to.AddDate(0, 0, -30)
+	if *start != "" {
+		if from, err = time.ParseInLocation(time.DateOnly, *start, loc); err != nil {
+			return fmt.Errorf("-start: %w", err)
+		}
+	}
+	if *end != "" {
+		if to, err = time.ParseInLocation(time.DateOnly, *end, loc); err != nil {
+			return fmt.Errorf("-end: %w", err)
+		}
+	}
+	if !to.After(from) {
+		return errors.New("-end must be after -start")
+	}
+
+	ctx, stop := commandContext()
+	defer stop()
+	connectCtx, cancel := context.WithTimeout(ctx, mongoTimeouts.connect)
+	client, err := connectMongo(connectCtx, *cluster)
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if rerr := mongoClients.release(ctx, client); err == nil {
+			err = rerr
+		}
+	}()
+	store, err := openReadingStore(ctx, client)
+	if err != nil {
+		return err
+	}
+	defer store.close()
+	cold, err := newColdStore()
+	if err != nil {
+		return err
+	}
+	cal, err := loadCalibration(ctx, sensorRegistry(client))
+	if err != nil {
+		return err
+	}
+	registry, err := loadSensors(ctx, sensorRegistry(client))
+	if err != nil {
+		return err
+	}
+
+	buckets, err := store.hourlyAverages(ctx, from, to, reportTimezone, sensors, cal)
+	if err != nil {
+		return err
+	}
+	tiers := client.Database(readingsDatabase).Collection(tiersCollection)
+	if buckets, err = federate(ctx, cold, tiers, from, to, sensors, cal, buckets, hourlyKey(loc)); err != nil {
+		return err
+	}
+	profiles := hourProfiles(buckets)
+	if *format == "csv" {
+		return printProfilesCSV(profiles, registry)
+	}
+	return printProfiles(profiles, registry, from, to, loc)
+}
+
+// hourProfiles averages hourly averages keyed by local time by sensor
+// and hour of the day. Every day with readings in an hour counts the
+// same, however many readings it had.
+func hourProfiles(hourly []bucketAvg[string]) []hourProfile {
+	type group struct {
+		sensor string
+		hour   int
+	}
+	byGroup := map[group]*hourProfile{}
+	for _, b := range hourly {
+		if b.Count == 0 {
+			continue
+		}
+		t, err := time.Parse(time.DateTime, b.Key)
+		if err != nil {
+			continue
+		}
+		g := group{b.Sensor, t.Hour()}
+		p, ok := byGroup[g]
+		if !ok {
+			p = &hourProfile{
+				sensor: b.Sensor, hour: g.hour,
+				minTemperature: b.Temperature, maxTemperature: b.Temperature,
+				minHumidity: b.Humidity, maxHumidity: b.Humidity,
+			}
+			byGroup[g] = p
+		}
+		p.days++
+		p.temperature += b.Temperature
+		p.humidity += b.Humidity
+		p.minTemperature, p.maxTemperature = min(p.minTemperature, b.Temperature), max(p.maxTemperature, b.Temperature)
+		p.minHumidity, p.maxHumidity = min(p.minHumidity, b.Humidity), max(p.maxHumidity, b.Humidity)
+	}
+	out := make([]hourProfile, 0, len(byGroup))
+	for _, p := range byGroup {
+		p.temperature /= float64(p.days)
+		p.humidity /= float64(p.days)
+		out = append(out, *p)
+	}
+	slices.SortFunc(out, func(a, b hourProfile) int {
+		return cmp.Or(cmp.Compare(a.sensor, b.sensor), cmp.Compare(a.hour, b.hour))
+	})
+	return out
+}
+
+func printProfiles(profiles []hourProfile, registry map[string]sensorInfo, from, to time.Time, loc *time.Location) error {
+	if len(profiles) == 0 {
+		fmt.Println("No readings in the range.")
+		return nil
+	}
+	fmt.Printf("Average of each hour of the day (%s), %s to %s:\n", loc, from.Format(time.DateOnly), to.AddDate(0, 0, -1).Format(time.DateOnly))
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SENSOR\tHOUR\tTEMP\tMIN\tMAX\tHUMIDITY\tMIN\tMAX\tDAYS")
+	for _, p := range profiles {
+		fmt.Fprintf(w, "%s\t%02d:00\t%.2f\t%.2f\t%.2f\t%.2f\t%.2f\t%.2f\t%d\n", sensorName(registry, p.sensor), p.hour,
+			p.temperature, p.minTemperature, p.maxTemperature, p.humidity, p.minHumidity, p.maxHumidity, p.days)
+	}
+	return w.Flush()
+}
+
+func printProfilesCSV(profiles []hourProfile, registry map[string]sensorInfo) error {
+	w := csv.NewWriter(os.Stdout)
+	w.Write([]string{"sensor_id", "sensor_name", "hour", "temperature", "min_temperature", "max_temperature", "humidity", "min_humidity", "max_humidity", "days"})
+	for _, p := range profiles {
+		w.Write([]string{
+			p.sensor,
+			sensorName(registry, p.sensor),
+			strconv.Itoa(p.hour),
+			strconv.FormatFloat(p.temperature, 'f', 2, 64),
+			strconv.FormatFloat(p.minTemperature, 'f', 2, 64),
+			strconv.FormatFloat(p.maxTemperature, 'f', 2, 64),
+			strconv.FormatFloat(p.humidity, 'f', 2, 64),
+			strconv.FormatFloat(p.minHumidity, 'f', 2, 64),
+			strconv.FormatFloat(p.maxHumidity, 'f', 2, 64),
+			strconv.Itoa(p.days),
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// trustedProxies are the reverse proxies in front of serve, such as
+// nginx or Cloudflare, whose X-Forwarded-For and X-Real-IP headers are
+// believed. Requests from anywhere else are taken to come from their
+// own address, whatever headers they carry.
+type trustedProxies []netip.Prefix
+
+// parseTrustedProxies reads a comma-separated list of CIDRs and
+// addresses, as TRUSTED_PROXIES is set, e.g. "127.0.0.1,10.0.0.0/8".
+func parseTrustedProxies(s string) (trustedProxies, error) {
+	var out trustedProxies
+	for _, v := range splitList(s) {
+		if !strings.Contains(v, "/") {
+			addr, err := netip.ParseAddr(v)
+			if err != nil {
+				return nil, fmt.Errorf("trusted proxy %q is not an address or CIDR", v)
+			}
+			addr = addr.Unmap()
+			out = append(out, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(v)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q is not an address or CIDR", v)
+		}
+		if prefix.Addr().Is4In6() {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		out = append(out, prefix.Masked())
+	}
+	return out, nil
+}
+
+func (t trustedProxies) trusts(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range t {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseHopAddr reads an address as proxies forward it, with or without
+// a port.
+func parseHopAddr(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return addr.Unmap(), true
+	}
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return ap.Addr().Unmap(), true
+	}
+	return netip.Addr{}, false
+}
+
+// clientAddr returns the address of the client a request came from. The
+// X-Forwarded-For chain is followed back from the connection's address
+// through the trusted proxies only, so a client can't pass itself off
+// as another by sending the header itself; X-Real-IP is used when a
+// trusted proxy sends it instead.
+func (t trustedProxies) clientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, ok := parseHopAddr(host)
+	if !ok || !t.trusts(addr) {
+		return host
+	}
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	if len(hops) == 0 {
+		if real, ok := parseHopAddr(r.Header.Get("X-Real-IP")); ok {
+			return real.String()
+		}
+		return addr.String()
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, ok := parseHopAddr(hops[i])
+		if !ok {
+			// Not something a trusted proxy adds, so nothing before it
+			// can be believed either
+			break
+		}
+		addr = hop
+		if !t.trusts(hop) {
+			break
+		}
+	}
+	return addr.String()
+}
+
+type clientIPContextKey struct{}
+
+// realIP passes the client's address on in each request's context,
+// where clientIP finds it.
+func (t trustedProxies) realIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), clientIPContextKey{}, t.clientAddr(r))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// clientIP is the address of the client behind any trusted proxies, for
+// logs and audit records.
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPContextKey{}).(string); ok {
+		return ip
+	}
+	return trustedProxies(nil).clientAddr(r)
+}
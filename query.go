@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// intervalAverages averages the readings in [from, to) over buckets of
+// interval milliseconds aligned to the Unix epoch, across both tiers.
+// Readings of all sensors are averaged together unless sensors limits
+// them, after applying each sensor's calibration offsets. With time
+// weighting the raw readings are read and averaged here instead.
+func (s *server) intervalAverages(ctx context.Context, from, to time.Time, interval int64, sensors []string) ([]bucketAvg[int64], error) {
+	cal, err := loadCalibration(ctx, s.sensors)
+	if err != nil {
+		return nil, err
+	}
+	if s.weighting == weightingTime {
+		history, err := readHistory(ctx, s.store, s.client, s.cold, from, to, sensors)
+		if err != nil {
+			return nil, err
+		}
+		return timeWeightedAverages(history, cal, false, intervalBucket(interval)), nil
+	}
+
+	buckets, err := s.store.intervalAverages(ctx, from, to, interval, sensors, cal)
+	if err != nil {
+		return nil, err
+	}
+
+	// Ranges moved to cold storage are read back from their archives
+	return federate(ctx, s.cold, s.tiers, from, to, sensors, cal, buckets, func(c coldReading) (int64, string) {
+		ms := c.UpdatedAt.UnixMilli()
+		return ms - ms%interval, ""
+	})
+}
+
+// readingsFilter matches the readings in [from, to), limited to the
+// given sensors unless sensors is empty.
+func readingsFilter(from, to time.Time, sensors []string) bson.M {
+	filter := bson.M{"updatedAt": bson.M{"$gte": from, "$lt": to}}
+	if len(sensors) > 0 {
+		filter["sensorId"] = bson.M{"$in": sensors}
+	}
+	return filter
+}
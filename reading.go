@@ -0,0 +1,29 @@
+package main
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// reading is a single measurement as stored in the readings collection.
+// Air-quality sensors such as the Aranet4 also report CO2 and pressure.
+type reading struct {
+	SensorID    string    `bson:"sensorId,omitempty" json:"sensorId,omitempty"`
+	Temperature float64   `bson:"temperature" json:"temperature"`
+	Humidity    float64   `bson:"humidity" json:"humidity"`
+	CO2         *float64  `bson:"co2,omitempty" json:"co2,omitempty"`
+	Pressure    *float64  `bson:"pressure,omitempty" json:"pressure,omitempty"`
+	UpdatedAt   time.Time `bson:"updatedAt" json:"updatedAt"`
+}
+
+// key matches the stored reading from the same sensor at the same time,
+// which idempotent writes use to skip readings already present.
+func (r reading) key() bson.M {
+	// A null match also covers readings stored without a sensor ID
+	var sensor any
+	if r.SensorID != "" {
+		sensor = r.SensorID
+	}
+	return bson.M{"sensorId": sensor, "updatedAt": r.UpdatedAt}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+	"go.mongodb.org/mongo-driver/bson"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// errRemoteWriteReadBack is returned where a transfer would read back
+// from a remote-write destination.
+var errRemoteWriteReadBack = errors.New("reading back from a remote-write endpoint is not supported")
+
+// remoteWriter pushes readings as Prometheus remote-write samples, to
+// VictoriaMetrics, Mimir or anything else that accepts them. Each metric
+// becomes a PREFIX_temperature, PREFIX_humidity, PREFIX_co2 or
+// PREFIX_pressure series labelled with sensor_id and, for registered
+// sensors with one, location.
+type remoteWriter struct {
+	endpoint string
+	token    string
+	prefix   string
+	// locations maps sensor IDs to their registered locations
+	locations map[string]string
+	http      *http.Client
+}
+
+// newRemoteWriter posts to a prom+http(s)://HOST/PATH URI, e.g.
+// prom+https://vm:8428/api/v1/write. User info in the URI is sent as
+// basic auth, and REMOTE_WRITE_TOKEN, if set, as a bearer token.
+func newRemoteWriter(uri, prefix string, registry map[string]sensorInfo) (*remoteWriter, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	u.Scheme = strings.TrimPrefix(u.Scheme, "prom+")
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("remote-write URI %q must start with prom+http:// or prom+https://", uri)
+	}
+	locations := map[string]string{}
+	for id, s := range registry {
+		if s.Location != "" {
+			locations[id] = s.Location
+		}
+	}
+	return &remoteWriter{
+		endpoint:  u.String(),
+		token:     os.Getenv("REMOTE_WRITE_TOKEN"),
+		prefix:    prefix,
+		locations: locations,
+		http:      &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (w *remoteWriter) String() string {
+	u, _ := url.Parse(w.endpoint)
+	return "prom:" + u.Host + u.Path + ":" + w.prefix
+}
+
+// promSeries is one labelled series and its samples.
+type promSeries struct {
+	labels  [][2]string
+	samples []promSample
+}
+
+type promSample struct {
+	value float64
+	at    time.Time
+}
+
+// series gathers the samples of the readings' metrics into series,
+// each sorted by time as remote write requires.
+func (w *remoteWriter) series(rs []reading) []*promSeries {
+	bySeries := map[string]*promSeries{}
+	var out []*promSeries
+	add := func(sensor, metric string, value float64, at time.Time) {
+		name := w.prefix + "_" + metric
+		key := name + "\x00" + sensor
+		s, ok := bySeries[key]
+		if !ok {
+			s = &promSeries{labels: [][2]string{{"__name__", name}, {"sensor_id", sensor}}}
+			if loc := w.locations[sensor]; loc != "" {
+				s.labels = append(s.labels, [2]string{"location", loc})
+			}
+			slices.SortFunc(s.labels, func(a, b [2]string) int { return cmp.Compare(a[0], b[0]) })
+			bySeries[key] = s
+			out = append(out, s)
+		}
+		s.samples = append(s.samples, promSample{value, at})
+	}
+	for _, r := range rs {
+		add(r.SensorID, "temperature", r.Temperature, r.UpdatedAt)
+		add(r.SensorID, "humidity", r.Humidity, r.UpdatedAt)
+		if r.CO2 != nil {
+			add(r.SensorID, "co2", *r.CO2, r.UpdatedAt)
+		}
+		if r.Pressure != nil {
+			add(r.SensorID, "pressure", *r.Pressure, r.UpdatedAt)
+		}
+	}
+	for _, s := range out {
+		slices.SortStableFunc(s.samples, func(a, b promSample) int { return a.at.Compare(b.at) })
+	}
+	return out
+}
+
+// encodeWriteRequest marshals series as a prometheus.WriteRequest:
+// repeated TimeSeries timeseries = 1, each with repeated Label labels =
+// 1 (name = 1, value = 2) and repeated Sample samples = 2 (value = 1,
+// timestamp in milliseconds = 2).
+func encodeWriteRequest(series []*promSeries) []byte {
+	var req []byte
+	for _, s := range series {
+		var ts []byte
+		for _, l := range s.labels {
+			var label []byte
+			label = protowire.AppendTag(label, 1, protowire.BytesType)
+			label = protowire.AppendString(label, l[0])
+			label = protowire.AppendTag(label, 2, protowire.BytesType)
+			label = protowire.AppendString(label, l[1])
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, label)
+		}
+		for _, sample := range s.samples {
+			var b []byte
+			b = protowire.AppendTag(b, 1, protowire.Fixed64Type)
+			b = protowire.AppendFixed64(b, math.Float64bits(sample.value))
+			b = protowire.AppendTag(b, 2, protowire.VarintType)
+			b = protowire.AppendVarint(b, uint64(sample.at.UnixMilli()))
+			ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, b)
+		}
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, ts)
+	}
+	return req
+}
+
+// push sends readings in one snappy-compressed write request.
+func (w *remoteWriter) push(ctx context.Context, rs []reading) error {
+	body := snappy.Encode(nil, encodeWriteRequest(w.series(rs)))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if w.token != "" {
+		req.Header.Set("Authorization", "Bearer "+w.token)
+	}
+	resp, err := w.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("remote write: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+func (w *remoteWriter) write(ctx context.Context, records []bson.M) error {
+	rs := make([]reading, len(records))
+	for i, record := range records {
+		r, err := recordReading(record)
+		if err != nil {
+			return err
+		}
+		rs[i] = r
+	}
+	return w.push(ctx, rs)
+}
+
+func (w *remoteWriter) missing(context.Context, []bson.M) (int64, error) {
+	return 0, errRemoteWriteReadBack
+}
+
+func (w *remoteWriter) digest(context.Context, time.Time, time.Time) (map[string]dayDigest, error) {
+	return nil, errRemoteWriteReadBack
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// maxReportDays bounds the range of a report requested over the API,
+// since its anomalies are found in every raw reading.
+const maxReportDays = 31
+
+// report holds the hourly averages of a range, per sensor or rolled up
+// by location, and optionally its anomalies, ready to be printed or
+// rendered.
+type report struct {
+	from, to  time.Time
+	groupBy   string
+	sensors   []bucketAvg[string]
+	locations []locationAvg
+	// withAnomalies is set when anomalies were looked for
+	withAnomalies bool
+	anomalies     []anomaly
+	registry      map[string]sensorInfo
+	loc           *time.Location
+	// rnd is how averages are printed, as export prints them
+	rnd outputRounding
+	// filtered counts the outliers dropped, when filtering
+	filtered *outlierStats
+	// label, charts and downloads are shown on a share link's page
+	label     string
+	charts    []reportLink
+	downloads []reportLink
+}
+
+// reportLink is a named URL on a report's HTML page.
+type reportLink struct {
+	Name, URL string
+}
+
+// buildReport gathers the hourly averages of [from, to) in
+// reportTimezone, from the hot and cold tiers, limited to the given
+// sensors unless sensors is empty. Outliers are dropped before
+// averaging when filter is set.
+func buildReport(ctx context.Context, client *mongo.Client, store readingStore, cold *coldStore, from, to time.Time, sensors []string, groupBy, weighting string, withAnomalies bool, filter *outlierFilter) (*report, error) {
+	// Correct readings by each sensor's calibration offsets
+	cal, err := loadCalibration(ctx, sensorRegistry(client))
+	if err != nil {
+		return nil, err
+	}
+	loc, err := time.LoadLocation(reportTimezone)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		results  []bucketAvg[string]
+		filtered *outlierStats
+	)
+	if weighting == weightingTime || filter != nil {
+		// Both need the raw readings rather than the database's averages
+		history, err := readHistory(ctx, store, client, cold, from, to, sensors)
+		if err != nil {
+			return nil, err
+		}
+		if filter != nil {
+			var stats outlierStats
+			history, stats = filter.filter(history)
+			filtered = &stats
+		}
+		if weighting == weightingTime {
+			results = timeWeightedAverages(history, cal, true, hourBucket(loc))
+		} else {
+			rows := make([]coldReading, len(history))
+			for i, r := range history {
+				rows[i] = coldReading{UpdatedAt: r.UpdatedAt, SensorID: r.SensorID, Temperature: r.Temperature, Humidity: r.Humidity, CO2: r.CO2, Pressure: r.Pressure}
+			}
+			cal.apply(rows)
+			results = mergeCold(nil, rows, hourlyKey(loc))
+		}
+	} else {
+		if results, err = store.hourlyAverages(ctx, from, to, reportTimezone, sensors, cal); err != nil {
+			return nil, err
+		}
+		// Merge in any of the range that has been moved to cold storage
+		tiers := client.Database(readingsDatabase).Collection(tiersCollection)
+		results, err = federate(ctx, cold, tiers, from, to, sensors, cal, results, hourlyKey(loc))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Join the registry for friendly sensor names
+	registry, err := loadSensors(ctx, sensorRegistry(client))
+	if err != nil {
+		return nil, err
+	}
+
+	r := &report{from: from, to: to, groupBy: groupBy, registry: registry, loc: loc, filtered: filtered}
+	if groupBy == "location" {
+		r.locations = rollUp(results, registry)
+	} else {
+		r.sensors = results
+	}
+	if r.withAnomalies = withAnomalies; withAnomalies {
+		r.anomalies, err = dayAnomalies(ctx, client, store, cold, cal, registry, from, to)
+		if err != nil {
+			return nil, err
+		}
+		if len(sensors) > 0 {
+			r.anomalies = slices.DeleteFunc(r.anomalies, func(a anomaly) bool {
+				return a.sensor != "" && !slices.Contains(sensors, a.sensor)
+			})
+		}
+	}
+	return r, nil
+}
+
+// hourlyKey groups archived readings by sensor and local hour in loc,
+// keyed as hourlyAverages keys its buckets.
+func hourlyKey(loc *time.Location) func(coldReading) (string, string) {
+	return func(c coldReading) (string, string) {
+		return c.UpdatedAt.In(loc).Format("2006-01-02 15:00:00"), c.SensorID
+	}
+}
+
+// title names the report after its range.
+func (r *report) title() string {
+	last := r.to.Add(-time.Nanosecond).In(r.loc).Format(time.DateOnly)
+	first := r.from.In(r.loc).Format(time.DateOnly)
+	if first == last {
+		return "Temperature and humidity report for " + first
+	}
+	return fmt.Sprintf("Temperature and humidity report for %s to %s", first, last)
+}
+
+// table returns the averages as rows of cells under a header. Averages
+// are reportNumbers, counts int and missing values nil, so each format
+// can lay them out its own way.
+func (r *report) table() ([]string, [][]any) {
+	number := func(column string, v float64) any {
+		return newReportNumber(r.rnd, column, v)
+	}
+	optional := func(column string, v *float64) any {
+		if v == nil {
+			return nil
+		}
+		return number(column, *v)
+	}
+	var rows [][]any
+	if r.groupBy == "location" {
+		for _, l := range r.locations {
+			rows = append(rows, []any{l.Key, l.Location, l.Level, l.Sensors, number("humidity", l.Humidity), number("temperature", l.Temperature), optional("co2", l.CO2), optional("pressure", l.Pressure)})
+		}
+		return []string{"Hour", "Location", "Level", "Sensors", "Avg Humidity", "Avg Temperature", "Avg CO2", "Avg Pressure"}, rows
+	}
+	for _, s := range r.sensors {
+		rows = append(rows, []any{s.Key, s.Sensor, sensorName(r.registry, s.Sensor), number("humidity", s.Humidity), number("temperature", s.Temperature), optional("co2", s.CO2), optional("pressure", s.Pressure)})
+	}
+	return []string{"Hour", "Sensor ID", "Sensor", "Avg Humidity", "Avg Temperature", "Avg CO2", "Avg Pressure"}, rows
+}
+
+// reportNumber is an average in a report table, rounded as its column is
+// by rnd: text for the text-based formats and value for spreadsheets.
+type reportNumber struct {
+	text  string
+	value float64
+}
+
+func newReportNumber(rnd outputRounding, column string, v float64) reportNumber {
+	text := rnd.format(column, v)
+	rounded, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		// NaN and ±Inf
+		rounded = v
+	}
+	return reportNumber{text: text, value: rounded}
+}
+
+// anomalyTable returns the anomalies as rows of cells under a header,
+// in the order printAnomalies lists them.
+func (r *report) anomalyTable() ([]string, [][]any) {
+	sortAnomalies(r.anomalies, r.registry)
+	const layout = "2006-01-02 15:04"
+	var rows [][]any
+	for _, a := range r.anomalies {
+		row := []any{a.kind, sensorName(r.registry, a.sensor), a.from.In(r.loc).Format(layout), nil, nil, a.detail}
+		if a.kind != "outlier" {
+			to := a.to.In(r.loc).Format(layout)
+			if a.ongoing {
+				to += " (ongoing)"
+			}
+			row[3], row[4] = to, roughDuration(a.to.Sub(a.from))
+		}
+		rows = append(rows, row)
+	}
+	return []string{"Kind", "Sensor", "From", "To", "Duration", "Detail"}, rows
+}
+
+// cellText formats a table cell for the text-based formats.
+func cellText(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case reportNumber:
+		return v.text
+	case int:
+		return strconv.Itoa(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// reportFormats are the formats the reports API renders, with their
+// media types.
+var reportFormats = map[string]string{
+	"html": "text/html; charset=utf-8",
+	"pdf":  "application/pdf",
+	"xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+}
+
+// handleReport renders a report for schedulers that fetch and deliver
+// it themselves. from and to are dates in reportTimezone, to exclusive;
+// by default the report covers yesterday.
+func (s *server) handleReport(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	format := q.Get("format")
+	if format == "" {
+		format = "html"
+	}
+	contentType, ok := reportFormats[format]
+	if !ok {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unknown format %q (expected html, pdf or xlsx)", format))
+		return
+	}
+	groupBy := q.Get("group-by")
+	if groupBy == "" {
+		groupBy = "sensor"
+	}
+	if groupBy != "sensor" && groupBy != "location" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unknown grouping %q (expected sensor or location)", groupBy))
+		return
+	}
+	loc, err := time.LoadLocation(reportTimezone)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	now := time.Now().In(loc)
+	from := time.Date(now.Year(), now.Month(), now.Day()-1, 0, 0, 0, 0, loc)
+	if v := q.Get("from"); v != "" {
+		if from, err = time.ParseInLocation(time.DateOnly, v, loc); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("from: %w", err))
+			return
+		}
+	}
+	to := from.AddDate(0, 0, 1)
+	if v := q.Get("to"); v != "" {
+		if to, err = time.ParseInLocation(time.DateOnly, v, loc); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("to: %w", err))
+			return
+		}
+	}
+	if !to.After(from) {
+		writeError(w, http.StatusBadRequest, errors.New("to must be after from"))
+		return
+	}
+	if to.After(from.AddDate(0, 0, maxReportDays)) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("reports cover at most %d days", maxReportDays))
+		return
+	}
+	withAnomalies := q.Get("anomalies") != "false"
+	weighting := q.Get("weighting")
+	if weighting == "" {
+		weighting = s.weighting
+	}
+	if err := checkWeighting(weighting); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	rep, err := buildReport(r.Context(), s.client, s.store, s.cold, from, to, splitList(q.Get("sensor")), groupBy, weighting, withAnomalies, nil)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	rep.rnd = s.rounding
+	var body []byte
+	switch format {
+	case "html":
+		body, err = rep.html()
+	case "pdf":
+		body, err = rep.pdf()
+	case "xlsx":
+		body, err = rep.xlsx()
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	name := "temphums-" + from.Format(time.DateOnly)
+	if last := to.AddDate(0, 0, -1); last.After(from) {
+		name += "-to-" + last.Format(time.DateOnly)
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+"."+format))
+	w.Write(body)
+}
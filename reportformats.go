@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"slices"
+	"time"
+
+	"github.com/go-pdf/fpdf"
+	"github.com/xuri/excelize/v2"
+)
+
+var reportHTML = template.Must(template.New("report").Funcs(template.FuncMap{"cell": cellText, "numeric": numericCell}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.25em 0.5em; text-align: left; }
+th { background: #eee; }
+td.number { text-align: right; }
+figure { display: inline-block; margin: 0 1em 1em 0; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+{{with .Label}}<p><strong>{{.}}</strong></p>
+{{end}}<p>Generated {{.Generated}}. Hours are in {{.Zone}}.{{if .Downloads}} Download as {{range $i, $d := .Downloads}}{{if $i}}, {{end}}<a href="{{$d.URL}}">{{$d.Name}}</a>{{end}}.{{end}}</p>
+{{if .Charts}}<h2>Charts</h2>
+<p>Temperature in red, humidity in blue.</p>
+{{range .Charts}}<figure><img src="{{.URL}}" alt="{{.Name}}" width="480" height="160"><figcaption>{{.Name}}</figcaption></figure>
+{{end}}{{end}}<h2>Hourly averages</h2>
+{{template "table" .Averages}}
+{{if .Anomalies}}<h2>Anomalies and alerts</h2>
+{{if .Anomalies.Rows}}{{template "table" .Anomalies}}{{else}}<p>None.</p>{{end}}
+{{end}}</body>
+</html>
+{{define "table"}}<table>
+<tr>{{range .Header}}<th>{{.}}</th>{{end}}</tr>
+{{range .Rows}}<tr>{{range .}}<td{{if numeric .}} class="number"{{end}}>{{cell .}}</td>{{end}}</tr>
+{{end}}</table>{{end}}
+`))
+
+// numericCell reports whether a table cell is a number, which is
+// aligned right.
+func numericCell(v any) bool {
+	switch v.(type) {
+	case reportNumber, int:
+		return true
+	}
+	return false
+}
+
+// reportTable is a header and rows, as passed to the HTML template.
+type reportTable struct {
+	Header []string
+	Rows   [][]any
+}
+
+// html renders the report as a standalone HTML page.
+func (r *report) html() ([]byte, error) {
+	data := struct {
+		Title, Label, Generated, Zone string
+		Charts, Downloads             []reportLink
+		Averages                      reportTable
+		Anomalies                     *reportTable
+	}{
+		Title:     r.title(),
+		Label:     r.label,
+		Generated: time.Now().In(r.loc).Format("2006-01-02 15:04 MST"),
+		Zone:      reportTimezone,
+		Charts:    r.charts,
+		Downloads: r.downloads,
+	}
+	data.Averages.Header, data.Averages.Rows = r.table()
+	if r.withAnomalies {
+		data.Anomalies = &reportTable{}
+		data.Anomalies.Header, data.Anomalies.Rows = r.anomalyTable()
+	}
+	var buf bytes.Buffer
+	err := reportHTML.Execute(&buf, data)
+	return buf.Bytes(), err
+}
+
+// pdf renders the report as a landscape A4 document, repeating each
+// table's header on every page.
+func (r *report) pdf() ([]byte, error) {
+	doc := fpdf.New("L", "mm", "A4", "")
+	doc.SetTitle(r.title(), true)
+	doc.SetAutoPageBreak(false, 10)
+	// The core fonts are Latin-1; translate names and details into it
+	tr := doc.UnicodeTranslatorFromDescriptor("")
+	doc.AliasNbPages("")
+	doc.SetFooterFunc(func() {
+		doc.SetY(-10)
+		doc.SetFont("Helvetica", "", 8)
+		doc.CellFormat(0, 5, fmt.Sprintf("%s - page %d of {nb}", tr(r.title()), doc.PageNo()), "", 0, "C", false, 0, "")
+	})
+	doc.AddPage()
+	doc.SetFont("Helvetica", "B", 14)
+	doc.CellFormat(0, 8, tr(r.title()), "", 1, "L", false, 0, "")
+	doc.SetFont("Helvetica", "", 9)
+	doc.CellFormat(0, 6, "Hours are in "+reportTimezone+".", "", 1, "L", false, 0, "")
+
+	header, rows := r.table()
+	pdfTable(doc, tr, "Hourly averages", header, rows)
+	if r.withAnomalies {
+		header, rows := r.anomalyTable()
+		if len(rows) == 0 {
+			rows = [][]any{{"none"}}
+		}
+		pdfTable(doc, tr, "Anomalies and alerts", header, rows)
+	}
+
+	var buf bytes.Buffer
+	err := doc.Output(&buf)
+	return buf.Bytes(), err
+}
+
+// pdfTable draws a titled table, sizing columns to their widest cell
+// and truncating cells that would still overflow the page.
+func pdfTable(doc *fpdf.Fpdf, tr func(string) string, title string, header []string, rows [][]any) {
+	const rowHeight, pad, maxColumn = 5.0, 2.0, 90.0
+	pageWidth, pageHeight := doc.GetPageSize()
+	left, _, right, bottom := doc.GetMargins()
+
+	doc.SetFont("Helvetica", "B", 9)
+	widths := make([]float64, len(header))
+	for i, h := range header {
+		widths[i] = doc.GetStringWidth(h) + 2*pad
+	}
+	doc.SetFont("Helvetica", "", 9)
+	for _, row := range rows {
+		for i, v := range row {
+			widths[i] = min(max(widths[i], doc.GetStringWidth(tr(cellText(v)))+2*pad), maxColumn)
+		}
+	}
+	var total float64
+	for _, w := range widths {
+		total += w
+	}
+	if avail := pageWidth - left - right; total > avail {
+		for i := range widths {
+			widths[i] *= avail / total
+		}
+	}
+
+	drawHeader := func() {
+		doc.SetFont("Helvetica", "B", 9)
+		doc.SetFillColor(230, 230, 230)
+		for i, h := range header {
+			doc.CellFormat(widths[i], rowHeight+1, h, "1", 0, "L", true, 0, "")
+		}
+		doc.Ln(-1)
+		doc.SetFont("Helvetica", "", 9)
+	}
+	doc.Ln(4)
+	doc.SetFont("Helvetica", "B", 11)
+	doc.CellFormat(0, 7, title, "", 1, "L", false, 0, "")
+	drawHeader()
+	for _, row := range rows {
+		if doc.GetY()+rowHeight > pageHeight-bottom-5 {
+			doc.AddPage()
+			drawHeader()
+		}
+		for i, v := range row {
+			text := tr(cellText(v))
+			for text != "" && doc.GetStringWidth(text)+2*pad > widths[i] {
+				text = text[:len(text)-1]
+			}
+			align := "L"
+			if numericCell(v) {
+				align = "R"
+			}
+			doc.CellFormat(widths[i], rowHeight, text, "1", 0, align, false, 0, "")
+		}
+		doc.Ln(-1)
+	}
+}
+
+// xlsx renders the report as a workbook with a sheet per table, keeping
+// numbers as numbers for further analysis.
+func (r *report) xlsx() ([]byte, error) {
+	f := excelize.NewFile()
+	defer f.Close()
+	bold, err := f.NewStyle(&excelize.Style{Font: &excelize.Font{Bold: true}})
+	if err != nil {
+		return nil, err
+	}
+	header, rows := r.table()
+	if err := f.SetSheetName("Sheet1", "Averages"); err != nil {
+		return nil, err
+	}
+	if err := xlsxSheet(f, "Averages", bold, header, rows); err != nil {
+		return nil, err
+	}
+	if r.withAnomalies {
+		header, rows := r.anomalyTable()
+		if _, err := f.NewSheet("Anomalies"); err != nil {
+			return nil, err
+		}
+		if err := xlsxSheet(f, "Anomalies", bold, header, rows); err != nil {
+			return nil, err
+		}
+	}
+	buf, err := f.WriteToBuffer()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// xlsxSheet fills a sheet with a bold, frozen, filterable header and
+// rows below it.
+func xlsxSheet(f *excelize.File, sheet string, headerStyle int, header []string, rows [][]any) error {
+	if err := f.SetSheetRow(sheet, "A1", &header); err != nil {
+		return err
+	}
+	last, err := excelize.ColumnNumberToName(len(header))
+	if err != nil {
+		return err
+	}
+	if err := f.SetCellStyle(sheet, "A1", last+"1", headerStyle); err != nil {
+		return err
+	}
+	for i, row := range rows {
+		cell, err := excelize.CoordinatesToCellName(1, i+2)
+		if err != nil {
+			return err
+		}
+		row = slices.Clone(row)
+		for j, v := range row {
+			if n, ok := v.(reportNumber); ok {
+				row[j] = n.value
+			}
+		}
+		if err := f.SetSheetRow(sheet, cell, &row); err != nil {
+			return err
+		}
+	}
+	if err := f.SetColWidth(sheet, "A", last, 18); err != nil {
+		return err
+	}
+	if err := f.AutoFilter(sheet, fmt.Sprintf("A1:%s%d", last, len(rows)+1), nil); err != nil {
+		return err
+	}
+	return f.SetPanes(sheet, &excelize.Panes{Freeze: true, YSplit: 1, TopLeftCell: "A2", ActivePane: "bottomLeft"})
+}
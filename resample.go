@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Fill methods for resampling. linear interpolates between the readings
+// either side of a grid point, hold repeats the last reading before it.
+const (
+	fillLinear = "linear"
+	fillHold   = "hold"
+)
+
+// maxResamplePoints bounds the grid points per sensor of a resample
+// requested over the API.
+const maxResamplePoints = 100_000
+
+// resampledPoint is one sensor's calibrated values at a grid point. The
+// values are nil where the sensor has no reading close enough.
+type resampledPoint struct {
+	SensorID    string    `json:"sensor_id"`
+	At          time.Time `json:"at"`
+	Temperature *float64  `json:"temperature"`
+	Humidity    *float64  `json:"humidity"`
+	CO2         *float64  `json:"co2"`
+	Pressure    *float64  `json:"pressure"`
+}
+
+// checkFill validates a fill method.
+func checkFill(fill string) error {
+	if fill != fillLinear && fill != fillHold {
+		return fmt.Errorf("unknown fill %q (expected linear or hold)", fill)
+	}
+	return nil
+}
+
+// resample puts each sensor's calibrated readings on a regular grid of
+// step, aligned to the Unix epoch, in [from, to). Values are never
+// carried across a gap longer than maxGap between readings, so a sensor
+// that was offline shows up as missing values rather than a straight
+// line. history needs the readings up to maxGap either side of the
+// range to fill its ends.
+func resample(history []reading, cal calibration, from, to time.Time, step, maxGap time.Duration, fill string) []resampledPoint {
+	bySensor := map[string][]reading{}
+	for _, r := range history {
+		bySensor[r.SensorID] = append(bySensor[r.SensorID], r)
+	}
+	ids := make([]string, 0, len(bySensor))
+	for id := range bySensor {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+
+	first := time.Unix(0, from.UnixNano()/int64(step)*int64(step)).UTC()
+	if first.Before(from) {
+		first = first.Add(step)
+	}
+	var points []resampledPoint
+	for _, id := range ids {
+		rs := bySensor[id]
+		slices.SortStableFunc(rs, func(a, b reading) int { return a.UpdatedAt.Compare(b.UpdatedAt) })
+		o := cal[id]
+		for t := first; t.Before(to); t = t.Add(step) {
+			p := resampledPoint{SensorID: id, At: t}
+			// next is the first reading at or after t
+			next, _ := slices.BinarySearchFunc(rs, t, func(r reading, t time.Time) int { return r.UpdatedAt.Compare(t) })
+			switch {
+			case next < len(rs) && rs[next].UpdatedAt.Equal(t):
+				p.set(rs[next], rs[next], 0)
+			case next == 0:
+				// Before the sensor's first reading
+			case fill == fillHold:
+				if prev := rs[next-1]; t.Sub(prev.UpdatedAt) <= maxGap {
+					p.set(prev, prev, 0)
+				}
+			case next < len(rs):
+				prev, after := rs[next-1], rs[next]
+				if gap := after.UpdatedAt.Sub(prev.UpdatedAt); gap <= maxGap {
+					p.set(prev, after, float64(t.Sub(prev.UpdatedAt))/float64(gap))
+				}
+			}
+			if p.Temperature != nil {
+				*p.Temperature += o.Temperature
+				*p.Humidity += o.Humidity
+			}
+			points = append(points, p)
+		}
+	}
+	return points
+}
+
+// set interpolates p's values a fraction f of the way from a to b.
+// Optional metrics are only set when both readings have them.
+func (p *resampledPoint) set(a, b reading, f float64) {
+	lerp := func(x, y float64) *float64 {
+		v := x + (y-x)*f
+		return &v
+	}
+	p.Temperature = lerp(a.Temperature, b.Temperature)
+	p.Humidity = lerp(a.Humidity, b.Humidity)
+	if a.CO2 != nil && b.CO2 != nil {
+		p.CO2 = lerp(*a.CO2, *b.CO2)
+	}
+	if a.Pressure != nil && b.Pressure != nil {
+		p.Pressure = lerp(*a.Pressure, *b.Pressure)
+	}
+}
+
+// printResampled prints resampled points as text or CSV, times in loc.
+func printResampled(out io.Writer, format string, points []resampledPoint, registry map[string]sensorInfo, loc *time.Location, rnd outputRounding) error {
+	switch format {
+	case "text":
+		for _, p := range points {
+			if p.Temperature == nil {
+				fmt.Fprintf(out, "Time: %s, Sensor: %s, no data\n", p.At.In(loc).Format(time.DateTime), sensorName(registry, p.SensorID))
+				continue
+			}
+			fmt.Fprintf(out, "Time: %s, Sensor: %s, Humidity: %s, Temperature: %s%s\n",
+				p.At.In(loc).Format(time.DateTime), sensorName(registry, p.SensorID), rnd.format("humidity", *p.Humidity), rnd.format("temperature", *p.Temperature),
+				airQualityText(p.CO2, p.Pressure, rnd))
+		}
+		return nil
+	case "csv":
+		w := csv.NewWriter(out)
+		w.Write([]string{"time", "sensor_id", "sensor_name", "humidity", "temperature", "co2", "pressure"})
+		for _, p := range points {
+			w.Write([]string{
+				p.At.In(loc).Format(time.RFC3339),
+				p.SensorID,
+				sensorName(registry, p.SensorID),
+				rnd.optional("humidity", p.Humidity),
+				rnd.optional("temperature", p.Temperature),
+				rnd.optional("co2", p.CO2),
+				rnd.optional("pressure", p.Pressure),
+			})
+		}
+		w.Flush()
+		return w.Error()
+	}
+	return fmt.Errorf("-resample prints text or csv, not %s", format)
+}
+
+// handleResample returns a sensor's readings resampled to ?step=
+// (default 5m) between ?from= and ?to= (Unix milliseconds, default the
+// last chartWindow), filled by ?fill= (linear or hold).
+func (s *server) handleResample(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	to := time.Now()
+	from := to.Add(-chartWindow)
+	for name, t := range map[string]*time.Time{"from": &from, "to": &to} {
+		v := q.Get(name)
+		if v == "" {
+			continue
+		}
+		ms, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("%s: not Unix milliseconds: %q", name, v))
+			return
+		}
+		*t = time.UnixMilli(ms)
+	}
+	if !from.Before(to) {
+		writeError(w, http.StatusBadRequest, errors.New("from must be before to"))
+		return
+	}
+	step := 5 * time.Minute
+	if v := q.Get("step"); v != "" {
+		var err error
+		if step, err = time.ParseDuration(v); err != nil || step < time.Second {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("step must be a duration of at least 1s, not %q", v))
+			return
+		}
+	}
+	if to.Sub(from)/step > maxResamplePoints {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("at most %d points per request; use a larger step or shorter range", maxResamplePoints))
+		return
+	}
+	fill := q.Get("fill")
+	if fill == "" {
+		fill = fillLinear
+	}
+	if err := checkFill(fill); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	maxGap := offlineAfter
+	if v := q.Get("max-gap"); v != "" {
+		var err error
+		if maxGap, err = time.ParseDuration(v); err != nil || maxGap <= 0 || maxGap > 24*time.Hour {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("max-gap must be a positive duration of at most 24h, not %q", v))
+			return
+		}
+	}
+
+	ctx := r.Context()
+	cal, err := loadCalibration(ctx, s.sensors)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	sensor := r.PathValue("id")
+	history, err := readHistory(ctx, s.store, s.client, s.cold, from.Add(-maxGap), to.Add(maxGap), []string{sensor})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	points := resample(history, cal, from, to, step, maxGap, fill)
+	if points == nil {
+		points = []resampledPoint{}
+	}
+	writeJSON(w, http.StatusOK, points)
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// summariesCollection holds the hourly and daily summaries raw readings
+// are rolled up into once they are past retention.
+const summariesCollection = "temphums_hourly"
+
+// Periods a summary covers, starting on the UTC hour or day.
+const (
+	periodHour = "hour"
+	periodDay  = "day"
+)
+
+// summaryStats summarises one metric over a period.
+type summaryStats struct {
+	Avg   float64 `bson:"avg"`
+	Min   float64 `bson:"min"`
+	Max   float64 `bson:"max"`
+	Count int64   `bson:"count"`
+}
+
+// merge combines the stats of two sets of readings.
+func (s summaryStats) merge(o summaryStats) summaryStats {
+	switch {
+	case o.Count == 0:
+		return s
+	case s.Count == 0:
+		return o
+	}
+	n := s.Count + o.Count
+	return summaryStats{
+		Avg:   (s.Avg*float64(s.Count) + o.Avg*float64(o.Count)) / float64(n),
+		Min:   math.Min(s.Min, o.Min),
+		Max:   math.Max(s.Max, o.Max),
+		Count: n,
+	}
+}
+
+func mergeOptionalStats(a, b *summaryStats) *summaryStats {
+	switch {
+	case b == nil:
+		return a
+	case a == nil:
+		v := *b
+		return &v
+	}
+	v := a.merge(*b)
+	return &v
+}
+
+// summary is a sensor's readings over one UTC hour or day. Like the raw
+// readings, summaries are stored uncalibrated.
+type summary struct {
+	ID          string        `bson:"_id"`
+	SensorID    string        `bson:"sensorId"`
+	Period      string        `bson:"period"`
+	Start       time.Time     `bson:"start"`
+	Temperature summaryStats  `bson:"temperature"`
+	Humidity    summaryStats  `bson:"humidity"`
+	CO2         *summaryStats `bson:"co2,omitempty"`
+	Pressure    *summaryStats `bson:"pressure,omitempty"`
+}
+
+// readingSummary is a summary of the single reading r, to roll up.
+func readingSummary(r reading) summary {
+	one := func(v float64) summaryStats { return summaryStats{Avg: v, Min: v, Max: v, Count: 1} }
+	s := summary{SensorID: r.SensorID, Start: r.UpdatedAt, Temperature: one(r.Temperature), Humidity: one(r.Humidity)}
+	if r.CO2 != nil {
+		v := one(*r.CO2)
+		s.CO2 = &v
+	}
+	if r.Pressure != nil {
+		v := one(*r.Pressure)
+		s.Pressure = &v
+	}
+	return s
+}
+
+func (s summary) merge(o summary) summary {
+	s.Temperature = s.Temperature.merge(o.Temperature)
+	s.Humidity = s.Humidity.merge(o.Humidity)
+	s.CO2 = mergeOptionalStats(s.CO2, o.CO2)
+	s.Pressure = mergeOptionalStats(s.Pressure, o.Pressure)
+	return s
+}
+
+// summarize combines summaries, or readings made into summaries, into
+// summaries of period.
+func summarize(period string, parts []summary) map[string]summary {
+	out := map[string]summary{}
+	for _, p := range parts {
+		start := p.Start.UTC().Truncate(time.Hour)
+		if period == periodDay {
+			start = time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, time.UTC)
+		}
+		id := fmt.Sprintf("%s:%s:%s", period, p.SensorID, start.Format(time.RFC3339))
+		s, ok := out[id]
+		if !ok {
+			s = summary{ID: id, SensorID: p.SensorID, Period: period, Start: start}
+		}
+		out[id] = s.merge(p)
+	}
+	return out
+}
+
+// retentionJob downsamples old data a UTC day at a time: raw readings
+// older than rawDays into hourly summaries, and, unless hourlyDays is 0,
+// hourly summaries older than that into daily ones.
+type retentionJob struct {
+	store     readingStore
+	summaries *mongo.Collection
+	state     *mongo.Collection
+	rawDays   int
+	// hourlyDays of 0 keeps hourly summaries
+	hourlyDays int
+}
+
+func newRetentionJob(client *mongo.Client, store readingStore, rawDays, hourlyDays int) (*retentionJob, error) {
+	if rawDays < 1 {
+		return nil, errors.New("raw readings must be kept for at least a day")
+	}
+	if hourlyDays != 0 && hourlyDays <= rawDays {
+		return nil, errors.New("hourly summaries must be kept for longer than raw readings")
+	}
+	return &retentionJob{
+		store:      store,
+		summaries:  client.Database(readingsDatabase).Collection(summariesCollection),
+		state:      importState(client),
+		rawDays:    rawDays,
+		hourlyDays: hourlyDays,
+	}, nil
+}
+
+// runRetention downsamples readings past retention once.
+func runRetention(args []string) (err error) {
+	fs := flag.NewFlagSet("retention", flag.ExitOnError)
+	days := fs.Int("days", 90, "roll raw readings older than this many days into hourly summaries")
+	dailyAfter := fs.Int("daily-after", 0, "roll hourly summaries older than this many days into daily ones (disabled when 0)")
+	cluster := fs.String("cluster", "", "cluster from CLUSTERS_FILE to downsample, or a MongoDB URI (default MONGO_CLUSTER, or MONGO_URI)")
+	fs.Parse(args)
+
+	ctx, stop := commandContext()
+	defer stop()
+	connectCtx, cancel := context.WithTimeout(ctx, mongoTimeouts.connect)
+	client, err := connectMongo(connectCtx, *cluster)
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if rerr := mongoClients.release(ctx, client); err == nil {
+			err = rerr
+		}
+	}()
+	store, err := openReadingStore(ctx, client)
+	if err != nil {
+		return err
+	}
+	defer store.close()
+	job, err := newRetentionJob(client, store, *days, *dailyAfter)
+	if err != nil {
+		return err
+	}
+	return job.run(ctx, time.Now())
+}
+
+// runEvery runs the job now and then every interval until ctx is done,
+// logging failures.
+func (j *retentionJob) runEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := j.run(ctx, time.Now()); err != nil && ctx.Err() == nil {
+			log.Printf("Retention: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// run downsamples every whole day before the cutoffs, oldest first.
+func (j *retentionJob) run(ctx context.Context, now time.Time) error {
+	today := now.UTC().Truncate(24 * time.Hour)
+	oldest, err := j.store.oldest(ctx)
+	if err != nil {
+		return err
+	}
+	if !oldest.IsZero() {
+		cutoff := today.AddDate(0, 0, -j.rawDays)
+		for day := oldest.UTC().Truncate(24 * time.Hour); day.Before(cutoff); day = day.AddDate(0, 0, 1) {
+			end := day.AddDate(0, 0, 1)
+			// Only the readings summarized are dropped; any stored
+			// meanwhile are left for the next run
+			var ids []any
+			err := j.downsample(ctx, day, periodHour, func() ([]summary, error) {
+				rs, found, err := j.store.findIDs(ctx, day, end)
+				ids = found
+				parts := make([]summary, len(rs))
+				for i, r := range rs {
+					parts[i] = readingSummary(r)
+				}
+				return parts, err
+			}, func() (int64, error) {
+				return j.store.deleteIDs(ctx, ids)
+			})
+			if err != nil {
+				return fmt.Errorf("downsampling %s: %w", day.Format(time.DateOnly), err)
+			}
+		}
+	}
+	if j.hourlyDays == 0 {
+		return nil
+	}
+
+	var first summary
+	err = j.summaries.FindOne(ctx, bson.M{"period": periodHour}, options.FindOne().SetSort(bson.M{"start": 1})).Decode(&first)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	cutoff := today.AddDate(0, 0, -j.hourlyDays)
+	for day := first.Start.UTC().Truncate(24 * time.Hour); day.Before(cutoff); day = day.AddDate(0, 0, 1) {
+		hourly := bson.M{"period": periodHour, "start": bson.M{"$gte": day, "$lt": day.AddDate(0, 0, 1)}}
+		var ids []string
+		err := j.downsample(ctx, day, periodDay, func() ([]summary, error) {
+			cursor, err := j.summaries.Find(ctx, hourly)
+			if err != nil {
+				return nil, err
+			}
+			var parts []summary
+			err = cursor.All(ctx, &parts)
+			ids = ids[:0]
+			for _, p := range parts {
+				ids = append(ids, p.ID)
+			}
+			return parts, err
+		}, func() (int64, error) {
+			res, err := j.summaries.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+			if err != nil {
+				return 0, err
+			}
+			return res.DeletedCount, nil
+		})
+		if err != nil {
+			return fmt.Errorf("rolling up %s: %w", day.Format(time.DateOnly), err)
+		}
+	}
+	return nil
+}
+
+// downsample rolls the data of the day that load returns up into
+// summaries of period, then removes that data, and only that, with drop.
+//
+// Summaries are written before anything is dropped, and checkpoints
+// record the days whose summaries are complete and whose data is gone.
+// A repeated run rewrites incomplete summaries from scratch and finishes
+// interrupted deletes, so an interrupted run neither loses data nor
+// counts it twice. Data turning up later for a day already done is
+// merged into its summaries.
+func (j *retentionJob) downsample(ctx context.Context, day time.Time, period string, load func() ([]summary, error), drop func() (int64, error)) error {
+	end := day.AddDate(0, 0, 1)
+	parts, err := load()
+	if err != nil {
+		return err
+	}
+	if len(parts) == 0 {
+		return nil
+	}
+	summarized, err := loadImportCursor(ctx, j.state, "retention:"+period)
+	if err != nil {
+		return err
+	}
+	deleted, err := loadImportCursor(ctx, j.state, "retention:"+period+":deleted")
+	if err != nil {
+		return err
+	}
+
+	summaries := summarize(period, parts)
+	switch {
+	case end.After(summarized.SyncedTo):
+		if err := j.write(ctx, summaries); err != nil {
+			return err
+		}
+		summarized.SyncedTo = end
+		if err := saveImportCursor(ctx, j.state, summarized); err != nil {
+			return err
+		}
+	case end.After(deleted.SyncedTo):
+		// The summaries were written but not all of the data deleted
+	default:
+		ids := make([]string, 0, len(summaries))
+		for id := range summaries {
+			ids = append(ids, id)
+		}
+		cursor, err := j.summaries.Find(ctx, bson.M{"_id": bson.M{"$in": ids}})
+		if err != nil {
+			return err
+		}
+		var existing []summary
+		if err := cursor.All(ctx, &existing); err != nil {
+			return err
+		}
+		for _, e := range existing {
+			summaries[e.ID] = e.merge(summaries[e.ID])
+		}
+		if err := j.write(ctx, summaries); err != nil {
+			return err
+		}
+	}
+
+	dropped, err := drop()
+	if err != nil {
+		return err
+	}
+	if end.After(deleted.SyncedTo) {
+		deleted.SyncedTo = end
+		if err := saveImportCursor(ctx, j.state, deleted); err != nil {
+			return err
+		}
+	}
+	kind := "hourly"
+	if period == periodDay {
+		kind = "daily"
+	}
+	log.Printf("Downsampled %s: %d records into %d %s summaries, %d deleted", day.Format(time.DateOnly), len(parts), len(summaries), kind, dropped)
+	return nil
+}
+
+// write replaces summaries by _id.
+func (j *retentionJob) write(ctx context.Context, summaries map[string]summary) error {
+	models := make([]mongo.WriteModel, 0, len(summaries))
+	for id, s := range summaries {
+		models = append(models, mongo.NewReplaceOneModel().SetFilter(bson.M{"_id": id}).SetReplacement(s).SetUpsert(true))
+	}
+	_, err := j.summaries.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	return err
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// maxRetryDelay caps the backoff between attempts.
+const maxRetryDelay = 30 * time.Second
+
+// retryPolicy is how often and how patiently operations are retried.
+type retryPolicy struct {
+	// attempts is the most times an operation is tried, 1 for no retries
+	attempts int
+	// backoff is the delay before the first retry, doubling after each
+	backoff time.Duration
+}
+
+// mongoRetry retries MongoDB operations that fail for a transient
+// reason, such as an Atlas primary stepping down or a dropped connection,
+// on top of the driver's own single retry. MONGO_RETRY_ATTEMPTS and
+// MONGO_RETRY_BACKOFF override it.
+var mongoRetry = retryPolicy{attempts: 4, backoff: 500 * time.Millisecond}
+
+// configureMongoRetry reads mongoRetry from the environment.
+func configureMongoRetry() error {
+	if v := os.Getenv("MONGO_RETRY_ATTEMPTS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("MONGO_RETRY_ATTEMPTS must be a whole number from 1, not %q", v)
+		}
+		mongoRetry.attempts = n
+	}
+	if v := os.Getenv("MONGO_RETRY_BACKOFF"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("MONGO_RETRY_BACKOFF must be a positive duration, not %q", v)
+		}
+		mongoRetry.backoff = d
+	}
+	return nil
+}
+
+// delay is the wait before retry n, from 1: the backoff doubled for each
+// retry before it, with jitter so clients that failed together don't
+// retry together.
+func (p retryPolicy) delay(n int) time.Duration {
+	d := min(p.backoff<<(n-1), maxRetryDelay)
+	if d <= 0 {
+		// The shift overflowed
+		d = maxRetryDelay
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+// retryMongo calls fn until it succeeds, fails for a reason that isn't
+// transient, or runs out of attempts, and returns its last result. fn
+// is passed the context of the attempt, which ends after the query
+// timeout, and the attempt, from 1. op names the operation in the log.
+func retryMongo[T any](ctx context.Context, op string, fn func(ctx context.Context, attempt int) (T, error)) (T, error) {
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancel := queryContext(ctx)
+		v, err := fn(attemptCtx, attempt)
+		cancel()
+		if err == nil || attempt >= mongoRetry.attempts || !transientMongoError(err) || ctx.Err() != nil {
+			return v, err
+		}
+		wait := mongoRetry.delay(attempt)
+		log.Printf("MongoDB %s failed (attempt %d of %d), retrying in %s: %v", op, attempt, mongoRetry.attempts, wait.Round(time.Millisecond), err)
+		select {
+		case <-ctx.Done():
+			return v, err
+		case <-time.After(wait):
+		}
+	}
+}
+
+// transientMongoError reports whether err may not recur if the operation
+// is tried again: a network error, a timeout finding a server, a failed
+// DNS lookup of an Atlas SRV record, or a server error the driver
+// labels as retryable, as during an election.
+func transientMongoError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		// The caller's deadline or the query timeout, which trying again
+		// won't help
+		return false
+	}
+	if mongo.IsNetworkError(err) || mongo.IsTimeout(err) {
+		return true
+	}
+	var dns *net.DNSError
+	if errors.As(err, &dns) {
+		return dns.IsTemporary || dns.IsTimeout
+	}
+	var le mongo.LabeledError
+	if errors.As(err, &le) {
+		return le.HasErrorLabel("RetryableWriteError") || le.HasErrorLabel("TransientTransactionError")
+	}
+	return false
+}
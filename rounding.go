@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Rounding modes. half-up rounds ties away from zero, as most people
+// round by hand; half-even (banker's rounding) rounds them to the even
+// digit, so ties don't push a column of figures one way.
+const (
+	roundHalfUp   = "half-up"
+	roundHalfEven = "half-even"
+)
+
+// outputRounding is how exports print values: the decimals of each
+// column and how ties are rounded. Values are only ever rounded here,
+// after averaging.
+type outputRounding struct {
+	digits map[string]int
+	mode   string
+}
+
+// defaultDigits are the decimals of each column unless -precision says
+// otherwise.
+var defaultDigits = map[string]int{"temperature": 2, "humidity": 2, "co2": 0, "pressure": 1, "humidex": 1, "vpd": 2}
+
+// parseRounding reads -precision, a comma-separated list such as
+// "temperature=1,humidity=0" overriding defaultDigits, and -rounding.
+func parseRounding(precision, mode string) (outputRounding, error) {
+	r := outputRounding{digits: map[string]int{}, mode: mode}
+	if mode != roundHalfUp && mode != roundHalfEven {
+		return r, fmt.Errorf("unknown rounding %q (expected half-up or half-even)", mode)
+	}
+	for column, n := range defaultDigits {
+		r.digits[column] = n
+	}
+	for _, item := range splitList(precision) {
+		column, digits, ok := strings.Cut(item, "=")
+		column = strings.ToLower(strings.TrimSpace(column))
+		if _, known := defaultDigits[column]; !ok || !known {
+			return r, fmt.Errorf("precision %q: expected COLUMN=DIGITS with column temperature, humidity, co2, pressure, humidex or vpd", item)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(digits))
+		if err != nil || n < 0 || n > 10 {
+			return r, fmt.Errorf("precision %q: digits must be 0 to 10", item)
+		}
+		r.digits[column] = n
+	}
+	return r, nil
+}
+
+// format prints v with the column's decimals.
+func (r outputRounding) format(column string, v float64) string {
+	return roundDecimal(v, r.digits[column], r.mode == roundHalfEven)
+}
+
+// optional prints v with the column's decimals, or "" when missing.
+func (r outputRounding) optional(column string, v *float64) string {
+	if v == nil {
+		return ""
+	}
+	return r.format(column, *v)
+}
+
+// roundDecimal rounds v to digits decimals. It rounds the shortest
+// decimal that reads back as v, so 2.675 is a tie, as written, rather
+// than the binary 2.67499999... that FormatFloat would round down.
+func roundDecimal(v float64, digits int, halfEven bool) string {
+	s := strconv.FormatFloat(v, 'f', -1, 64)
+	if strings.ContainsAny(s, "NI") {
+		// NaN and ±Inf
+		return s
+	}
+	negative := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+	whole, frac, _ := strings.Cut(s, ".")
+	if len(frac) <= digits {
+		frac += strings.Repeat("0", digits-len(frac))
+		return sign(negative, whole, frac)
+	}
+	kept := []byte(whole + frac[:digits])
+	next, rest := frac[digits], strings.TrimRight(frac[digits+1:], "0")
+	up := next > '5' || next == '5' && (rest != "" || !halfEven || (kept[len(kept)-1]-'0')%2 == 1)
+	if up {
+		i := len(kept) - 1
+		for ; i >= 0 && kept[i] == '9'; i-- {
+			kept[i] = '0'
+		}
+		if i < 0 {
+			kept = append([]byte{'1'}, kept...)
+		} else {
+			kept[i]++
+		}
+	}
+	cut := len(kept) - digits
+	return sign(negative, string(kept[:cut]), string(kept[cut:]))
+}
+
+// sign joins a rounded number, dropping the sign of a negative zero.
+func sign(negative bool, whole, frac string) string {
+	s := whole
+	if frac != "" {
+		s += "." + frac
+	}
+	if negative && strings.Trim(whole+frac, "0") != "" {
+		s = "-" + s
+	}
+	return s
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+// sealedVersion is the version of the sealed payload format.
+const sealedVersion = 1
+
+// sealedPayload is a reading payload encrypted with its device's key, for
+// collectors that publish through brokers or relays they don't trust.
+// The payload is sealed with AES-256-GCM, bound to the device ID, so a
+// relay can neither read nor alter it nor pass it off as another
+// device's.
+type sealedPayload struct {
+	Version    int    `json:"v"`
+	Device     string `json:"device"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// deviceKeys maps device IDs to their pre-shared 32-byte keys.
+type deviceKeys map[string][]byte
+
+// loadDeviceKeys reads a JSON object of device IDs and base64 keys, as
+// written by ingest keygen.
+func loadDeviceKeys(path string) (deviceKeys, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var encoded map[string]string
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	keys := make(deviceKeys, len(encoded))
+	for device, k := range encoded {
+		key, err := base64.StdEncoding.DecodeString(k)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("%s: the key of %q is not 32 bytes of base64", path, device)
+		}
+		keys[device] = key
+	}
+	return keys, nil
+}
+
+// isSealed tells sealed payloads from plain ones.
+func isSealed(data []byte) bool {
+	var probe struct {
+		Version    int    `json:"v"`
+		Ciphertext []byte `json:"ciphertext"`
+	}
+	return json.Unmarshal(data, &probe) == nil && probe.Version != 0 && probe.Ciphertext != nil
+}
+
+func deviceCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts a reading payload for device.
+func seal(device string, key, payload []byte) ([]byte, error) {
+	aead, err := deviceCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return json.Marshal(sealedPayload{
+		Version:    sealedVersion,
+		Device:     device,
+		Nonce:      nonce,
+		Ciphertext: aead.Seal(nil, nonce, payload, []byte(device)),
+	})
+}
+
+// open decrypts a sealed payload, returning its device and the reading
+// payload inside.
+func (k deviceKeys) open(data []byte) (string, []byte, error) {
+	var s sealedPayload
+	if err := json.Unmarshal(data, &s); err != nil {
+		return "", nil, err
+	}
+	if s.Version != sealedVersion {
+		return "", nil, fmt.Errorf("unsupported sealed payload version %d", s.Version)
+	}
+	key, ok := k[s.Device]
+	if !ok {
+		return "", nil, fmt.Errorf("no key for device %q", s.Device)
+	}
+	aead, err := deviceCipher(key)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(s.Nonce) != aead.NonceSize() {
+		return "", nil, errors.New("sealed payload has a bad nonce")
+	}
+	payload, err := aead.Open(nil, s.Nonce, s.Ciphertext, []byte(s.Device))
+	if err != nil {
+		return "", nil, fmt.Errorf("payload of device %q doesn't decrypt with its key", s.Device)
+	}
+	return s.Device, payload, nil
+}
+
+// runIngestKeygen creates a key for a device and adds it to the keys
+// file, printing it for the device's configuration.
+func runIngestKeygen(args []string) error {
+	fs := flag.NewFlagSet("ingest keygen", flag.ExitOnError)
+	device := fs.String("device", "", "device ID the key is for (required)")
+	keysFile := fs.String("keys", os.Getenv("DEVICE_KEYS_FILE"), "JSON file of device keys to add the key to")
+	force := fs.Bool("force", false, "replace the device's existing key")
+	fs.Parse(args)
+	if *device == "" || *keysFile == "" {
+		return usageError("usage: ingest keygen -device ID -keys FILE")
+	}
+
+	encoded := map[string]string{}
+	if data, err := os.ReadFile(*keysFile); err == nil {
+		if err := json.Unmarshal(data, &encoded); err != nil {
+			return fmt.Errorf("%s: %w", *keysFile, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if _, ok := encoded[*device]; ok && !*force {
+		return fmt.Errorf("%s already has a key for %q; use -force to replace it", *keysFile, *device)
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	encoded[*device] = base64.StdEncoding.EncodeToString(key)
+	data, err := json.MarshalIndent(encoded, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Keys are secrets, so only the owner may read the file
+	if err := os.WriteFile(*keysFile, append(data, '\n'), 0o600); err != nil {
+		return err
+	}
+	log.Printf("Added a key for %s to %s", *device, *keysFile)
+	fmt.Println(encoded[*device])
+	return nil
+}
+
+// runIngestSeal encrypts reading payloads, one JSON object per line on
+// standard input, for a device that can't itself, e.g. to publish with
+// mosquitto_pub from a shell script.
+func runIngestSeal(args []string) error {
+	fs := flag.NewFlagSet("ingest seal", flag.ExitOnError)
+	device := fs.String("device", "", "device ID to seal for (required)")
+	key := fs.String("key", os.Getenv("DEVICE_KEY"), "the device's base64 key")
+	fs.Parse(args)
+	raw, err := base64.StdEncoding.DecodeString(*key)
+	if *device == "" || err != nil || len(raw) != 32 {
+		return usageError("usage: ingest seal -device ID -key BASE64 < payloads.ndjson")
+	}
+	// Each line is written as soon as it is read, for pipes that publish
+	// line by line
+	sc := bufio.NewScanner(os.Stdin)
+	for sc.Scan() {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		sealed, err := seal(*device, raw, sc.Bytes())
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Printf("%s\n", sealed); err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"slices"
+	"text/tabwriter"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// baselinesCollection holds each sensor's seasonal baselines: what is
+// typical of each metric by week of the year and hour of the day.
+const baselinesCollection = "baselines"
+
+const (
+	// baselineWindow is how many weeks either side of a week also make
+	// its baseline, so a year of history gives each hour three weeks of
+	// days rather than one
+	baselineWindow = 1
+	// baselineMinHours is how many hourly averages an hour of a week
+	// needs before its baseline is trusted
+	baselineMinHours = 14
+)
+
+// seasonalBaseline is what is typical of one sensor's metric in one ISO
+// week of the year, hour by hour in reportTimezone. Values are in the
+// sensor's own unit, calibrated, as its hourly averages are.
+type seasonalBaseline struct {
+	ID     string `bson:"_id"`
+	Sensor string `bson:"sensor"`
+	Metric string `bson:"metric"`
+	Week   int    `bson:"week"`
+	// Typical holds the median of each hour of the day, from midnight,
+	// Spread the robust standard deviation around it, and Hours how
+	// many hourly averages each was worked out from
+	Typical []float64 `bson:"typical"`
+	Spread  []float64 `bson:"spread"`
+	Hours   []int     `bson:"hours"`
+	// From and To are the range of the history they were computed from
+	From       time.Time `bson:"from"`
+	To         time.Time `bson:"to"`
+	ComputedAt time.Time `bson:"computedAt"`
+}
+
+// baselineKey identifies a sensor's baseline of a metric in a week.
+type baselineKey struct {
+	sensor, metric string
+	week           int
+}
+
+// baselineLibrary holds the stored seasonal baselines, for anomalies,
+// alert conditions and reports to compare with.
+type baselineLibrary map[baselineKey]seasonalBaseline
+
+// at returns the typical value of a sensor's metric at t, which should
+// be in reportTimezone, and its spread. ok is false when the hour has
+// too little history.
+func (l baselineLibrary) at(sensor, metric string, t time.Time) (typical, spread float64, ok bool) {
+	_, week := t.ISOWeek()
+	b, found := l[baselineKey{sensor, metric, week}]
+	h := t.Hour()
+	if !found || len(b.Hours) != 24 || b.Hours[h] < baselineMinHours {
+		return 0, 0, false
+	}
+	return b.Typical[h], b.Spread[h], true
+}
+
+// versus returns how far v is above the typical value of a sensor's
+// metric at t, and v's percentile rank from 0 to 100, taking the values
+// of that hour to spread normally around the typical one. The spread is
+// at least outlierFloor, as for anomalies.
+func (l baselineLibrary) versus(sensor, metric string, t time.Time, v float64) (delta, rank float64, ok bool) {
+	typical, spread, ok := l.at(sensor, metric, t)
+	if !ok {
+		return 0, 0, false
+	}
+	delta = v - typical
+	z := delta / max(spread, outlierFloor[metric])
+	return delta, 50 * (1 + math.Erf(z/math.Sqrt2)), true
+}
+
+// baselineWeeks returns week and the weeks within baselineWindow of it,
+// wrapping around the year. Week 53 neighbours week 1.
+func baselineWeeks(week int) []int {
+	weeks := make([]int, 0, 2*baselineWindow+1)
+	for d := -baselineWindow; d <= baselineWindow; d++ {
+		weeks = append(weeks, (week-1+d+53)%53+1)
+	}
+	return weeks
+}
+
+// seasonalBaselines works out baselines from hourly averages keyed by
+// local time.
+func seasonalBaselines(hourly []bucketAvg[string], loc *time.Location, from, to time.Time) []seasonalBaseline {
+	type cell struct {
+		key  baselineKey
+		hour int
+	}
+	values := map[cell][]float64{}
+	for _, b := range hourly {
+		t, err := time.ParseInLocation(time.DateTime, b.Key, loc)
+		if err != nil {
+			continue
+		}
+		_, week := t.ISOWeek()
+		for _, metric := range baselineMetrics {
+			v, ok := bucketMetric(b, metric)
+			if !ok {
+				continue
+			}
+			for _, w := range baselineWeeks(week) {
+				c := cell{baselineKey{b.Sensor, metric, w}, t.Hour()}
+				values[c] = append(values[c], v)
+			}
+		}
+	}
+
+	byKey := map[baselineKey]*seasonalBaseline{}
+	for c, vs := range values {
+		b, ok := byKey[c.key]
+		if !ok {
+			b = &seasonalBaseline{
+				ID:     fmt.Sprintf("%s/%s/%d", c.key.sensor, c.key.metric, c.key.week),
+				Sensor: c.key.sensor, Metric: c.key.metric, Week: c.key.week,
+				Typical: make([]float64, 24), Spread: make([]float64, 24), Hours: make([]int, 24),
+				From: from, To: to, ComputedAt: time.Now(),
+			}
+			byKey[c.key] = b
+		}
+		med := median(vs)
+		deviations := make([]float64, len(vs))
+		for i, v := range vs {
+			deviations[i] = math.Abs(v - med)
+		}
+		b.Typical[c.hour] = med
+		b.Spread[c.hour] = 1.4826 * median(deviations)
+		b.Hours[c.hour] = len(vs)
+	}
+	out := make([]seasonalBaseline, 0, len(byKey))
+	for _, b := range byKey {
+		out = append(out, *b)
+	}
+	slices.SortFunc(out, func(a, b seasonalBaseline) int {
+		return cmp.Or(cmp.Compare(a.Sensor, b.Sensor), cmp.Compare(slices.Index(baselineMetrics, a.Metric), slices.Index(baselineMetrics, b.Metric)), cmp.Compare(a.Week, b.Week))
+	})
+	return out
+}
+
+// baselineJob works out each sensor's seasonal baselines from the
+// hourly averages of the last years.
+type baselineJob struct {
+	client *mongo.Client
+	store  readingStore
+	cold   *coldStore
+	years  int
+}
+
+// runEvery works out and stores the baselines every interval until ctx
+// is done.
+func (j *baselineJob) runEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if list, err := j.run(ctx, time.Now()); err != nil && ctx.Err() == nil {
+			log.Printf("Baselines: %v", err)
+		} else if err == nil {
+			log.Printf("Baselines: updated %d", len(list))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// run works out the baselines of the years before now and replaces the
+// stored ones with them.
+func (j *baselineJob) run(ctx context.Context, now time.Time) ([]seasonalBaseline, error) {
+	loc, err := time.LoadLocation(reportTimezone)
+	if err != nil {
+		return nil, err
+	}
+	from := now.AddDate(-j.years, 0, 0)
+	cal, err := loadCalibration(ctx, sensorRegistry(j.client))
+	if err != nil {
+		return nil, err
+	}
+	buckets, err := j.store.hourlyAverages(ctx, from, now, reportTimezone, nil, cal)
+	if err != nil {
+		return nil, err
+	}
+	tiers := j.client.Database(readingsDatabase).Collection(tiersCollection)
+	if buckets, err = federate(ctx, j.cold, tiers, from, now, nil, cal, buckets, hourlyKey(loc)); err != nil {
+		return nil, err
+	}
+	list := seasonalBaselines(buckets, loc, from, now)
+
+	coll := j.client.Database(readingsDatabase).Collection(baselinesCollection)
+	if len(list) > 0 {
+		models := make([]mongo.WriteModel, len(list))
+		for i, b := range list {
+			models[i] = mongo.NewReplaceOneModel().SetFilter(bson.M{"_id": b.ID}).SetReplacement(b).SetUpsert(true)
+		}
+		if _, err := coll.BulkWrite(ctx, models); err != nil {
+			return nil, err
+		}
+	}
+	// Baselines of sensors and weeks no longer in the history go
+	ids := make([]string, len(list))
+	for i, b := range list {
+		ids[i] = b.ID
+	}
+	if _, err := coll.DeleteMany(ctx, bson.M{"_id": bson.M{"$nin": ids}}); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// loadBaselines reads the stored baselines of sensors, or of every
+// sensor when sensors is empty.
+func loadBaselines(ctx context.Context, coll *mongo.Collection, sensors []string) (baselineLibrary, error) {
+	filter := bson.M{}
+	if len(sensors) > 0 {
+		filter["sensor"] = bson.M{"$in": sensors}
+	}
+	cursor, err := coll.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	var list []seasonalBaseline
+	if err := cursor.All(ctx, &list); err != nil {
+		return nil, err
+	}
+	out := make(baselineLibrary, len(list))
+	for _, b := range list {
+		out[baselineKey{b.Sensor, b.Metric, b.Week}] = b
+	}
+	return out, nil
+}
+
+// runAnomalyBaselines works out and stores the seasonal baselines now,
+// rather than waiting for serve to, and summarises them.
+func runAnomalyBaselines(args []string) (err error) {
+	fs := flag.NewFlagSet("anomalies baselines", flag.ExitOnError)
+	years := fs.Int("years", 3, "work baselines out from this many years of history")
+	cluster := fs.String("cluster", "", "cluster from CLUSTERS_FILE to read, or a MongoDB URI (default MONGO_CLUSTER, or MONGO_URI)")
+	fs.Parse(args)
+	if *years < 1 {
+		return usageError("usage: anomalies baselines [-years N]")
+	}
+
+	ctx, stop := commandContext()
+	defer stop()
+	connectCtx, cancel := context.WithTimeout(ctx, mongoTimeouts.connect)
+	client, err := connectMongo(connectCtx, *cluster)
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if rerr := mongoClients.release(ctx, client); err == nil {
+			err = rerr
+		}
+	}()
+	store, err := openReadingStore(ctx, client)
+	if err != nil {
+		return err
+	}
+	defer store.close()
+	cold, err := newColdStore()
+	if err != nil {
+		return err
+	}
+	registry, err := loadSensors(ctx, sensorRegistry(client))
+	if err != nil {
+		return err
+	}
+	job := &baselineJob{client: client, store: store, cold: cold, years: *years}
+	list, err := job.run(ctx, time.Now())
+	if err != nil {
+		return err
+	}
+	if len(list) == 0 {
+		fmt.Println("No readings to work baselines out from.")
+		return nil
+	}
+
+	// Summarised per sensor and metric: a full year is 52 or 53 weeks
+	// of 24 hours
+	type summary struct {
+		sensor, metric string
+		weeks, hours   int
+		trusted        int
+	}
+	var rows []summary
+	for _, b := range list {
+		if n := len(rows); n == 0 || rows[n-1].sensor != b.Sensor || rows[n-1].metric != b.Metric {
+			rows = append(rows, summary{sensor: b.Sensor, metric: b.Metric})
+		}
+		row := &rows[len(rows)-1]
+		row.weeks++
+		for _, h := range b.Hours {
+			row.hours += h
+			if h >= baselineMinHours {
+				row.trusted++
+			}
+		}
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SENSOR\tMETRIC\tWEEKS\tTRUSTED HOURS\tSAMPLES")
+	for _, r := range rows {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d of %d\t%d\n", sensorName(registry, r.sensor), r.metric, r.weeks, r.trusted, 24*r.weeks, r.hours)
+	}
+	return w.Flush()
+}
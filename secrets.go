@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// secretTimeout bounds fetching one secret, so a command doesn't hang on
+// an unreachable secrets manager.
+const secretTimeout = 15 * time.Second
+
+// Schemes of references to secrets held by a secrets manager, which any
+// environment variable or cluster URI can be set to instead of the
+// secret itself. A #field names a field of a secret holding several,
+// as JSON or a Vault key-value secret.
+const (
+	// vault://MOUNT/PATH#field reads a key-value secret from HashiCorp
+	// Vault at VAULT_ADDR with VAULT_TOKEN, or the token of vault login
+	vaultScheme = "vault://"
+	// aws-sm://NAME-OR-ARN#field reads a secret from AWS Secrets Manager
+	// in AWS_REGION, with the credentials of the environment,
+	// ~/.aws/credentials or the instance's role
+	awsSecretScheme = "aws-sm://"
+	// gcp-sm://PROJECT/SECRET[/VERSION]#field reads a secret from Google
+	// Secret Manager, by default its latest version, as the service
+	// account of GOOGLE_APPLICATION_CREDENTIALS or of the instance
+	gcpSecretScheme = "gcp-sm://"
+)
+
+var secretHTTP = &http.Client{Timeout: secretTimeout}
+
+// secretCache holds the secrets fetched, by reference without its
+// field, so a URI and a password from one secret are fetched once.
+var secretCache = map[string]string{}
+
+// isSecretRef reports whether v refers to a secret rather than being
+// one.
+func isSecretRef(v string) bool {
+	for _, scheme := range []string{vaultScheme, awsSecretScheme, gcpSecretScheme} {
+		if strings.HasPrefix(v, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveSecrets replaces each environment variable that refers to a
+// secret, such as MONGO_URI=vault://secret/temphums#uri, with the
+// secret, so the rest of the program never sees the reference.
+func resolveSecrets() error {
+	var names []string
+	for _, kv := range os.Environ() {
+		if name, v, _ := strings.Cut(kv, "="); isSecretRef(v) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		v, err := readSecret(os.Getenv(name))
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		os.Setenv(name, v)
+	}
+	return nil
+}
+
+// readSecret fetches the secret ref refers to, and its field if it
+// names one.
+func readSecret(ref string) (string, error) {
+	ref, field, _ := strings.Cut(ref, "#")
+	doc, ok := secretCache[ref]
+	if !ok {
+		ctx, cancel := context.WithTimeout(context.Background(), secretTimeout)
+		defer cancel()
+		var err error
+		switch {
+		case strings.HasPrefix(ref, vaultScheme):
+			doc, err = readVaultSecret(ctx, strings.TrimPrefix(ref, vaultScheme))
+		case strings.HasPrefix(ref, awsSecretScheme):
+			doc, err = readAWSSecret(ctx, strings.TrimPrefix(ref, awsSecretScheme))
+		case strings.HasPrefix(ref, gcpSecretScheme):
+			doc, err = readGCPSecret(ctx, strings.TrimPrefix(ref, gcpSecretScheme))
+		default:
+			err = errors.New("not a secret reference")
+		}
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", ref, err)
+		}
+		secretCache[ref] = doc
+	}
+	if field == "" {
+		return doc, nil
+	}
+	var fields map[string]any
+	if err := json.Unmarshal([]byte(doc), &fields); err != nil {
+		return "", fmt.Errorf("%s: secret isn't JSON, so has no field %q", ref, field)
+	}
+	v, ok := fields[field]
+	if !ok {
+		return "", fmt.Errorf("%s: secret has no field %q", ref, field)
+	}
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+	return fmt.Sprint(v), nil
+}
+
+// secretRequest sends req and decodes its JSON response into out,
+// reporting the service's own error message on failure.
+func secretRequest(req *http.Request, out any) (status int, err error) {
+	resp, err := secretHTTP.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg := strings.TrimSpace(string(body))
+		if len(msg) > 200 {
+			msg = msg[:200] + "..."
+		}
+		return resp.StatusCode, fmt.Errorf("%s: %s", resp.Status, msg)
+	}
+	return resp.StatusCode, json.Unmarshal(body, out)
+}
+
+// readVaultSecret reads a key-value secret at MOUNT/PATH as JSON, trying
+// version 2 of the engine before version 1.
+func readVaultSecret(ctx context.Context, path string) (string, error) {
+	addr := strings.TrimRight(os.Getenv("VAULT_ADDR"), "/")
+	if addr == "" {
+		return "", configError{errors.New("VAULT_ADDR not set in environment")}
+	}
+	token := os.Getenv("VAULT_TOKEN")
+	if token == "" {
+		// Where vault login leaves it
+		if home, err := os.UserHomeDir(); err == nil {
+			data, _ := os.ReadFile(filepath.Join(home, ".vault-token"))
+			token = strings.TrimSpace(string(data))
+		}
+	}
+	if token == "" {
+		return "", configError{errors.New("VAULT_TOKEN not set in environment and no ~/.vault-token")}
+	}
+	mount, rest, ok := strings.Cut(strings.Trim(path, "/"), "/")
+	if !ok || rest == "" {
+		return "", errors.New("expected vault://MOUNT/PATH")
+	}
+	get := func(p string, out any) (int, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, addr+"/v1/"+p, nil)
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("X-Vault-Token", token)
+		if ns := os.Getenv("VAULT_NAMESPACE"); ns != "" {
+			req.Header.Set("X-Vault-Namespace", ns)
+		}
+		return secretRequest(req, out)
+	}
+
+	var v2 struct {
+		Data struct {
+			Data map[string]any `json:"data"`
+		} `json:"data"`
+	}
+	status, err := get(mount+"/data/"+rest, &v2)
+	if err == nil {
+		data, err := json.Marshal(v2.Data.Data)
+		return string(data), err
+	}
+	if status != http.StatusNotFound {
+		return "", err
+	}
+	var v1 struct {
+		Data map[string]any `json:"data"`
+	}
+	if _, err := get(mount+"/"+rest, &v1); err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(v1.Data)
+	return string(data), err
+}
+
+// awsCredentials finds AWS credentials as the AWS CLI does: in the
+// environment, the shared credentials file, or the instance's role.
+var awsCredentials = credentials.NewChainCredentials([]credentials.Provider{
+	&credentials.EnvAWS{},
+	&credentials.FileAWSCredentials{},
+	&credentials.IAM{Client: &http.Client{Timeout: 2 * time.Second}},
+})
+
+// readAWSSecret reads the current version of a secret from AWS Secrets
+// Manager, in the region of its ARN or else AWS_REGION.
+func readAWSSecret(ctx context.Context, id string) (string, error) {
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	// arn:aws:secretsmanager:REGION:ACCOUNT:secret:NAME
+	if parts := strings.Split(id, ":"); len(parts) > 3 && parts[0] == "arn" {
+		region = parts[3]
+	}
+	if region == "" {
+		return "", configError{errors.New("AWS_REGION not set in environment")}
+	}
+	creds, err := awsCredentials.Get()
+	if err != nil {
+		return "", err
+	}
+	if creds.AccessKeyID == "" {
+		return "", configError{errors.New("no AWS credentials in the environment, ~/.aws/credentials or instance role")}
+	}
+	endpoint := os.Getenv("AWS_ENDPOINT_URL_SECRETS_MANAGER")
+	if endpoint == "" {
+		endpoint = "https://secretsmanager." + region + ".amazonaws.com"
+	}
+	body, err := json.Marshal(map[string]string{"SecretId": id})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(endpoint, "/")+"/", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	signAWS(req, body, creds, region, "secretsmanager", time.Now())
+
+	var out struct {
+		SecretString *string `json:"SecretString"`
+	}
+	if _, err := secretRequest(req, &out); err != nil {
+		return "", err
+	}
+	if out.SecretString == nil {
+		return "", errors.New("secret is binary rather than a string")
+	}
+	return *out.SecretString, nil
+}
+
+// signAWS signs a request with AWS Signature Version 4.
+func signAWS(req *http.Request, body []byte, creds credentials.Value, region, service string, now time.Time) {
+	stamp := now.UTC().Format("20060102T150405Z")
+	day := stamp[:8]
+	req.Header.Set("X-Amz-Date", stamp)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(req.Header.Get(name))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonical strings.Builder
+	for _, name := range names {
+		canonical.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signed := strings.Join(names, ";")
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	payload := sha256.Sum256(body)
+	request := strings.Join([]string{req.Method, path, req.URL.RawQuery, canonical.String(), signed, hex.EncodeToString(payload[:])}, "\n")
+
+	scope := day + "/" + region + "/" + service + "/aws4_request"
+	hashed := sha256.Sum256([]byte(request))
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+	mac := func(key []byte, data string) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(data))
+		return h.Sum(nil)
+	}
+	key := mac([]byte("AWS4"+creds.SecretAccessKey), day)
+	for _, part := range []string{region, service, "aws4_request"} {
+		key = mac(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signed, hex.EncodeToString(mac(key, toSign))))
+}
+
+// readGCPSecret reads a version of a secret from Google Secret Manager,
+// named as PROJECT/SECRET[/VERSION] or by its resource name,
+// projects/PROJECT/secrets/SECRET[/versions/VERSION].
+func readGCPSecret(ctx context.Context, name string) (string, error) {
+	parts := strings.Split(strings.Trim(name, "/"), "/")
+	if len(parts) >= 4 && parts[0] == "projects" && parts[2] == "secrets" {
+		short := []string{parts[1], parts[3]}
+		if len(parts) == 6 && parts[4] == "versions" {
+			short = append(short, parts[5])
+		}
+		parts = short
+	}
+	if len(parts) == 2 {
+		parts = append(parts, "latest")
+	}
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return "", errors.New("expected gcp-sm://PROJECT/SECRET[/VERSION]")
+	}
+	token, err := gcpAccessToken(ctx)
+	if err != nil {
+		return "", err
+	}
+	u := fmt.Sprintf("https://secretmanager.googleapis.com/v1/projects/%s/secrets/%s/versions/%s:access",
+		url.PathEscape(parts[0]), url.PathEscape(parts[1]), url.PathEscape(parts[2]))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	var out struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}
+	if _, err := secretRequest(req, &out); err != nil {
+		return "", err
+	}
+	data, err := base64.StdEncoding.DecodeString(out.Payload.Data)
+	return string(data), err
+}
+
+// gcpAccessToken returns an OAuth access token for Google Cloud: that of
+// the service account key at GOOGLE_APPLICATION_CREDENTIALS, or else of
+// the instance's service account from the metadata server.
+func gcpAccessToken(ctx context.Context) (string, error) {
+	var out struct {
+		AccessToken string `json:"access_token"`
+	}
+	path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if path == "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+			"http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token", nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		if _, err := secretRequest(req, &out); err != nil {
+			return "", configError{fmt.Errorf("GOOGLE_APPLICATION_CREDENTIALS not set in environment, and no metadata server: %w", err)}
+		}
+		return out.AccessToken, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", configError{err}
+	}
+	var key struct {
+		Type        string `json:"type"`
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+		TokenURI    string `json:"token_uri"`
+	}
+	if err := json.Unmarshal(data, &key); err != nil || key.Type != "service_account" {
+		return "", configError{fmt.Errorf("%s: not a service account key", path)}
+	}
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	if block == nil {
+		return "", configError{fmt.Errorf("%s: no private key", path)}
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return "", configError{fmt.Errorf("%s: %w", path, err)}
+	}
+	private, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return "", configError{fmt.Errorf("%s: private key isn't RSA", path)}
+	}
+
+	// A JWT asserting the service account, exchanged for a token
+	now := time.Now()
+	segment := func(v any) string {
+		data, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	unsigned := segment(map[string]string{"alg": "RS256", "typ": "JWT"}) + "." + segment(map[string]any{
+		"iss":   key.ClientEmail,
+		"scope": "https://www.googleapis.com/auth/cloud-platform",
+		"aud":   key.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(nil, private, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, key.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if _, err := secretRequest(req, &out); err != nil {
+		return "", err
+	}
+	return out.AccessToken, nil
+}
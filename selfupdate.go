@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// version is the release this binary was built from, set with
+// -ldflags "-X main.version=v1.2.3" by the release build.
+var version = "dev"
+
+// Release assets are named like goreleaser's, e.g. temphums_linux_armv7,
+// next to a checksums.txt of their SHA-256 sums and its detached
+// Ed25519 signature.
+const (
+	checksumsAsset = "checksums.txt"
+	signatureAsset = "checksums.txt.sig"
+)
+
+// githubRelease is the part of the GitHub releases API used here.
+type githubRelease struct {
+	TagName string `json:"tag_name"`
+	Assets  []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+func (r githubRelease) assetURL(name string) (string, error) {
+	for _, a := range r.Assets {
+		if a.Name == name {
+			return a.URL, nil
+		}
+	}
+	return "", fmt.Errorf("release %s has no asset %s", r.TagName, name)
+}
+
+// runSelfUpdate replaces the running binary with the latest GitHub
+// release for this platform, for collectors nobody logs in to. The
+// download must match checksums.txt, and checksums.txt must be signed by
+// -public-key when one is set. The new version runs from the next start,
+// so restart the service afterwards.
+func runSelfUpdate(args []string) error {
+	fs := flag.NewFlagSet("self-update", flag.ExitOnError)
+	repo := fs.String("repo", envOr("UPDATE_REPO", "baskint/temphums_go"), "GitHub repository to take releases from, as owner/name")
+	publicKey := fs.String("public-key", os.Getenv("UPDATE_PUBLIC_KEY"), "base64 Ed25519 key that must have signed the release checksums")
+	checkOnly := fs.Bool("check", false, "only report whether a newer release is available")
+	force := fs.Bool("force", false, "install the latest release even if it is this version")
+	fs.Parse(args)
+
+	var key ed25519.PublicKey
+	if *publicKey != "" {
+		raw, err := base64.StdEncoding.DecodeString(*publicKey)
+		if err != nil || len(raw) != ed25519.PublicKeySize {
+			return errors.New("-public-key must be a base64 Ed25519 public key")
+		}
+		key = raw
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	client := &http.Client{Timeout: 5 * time.Minute}
+	var rel githubRelease
+	body, err := download(ctx, client, "https://api.github.com/repos/"+*repo+"/releases/latest", 1<<20)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, &rel); err != nil {
+		return fmt.Errorf("reading the latest release: %w", err)
+	}
+	current := currentVersion()
+	if rel.TagName == current && !*force {
+		log.Printf("%s is the latest release", current)
+		return nil
+	}
+	log.Printf("Release %s is available (running %s)", rel.TagName, current)
+	if *checkOnly {
+		return nil
+	}
+
+	name := releaseAsset()
+	sums, err := releaseChecksums(ctx, client, rel, key)
+	if err != nil {
+		return err
+	}
+	want, ok := sums[name]
+	if !ok {
+		return fmt.Errorf("%s has no checksum for %s", checksumsAsset, name)
+	}
+	url, err := rel.assetURL(name)
+	if err != nil {
+		return err
+	}
+	if err := replaceExecutable(ctx, client, exe, url, want); err != nil {
+		return err
+	}
+	log.Printf("Updated %s to %s; restart it to run the new version", exe, rel.TagName)
+	return nil
+}
+
+// currentVersion is version, or the module version go install recorded
+// for a dev build.
+func currentVersion() string {
+	if version != "dev" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	return version
+}
+
+// releaseAsset is the name of this platform's binary, with the ARM
+// version for 32-bit Raspberry Pis.
+func releaseAsset() string {
+	arch := runtime.GOARCH
+	if info, ok := debug.ReadBuildInfo(); ok && arch == "arm" {
+		for _, s := range info.Settings {
+			if s.Key == "GOARM" {
+				arch += "v" + strings.TrimSuffix(s.Value, ",softfloat")
+			}
+		}
+	}
+	name := "temphums_" + runtime.GOOS + "_" + arch
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+// releaseChecksums downloads the SHA-256 sums of a release's assets,
+// checking their signature when there is a key.
+func releaseChecksums(ctx context.Context, client *http.Client, rel githubRelease, key ed25519.PublicKey) (map[string]string, error) {
+	url, err := rel.assetURL(checksumsAsset)
+	if err != nil {
+		return nil, err
+	}
+	data, err := download(ctx, client, url, 1<<20)
+	if err != nil {
+		return nil, err
+	}
+	if key != nil {
+		url, err := rel.assetURL(signatureAsset)
+		if err != nil {
+			return nil, err
+		}
+		sig, err := download(ctx, client, url, 1<<10)
+		if err != nil {
+			return nil, err
+		}
+		// Accept the signature raw or base64-encoded
+		if len(sig) != ed25519.SignatureSize {
+			if sig, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig))); err != nil {
+				return nil, fmt.Errorf("reading %s: %w", signatureAsset, err)
+			}
+		}
+		if !ed25519.Verify(key, data, sig) {
+			return nil, fmt.Errorf("%s of %s is not signed by -public-key", checksumsAsset, rel.TagName)
+		}
+	} else {
+		log.Printf("UPDATE_PUBLIC_KEY not set; checking the download against %s only", checksumsAsset)
+	}
+
+	// Lines are "<sha256>  <name>", as written by sha256sum
+	sums := map[string]string{}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 2 {
+			sums[strings.TrimPrefix(fields[1], "*")] = strings.ToLower(fields[0])
+		}
+	}
+	return sums, sc.Err()
+}
+
+// replaceExecutable downloads url next to exe, checks its SHA-256 sum and
+// moves it into place. The running binary is moved aside first, which
+// Windows allows where overwriting it isn't.
+func replaceExecutable(ctx context.Context, client *http.Client, exe, url, sum string) error {
+	dir := filepath.Dir(exe)
+	f, err := os.CreateTemp(dir, ".temphums-update-*")
+	if err != nil {
+		return fmt.Errorf("writing next to %s: %w", exe, err)
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		f.Close()
+		return fmt.Errorf("downloading %s: %s", url, resp.Status)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), resp.Body); err != nil {
+		f.Close()
+		return fmt.Errorf("downloading %s: %w", url, err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != sum {
+		return fmt.Errorf("%s has SHA-256 %s, but %s says %s", filepath.Base(url), got, checksumsAsset, sum)
+	}
+	if err := os.Chmod(tmp, 0o755); err != nil {
+		return err
+	}
+
+	old := exe + ".old"
+	os.Remove(old)
+	if err := os.Rename(exe, old); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, exe); err != nil {
+		// Put the old binary back rather than leave none
+		if err := os.Rename(old, exe); err != nil {
+			log.Printf("Restoring %s: %v", exe, err)
+		}
+		return err
+	}
+	// Windows keeps the running binary locked until it exits
+	os.Remove(old)
+	return nil
+}
+
+// download fetches url, failing beyond limit bytes. GITHUB_TOKEN, when
+// set, raises the API's rate limit.
+func download(ctx context.Context, client *http.Client, url string, limit int64) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token := os.Getenv("GITHUB_TOKEN"); token != "" && strings.HasPrefix(url, "https://api.github.com/") {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", url, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("fetching %s: more than %d bytes", url, limit)
+	}
+	return data, nil
+}
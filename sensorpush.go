@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// sensorPushAPI is the SensorPush gateway cloud API.
+const sensorPushAPI = "https://api.sensorpush.com/api/v1"
+
+// sensorPushPage is how many samples are requested at a time.
+const sensorPushPage = 10000
+
+// runImportSensorPush copies the sample history of every sensor on a
+// SensorPush account into the readings collection.
+func runImportSensorPush(args []string) error {
+	fs := flag.NewFlagSet("import sensorpush", flag.ExitOnError)
+	start := fs.String("start", "", "import samples from this date, YYYY-MM-DD (default 30 days ago)")
+	end := fs.String("end", "", "import samples before this date, YYYY-MM-DD (default now)")
+	prefix := fs.String("prefix", "sensorpush-", "prefix for the sensor IDs of imported readings")
+	fs.Parse(args)
+
+	email, password := os.Getenv("SENSORPUSH_EMAIL"), os.Getenv("SENSORPUSH_PASSWORD")
+	if email == "" || password == "" {
+		return errors.New("SENSORPUSH_EMAIL and SENSORPUSH_PASSWORD must be set")
+	}
+	to := time.Now()
+	from := to.AddDate(0, 0, -30)
+	var err error
+	if *start != "" {
+		if from, err = time.Parse(time.DateOnly, *start); err != nil {
+			return fmt.Errorf("-start: %w", err)
+		}
+	}
+	if *end != "" {
+		if to, err = time.Parse(time.DateOnly, *end); err != nil {
+			return fmt.Errorf("-end: %w", err)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	connectCtx, cancel := context.WithTimeout(ctx, mongoTimeouts.connect)
+	client, err := connectMongo(connectCtx, "")
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := mongoClients.release(context.Background(), client); err != nil {
+			log.Print(err)
+		}
+	}()
+	coll := readings(client)
+	registry := sensorRegistry(client)
+
+	sp := &sensorPushClient{email: email, password: password, http: &http.Client{Timeout: time.Minute}}
+	sensors, err := sp.sensors(ctx)
+	if err != nil {
+		return err
+	}
+	for id, s := range sensors {
+		sensorID := *prefix + id
+		if err := registerImportedSensor(ctx, registry, sensorID, s.Name, unitCelsius); err != nil {
+			return err
+		}
+		var total int64
+		// Samples come newest first, so page backwards from the end
+		for before := to; before.After(from); {
+			samples, truncated, err := sp.samples(ctx, id, from, before)
+			if err != nil {
+				return fmt.Errorf("%s: %w", s.Name, err)
+			}
+			if len(samples) == 0 {
+				break
+			}
+			rows := make([]reading, 0, len(samples))
+			for _, smp := range samples {
+				if smp.Observed.Before(before) {
+					before = smp.Observed
+				}
+				// SensorPush reports Fahrenheit; imports are stored in Celsius
+				temp := (smp.Temperature - 32) * 5 / 9
+				p := readingPayload{SensorID: sensorID, Temperature: &temp, Humidity: &smp.Humidity, UpdatedAt: &smp.Observed}
+				r, err := p.reading(time.Now())
+				if err != nil {
+					log.Printf("%s: skipping sample at %s: %v", s.Name, smp.Observed.Format(time.RFC3339), err)
+					continue
+				}
+				rows = append(rows, r)
+			}
+			n, err := importReadings(ctx, coll, rows)
+			if err != nil {
+				return err
+			}
+			total += n
+			if !truncated {
+				break
+			}
+			before = before.Add(-time.Millisecond)
+		}
+		log.Printf("%s (%s): imported %d new readings", s.Name, sensorID, total)
+	}
+	return nil
+}
+
+// sensorPushClient is a minimal client for the SensorPush cloud API.
+type sensorPushClient struct {
+	email, password string
+	http            *http.Client
+	token           string
+}
+
+type sensorPushSensor struct {
+	Name string `json:"name"`
+}
+
+type sensorPushSample struct {
+	Observed    time.Time `json:"observed"`
+	Temperature float64   `json:"temperature"`
+	Humidity    float64   `json:"humidity"`
+}
+
+// sensors lists the account's sensors keyed by SensorPush ID.
+func (c *sensorPushClient) sensors(ctx context.Context) (map[string]sensorPushSensor, error) {
+	var sensors map[string]sensorPushSensor
+	err := c.call(ctx, "/devices/sensors", map[string]any{}, &sensors)
+	return sensors, err
+}
+
+// samples returns up to a page of samples of one sensor in
+// [from, before), newest first, and whether more remain.
+func (c *sensorPushClient) samples(ctx context.Context, id string, from, before time.Time) ([]sensorPushSample, bool, error) {
+	req := map[string]any{
+		"sensors":   []string{id},
+		"startTime": from.UTC().Format(time.RFC3339),
+		"stopTime":  before.UTC().Format(time.RFC3339Nano),
+		"limit":     sensorPushPage,
+		"measures":  []string{"temperature", "humidity"},
+	}
+	var resp struct {
+		Sensors   map[string][]sensorPushSample `json:"sensors"`
+		Truncated bool                          `json:"truncated"`
+	}
+	if err := c.call(ctx, "/samples", req, &resp); err != nil {
+		return nil, false, err
+	}
+	return resp.Sensors[id], resp.Truncated, nil
+}
+
+// call posts body to path and decodes the response into out, signing
+// in first and again whenever the access token has expired.
+func (c *sensorPushClient) call(ctx context.Context, path string, body, out any) error {
+	if c.token == "" {
+		if err := c.signIn(ctx); err != nil {
+			return err
+		}
+	}
+	status, err := c.post(ctx, path, c.token, body, out)
+	if status == http.StatusUnauthorized || status == http.StatusForbidden {
+		if err := c.signIn(ctx); err != nil {
+			return err
+		}
+		_, err = c.post(ctx, path, c.token, body, out)
+	}
+	return err
+}
+
+// signIn exchanges the account credentials for an access token.
+func (c *sensorPushClient) signIn(ctx context.Context) error {
+	var auth struct {
+		Authorization string `json:"authorization"`
+	}
+	if _, err := c.post(ctx, "/oauth/authorize", "", map[string]string{"email": c.email, "password": c.password}, &auth); err != nil {
+		return fmt.Errorf("signing in to SensorPush: %w", err)
+	}
+	var token struct {
+		AccessToken string `json:"accesstoken"`
+	}
+	if _, err := c.post(ctx, "/oauth/accesstoken", "", map[string]string{"authorization": auth.Authorization}, &token); err != nil {
+		return fmt.Errorf("signing in to SensorPush: %w", err)
+	}
+	c.token = token.AccessToken
+	return nil
+}
+
+func (c *sensorPushClient) post(ctx context.Context, path, token string, body, out any) (int, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sensorPushAPI+path, bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, fmt.Errorf("%s: %s", path, resp.Status)
+	}
+	return resp.StatusCode, json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// sensorsCollection holds the sensor registry.
+const sensorsCollection = "sensors"
+
+// sensorInfo describes one registered sensor. Readings refer to it by
+// ID; everything else is metadata for reports and corrections.
+type sensorInfo struct {
+	ID                string     `bson:"_id" json:"id"`
+	Name              string     `bson:"name" json:"name"`
+	Location          string     `bson:"location,omitempty" json:"location,omitempty"`
+	TemperatureOffset float64    `bson:"temperatureOffset" json:"temperatureOffset"`
+	HumidityOffset    float64    `bson:"humidityOffset" json:"humidityOffset"`
+	TemperatureUnit   string     `bson:"temperatureUnit" json:"temperatureUnit"`
+	CreatedAt         time.Time  `bson:"createdAt" json:"createdAt"`
+	RetiredAt         *time.Time `bson:"retiredAt,omitempty" json:"retiredAt,omitempty"`
+}
+
+func sensorRegistry(client *mongo.Client) *mongo.Collection {
+	return client.Database(readingsDatabase).Collection(sensorsCollection)
+}
+
+// loadSensors returns every registered sensor keyed by ID.
+func loadSensors(ctx context.Context, coll *mongo.Collection) (map[string]sensorInfo, error) {
+	list, err := retryMongo(ctx, "find", func(ctx context.Context, _ int) ([]sensorInfo, error) {
+		cursor, err := coll.Find(ctx, bson.M{})
+		if err != nil {
+			return nil, err
+		}
+		var list []sensorInfo
+		err = cursor.All(ctx, &list)
+		return list, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	sensors := make(map[string]sensorInfo, len(list))
+	for _, s := range list {
+		sensors[s.ID] = s
+	}
+	return sensors, nil
+}
+
+// sensorName returns the friendly name of id, falling back to the ID
+// itself for unregistered sensors.
+func sensorName(sensors map[string]sensorInfo, id string) string {
+	if s, ok := sensors[id]; ok && s.Name != "" {
+		return s.Name
+	}
+	return id
+}
+
+// sensorCelsius converts a temperature reported by id to Celsius.
+// Sensors registered with unit F report Fahrenheit; imports and
+// unregistered sensors are taken to report Celsius.
+func sensorCelsius(sensors map[string]sensorInfo, id string, t float64) float64 {
+	if sensorUnit(sensors, id) == unitFahrenheit {
+		return (t - 32) * 5 / 9
+	}
+	return t
+}
+
+// sensorUnit is the temperature unit id reports in: F for sensors
+// registered with it, and C for the rest, as sensorCelsius takes them.
+func sensorUnit(sensors map[string]sensorInfo, id string) string {
+	if sensors[id].TemperatureUnit == unitFahrenheit {
+		return unitFahrenheit
+	}
+	return unitCelsius
+}
+
+// handleSensors lists the active sensors in the registry.
+func (s *server) handleSensors(w http.ResponseWriter, r *http.Request) {
+	cursor, err := s.sensors.Find(r.Context(), bson.M{"retiredAt": bson.M{"$exists": false}}, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	list := []sensorInfo{}
+	if err := cursor.All(r.Context(), &list); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// runSensors manages the sensor registry.
+func runSensors(args []string) (err error) {
+	if len(args) == 0 {
+		return usageError("usage: sensors list|add|rename|move|calibrate|retire [flags]")
+	}
+
+	ctx, stop := commandContext()
+	defer stop()
+	connectCtx, cancel := context.WithTimeout(ctx, mongoTimeouts.connect)
+	client, err := connectMongo(connectCtx, "")
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if rerr := mongoClients.release(ctx, client); err == nil {
+			err = rerr
+		}
+	}()
+	coll := sensorRegistry(client)
+
+	switch args[0] {
+	case "list":
+		return listSensors(ctx, coll, args[1:])
+	case "add":
+		return addSensor(ctx, coll, args[1:])
+	case "rename":
+		if len(args) != 3 {
+			return usageError("usage: sensors rename ID NAME")
+		}
+		return updateSensor(ctx, coll, args[1], bson.M{"name": args[2]})
+	case "move":
+		if len(args) != 3 {
+			return usageError("usage: sensors move ID BUILDING/FLOOR/ROOM")
+		}
+		return updateSensor(ctx, coll, args[1], bson.M{"location": args[2]})
+	case "calibrate":
+		if len(args) != 4 {
+			return usageError("usage: sensors calibrate ID TEMP_OFFSET HUM_OFFSET")
+		}
+		temp, err := strconv.ParseFloat(args[2], 64)
+		if err != nil {
+			return fmt.Errorf("temperature offset: %w", err)
+		}
+		hum, err := strconv.ParseFloat(args[3], 64)
+		if err != nil {
+			return fmt.Errorf("humidity offset: %w", err)
+		}
+		return updateSensor(ctx, coll, args[1], bson.M{"temperatureOffset": temp, "humidityOffset": hum})
+	case "retire":
+		if len(args) != 2 {
+			return usageError("usage: sensors retire ID")
+		}
+		return updateSensor(ctx, coll, args[1], bson.M{"retiredAt": time.Now()})
+	default:
+		return usageError(fmt.Sprintf("unknown sensors command %q (expected list, add, rename, move, calibrate or retire)", args[0]))
+	}
+}
+
+func listSensors(ctx context.Context, coll *mongo.Collection, args []string) error {
+	fs := flag.NewFlagSet("sensors list", flag.ExitOnError)
+	all := fs.Bool("all", false, "include retired sensors")
+	fs.Parse(args)
+
+	filter := bson.M{}
+	if !*all {
+		filter["retiredAt"] = bson.M{"$exists": false}
+	}
+	cursor, err := coll.Find(ctx, filter, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return err
+	}
+	var list []sensorInfo
+	if err := cursor.All(ctx, &list); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tLOCATION\tUNIT\tTEMP OFFSET\tHUM OFFSET\tSTATUS")
+	for _, s := range list {
+		status := "active"
+		if s.RetiredAt != nil {
+			status = "retired " + s.RetiredAt.Format("2006-01-02")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%+.2f\t%+.2f\t%s\n",
+			s.ID, s.Name, s.Location, s.TemperatureUnit, s.TemperatureOffset, s.HumidityOffset, status)
+	}
+	return w.Flush()
+}
+
+func addSensor(ctx context.Context, coll *mongo.Collection, args []string) error {
+	fs := flag.NewFlagSet("sensors add", flag.ExitOnError)
+	id := fs.String("id", "", "sensor ID as sent with readings (required)")
+	name := fs.String("name", "", "friendly name (defaults to the ID)")
+	location := fs.String("location", "", "where the sensor is installed, as building/floor/room")
+	unit := fs.String("unit", "F", "temperature unit the sensor reports, F or C")
+	tempOffset := fs.Float64("temp-offset", 0, "calibration offset added to temperatures")
+	humOffset := fs.Float64("hum-offset", 0, "calibration offset added to humidity")
+	fs.Parse(args)
+
+	if *id == "" {
+		return errors.New("-id is required")
+	}
+	if *unit != "F" && *unit != "C" {
+		return fmt.Errorf("unit must be F or C, not %q", *unit)
+	}
+	if *name == "" {
+		*name = *id
+	}
+	s := sensorInfo{
+		ID:                *id,
+		Name:              *name,
+		Location:          *location,
+		TemperatureOffset: *tempOffset,
+		HumidityOffset:    *humOffset,
+		TemperatureUnit:   *unit,
+		CreatedAt:         time.Now(),
+	}
+	if _, err := coll.InsertOne(ctx, s); mongo.IsDuplicateKeyError(err) {
+		return fmt.Errorf("sensor %q is already registered", *id)
+	} else if err != nil {
+		return err
+	}
+	log.Printf("Registered sensor %s (%s)", s.ID, s.Name)
+	return nil
+}
+
+func updateSensor(ctx context.Context, coll *mongo.Collection, id string, set bson.M) error {
+	res, err := coll.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": set})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return fmt.Errorf("no sensor %q registered", id)
+	}
+	log.Printf("Updated sensor %s", id)
+	return nil
+}
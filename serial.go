@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// runIngestSerial reads line-delimited readings from a serial device,
+// such as a microcontroller wired to a DHT22 or SHT31, and stores them.
+func runIngestSerial(args []string) error {
+	fs := flag.NewFlagSet("ingest serial", flag.ExitOnError)
+	device := fs.String("device", envOr("SERIAL_DEVICE", "/dev/ttyUSB0"), "serial device to read")
+	baud := fs.Int("baud", 9600, "baud rate")
+	format := fs.String("format", "json", "line format: json, csv (temperature,humidity[,sensorId]) or kv (t=21.5 h=40)")
+	sensorID := fs.String("sensor", "", "sensor ID for lines that don't name one")
+	batchSize := fs.Int("batch-size", 100, "readings per insert")
+	flushInterval := fs.Duration("flush-interval", 30*time.Second, "maximum time a reading waits before being inserted")
+	walDir := fs.String("wal", os.Getenv("INGEST_WAL_DIR"), "directory of a write-ahead log keeping readings until they are inserted, across restarts (disabled when empty)")
+	parseModeFlag := parseModeFlags(fs)
+	fs.Parse(args)
+	mode, err := parseModeFlag()
+	if err != nil {
+		return err
+	}
+
+	switch *format {
+	case "json", "csv", "kv":
+	default:
+		return fmt.Errorf("unknown format %q (expected json, csv or kv)", *format)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	connectCtx, cancel := context.WithTimeout(ctx, mongoTimeouts.connect)
+	client, err := connectMongo(connectCtx, "")
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := mongoClients.release(context.Background(), client); err != nil {
+			log.Print(err)
+		}
+	}()
+
+	store, err := openReadingStore(ctx, client)
+	if err != nil {
+		return err
+	}
+	defer store.close()
+
+	writer := newBatchWriter(store, *batchSize, *flushInterval)
+	if *walDir != "" {
+		if writer.wal, err = openWAL(*walDir); err != nil {
+			return fmt.Errorf("-wal: %w", err)
+		}
+		defer writer.wal.close()
+	}
+	go writer.run(ctx)
+
+	// In strict mode the first malformed line stops ingestion
+	var malformed error
+	// Keep reopening the device, e.g. after the USB adapter is replugged
+	for ctx.Err() == nil {
+		err := readSerial(ctx, *device, *baud, func(line string) {
+			if malformed != nil {
+				return
+			}
+			r, warnings, err := parseSerialLine(*format, line, time.Now(), mode)
+			if err != nil {
+				if mode == parseStrict {
+					malformed = fmt.Errorf("malformed line %q: %w", line, err)
+					stop()
+					return
+				}
+				log.Printf("Ignoring line %q: %v", line, err)
+				return
+			}
+			for _, w := range warnings {
+				log.Printf("Line %q: %s", line, w)
+			}
+			if r.SensorID == "" {
+				r.SensorID = *sensorID
+			}
+			writer.add(r)
+		})
+		if ctx.Err() != nil {
+			break
+		}
+		log.Printf("Serial device %s: %v (reopening in 5s)", *device, err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(5 * time.Second):
+		}
+	}
+
+	<-writer.stopped
+	return malformed
+}
+
+// readSerial opens the device and calls handle for each non-empty line
+// until reading fails or ctx is done.
+func readSerial(ctx context.Context, device string, baud int, handle func(string)) error {
+	port, err := serial.Open(device, &serial.Mode{BaudRate: baud})
+	if err != nil {
+		return err
+	}
+	// Closing the port unblocks the pending read on shutdown
+	stop := context.AfterFunc(ctx, func() { port.Close() })
+	defer stop()
+	defer port.Close()
+	log.Printf("Reading %s at %d baud", device, baud)
+
+	sc := bufio.NewScanner(port)
+	for sc.Scan() {
+		if line := strings.TrimSpace(sc.Text()); line != "" {
+			handle(line)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	return errors.New("device closed")
+}
+
+// parseSerialLine decodes one line in the given format, returning any
+// lenient coercions as warnings.
+func parseSerialLine(format, line string, now time.Time, mode parseMode) (reading, []string, error) {
+	var p readingPayload
+	var warnings []string
+	number := func(name, v string) (float64, error) {
+		f, warning, err := mode.number(v)
+		if warning != "" {
+			warnings = append(warnings, name+": "+warning)
+		}
+		return f, err
+	}
+	switch format {
+	case "json":
+		var err error
+		if p, warnings, err = mode.decodePayload([]byte(line)); err != nil {
+			return reading{}, warnings, err
+		}
+	case "csv":
+		fields := strings.Split(line, ",")
+		if len(fields) < 2 {
+			return reading{}, nil, errors.New("want temperature,humidity[,sensorId]")
+		}
+		t, err := number("temperature", fields[0])
+		if err != nil {
+			return reading{}, warnings, err
+		}
+		h, err := number("humidity", fields[1])
+		if err != nil {
+			return reading{}, warnings, err
+		}
+		p.Temperature, p.Humidity = &t, &h
+		if len(fields) > 2 {
+			p.SensorID = strings.TrimSpace(fields[2])
+		}
+	case "kv":
+		// Accept "t=21.5 h=40", "temp:21.5,hum:40" and similar
+		for _, field := range strings.FieldsFunc(line, func(r rune) bool { return r == ' ' || r == ',' || r == ';' }) {
+			k, v, ok := strings.Cut(field, "=")
+			if !ok {
+				k, v, ok = strings.Cut(field, ":")
+			}
+			if !ok {
+				continue
+			}
+			k = strings.ToLower(strings.TrimSpace(k))
+			switch k {
+			case "t", "temp", "temperature", "h", "hum", "humidity":
+				f, err := number(k, v)
+				if err != nil {
+					return reading{}, warnings, fmt.Errorf("%s: %w", k, err)
+				}
+				if k[0] == 't' {
+					p.Temperature = &f
+				} else {
+					p.Humidity = &f
+				}
+			case "co2":
+				f, err := number(k, v)
+				if err != nil {
+					return reading{}, warnings, fmt.Errorf("%s: %w", k, err)
+				}
+				p.CO2 = &f
+			case "p", "pressure", "hpa":
+				f, err := number(k, v)
+				if err != nil {
+					return reading{}, warnings, fmt.Errorf("%s: %w", k, err)
+				}
+				p.Pressure = &f
+			case "id", "sensor", "sensorid":
+				p.SensorID = strings.TrimSpace(v)
+			}
+		}
+	}
+	r, err := p.reading(now)
+	return r, warnings, err
+}
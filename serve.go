@@ -0,0 +1,454 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// server holds the state shared by the HTTP handlers.
+type server struct {
+	client *mongo.Client
+	store  readingStore
+	live   *liveHub
+
+	// Sensor registry
+	sensors *mongo.Collection
+
+	// Archived and registered legacy ranges
+	cold  *coldStore
+	tiers *mongo.Collection
+
+	// Keys accepted by the write API
+	apiKeys []string
+	// Enrolled devices, with credentials of their own, and the tokens
+	// they enroll with
+	devices      *mongo.Collection
+	provisioning *mongo.Collection
+	firmware     *firmwareRecorder
+
+	// Pre-signed bulk uploads
+	uploads   *mongo.Collection
+	rejects   *mongo.Collection
+	uploadKey []byte
+	uploadDir string
+	templates *mongo.Collection
+	// weighting is how buckets are averaged, weightingSample or
+	// weightingTime
+	weighting string
+	// rounding is how reports print their averages
+	rounding outputRounding
+	// alerts holds the latest alerts sent, for the status page
+	alerts *alertLog
+	// proxies are the reverse proxies whose forwarding headers tell the
+	// client's address
+	proxies trustedProxies
+	// audit records every call of the write API
+	audit *mongo.Collection
+	// publicPages serves the pages for displays, and the charts they
+	// show, without an API key
+	publicPages bool
+	// background is done when the server stops, which stops the uploads
+	// being processed that uploading tracks
+	background context.Context
+	uploading  sync.WaitGroup
+}
+
+// runServe starts the HTTP server and blocks until it is interrupted.
+func runServe(args []string) error {
+	publicDefault, err := envFlag("PUBLIC_PAGES")
+	if err != nil {
+		return err
+	}
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fs.String("addr", envOr("LISTEN_ADDR", ":8080"), "address to listen on")
+	grpcAddr := fs.String("grpc-addr", os.Getenv("GRPC_ADDR"), "address for the gRPC service (disabled when empty)")
+	stormDrop := fs.Float64("storm-drop", 0, "warn when a sensor's pressure falls this many hPa in 3 hours (disabled when 0)")
+	stormWebhook := fs.String("storm-webhook", os.Getenv("STORM_WEBHOOK"), "URL to post storm warnings to as JSON")
+	alertWebhook := fs.String("alert-webhook", os.Getenv("ALERT_WEBHOOK"), "URL to post alerts to as JSON")
+	alertSlack := fs.String("alert-slack", os.Getenv("ALERT_SLACK_WEBHOOK"), "Slack incoming webhook URL to post alerts to")
+	alertDiscord := fs.String("alert-discord", os.Getenv("ALERT_DISCORD_WEBHOOK"), "Discord webhook URL to post alerts to")
+	telegramToken := fs.String("telegram-token", os.Getenv("TELEGRAM_BOT_TOKEN"), "Telegram bot token, to send alerts to and answer /now and /yesterday in -telegram-chats")
+	telegramChats := fs.String("telegram-chats", os.Getenv("TELEGRAM_CHAT_IDS"), "comma-separated Telegram chat IDs the bot talks to")
+	alertPagerDuty := fs.String("alert-pagerduty", os.Getenv("PAGERDUTY_ROUTING_KEY"), "PagerDuty Events API v2 routing key to page with")
+	alertOpsgenie := fs.String("alert-opsgenie", os.Getenv("OPSGENIE_API_KEY"), "Opsgenie API integration key to page with")
+	alertOpsgenieAPI := fs.String("alert-opsgenie-api", envOr("OPSGENIE_API_URL", opsgenieAPI), "Opsgenie API URL, e.g. https://api.eu.opsgenie.com in the EU")
+	alertPageSeverity := fs.String("alert-page-severity", severityCritical, "least severe rule that pages PagerDuty and Opsgenie: critical, error, warning or info")
+	alertStaleAfter := fs.Duration("alert-stale-after", 0, "alert when a registered sensor hasn't reported for this long (disabled when 0)")
+	alertStaleSeverity := fs.String("alert-stale-severity", severityWarning, "severity of stale alerts")
+	alertTemplate := fs.String("alert-template", os.Getenv("ALERT_TEMPLATE"), "Go template for alert messages of rules without their own")
+	alertChartURL := fs.String("alert-chart-url", os.Getenv("ALERT_CHART_URL"), "chart link for alert messages, with {sensor}, {from} and {to} placeholders (default: this server's chart of the sensor)")
+	alertCooldown := fs.Duration("alert-cooldown", 0, "how long alerts stay quiet after resolving, for rules without their own cooldown")
+	publicURL := fs.String("public-url", os.Getenv("PUBLIC_URL"), "URL this server is reached at, for links in alerts")
+	weighting := fs.String("weighting", envOr("AVERAGE_WEIGHTING", weightingSample), "how chart, Grafana and gRPC buckets are averaged: sample or time")
+	precision := fs.String("precision", "", "decimals per column of HTML, PDF and XLSX reports, as for export (default temperature=2,humidity=2,co2=0,pressure=1)")
+	roundingMode := fs.String("rounding", roundHalfUp, "how report ties are rounded: half-up (away from zero) or half-even (banker's)")
+	retentionDays := fs.Int("retention-days", 0, "hourly, roll raw readings older than this many days into hourly summaries (disabled when 0)")
+	retentionDailyAfter := fs.Int("retention-daily-after", 0, "with -retention-days, roll hourly summaries older than this many days into daily ones (disabled when 0)")
+	percentilesEvery := fs.Duration("alert-percentiles-every", 24*time.Hour, "how often to work out each sensor's percentiles for alert conditions (disabled when 0)")
+	percentileDays := fs.Int("alert-percentile-days", 365, "work percentiles out from this many days of history")
+	baselinesEvery := fs.Duration("baselines-every", 24*time.Hour, "how often to work out each sensor's seasonal baselines (disabled when 0)")
+	baselineYears := fs.Int("baseline-years", 3, "work seasonal baselines out from this many years of history")
+	createIndexes := fs.Bool("create-indexes", false, "create missing indexes of the readings first, with the READINGS_TTL expiry (see ensure-indexes)")
+	cluster := fs.String("cluster", "", "cluster from CLUSTERS_FILE to serve, or a MongoDB URI (default MONGO_CLUSTER, or MONGO_URI)")
+	trusted := fs.String("trusted-proxies", os.Getenv("TRUSTED_PROXIES"), "comma-separated addresses and CIDRs of reverse proxies whose X-Forwarded-For and X-Real-IP are believed")
+	publicPages := fs.Bool("public-pages", publicDefault, "serve the embedded charts, status page and e-ink data to anyone, without an API key")
+	fs.Parse(args)
+	if err := checkWeighting(*weighting); err != nil {
+		return fmt.Errorf("-weighting: %w", err)
+	}
+	rounding, err := parseRounding(*precision, *roundingMode)
+	if err != nil {
+		return err
+	}
+	proxies, err := parseTrustedProxies(*trusted)
+	if err != nil {
+		return fmt.Errorf("-trusted-proxies: %w", err)
+	}
+	alertTmpl, err := parseAlertTemplate(*alertTemplate)
+	if err != nil {
+		return fmt.Errorf("-alert-template: %w", err)
+	}
+	pagers, err := pagingNotifiers(*alertPagerDuty, *alertOpsgenie, *alertOpsgenieAPI, *alertPageSeverity)
+	if err != nil {
+		return fmt.Errorf("-alert-page-severity: %w", err)
+	}
+	if err := checkSeverity(*alertStaleSeverity); err != nil {
+		return fmt.Errorf("-alert-stale-severity: %w", err)
+	}
+
+	// Stop serving on Ctrl-C or when the service manager asks us to
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	connectCtx, cancel := context.WithTimeout(ctx, mongoTimeouts.connect)
+	client, err := connectMongo(connectCtx, *cluster)
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := mongoClients.release(context.Background(), client); err != nil {
+			log.Print(err)
+		}
+	}()
+	if *createIndexes {
+		if err := ensureIndexes(ctx, client, readingsTTL()); err != nil {
+			return err
+		}
+	}
+
+	store, err := openReadingStore(ctx, client)
+	if err != nil {
+		return err
+	}
+	defer store.close()
+	cold, err := newColdStore()
+	if err != nil {
+		return err
+	}
+
+	s := &server{
+		client:  client,
+		store:   store,
+		live:    newLiveHub(),
+		sensors: sensorRegistry(client),
+		cold:    cold,
+		tiers:   client.Database(readingsDatabase).Collection(tiersCollection),
+		apiKeys: apiKeys(),
+
+		devices:      deviceRegistry(client),
+		provisioning: provisioningTokens(client),
+		firmware:     newFirmwareRecorder(deviceRegistry(client)),
+
+		uploads:   client.Database(readingsDatabase).Collection(uploadsCollection),
+		rejects:   client.Database(readingsDatabase).Collection(rejectsCollection),
+		uploadKey: uploadSigningKey(),
+		uploadDir: envOr("UPLOAD_DIR", cacheDir("uploads")),
+		templates: importTemplates(client),
+		weighting: *weighting,
+		rounding:  rounding,
+		alerts:    newAlertLog(),
+		proxies:   proxies,
+		audit:     auditTrail(client),
+
+		publicPages: *publicPages,
+
+		background: ctx,
+	}
+	if len(s.apiKeys) == 0 {
+		log.Println("API_KEYS not set; only enrolled devices can use the write and read APIs")
+	}
+	if s.publicPages {
+		log.Println("Serving charts, the status page and e-ink data to anyone, without an API key")
+	}
+	if err := s.failInterruptedUploads(ctx); err != nil {
+		log.Printf("Error checking for interrupted uploads: %v", err)
+	}
+	go s.live.run(ctx, s.store)
+	go mongoClients.monitor(ctx, time.Minute)
+	if *stormDrop > 0 {
+		watch := &stormWatch{
+			readings: s.store,
+			sensors:  s.sensors,
+			drop:     *stormDrop,
+			webhook:  *stormWebhook,
+			http:     &http.Client{Timeout: 10 * time.Second},
+			warned:   map[string]bool{},
+		}
+		go watch.run(ctx, s.live)
+	}
+	alerts := &alertEngine{
+		readings:   s.store,
+		rules:      alertRules(client),
+		sensors:    s.sensors,
+		notifiers:  append(alertNotifiers(*alertWebhook, *alertSlack, *alertDiscord), pagers...),
+		http:       &http.Client{Timeout: 10 * time.Second},
+		state:      map[alertKey]*alertState{},
+		latest:     map[string]reading{},
+		template:   alertTmpl,
+		chartURL:   *alertChartURL,
+		charts:     s,
+		cooldown:   *alertCooldown,
+		staleAfter: *alertStaleAfter,
+		staleLevel: *alertStaleSeverity,
+		recent:     s.alerts,
+	}
+	if *telegramToken != "" {
+		bot, err := newTelegramBot(*telegramToken, *telegramChats, s)
+		if err != nil {
+			return fmt.Errorf("-telegram-chats: %w", err)
+		}
+		alerts.notifiers = append(alerts.notifiers, bot.notifiers()...)
+		go bot.run(ctx)
+	}
+	if alerts.chartURL == "" && *publicURL != "" {
+		alerts.chartURL = strings.TrimSuffix(*publicURL, "/") + "/api/sensors/{sensor}/chart.png?from={from}&to={to}"
+	}
+	go alerts.run(ctx, s.live)
+	if *percentilesEvery > 0 {
+		job := &percentileJob{client: client, store: store, cold: cold, days: *percentileDays}
+		go job.runEvery(ctx, *percentilesEvery)
+	}
+	if *baselinesEvery > 0 {
+		job := &baselineJob{client: client, store: store, cold: cold, years: *baselineYears}
+		go job.runEvery(ctx, *baselinesEvery)
+	}
+	if *retentionDays > 0 {
+		job, err := newRetentionJob(client, store, *retentionDays, *retentionDailyAfter)
+		if err != nil {
+			return fmt.Errorf("-retention-days: %w", err)
+		}
+		go job.runEvery(ctx, time.Hour)
+	}
+
+	// Listen on both ports before serving either, so that one failing
+	// doesn't leave the other serving
+	srv := &http.Server{Addr: *addr, Handler: s.routes()}
+	lis, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return err
+	}
+	var grpcLis net.Listener
+	if *grpcAddr != "" {
+		if grpcLis, err = net.Listen("tcp", *grpcAddr); err != nil {
+			lis.Close()
+			return err
+		}
+	}
+
+	errc := make(chan error, 2)
+	go func() {
+		log.Printf("Listening on %s", *addr)
+		errc <- srv.Serve(lis)
+	}()
+	if grpcLis != nil {
+		gs := s.newGRPCServer()
+		defer gs.GracefulStop()
+		go func() {
+			log.Printf("gRPC listening on %s", *grpcAddr)
+			errc <- gs.Serve(grpcLis)
+		}()
+	}
+
+	// Tell systemd we're up once both servers listen, and keep its
+	// watchdog fed while HTTP answers
+	if err := sdNotify("READY=1\nSTATUS=Listening on " + lis.Addr().String()); err != nil {
+		log.Print(err)
+	}
+	if interval := watchdogInterval(); interval > 0 {
+		go runWatchdog(ctx, interval, lis.Addr())
+	}
+
+	select {
+	case err := <-errc:
+		// Either server stopping stops both; gRPC's on return
+		srv.Close()
+		return err
+	case <-ctx.Done():
+	}
+	if err := sdNotify("STOPPING=1"); err != nil {
+		log.Print(err)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	// Uploads stop after the batch they are on, and record that they
+	// were interrupted
+	uploaded := make(chan struct{})
+	go func() {
+		s.uploading.Wait()
+		close(uploaded)
+	}()
+	select {
+	case <-uploaded:
+	case <-shutdownCtx.Done():
+		log.Print("Stopped without waiting any longer for uploads to finish")
+	}
+	return nil
+}
+
+// routes registers every endpoint served in serve mode.
+func (s *server) routes() http.Handler {
+	mux := http.NewServeMux()
+
+	// Readings are only served for an API key with the read scope, so
+	// that share links are the way to show them to anyone else. The
+	// pages for displays, which can't send a key, are served to anyone
+	// only when -public-pages says so.
+	read := func(h http.HandlerFunc) http.Handler {
+		return s.requireAPIKey(scopeRead, h)
+	}
+	page := func(h http.HandlerFunc) http.Handler {
+		if s.publicPages {
+			return h
+		}
+		return read(h)
+	}
+
+	// Grafana simple-JSON datasource contract; its connection test
+	// needs no key
+	mux.HandleFunc("GET /{$}", s.handleHealth)
+	mux.Handle("POST /search", read(s.handleGrafanaSearch))
+	mux.Handle("POST /query", read(s.handleGrafanaQuery))
+	mux.Handle("POST /annotations", read(s.handleGrafanaAnnotations))
+
+	// Live stream of new readings
+	mux.Handle("GET /ws/live", read(s.handleLiveWS))
+	mux.Handle("GET /events", read(s.handleEvents))
+
+	// Read API
+	mux.Handle("GET /api/sensors", read(s.handleSensors))
+	mux.Handle("GET /api/sensors/{id}/chart.png", page(s.handleSensorChart))
+	mux.Handle("GET /api/sensors/{id}/resample", read(s.handleResample))
+	mux.Handle("GET /embed/{id}", page(s.handleEmbed))
+	mux.Handle("GET /status", page(s.handleStatus))
+	mux.Handle("GET /status.json", page(s.handleStatusJSON))
+	mux.Handle("GET /api/eink", page(s.handleEink))
+
+	// Database health and connection pool metrics
+	mux.HandleFunc("GET /api/health", s.handleDatabaseHealth)
+	mux.HandleFunc("GET /metrics", s.handleMetrics)
+
+	// Flow API for Node-RED and n8n, described by the OpenAPI spec
+	mux.HandleFunc("GET /api/openapi.json", s.handleOpenAPI)
+	mux.Handle("GET /api/flow/latest", read(s.handleFlowLatest))
+	mux.Handle("GET /api/flow/stats", read(s.handleFlowStats))
+	mux.Handle("POST /api/flow/readings", s.audited("flow readings", s.requireAPIKey(scopeIngest, http.HandlerFunc(s.handleFlowReadings))))
+
+	// Write API, whose calls are audited
+	mux.Handle("POST /api/readings", s.audited("ingest readings", s.requireAPIKey(scopeIngest, http.HandlerFunc(s.handleIngest))))
+	mux.Handle("POST /api/uploads", s.audited("create upload", s.requireAPIKey(scopeIngest, http.HandlerFunc(s.handleCreateUpload))))
+	mux.Handle("GET /api/uploads/{id}", s.requireAPIKey(scopeIngest, http.HandlerFunc(s.handleUploadStatus)))
+	mux.Handle("GET /api/uploads/{id}/rejects", s.requireAPIKey(scopeIngest, http.HandlerFunc(s.handleUploadRejects)))
+	mux.Handle("GET /api/reports", s.requireAPIKey(scopeRead, http.HandlerFunc(s.handleReport)))
+	// Authorised by the URL signature instead of an API key
+	mux.Handle("PUT /api/uploads/{id}/data", s.audited("upload data", http.HandlerFunc(s.handleUploadData)))
+	// Authorised by the one-time provisioning token in the body
+	mux.Handle("POST /api/devices/enroll", s.audited("enroll device", http.HandlerFunc(s.handleEnroll)))
+	// Authorised by the share link's token in the path
+	mux.HandleFunc("GET /share/{token}", s.handleShare)
+	mux.HandleFunc("GET /share/{token}/chart.png", s.handleShareChart)
+	mux.HandleFunc("GET /share/{token}/report", s.handleShareReport)
+
+	return s.proxies.realIP(mux)
+}
+
+func (s *server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleDatabaseHealth pings each MongoDB cluster in use and reports
+// its connection pool, with 503 if any doesn't answer, for readiness
+// probes.
+func (s *server) handleDatabaseHealth(w http.ResponseWriter, r *http.Request) {
+	clients := mongoClients.health(r.Context())
+	status := http.StatusOK
+	for _, c := range clients {
+		if !c.OK {
+			status = http.StatusServiceUnavailable
+		}
+	}
+	writeJSON(w, status, map[string]any{"mongodb": clients})
+}
+
+// handleMetrics reports the MongoDB connection pools in the Prometheus
+// text format.
+func (s *server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	clients := mongoClients.health(r.Context())
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics := []struct {
+		name, kind, help string
+		value            func(clientHealth) float64
+	}{
+		{"temphums_mongo_up", "gauge", "Whether the cluster answered a ping.", func(c clientHealth) float64 {
+			if c.OK {
+				return 1
+			}
+			return 0
+		}},
+		{"temphums_mongo_ping_seconds", "gauge", "How long the primary took to answer a ping.", func(c clientHealth) float64 { return c.PingMillis / 1000 }},
+		{"temphums_mongo_pool_open_connections", "gauge", "Connections in the pool.", func(c clientHealth) float64 { return float64(c.Open) }},
+		{"temphums_mongo_pool_in_use_connections", "gauge", "Connections checked out of the pool.", func(c clientHealth) float64 { return float64(c.InUse) }},
+		{"temphums_mongo_pool_checkouts_total", "counter", "Connections checked out.", func(c clientHealth) float64 { return float64(c.Checkouts) }},
+		{"temphums_mongo_pool_checkout_failures_total", "counter", "Failed connection checkouts.", func(c clientHealth) float64 { return float64(c.CheckoutFailures) }},
+		{"temphums_mongo_pool_connections_created_total", "counter", "Connections opened.", func(c clientHealth) float64 { return float64(c.Created) }},
+		{"temphums_mongo_pool_clears_total", "counter", "Times the pool was cleared after an error.", func(c clientHealth) float64 { return float64(c.PoolClears) }},
+	}
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+		for _, c := range clients {
+			fmt.Fprintf(w, "%s{cluster=%q} %g\n", m.name, c.Cluster, m.value(c))
+		}
+	}
+}
+
+// writeJSON encodes v as the JSON response body.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
+
+// writeError reports err to the client as a JSON error object.
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// sharesCollection holds the read-only links to a range of some sensors'
+// readings, for people without an API key.
+const sharesCollection = "shares"
+
+var errShareGone = errors.New("share link is invalid, revoked or expired")
+
+// shareIDLength is how many characters of a link's hash identify it to
+// shares list and revoke, so the token itself needn't be kept.
+const shareIDLength = 12
+
+// shareLink is a read-only link to a report and charts of some sensors
+// over [From, To). It is stored by the hash of its token, which is the
+// link's only authorisation, and lapses at ExpiresAt.
+type shareLink struct {
+	Hash      string     `bson:"_id"`
+	Label     string     `bson:"label,omitempty"`
+	Sensors   []string   `bson:"sensors"`
+	From      time.Time  `bson:"from"`
+	To        time.Time  `bson:"to"`
+	CreatedAt time.Time  `bson:"createdAt"`
+	ExpiresAt time.Time  `bson:"expiresAt"`
+	RevokedAt *time.Time `bson:"revokedAt,omitempty"`
+}
+
+// id is how shares list and revoke name the link.
+func (l *shareLink) id() string {
+	return l.Hash[:shareIDLength]
+}
+
+func shareLinks(client *mongo.Client) *mongo.Collection {
+	return client.Database(readingsDatabase).Collection(sharesCollection)
+}
+
+// ensureShareIndexes lets MongoDB delete share links once they lapse.
+func ensureShareIndexes(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection(sharesCollection).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		return fmt.Errorf("indexing %s: %w", sharesCollection, err)
+	}
+	return nil
+}
+
+// shareByToken returns the active share link whose token is token.
+// MongoDB deletes expired links only once a minute, so expiry is checked
+// here too.
+func (s *server) shareByToken(ctx context.Context, token string) (*shareLink, error) {
+	var l shareLink
+	err := shareLinks(s.client).FindOne(ctx, bson.M{
+		"_id":       hashSecret(token),
+		"revokedAt": bson.M{"$exists": false},
+		"expiresAt": bson.M{"$gt": time.Now()},
+	}).Decode(&l)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, errShareGone
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// sharedRequest looks up the share link of the request's token and
+// sets the headers every shared response has: the token is in the URL,
+// so it mustn't leak through the Referer or search engines. It writes
+// the error and returns nil when the link can't be used.
+func (s *server) sharedRequest(w http.ResponseWriter, r *http.Request) *shareLink {
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("X-Robots-Tag", "noindex, nofollow")
+	w.Header().Set("Cache-Control", "private, no-store")
+	l, err := s.shareByToken(r.Context(), r.PathValue("token"))
+	if errors.Is(err, errShareGone) {
+		writeError(w, http.StatusNotFound, err)
+		return nil
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return nil
+	}
+	return l
+}
+
+// sharedReport builds the report of a share link, with its anomalies,
+// limited to its sensors.
+func (s *server) sharedReport(ctx context.Context, l *shareLink) (*report, error) {
+	rep, err := buildReport(ctx, s.client, s.store, s.cold, l.From, l.To, l.Sensors, "sensor", s.weighting, true, nil)
+	if err != nil {
+		return nil, err
+	}
+	rep.rnd = s.rounding
+	return rep, nil
+}
+
+// handleShare serves the page of a share link: a chart of each sensor
+// over the range, its hourly averages and anomalies, and links to
+// download the report.
+func (s *server) handleShare(w http.ResponseWriter, r *http.Request) {
+	l := s.sharedRequest(w, r)
+	if l == nil {
+		return
+	}
+	rep, err := s.sharedReport(r.Context(), l)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	// Relative to the page, so the links work behind any proxy
+	base := url.PathEscape(r.PathValue("token"))
+	rep.label = l.Label
+	for _, sensor := range l.Sensors {
+		rep.charts = append(rep.charts, reportLink{
+			Name: sensorName(rep.registry, sensor),
+			URL:  base + "/chart.png?sensor=" + url.QueryEscape(sensor),
+		})
+	}
+	for _, format := range []string{"pdf", "xlsx"} {
+		rep.downloads = append(rep.downloads, reportLink{Name: strings.ToUpper(format), URL: base + "/report?format=" + format})
+	}
+	body, err := rep.html()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", reportFormats["html"])
+	w.Write(body)
+}
+
+// handleShareChart serves the chart of one of a share link's sensors
+// over its range.
+func (s *server) handleShareChart(w http.ResponseWriter, r *http.Request) {
+	l := s.sharedRequest(w, r)
+	if l == nil {
+		return
+	}
+	sensor := r.URL.Query().Get("sensor")
+	if !slices.Contains(l.Sensors, sensor) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("sensor %q isn't shared", sensor))
+		return
+	}
+	data, err := s.sensorChart(r.Context(), sensor, l.From, l.To)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(data)
+}
+
+// handleShareReport serves the report of a share link as html, pdf or
+// xlsx, as the reports API does.
+func (s *server) handleShareReport(w http.ResponseWriter, r *http.Request) {
+	l := s.sharedRequest(w, r)
+	if l == nil {
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "html"
+	}
+	contentType, ok := reportFormats[format]
+	if !ok {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unknown format %q (expected html, pdf or xlsx)", format))
+		return
+	}
+	rep, err := s.sharedReport(r.Context(), l)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	rep.label = l.Label
+	var body []byte
+	switch format {
+	case "html":
+		body, err = rep.html()
+	case "pdf":
+		body, err = rep.pdf()
+	case "xlsx":
+		body, err = rep.xlsx()
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	name := "temphums-" + rep.from.In(rep.loc).Format(time.DateOnly)
+	if last := l.To.AddDate(0, 0, -1).In(rep.loc); last.After(l.From) {
+		name += "-to-" + last.Format(time.DateOnly)
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+"."+format))
+	w.Write(body)
+}
+
+// runShares manages share links.
+func runShares(args []string) (err error) {
+	if len(args) == 0 {
+		return usageError("usage: shares create|list|revoke [flags]")
+	}
+
+	ctx, stop := commandContext()
+	defer stop()
+	connectCtx, cancel := context.WithTimeout(ctx, mongoTimeouts.connect)
+	client, err := connectMongo(connectCtx, "")
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if rerr := mongoClients.release(ctx, client); err == nil {
+			err = rerr
+		}
+	}()
+
+	switch args[0] {
+	case "create":
+		return createShareLink(ctx, client, args[1:])
+	case "list":
+		return listShareLinks(ctx, shareLinks(client), args[1:])
+	case "revoke":
+		if len(args) != 2 || !shareID.MatchString(args[1]) {
+			return usageError("usage: shares revoke ID")
+		}
+		res, err := shareLinks(client).UpdateOne(ctx,
+			bson.M{"_id": bson.M{"$regex": "^" + args[1]}, "revokedAt": bson.M{"$exists": false}},
+			bson.M{"$set": bson.M{"revokedAt": time.Now()}})
+		if err != nil {
+			return err
+		}
+		if res.MatchedCount == 0 {
+			return fmt.Errorf("no active share link %q", args[1])
+		}
+		log.Printf("Revoked share link %s", args[1])
+		return nil
+	default:
+		return usageError(fmt.Sprintf("unknown shares command %q (expected create, list or revoke)", args[0]))
+	}
+}
+
+// shareID matches the IDs shares list shows.
+var shareID = regexp.MustCompile(fmt.Sprintf("^[0-9a-f]{%d}$", shareIDLength))
+
+// createShareLink issues a share link and prints its URL, the only time
+// the token is shown.
+func createShareLink(ctx context.Context, client *mongo.Client, args []string) error {
+	fs := flag.NewFlagSet("shares create", flag.ExitOnError)
+	sensorList := fs.String("sensor", "", "comma-separated sensor IDs to share (required)")
+	start := fs.String("start", "", "share from this date, YYYY-MM-DD (default 7 days ago)")
+	end := fs.String("end", "", "share up to this date, YYYY-MM-DD, exclusive (default today)")
+	expires := fs.Duration("expires", 30*24*time.Hour, "how long the link works")
+	label := fs.String("label", "", "heading of the shared page, such as what it shows")
+	publicURL := fs.String("public-url", os.Getenv("PUBLIC_URL"), "URL the server is reached at, for the link")
+	fs.Parse(args)
+
+	sensors := splitList(*sensorList)
+	if len(sensors) == 0 {
+		return errors.New("-sensor is required")
+	}
+	if *expires <= 0 {
+		return errors.New("-expires must be positive")
+	}
+	loc, err := time.LoadLocation(reportTimezone)
+	if err != nil {
+		return err
+	}
+	now := time.Now().In(loc)
+	to := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	from := to.AddDate(0, 0, -7)
+	if *start != "" {
+		if from, err = time.ParseInLocation(time.DateOnly, *start, loc); err != nil {
+			return fmt.Errorf("-start: %w", err)
+		}
+	}
+	if *end != "" {
+		if to, err = time.ParseInLocation(time.DateOnly, *end, loc); err != nil {
+			return fmt.Errorf("-end: %w", err)
+		}
+	}
+	if !to.After(from) {
+		return errors.New("-end must be after -start")
+	}
+	// Shared pages are reports, with their limit
+	if to.After(from.AddDate(0, 0, maxReportDays)) {
+		return fmt.Errorf("share links cover at most %d days", maxReportDays)
+	}
+
+	registry, err := loadSensors(ctx, sensorRegistry(client))
+	if err != nil {
+		return err
+	}
+	for _, sensor := range sensors {
+		if _, ok := registry[sensor]; !ok && len(registry) > 0 {
+			log.Printf("Sensor %s isn't registered; sharing it anyway", sensor)
+		}
+	}
+	if err := ensureShareIndexes(ctx, client.Database(readingsDatabase)); err != nil {
+		return err
+	}
+	token, err := newSecret()
+	if err != nil {
+		return err
+	}
+	l := shareLink{
+		Hash:      hashSecret(token),
+		Label:     *label,
+		Sensors:   sensors,
+		From:      from,
+		To:        to,
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(*expires),
+	}
+	if _, err := shareLinks(client).InsertOne(ctx, l); err != nil {
+		return err
+	}
+	log.Printf("Share link %s valid until %s", l.id(), l.ExpiresAt.In(loc).Format(time.DateTime))
+	if *publicURL == "" {
+		log.Printf("PUBLIC_URL isn't set; prefix the path with the server's URL")
+	}
+	fmt.Println(strings.TrimRight(*publicURL, "/") + "/share/" + token)
+	return nil
+}
+
+func listShareLinks(ctx context.Context, coll *mongo.Collection, args []string) error {
+	fs := flag.NewFlagSet("shares list", flag.ExitOnError)
+	all := fs.Bool("all", false, "include revoked and expired links")
+	fs.Parse(args)
+
+	filter := bson.M{}
+	if !*all {
+		filter["revokedAt"] = bson.M{"$exists": false}
+		filter["expiresAt"] = bson.M{"$gt": time.Now()}
+	}
+	cursor, err := coll.Find(ctx, filter, options.Find().SetSort(bson.M{"createdAt": 1}))
+	if err != nil {
+		return err
+	}
+	var list []shareLink
+	if err := cursor.All(ctx, &list); err != nil {
+		return err
+	}
+	loc, err := time.LoadLocation(reportTimezone)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tLABEL\tSENSORS\tFROM\tTO\tEXPIRES\tSTATUS")
+	for _, l := range list {
+		status := "active"
+		if l.RevokedAt != nil {
+			status = "revoked " + l.RevokedAt.In(loc).Format(time.DateOnly)
+		} else if !l.ExpiresAt.After(time.Now()) {
+			status = "expired"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			l.id(), cmp.Or(l.Label, "-"), strings.Join(l.Sensors, ","),
+			l.From.In(loc).Format(time.DateOnly), l.To.In(loc).AddDate(0, 0, -1).Format(time.DateOnly),
+			l.ExpiresAt.In(loc).Format("2006-01-02 15:04"), status)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// statusStale is how old a sensor's latest reading may be before the
+	// status page shows it as stale, as gaps does by default
+	statusStale = 15 * time.Minute
+	// statusRefresh is how often the status page reloads by default
+	statusRefresh = time.Minute
+	// statusAlertWindow is how far back the status page lists alerts by
+	// default
+	statusAlertWindow = 24 * time.Hour
+	// alertLogSize is how many of the latest alerts the server keeps
+	alertLogSize = 100
+)
+
+// alertLog keeps the latest alerts sent since the server started, for
+// the status page. A nil log keeps nothing.
+type alertLog struct {
+	mu      sync.Mutex
+	started time.Time
+	events  []alertEvent
+}
+
+func newAlertLog() *alertLog {
+	return &alertLog{started: time.Now()}
+}
+
+// add records an event, without its chart.
+func (l *alertLog) add(event alertEvent) {
+	if l == nil {
+		return
+	}
+	event.Chart = nil
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, event)
+	if len(l.events) > alertLogSize {
+		l.events = slices.Delete(l.events, 0, len(l.events)-alertLogSize)
+	}
+}
+
+// since returns the events from t on, the latest first.
+func (l *alertLog) since(t time.Time) []alertEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var out []alertEvent
+	for i := len(l.events) - 1; i >= 0 && !l.events[i].At.Before(t); i-- {
+		out = append(out, l.events[i])
+	}
+	return out
+}
+
+// firing returns the latest event of each rule and sensor that is still
+// firing, the latest first.
+func (l *alertLog) firing() []alertEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	seen := map[alertKey]bool{}
+	var out []alertEvent
+	for i := len(l.events) - 1; i >= 0; i-- {
+		e := l.events[i]
+		k := alertKey{e.Rule, e.SensorID}
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		if e.State == "firing" {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// statusSensor is a sensor's current conditions and health.
+type statusSensor struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Location string `json:"location,omitempty"`
+	// Health is ok, stale when the latest reading is older than
+	// statusStale, or offline when there is none from the last week
+	Health      string     `json:"health"`
+	Temperature *float64   `json:"temperature,omitempty"`
+	Unit        string     `json:"unit"`
+	Humidity    *float64   `json:"humidity,omitempty"`
+	CO2         *float64   `json:"co2,omitempty"`
+	Pressure    *float64   `json:"pressure,omitempty"`
+	UpdatedAt   *time.Time `json:"updated_at,omitempty"`
+	AgeSeconds  *int64     `json:"age_seconds,omitempty"`
+}
+
+// statusReport is what the status page shows.
+type statusReport struct {
+	Generated time.Time `json:"generated"`
+	// Database is false when a MongoDB cluster in use doesn't answer
+	Database bool           `json:"database_ok"`
+	Sensors  []statusSensor `json:"sensors"`
+	// Health counts the sensors by health
+	Health map[string]int `json:"health"`
+	// Firing are the alerts still firing, and Alerts those of the
+	// window, which begins no earlier than AlertsSince, when the server
+	// started
+	Firing      []alertEvent `json:"firing"`
+	Alerts      []alertEvent `json:"alerts"`
+	AlertsSince time.Time    `json:"alerts_since"`
+}
+
+// status gathers the current conditions of every registered sensor and
+// any other that reported in the last week, and the alerts of the last
+// window.
+func (s *server) status(ctx context.Context, window time.Duration) (*statusReport, error) {
+	latest, err := s.flowLatest(ctx)
+	if err != nil {
+		return nil, err
+	}
+	registry, err := loadSensors(ctx, s.sensors)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	out := &statusReport{Generated: now, Database: true, Health: map[string]int{}}
+	for _, c := range mongoClients.health(ctx) {
+		out.Database = out.Database && c.OK
+	}
+
+	reported := map[string]bool{}
+	for _, l := range latest {
+		reported[l.SensorID] = true
+		age := int64(now.Sub(l.UpdatedAt).Seconds())
+		health := "ok"
+		if now.Sub(l.UpdatedAt) > statusStale {
+			health = "stale"
+		}
+		out.Sensors = append(out.Sensors, statusSensor{
+			ID: l.SensorID, Name: l.Name, Location: l.Location, Health: health,
+			Temperature: &l.Temperature, Unit: temperatureUnit(registry, l.SensorID), Humidity: &l.Humidity,
+			CO2: l.CO2, Pressure: l.Pressure, UpdatedAt: &l.UpdatedAt, AgeSeconds: &age,
+		})
+	}
+	for id, info := range registry {
+		if reported[id] || info.RetiredAt != nil {
+			continue
+		}
+		out.Sensors = append(out.Sensors, statusSensor{
+			ID: id, Name: sensorName(registry, id), Location: info.Location, Health: "offline",
+			Unit: temperatureUnit(registry, id),
+		})
+	}
+	slices.SortFunc(out.Sensors, func(a, b statusSensor) int {
+		return cmp.Or(cmp.Compare(a.Location, b.Location), cmp.Compare(a.Name, b.Name), cmp.Compare(a.ID, b.ID))
+	})
+	for _, sensor := range out.Sensors {
+		out.Health[sensor.Health]++
+	}
+
+	out.Firing, out.Alerts = []alertEvent{}, []alertEvent{}
+	if s.alerts != nil {
+		out.AlertsSince = s.alerts.started
+		out.Firing = s.alerts.firing()
+		out.Alerts = s.alerts.since(now.Add(-window))
+	}
+	return out, nil
+}
+
+// temperatureUnit is the symbol of a sensor's temperature unit.
+func temperatureUnit(registry map[string]sensorInfo, id string) string {
+	if registry[id].TemperatureUnit == unitFahrenheit {
+		return "°F"
+	}
+	return "°C"
+}
+
+// statusWindow reads how far back to list alerts from ?alerts=.
+func statusWindow(r *http.Request) (time.Duration, error) {
+	v := r.URL.Query().Get("alerts")
+	if v == "" {
+		return statusAlertWindow, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("alerts: not a positive duration: %q", v)
+	}
+	return d, nil
+}
+
+// handleStatusJSON serves the status page's contents as JSON, for
+// displays that draw their own.
+func (s *server) handleStatusJSON(w http.ResponseWriter, r *http.Request) {
+	window, err := statusWindow(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	status, err := s.status(r.Context(), window)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+var statusHTML = template.Must(template.New("status").Funcs(template.FuncMap{
+	"age": func(seconds *int64) string {
+		if seconds == nil {
+			return "no readings this week"
+		}
+		return roughDuration(time.Duration(*seconds)*time.Second) + " ago"
+	},
+	"clock": func(t time.Time) string { return t.Format("Mon 15:04") },
+	"round": func(v *float64, places int) string { return strconv.FormatFloat(*v, 'f', places, 64) },
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+{{if .Refresh}}<meta http-equiv="refresh" content="{{.Refresh}}">
+{{end}}<title>Status</title>
+<style>
+body { font-family: sans-serif; margin: 1.5em; background: #111; color: #eee; }
+h1 { font-size: 1.4em; margin: 0 0 0.5em; }
+h2 { font-size: 1.1em; margin: 1.5em 0 0.5em; color: #aaa; }
+.sensors { display: flex; flex-wrap: wrap; gap: 1em; }
+.sensor { border-left: 0.4em solid #2a2; background: #222; padding: 0.75em 1em; min-width: 11em; }
+.sensor.stale { border-color: #da2; }
+.sensor.offline { border-color: #d33; color: #999; }
+.reading { font-size: 2.2em; }
+.small { font-size: 0.85em; color: #aaa; }
+.problem { color: #f66; }
+ul { list-style: none; padding: 0; margin: 0; }
+li { margin: 0.3em 0; }
+.firing { color: #f66; }
+.resolved { color: #8c8; }
+</style>
+</head>
+<body>
+<h1>{{.Zone}} {{clock .Local}}{{if not .Status.Database}} · <span class="problem">database not answering</span>{{end}}</h1>
+<div class="sensors">
+{{range .Status.Sensors}}<div class="sensor {{.Health}}">
+<div>{{.Name}}{{with .Location}} <span class="small">{{.}}</span>{{end}}</div>
+{{if .Temperature}}<div class="reading">{{round .Temperature 1}}{{.Unit}} {{round .Humidity 0}}%</div>
+{{end}}{{with .CO2}}<div>CO₂ {{round . 0}} ppm</div>
+{{end}}<div class="small">{{.Health}}, {{age .AgeSeconds}}</div>
+</div>
+{{end}}</div>
+{{if .Status.Firing}}<h2>Firing</h2>
+<ul>
+{{range .Status.Firing}}<li class="firing">{{.Severity}}: {{.Message}}</li>
+{{end}}</ul>
+{{end}}<h2>Alerts of the last {{.Window}}</h2>
+{{if .Status.Alerts}}<ul>
+{{range .Alerts}}<li class="{{.State}}">{{.Time}} {{.State}}: {{.Message}}</li>
+{{end}}</ul>
+{{else}}<p class="small">None{{if .Since}} since {{.Since}}{{end}}.</p>
+{{end}}</body>
+</html>
+`))
+
+// handleStatus serves a page of the current conditions and health of
+// every sensor and the recent alerts, for a wall-mounted display. It
+// reloads every refresh, 1m by default or never when 0, and lists the
+// alerts of the last alerts, 24h by default.
+func (s *server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	refresh := statusRefresh
+	if v := r.URL.Query().Get("refresh"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("refresh: not a duration: %q", v))
+			return
+		}
+		if d > 0 && d < 10*time.Second {
+			writeError(w, http.StatusBadRequest, errors.New("refresh must be at least 10s"))
+			return
+		}
+		refresh = d
+	}
+	window, err := statusWindow(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	status, err := s.status(r.Context(), window)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	loc, err := time.LoadLocation(reportTimezone)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	type alertLine struct{ Time, State, Message string }
+	data := struct {
+		Status              *statusReport
+		Zone, Window, Since string
+		Local               time.Time
+		Refresh             int
+		Alerts              []alertLine
+	}{
+		Status:  status,
+		Zone:    reportTimezone,
+		Window:  roughDuration(window),
+		Local:   status.Generated.In(loc),
+		Refresh: int(refresh.Seconds()),
+	}
+	if status.AlertsSince.After(status.Generated.Add(-window)) {
+		// The server hasn't been up for the whole window
+		data.Since = status.AlertsSince.In(loc).Format("Mon 15:04")
+	}
+	for _, e := range status.Alerts {
+		data.Alerts = append(data.Alerts, alertLine{Time: e.At.In(loc).Format("Mon 15:04"), State: e.State, Message: e.Message})
+	}
+	var buf bytes.Buffer
+	if err := statusHTML.Execute(&buf, data); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"temphums_go/pipeline"
+)
+
+// deleteBatchSize is how many readings deleteIDs deletes per request.
+const deleteBatchSize = 10000
+
+// readingStore holds the raw readings: the MongoDB readings collection,
+// or a PostgreSQL/TimescaleDB table with STORAGE=postgres. The sensor
+// registry, alert rules, tiering records and other metadata stay in
+// MongoDB either way.
+type readingStore interface {
+	// insert stores readings as they are
+	insert(ctx context.Context, rs []reading) error
+	// upsert stores r unless a reading from the same sensor at the same
+	// time already exists, which makes retried writes harmless
+	upsert(ctx context.Context, r reading) error
+	// find returns the readings in [from, to), oldest first, limited to
+	// the given sensors unless sensors is empty
+	find(ctx context.Context, from, to time.Time, sensors []string) ([]reading, error)
+	// latest returns each sensor's latest reading since the given time
+	latest(ctx context.Context, since time.Time) ([]reading, error)
+	// sensorIDs lists the sensors that have readings
+	sensorIDs(ctx context.Context) ([]string, error)
+	// intervalAverages averages calibrated readings in [from, to) over
+	// buckets of interval milliseconds aligned to the Unix epoch
+	intervalAverages(ctx context.Context, from, to time.Time, interval int64, sensors []string, cal calibration) ([]bucketAvg[int64], error)
+	// hourlyAverages averages calibrated readings in [from, to) per
+	// sensor and local hour in tz, keyed "2006-01-02 15:00:00"
+	hourlyAverages(ctx context.Context, from, to time.Time, tz string, sensors []string, cal calibration) ([]bucketAvg[string], error)
+	// oldest returns the time of the oldest reading, or zero if there
+	// are none
+	oldest(ctx context.Context) (time.Time, error)
+	// findIDs returns the readings in [from, to) as find does, with the
+	// ids deleteIDs takes to delete exactly those, and none stored since
+	findIDs(ctx context.Context, from, to time.Time) ([]reading, []any, error)
+	// deleteIDs deletes the readings of ids from findIDs
+	deleteIDs(ctx context.Context, ids []any) (int64, error)
+	// watch calls fn with each new reading until ctx is done or the
+	// stream fails
+	watch(ctx context.Context, fn func(reading)) error
+	close() error
+}
+
+// openReadingStore returns the store selected by STORAGE, mongo (the
+// default) or postgres.
+func openReadingStore(ctx context.Context, client *mongo.Client) (readingStore, error) {
+	switch storage := os.Getenv("STORAGE"); storage {
+	case "", "mongo":
+		return openMongoStore(ctx, readings(client))
+	case "postgres":
+		uri := os.Getenv("POSTGRES_URI")
+		if uri == "" {
+			return nil, configError{errors.New("POSTGRES_URI not set in environment")}
+		}
+		return openPostgresStore(ctx, uri, readingsCollection)
+	default:
+		return nil, fmt.Errorf("unknown STORAGE %q (expected mongo or postgres)", storage)
+	}
+}
+
+// mongoStore keeps readings in a MongoDB collection, a regular or a
+// time-series one.
+type mongoStore struct {
+	coll *mongo.Collection
+	// timeSeries is set for a time-series collection, which has no
+	// upserts or change streams
+	timeSeries bool
+}
+
+func (m *mongoStore) insert(ctx context.Context, rs []reading) error {
+	docs := make([]any, len(rs))
+	for i, r := range rs {
+		docs[i] = r
+	}
+	_, err := retryMongo(ctx, "insert", func(ctx context.Context, attempt int) (any, error) {
+		if attempt > 1 {
+			// Some readings may have been stored before the failure
+			return insertMissing(ctx, m.coll, rs)
+		}
+		return m.coll.InsertMany(ctx, docs)
+	})
+	return err
+}
+
+func (m *mongoStore) upsert(ctx context.Context, r reading) error {
+	if m.timeSeries {
+		_, err := insertMissing(ctx, m.coll, []reading{r})
+		return err
+	}
+	update := bson.M{"$setOnInsert": r}
+	_, err := m.coll.UpdateOne(ctx, r.key(), update, options.Update().SetUpsert(true))
+	return err
+}
+
+func (m *mongoStore) find(ctx context.Context, from, to time.Time, sensors []string) ([]reading, error) {
+	return retryMongo(ctx, "find", func(ctx context.Context, _ int) ([]reading, error) {
+		cursor, err := m.coll.Find(ctx, readingsFilter(from, to, sensors), options.Find().SetSort(bson.M{"updatedAt": 1}))
+		if err != nil {
+			return nil, err
+		}
+		var out []reading
+		err = cursor.All(ctx, &out)
+		return out, err
+	})
+}
+
+func (m *mongoStore) latest(ctx context.Context, since time.Time) ([]reading, error) {
+	type latestReading struct {
+		Reading reading `bson:"latest"`
+	}
+	latest, err := retryMongo(ctx, "aggregate", func(ctx context.Context, _ int) ([]latestReading, error) {
+		cursor, err := m.coll.Aggregate(ctx, pipeline.New().
+			Match(bson.M{"updatedAt": bson.M{"$gte": since}}).
+			Sort("updatedAt").
+			Bucket("$sensorId").
+			Stats(pipeline.Last("latest", "$$ROOT")).
+			Pipeline())
+		if err != nil {
+			return nil, err
+		}
+		var latest []latestReading
+		err = cursor.All(ctx, &latest)
+		return latest, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	out := make([]reading, len(latest))
+	for i, l := range latest {
+		out[i] = l.Reading
+	}
+	return out, nil
+}
+
+func (m *mongoStore) sensorIDs(ctx context.Context) ([]string, error) {
+	values, err := m.coll.Distinct(ctx, "sensorId", bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, v := range values {
+		if id, ok := v.(string); ok && id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (m *mongoStore) intervalAverages(ctx context.Context, from, to time.Time, interval int64, sensors []string, cal calibration) ([]bucketAvg[int64], error) {
+	return retryMongo(ctx, "aggregate", func(ctx context.Context, _ int) ([]bucketAvg[int64], error) {
+		cursor, err := m.coll.Aggregate(ctx, intervalPipeline(from, to, interval, sensors, cal))
+		if err != nil {
+			return nil, err
+		}
+		var buckets []bucketAvg[int64]
+		err = cursor.All(ctx, &buckets)
+		return buckets, err
+	})
+}
+
+// intervalPipeline is the aggregation behind intervalAverages.
+func intervalPipeline(from, to time.Time, interval int64, sensors []string, cal calibration) mongo.Pipeline {
+	// Bucket each reading by flooring its timestamp to the interval
+	return pipeline.New().
+		Match(readingsFilter(from, to, sensors)).
+		Derive(cal.fields()).
+		Bucket(pipeline.Floor(pipeline.EpochMillis("$updatedAt"), interval)).
+		Stats(bucketStats...).
+		Sort("_id").
+		Pipeline()
+}
+
+func (m *mongoStore) hourlyAverages(ctx context.Context, from, to time.Time, tz string, sensors []string, cal calibration) ([]bucketAvg[string], error) {
+	return retryMongo(ctx, "aggregate", func(ctx context.Context, _ int) ([]bucketAvg[string], error) {
+		cursor, err := m.coll.Aggregate(ctx, hourlyPipeline(from, to, tz, sensors, cal))
+		if err != nil {
+			return nil, err
+		}
+		defer cursor.Close(ctx)
+		var results []bucketAvg[string]
+		err = cursor.All(ctx, &results)
+		return results, err
+	})
+}
+
+// hourlyPipeline is the aggregation behind hourlyAverages.
+func hourlyPipeline(from, to time.Time, tz string, sensors []string, cal calibration) mongo.Pipeline {
+	return pipeline.New().
+		Match(readingsFilter(from, to, sensors)).
+		Derive(cal.fields()).
+		Bucket(bson.D{
+			{Key: "hour", Value: pipeline.DateString("%Y-%m-%d %H:00:00", "$updatedAt", tz)},
+			{Key: "sensorId", Value: "$sensorId"},
+		}).
+		Stats(bucketStats...).
+		// Flatten the key into the fields bucketAvg reads
+		Derive(bson.D{{Key: "_id", Value: "$_id.hour"}, {Key: "sensorId", Value: "$_id.sensorId"}}).
+		Sort("_id", "sensorId").
+		Pipeline()
+}
+
+func (m *mongoStore) oldest(ctx context.Context) (time.Time, error) {
+	var oldest reading
+	err := m.coll.FindOne(ctx, bson.M{}, options.FindOne().SetSort(bson.M{"updatedAt": 1})).Decode(&oldest)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return time.Time{}, nil
+	}
+	return oldest.UpdatedAt, err
+}
+
+func (m *mongoStore) findIDs(ctx context.Context, from, to time.Time) ([]reading, []any, error) {
+	type storedReading struct {
+		ID      any `bson:"_id"`
+		reading `bson:",inline"`
+	}
+	stored, err := retryMongo(ctx, "find", func(ctx context.Context, _ int) ([]storedReading, error) {
+		cursor, err := m.coll.Find(ctx, readingsFilter(from, to, nil), options.Find().SetSort(bson.M{"updatedAt": 1}))
+		if err != nil {
+			return nil, err
+		}
+		var out []storedReading
+		err = cursor.All(ctx, &out)
+		return out, err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	rs, ids := make([]reading, len(stored)), make([]any, len(stored))
+	for i, r := range stored {
+		rs[i], ids[i] = r.reading, r.ID
+	}
+	return rs, ids, nil
+}
+
+func (m *mongoStore) deleteIDs(ctx context.Context, ids []any) (int64, error) {
+	var deleted int64
+	for len(ids) > 0 {
+		batch := ids[:min(len(ids), deleteBatchSize)]
+		ids = ids[len(batch):]
+		res, err := m.coll.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": batch}})
+		if err != nil {
+			return deleted, err
+		}
+		deleted += res.DeletedCount
+	}
+	return deleted, nil
+}
+
+// watch tails the collection's change stream, which needs a replica
+// set. A time-series collection has none, so it is polled instead.
+func (m *mongoStore) watch(ctx context.Context, fn func(reading)) error {
+	if m.timeSeries {
+		return m.poll(ctx, fn)
+	}
+	pipeline := bson.A{bson.M{"$match": bson.M{"operationType": "insert"}}}
+	stream, err := m.coll.Watch(ctx, pipeline)
+	if err != nil {
+		return err
+	}
+	defer stream.Close(context.Background())
+
+	for stream.Next(ctx) {
+		var event struct {
+			FullDocument reading `bson:"fullDocument"`
+		}
+		if err := stream.Decode(&event); err != nil {
+			return err
+		}
+		fn(event.FullDocument)
+	}
+	return stream.Err()
+}
+
+// poll looks for readings newer than the last one seen every
+// watchPollInterval. Readings that arrive late, timestamped before the
+// last one seen, are missed.
+func (m *mongoStore) poll(ctx context.Context, fn func(reading)) error {
+	last := time.Now()
+	ticker := time.NewTicker(watchPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		cursor, err := m.coll.Find(ctx, bson.M{"updatedAt": bson.M{"$gt": last}}, options.Find().SetSort(bson.M{"updatedAt": 1}))
+		if err != nil {
+			return err
+		}
+		var rs []reading
+		if err := cursor.All(ctx, &rs); err != nil {
+			return err
+		}
+		for _, r := range rs {
+			fn(r)
+			last = r.UpdatedAt
+		}
+	}
+}
+
+// The client is shared with the metadata, so it's closed by its owner
+func (m *mongoStore) close() error {
+	return nil
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// postgresStore keeps readings in a PostgreSQL table, made a hypertable
+// on TimescaleDB. New rows are announced on a channel named after the
+// table, which watch listens to.
+type postgresStore struct {
+	db    *sql.DB
+	uri   string
+	table string
+}
+
+// readingColumns are selected in the order scanReadings expects.
+const readingColumns = "sensor_id, updated_at, temperature, humidity, co2, pressure"
+
+func openPostgresStore(ctx context.Context, uri, table string) (*postgresStore, error) {
+	db, err := sql.Open("postgres", uri)
+	if err != nil {
+		return nil, err
+	}
+	if err := createReadingsTable(ctx, db, "postgres", table); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating table %s: %w", table, err)
+	}
+	// Notify from a trigger so rows written by other processes, such as
+	// transfer -follow, reach live clients too
+	_, err = db.ExecContext(ctx, fmt.Sprintf(`
+		CREATE OR REPLACE FUNCTION temphums_notify() RETURNS trigger AS $$
+		BEGIN
+			PERFORM pg_notify(TG_TABLE_NAME, row_to_json(NEW)::text);
+			RETURN NEW;
+		END
+		$$ LANGUAGE plpgsql;
+		DROP TRIGGER IF EXISTS temphums_notify ON %[1]s;
+		CREATE TRIGGER temphums_notify AFTER INSERT ON %[1]s
+			FOR EACH ROW EXECUTE FUNCTION temphums_notify();`, table))
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating notify trigger: %w", err)
+	}
+	return &postgresStore{db: db, uri: uri, table: table}, nil
+}
+
+// pgQuery collects the arguments of a query as it is built.
+type pgQuery struct {
+	args []any
+}
+
+// arg adds v and returns its placeholder.
+func (q *pgQuery) arg(v any) string {
+	q.args = append(q.args, v)
+	return "$" + strconv.Itoa(len(q.args))
+}
+
+// where matches [from, to), limited to the given sensors unless sensors
+// is empty.
+func (q *pgQuery) where(from, to time.Time, sensors []string) string {
+	where := fmt.Sprintf("updated_at >= %s AND updated_at < %s", q.arg(from), q.arg(to))
+	if len(sensors) > 0 {
+		where += " AND sensor_id = ANY(" + q.arg(pq.Array(sensors)) + ")"
+	}
+	return where
+}
+
+// calibrated returns column corrected by each sensor's offset.
+func (q *pgQuery) calibrated(column string, cal calibration, offset func(sensorOffsets) float64) string {
+	ids := make([]string, 0, len(cal))
+	for id, o := range cal {
+		if offset(o) != 0 {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return column
+	}
+	slices.Sort(ids)
+	var b strings.Builder
+	fmt.Fprintf(&b, "(%s + CASE sensor_id", column)
+	for _, id := range ids {
+		fmt.Fprintf(&b, " WHEN %s THEN %s", q.arg(id), strconv.FormatFloat(offset(cal[id]), 'g', -1, 64))
+	}
+	b.WriteString(" ELSE 0 END)")
+	return b.String()
+}
+
+func (p *postgresStore) insert(ctx context.Context, rs []reading) error {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// Unlike MongoDB, the key allows one reading per sensor and time
+	stmt, err := tx.PrepareContext(ctx, fmt.Sprintf(`INSERT INTO %s (%s) VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (sensor_id, updated_at) DO NOTHING`, p.table, readingColumns))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, r := range rs {
+		if _, err := stmt.ExecContext(ctx, r.SensorID, r.UpdatedAt, r.Temperature, r.Humidity, r.CO2, r.Pressure); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (p *postgresStore) upsert(ctx context.Context, r reading) error {
+	return p.insert(ctx, []reading{r})
+}
+
+func (p *postgresStore) find(ctx context.Context, from, to time.Time, sensors []string) ([]reading, error) {
+	var q pgQuery
+	rows, err := p.db.QueryContext(ctx, fmt.Sprintf(`SELECT %s FROM %s WHERE %s ORDER BY updated_at`,
+		readingColumns, p.table, q.where(from, to, sensors)), q.args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanReadings(rows)
+}
+
+func (p *postgresStore) latest(ctx context.Context, since time.Time) ([]reading, error) {
+	rows, err := p.db.QueryContext(ctx, fmt.Sprintf(`SELECT DISTINCT ON (sensor_id) %s FROM %s
+		WHERE updated_at >= $1 ORDER BY sensor_id, updated_at DESC`, readingColumns, p.table), since)
+	if err != nil {
+		return nil, err
+	}
+	return scanReadings(rows)
+}
+
+func scanReadings(rows *sql.Rows) ([]reading, error) {
+	defer rows.Close()
+	var out []reading
+	for rows.Next() {
+		var r reading
+		if err := rows.Scan(&r.SensorID, &r.UpdatedAt, &r.Temperature, &r.Humidity, &r.CO2, &r.Pressure); err != nil {
+			return nil, err
+		}
+		r.UpdatedAt = r.UpdatedAt.UTC()
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+func (p *postgresStore) sensorIDs(ctx context.Context) ([]string, error) {
+	rows, err := p.db.QueryContext(ctx, fmt.Sprintf(`SELECT DISTINCT sensor_id FROM %s WHERE sensor_id <> ''`, p.table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (p *postgresStore) intervalAverages(ctx context.Context, from, to time.Time, interval int64, sensors []string, cal calibration) ([]bucketAvg[int64], error) {
+	var q pgQuery
+	temperature := q.calibrated("temperature", cal, func(o sensorOffsets) float64 { return o.Temperature })
+	humidity := q.calibrated("humidity", cal, func(o sensorOffsets) float64 { return o.Humidity })
+	rows, err := p.db.QueryContext(ctx, fmt.Sprintf(`SELECT (floor(extract(epoch FROM updated_at) * 1000 / %[1]d) * %[1]d)::BIGINT AS bucket,
+			AVG(%[2]s), AVG(%[3]s), COUNT(*), AVG(co2), COUNT(co2), AVG(pressure), COUNT(pressure)
+		FROM %[4]s WHERE %[5]s GROUP BY bucket ORDER BY bucket`,
+		interval, temperature, humidity, p.table, q.where(from, to, sensors)), q.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var buckets []bucketAvg[int64]
+	for rows.Next() {
+		var b bucketAvg[int64]
+		if err := rows.Scan(&b.Key, &b.Temperature, &b.Humidity, &b.Count, &b.CO2, &b.CO2Count, &b.Pressure, &b.PressureCount); err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets, rows.Err()
+}
+
+func (p *postgresStore) hourlyAverages(ctx context.Context, from, to time.Time, tz string, sensors []string, cal calibration) ([]bucketAvg[string], error) {
+	var q pgQuery
+	temperature := q.calibrated("temperature", cal, func(o sensorOffsets) float64 { return o.Temperature })
+	humidity := q.calibrated("humidity", cal, func(o sensorOffsets) float64 { return o.Humidity })
+	rows, err := p.db.QueryContext(ctx, fmt.Sprintf(`SELECT to_char(updated_at AT TIME ZONE %s, 'YYYY-MM-DD HH24:00:00') AS hour, sensor_id,
+			AVG(%s), AVG(%s), COUNT(*),
+			AVG(co2), COUNT(co2), AVG(pressure), COUNT(pressure)
+		FROM %s WHERE %s GROUP BY hour, sensor_id ORDER BY hour, sensor_id`,
+		q.arg(tz), temperature, humidity, p.table, q.where(from, to, sensors)), q.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []bucketAvg[string]
+	for rows.Next() {
+		var b bucketAvg[string]
+		if err := rows.Scan(&b.Key, &b.Sensor, &b.Temperature, &b.Humidity, &b.Count, &b.CO2, &b.CO2Count, &b.Pressure, &b.PressureCount); err != nil {
+			return nil, err
+		}
+		results = append(results, b)
+	}
+	return results, rows.Err()
+}
+
+func (p *postgresStore) oldest(ctx context.Context) (time.Time, error) {
+	var oldest sql.NullTime
+	err := p.db.QueryRowContext(ctx, fmt.Sprintf(`SELECT MIN(updated_at) FROM %s`, p.table)).Scan(&oldest)
+	return oldest.Time.UTC(), err
+}
+
+// pgKey is the primary key of a row, which findIDs returns as its id.
+type pgKey struct {
+	sensor string
+	at     time.Time
+}
+
+func (p *postgresStore) findIDs(ctx context.Context, from, to time.Time) ([]reading, []any, error) {
+	rs, err := p.find(ctx, from, to, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	ids := make([]any, len(rs))
+	for i, r := range rs {
+		ids[i] = pgKey{r.SensorID, r.UpdatedAt}
+	}
+	return rs, ids, nil
+}
+
+func (p *postgresStore) deleteIDs(ctx context.Context, ids []any) (int64, error) {
+	var deleted int64
+	for len(ids) > 0 {
+		batch := ids[:min(len(ids), deleteBatchSize)]
+		ids = ids[len(batch):]
+		sensors, times := make([]string, len(batch)), make([]string, len(batch))
+		for i, id := range batch {
+			k := id.(pgKey)
+			sensors[i], times[i] = k.sensor, k.at.Format(time.RFC3339Nano)
+		}
+		res, err := p.db.ExecContext(ctx, fmt.Sprintf(`DELETE FROM %s WHERE (sensor_id, updated_at) IN (SELECT * FROM unnest($1::text[], $2::timestamptz[]))`, p.table),
+			pq.Array(sensors), pq.Array(times))
+		if err != nil {
+			return deleted, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return deleted, err
+		}
+		deleted += n
+	}
+	return deleted, nil
+}
+
+// watch listens for the rows the insert trigger announces.
+func (p *postgresStore) watch(ctx context.Context, fn func(reading)) error {
+	listener := pq.NewListener(p.uri, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("Postgres listener: %v", err)
+		}
+	})
+	defer listener.Close()
+	if err := listener.Listen(p.table); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case n := <-listener.Notify:
+			// nil follows a reconnect, after which nothing is replayed
+			if n == nil {
+				continue
+			}
+			var row struct {
+				SensorID    string    `json:"sensor_id"`
+				Temperature float64   `json:"temperature"`
+				Humidity    float64   `json:"humidity"`
+				CO2         *float64  `json:"co2"`
+				Pressure    *float64  `json:"pressure"`
+				UpdatedAt   time.Time `json:"updated_at"`
+			}
+			if err := json.Unmarshal([]byte(n.Extra), &row); err != nil {
+				return err
+			}
+			fn(reading(row))
+		case <-time.After(90 * time.Second):
+			// Notice a dead connection even when nothing is written
+			if err := listener.Ping(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (p *postgresStore) close() error {
+	return p.db.Close()
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sdNotify sends state, such as "READY=1", to the service manager when
+// running as a systemd Type=notify service, and does nothing otherwise.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// A leading @ names a socket in the abstract namespace
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("notifying systemd: %w", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("notifying systemd: %w", err)
+	}
+	return nil
+}
+
+// watchdogInterval is how often systemd expects to hear from this
+// process with WatchdogSec set, or 0 if it doesn't.
+func watchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// runWatchdog pings the systemd watchdog at half its interval for as
+// long as the HTTP server at addr answers, until ctx is done. A server
+// that stops answering is then restarted by systemd.
+func runWatchdog(ctx context.Context, interval time.Duration, addr net.Addr) {
+	url := "http://" + loopback(addr) + "/"
+	client := &http.Client{Timeout: interval / 4}
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		resp, err := client.Get(url)
+		if err != nil {
+			log.Printf("Watchdog: %v", err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			log.Printf("Watchdog: %s answered %s", url, resp.Status)
+			continue
+		}
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// loopback is the host:port to reach a listener at addr from this
+// machine, which for one on every interface is localhost.
+func loopback(addr net.Addr) string {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok || !tcp.IP.IsUnspecified() {
+		return addr.String()
+	}
+	return net.JoinHostPort("localhost", strconv.Itoa(tcp.Port))
+}
+
+// runSystemdUnit prints a systemd unit running serve, for
+// /etc/systemd/system/temphums.service. Arguments after "--" are passed
+// on to serve, as are the -env-file, -config and -no-dotenv flags this
+// command was given.
+func runSystemdUnit(args []string) error {
+	fs := flag.NewFlagSet("systemd-unit", flag.ExitOnError)
+	exe, _ := os.Executable()
+	dir, _ := os.Getwd()
+	binary := fs.String("binary", exe, "absolute path of the temphums binary, built with go build")
+	workDir := fs.String("dir", dir, "working directory, where .env files are read from")
+	user := fs.String("user", "temphums", "user to run as (root when empty)")
+	watchdog := fs.Duration("watchdog", 30*time.Second, "restart the service when it stops answering HTTP for this long (disabled when 0)")
+	outPath := fs.String("out", "", "file to write the unit to (default stdout)")
+	fs.Parse(args)
+	if !filepath.IsAbs(*binary) || !filepath.IsAbs(*workDir) {
+		return errors.New("-binary and -dir must be absolute paths")
+	}
+	if strings.Contains(*binary, filepath.Join(os.TempDir(), "go-build")) {
+		log.Printf("%s is a go run build that will be deleted; build the binary and set -binary", *binary)
+	}
+	if *watchdog < 0 || (*watchdog > 0 && *watchdog < 2*time.Second) {
+		return errors.New("-watchdog must be 0 or at least 2s")
+	}
+
+	command := []string{*binary}
+	g, _, err := parseGlobalFlags(os.Args[1:])
+	if err != nil {
+		return err
+	}
+	for _, f := range g.envFiles {
+		if f, err = filepath.Abs(f); err != nil {
+			return err
+		}
+		command = append(command, "-env-file", f)
+	}
+	if g.config != "" {
+		config, err := filepath.Abs(g.config)
+		if err != nil {
+			return err
+		}
+		command = append(command, "-config", config)
+	}
+	if g.noDotenv {
+		command = append(command, "-no-dotenv")
+	}
+	command = append(command, "serve")
+	command = append(command, fs.Args()...)
+	for i, arg := range command {
+		command[i] = systemdQuote(arg)
+	}
+
+	var b strings.Builder
+	b.WriteString("[Unit]\nDescription=temphums server\nWants=network-online.target\nAfter=network-online.target\n\n")
+	b.WriteString("[Service]\nType=notify\nNotifyAccess=main\n")
+	fmt.Fprintf(&b, "ExecStart=%s\n", strings.Join(command, " "))
+	fmt.Fprintf(&b, "WorkingDirectory=%s\n", strings.ReplaceAll(*workDir, "%", "%%"))
+	if *user != "" {
+		fmt.Fprintf(&b, "User=%s\n", *user)
+	}
+	// Connecting to MongoDB alone may take 10s
+	b.WriteString("Restart=on-failure\nRestartSec=5s\nTimeoutStartSec=30s\n")
+	if *watchdog > 0 {
+		fmt.Fprintf(&b, "WatchdogSec=%ds\n", int(watchdog.Seconds()))
+	}
+	b.WriteString("\n[Install]\nWantedBy=multi-user.target\n")
+
+	out, closeOut, err := createOutput(*outPath, false)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprint(out, b.String()); err != nil {
+		closeOut()
+		return err
+	}
+	return closeOut()
+}
+
+// systemdQuote quotes s for a unit file command line if it needs it,
+// escaping % specifiers.
+func systemdQuote(s string) string {
+	s = strings.ReplaceAll(s, "%", "%%")
+	if s != "" && !strings.ContainsAny(s, " \t\"'\\;$") {
+		return s
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", "$$")
+	return `"` + r.Replace(s) + `"`
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// telegramAPI is the Bot API's base URL.
+const telegramAPI = "https://api.telegram.org/bot"
+
+// telegramPoll is how long a getUpdates request waits for messages.
+const telegramPoll = 50 * time.Second
+
+// telegramBot sends alerts to Telegram chats and answers commands from
+// them: /now for the latest readings and /yesterday for a summary of
+// the day before. Only the configured chats are answered, since anyone
+// can message a bot.
+type telegramBot struct {
+	token string
+	chats []int64
+	s     *server
+	http  *http.Client
+}
+
+// newTelegramBot returns a bot for TOKEN talking to a comma-separated
+// list of chat IDs.
+func newTelegramBot(token, chats string, s *server) (*telegramBot, error) {
+	b := &telegramBot{token: token, s: s, http: &http.Client{Timeout: telegramPoll + 10*time.Second}}
+	for _, v := range splitList(chats) {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("chat ID %q: %w", v, err)
+		}
+		b.chats = append(b.chats, id)
+	}
+	if len(b.chats) == 0 {
+		return nil, errors.New("a Telegram bot needs at least one chat ID")
+	}
+	return b, nil
+}
+
+// notifiers returns a notifier per chat, for the alert engine.
+func (b *telegramBot) notifiers() []alertNotifier {
+	var out []alertNotifier
+	for _, chat := range b.chats {
+		out = append(out, alertNotifier{kind: "Telegram", url: telegramAPI + b.token + "/sendMessage", body: func(e alertEvent) any {
+			return telegramMessage{ChatID: chat, Text: chatText(e, "%s")}
+		}})
+	}
+	return out
+}
+
+type telegramMessage struct {
+	ChatID int64  `json:"chat_id"`
+	Text   string `json:"text"`
+}
+
+type telegramUpdate struct {
+	UpdateID int64 `json:"update_id"`
+	Message  *struct {
+		Chat struct {
+			ID int64 `json:"id"`
+		} `json:"chat"`
+		Text string `json:"text"`
+	} `json:"message"`
+}
+
+// call posts a Bot API method and decodes its result into out.
+func (b *telegramBot) call(ctx context.Context, method string, params, out any) error {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, telegramAPI+b.token+"/"+method, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := b.http.Do(req)
+	if err != nil {
+		// Keep the token in the URL out of logs
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	var body struct {
+		OK          bool            `json:"ok"`
+		Description string          `json:"description"`
+		Result      json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return fmt.Errorf("%s: %s", method, resp.Status)
+	}
+	if !body.OK {
+		return fmt.Errorf("%s: %s", method, body.Description)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(body.Result, out)
+}
+
+// run answers commands until ctx is done, retrying after failures.
+func (b *telegramBot) run(ctx context.Context) {
+	var offset int64
+	for ctx.Err() == nil {
+		var updates []telegramUpdate
+		params := map[string]any{"offset": offset, "timeout": int(telegramPoll.Seconds()), "allowed_updates": []string{"message"}}
+		if err := b.call(ctx, "getUpdates", params, &updates); err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Telegram: %v", err)
+				select {
+				case <-ctx.Done():
+				case <-time.After(30 * time.Second):
+				}
+			}
+			continue
+		}
+		for _, u := range updates {
+			offset = u.UpdateID + 1
+			if u.Message == nil || !slices.Contains(b.chats, u.Message.Chat.ID) {
+				continue
+			}
+			reply := b.answer(ctx, u.Message.Text)
+			if reply == "" {
+				continue
+			}
+			if err := b.call(ctx, "sendMessage", telegramMessage{ChatID: u.Message.Chat.ID, Text: reply}, nil); err != nil {
+				log.Printf("Telegram: %v", err)
+			}
+		}
+	}
+}
+
+// answer returns the reply to a message, or "" to ignore it.
+func (b *telegramBot) answer(ctx context.Context, text string) string {
+	command, _, _ := strings.Cut(strings.TrimSpace(text), " ")
+	// In groups commands may be addressed as /now@SomeBot
+	command, _, _ = strings.Cut(command, "@")
+	var (
+		reply string
+		err   error
+	)
+	switch strings.ToLower(command) {
+	case "/now":
+		reply, err = b.now(ctx)
+	case "/yesterday":
+		reply, err = b.yesterday(ctx)
+	case "/start", "/help":
+		reply = "/now - latest reading of each sensor\n/yesterday - yesterday's range and average per sensor"
+	default:
+		return ""
+	}
+	if err != nil {
+		log.Printf("Telegram %s: %v", command, err)
+		return "Sorry, that failed: " + err.Error()
+	}
+	return reply
+}
+
+// degrees returns the temperature unit suffix of a sensor.
+func degrees(registry map[string]sensorInfo, id string) string {
+	if unit := registry[id].TemperatureUnit; unit != "" {
+		return "°" + unit
+	}
+	return "°"
+}
+
+// now lists the latest reading of each sensor.
+func (b *telegramBot) now(ctx context.Context) (string, error) {
+	latest, err := b.s.flowLatest(ctx)
+	if err != nil {
+		return "", err
+	}
+	if len(latest) == 0 {
+		return "No readings in the last week.", nil
+	}
+	registry, err := loadSensors(ctx, b.s.sensors)
+	if err != nil {
+		return "", err
+	}
+	var msg strings.Builder
+	for _, l := range latest {
+		fmt.Fprintf(&msg, "%s: %.1f%s, %.0f%% RH", l.Name, l.Temperature, degrees(registry, l.SensorID), l.Humidity)
+		if l.CO2 != nil {
+			fmt.Fprintf(&msg, ", %.0f ppm CO2", *l.CO2)
+		}
+		fmt.Fprintf(&msg, " (%s ago)\n", roughDuration(time.Duration(l.AgeSeconds)*time.Second))
+	}
+	return msg.String(), nil
+}
+
+// yesterday summarises yesterday, in reportTimezone, per sensor.
+func (b *telegramBot) yesterday(ctx context.Context) (string, error) {
+	loc, err := time.LoadLocation(reportTimezone)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now().In(loc)
+	to := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	from := to.AddDate(0, 0, -1)
+	stats, err := b.s.flowStats(ctx, from, to, nil)
+	if err != nil {
+		return "", err
+	}
+	if len(stats) == 0 {
+		return "No readings yesterday.", nil
+	}
+	registry, err := loadSensors(ctx, b.s.sensors)
+	if err != nil {
+		return "", err
+	}
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "%s\n", from.Format("Monday 2 January"))
+	for _, st := range stats {
+		unit := degrees(registry, st.SensorID)
+		fmt.Fprintf(&msg, "%s: %.1f to %.1f%s (avg %.1f), %.0f to %.0f%% RH (avg %.0f)\n",
+			st.Name, st.TemperatureMin, st.TemperatureMax, unit, st.TemperatureAvg,
+			st.HumidityMin, st.HumidityMax, st.HumidityAvg)
+	}
+	return msg.String(), nil
+}
@@ -0,0 +1,212 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: temphums/v1/temphums.proto
+
+package temphumspb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Temphums_SubmitReading_FullMethodName   = "/temphums.v1.Temphums/SubmitReading"
+	Temphums_StreamReadings_FullMethodName  = "/temphums.v1.Temphums/StreamReadings"
+	Temphums_QueryAggregates_FullMethodName = "/temphums.v1.Temphums/QueryAggregates"
+)
+
+// TemphumsClient is the client API for Temphums service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Temphums ingests readings from gateways and serves aggregates.
+//
+// Writes are idempotent on (sensor_id, updated_at), so clients on flaky
+// links can retry any call that did not complete.
+type TemphumsClient interface {
+	// SubmitReading stores a single reading.
+	SubmitReading(ctx context.Context, in *SubmitReadingRequest, opts ...grpc.CallOption) (*SubmitReadingResponse, error)
+	// StreamReadings stores readings sent over a long-lived stream. Every
+	// reading is acknowledged with its sequence number once it is stored,
+	// so after a dropped connection the client resends only unacked ones.
+	StreamReadings(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[StreamReadingsRequest, StreamReadingsResponse], error)
+	// QueryAggregates returns averages over fixed intervals of a range.
+	QueryAggregates(ctx context.Context, in *QueryAggregatesRequest, opts ...grpc.CallOption) (*QueryAggregatesResponse, error)
+}
+
+type temphumsClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewTemphumsClient(cc grpc.ClientConnInterface) TemphumsClient {
+	return &temphumsClient{cc}
+}
+
+func (c *temphumsClient) SubmitReading(ctx context.Context, in *SubmitReadingRequest, opts ...grpc.CallOption) (*SubmitReadingResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(SubmitReadingResponse)
+	err := c.cc.Invoke(ctx, Temphums_SubmitReading_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *temphumsClient) StreamReadings(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[StreamReadingsRequest, StreamReadingsResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Temphums_ServiceDesc.Streams[0], Temphums_StreamReadings_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[StreamReadingsRequest, StreamReadingsResponse]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Temphums_StreamReadingsClient = grpc.BidiStreamingClient[StreamReadingsRequest, StreamReadingsResponse]
+
+func (c *temphumsClient) QueryAggregates(ctx context.Context, in *QueryAggregatesRequest, opts ...grpc.CallOption) (*QueryAggregatesResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(QueryAggregatesResponse)
+	err := c.cc.Invoke(ctx, Temphums_QueryAggregates_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// TemphumsServer is the server API for Temphums service.
+// All implementations must embed UnimplementedTemphumsServer
+// for forward compatibility.
+//
+// Temphums ingests readings from gateways and serves aggregates.
+//
+// Writes are idempotent on (sensor_id, updated_at), so clients on flaky
+// links can retry any call that did not complete.
+type TemphumsServer interface {
+	// SubmitReading stores a single reading.
+	SubmitReading(context.Context, *SubmitReadingRequest) (*SubmitReadingResponse, error)
+	// StreamReadings stores readings sent over a long-lived stream. Every
+	// reading is acknowledged with its sequence number once it is stored,
+	// so after a dropped connection the client resends only unacked ones.
+	StreamReadings(grpc.BidiStreamingServer[StreamReadingsRequest, StreamReadingsResponse]) error
+	// QueryAggregates returns averages over fixed intervals of a range.
+	QueryAggregates(context.Context, *QueryAggregatesRequest) (*QueryAggregatesResponse, error)
+	mustEmbedUnimplementedTemphumsServer()
+}
+
+// UnimplementedTemphumsServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedTemphumsServer struct{}
+
+func (UnimplementedTemphumsServer) SubmitReading(context.Context, *SubmitReadingRequest) (*SubmitReadingResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SubmitReading not implemented")
+}
+func (UnimplementedTemphumsServer) StreamReadings(grpc.BidiStreamingServer[StreamReadingsRequest, StreamReadingsResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method StreamReadings not implemented")
+}
+func (UnimplementedTemphumsServer) QueryAggregates(context.Context, *QueryAggregatesRequest) (*QueryAggregatesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method QueryAggregates not implemented")
+}
+func (UnimplementedTemphumsServer) mustEmbedUnimplementedTemphumsServer() {}
+func (UnimplementedTemphumsServer) testEmbeddedByValue()                  {}
+
+// UnsafeTemphumsServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to TemphumsServer will
+// result in compilation errors.
+type UnsafeTemphumsServer interface {
+	mustEmbedUnimplementedTemphumsServer()
+}
+
+func RegisterTemphumsServer(s grpc.ServiceRegistrar, srv TemphumsServer) {
+	// If the following call pancis, it indicates UnimplementedTemphumsServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Temphums_ServiceDesc, srv)
+}
+
+func _Temphums_SubmitReading_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SubmitReadingRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TemphumsServer).SubmitReading(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Temphums_SubmitReading_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TemphumsServer).SubmitReading(ctx, req.(*SubmitReadingRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Temphums_StreamReadings_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(TemphumsServer).StreamReadings(&grpc.GenericServerStream[StreamReadingsRequest, StreamReadingsResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Temphums_StreamReadingsServer = grpc.BidiStreamingServer[StreamReadingsRequest, StreamReadingsResponse]
+
+func _Temphums_QueryAggregates_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(QueryAggregatesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TemphumsServer).QueryAggregates(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Temphums_QueryAggregates_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TemphumsServer).QueryAggregates(ctx, req.(*QueryAggregatesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Temphums_ServiceDesc is the grpc.ServiceDesc for Temphums service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Temphums_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "temphums.v1.Temphums",
+	HandlerType: (*TemphumsServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "SubmitReading",
+			Handler:    _Temphums_SubmitReading_Handler,
+		},
+		{
+			MethodName: "QueryAggregates",
+			Handler:    _Temphums_QueryAggregates_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamReadings",
+			Handler:       _Temphums_StreamReadings_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "temphums/v1/temphums.proto",
+}
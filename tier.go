@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/parquet-go/parquet-go"
+	"github.com/parquet-go/parquet-go/compress/zstd"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"temphums_go/pipeline"
+)
+
+// tiersCollection records which ranges have been moved to cold storage.
+const tiersCollection = "tiers"
+
+// tierRange is one month of readings archived to the object store.
+type tierRange struct {
+	Key      string    `bson:"_id"`
+	From     time.Time `bson:"from"`
+	To       time.Time `bson:"to"`
+	Count    int64     `bson:"count"`
+	TieredAt time.Time `bson:"tieredAt"`
+
+	// ParseMode is how a registered legacy CSV was parsed, so queries
+	// read it back the same way.
+	ParseMode string `bson:"parseMode,omitempty"`
+	// Mapping locates the columns and units of a registered CSV
+	Mapping *csvMapping `bson:"mapping,omitempty"`
+}
+
+// coldReading is the Parquet row layout of an archived reading.
+type coldReading struct {
+	UpdatedAt   time.Time `parquet:"updatedAt,timestamp(millisecond)"`
+	SensorID    string    `parquet:"sensorId,optional"`
+	Temperature float64   `parquet:"temperature"`
+	Humidity    float64   `parquet:"humidity"`
+	CO2         *float64  `parquet:"co2,optional"`
+	Pressure    *float64  `parquet:"pressure,optional"`
+}
+
+// coldStore reads and writes archived months in an S3-compatible
+// bucket. GCS works through its S3 interoperability endpoint. It also
+// reads legacy files registered in place, which needs no bucket.
+type coldStore struct {
+	client   *minio.Client
+	bucket   string
+	prefix   string
+	cacheDir string
+}
+
+// newColdStore configures the object store from TIER_* environment
+// variables. Without TIER_BUCKET the store has no client and can only
+// read registered local files.
+func newColdStore() (*coldStore, error) {
+	cacheDir := envOr("TIER_CACHE_DIR", cacheDir("tier"))
+	bucket := os.Getenv("TIER_BUCKET")
+	if bucket == "" {
+		return &coldStore{cacheDir: cacheDir}, nil
+	}
+	endpoint := envOr("TIER_ENDPOINT", "s3.amazonaws.com")
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(os.Getenv("TIER_ACCESS_KEY"), os.Getenv("TIER_SECRET_KEY"), ""),
+		Secure: os.Getenv("TIER_INSECURE") == "",
+		Region: os.Getenv("TIER_REGION"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &coldStore{
+		client:   client,
+		bucket:   bucket,
+		prefix:   strings.Trim(envOr("TIER_PREFIX", "temphums"), "/"),
+		cacheDir: cacheDir,
+	}, nil
+}
+
+// monthKey is the object key of the archive holding the month of t.
+func (c *coldStore) monthKey(t time.Time) string {
+	return fmt.Sprintf("%s/%04d/%02d.parquet", c.prefix, t.Year(), t.Month())
+}
+
+func (c *coldStore) put(ctx context.Context, key string, data []byte) error {
+	_, err := c.client.PutObject(ctx, c.bucket, key, bytes.NewReader(data), int64(len(data)),
+		minio.PutObjectOptions{ContentType: "application/vnd.apache.parquet"})
+	return err
+}
+
+// read returns every row of the archive at key. Archives never change
+// once written, so they are cached on local disk after the first fetch.
+func (c *coldStore) read(ctx context.Context, key string) ([]coldReading, error) {
+	if c.client == nil {
+		return nil, fmt.Errorf("%s is archived in object storage but TIER_BUCKET is not set", key)
+	}
+	path := filepath.Join(c.cacheDir, filepath.FromSlash(key))
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		obj, err := c.client.GetObject(ctx, c.bucket, key, minio.GetObjectOptions{})
+		if err != nil {
+			return nil, err
+		}
+		defer obj.Close()
+		if data, err = io.ReadAll(obj); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err == nil {
+			if err := os.WriteFile(path, data, 0o644); err != nil {
+				log.Printf("Error caching %s: %v", key, err)
+			}
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	return parquet.Read[coldReading](bytes.NewReader(data), int64(len(data)))
+}
+
+// readRange returns every row of a tiered range, whether archived in
+// the bucket or registered in place.
+func (c *coldStore) readRange(ctx context.Context, tr tierRange) ([]coldReading, error) {
+	path, ok := strings.CutPrefix(tr.Key, legacyKeyPrefix)
+	if !ok {
+		return c.read(ctx, tr.Key)
+	}
+	mode, err := parseModeNamed(tr.ParseMode)
+	if err != nil {
+		return nil, err
+	}
+	// Rejects and warnings were reported when the file was registered
+	res, err := readLegacyFile(path, mode, tr.Mapping)
+	return res.rows, err
+}
+
+// coldReadings returns the archived readings in [from, to), limited to
+// the given sensors unless sensors is empty.
+func (c *coldStore) coldReadings(ctx context.Context, tiers *mongo.Collection, from, to time.Time, sensors []string) ([]coldReading, error) {
+	ranges, err := retryMongo(ctx, "find", func(ctx context.Context, _ int) ([]tierRange, error) {
+		cursor, err := tiers.Find(ctx, bson.M{"from": bson.M{"$lt": to}, "to": bson.M{"$gt": from}})
+		if err != nil {
+			return nil, err
+		}
+		var ranges []tierRange
+		err = cursor.All(ctx, &ranges)
+		return ranges, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var out []coldReading
+	for _, tr := range ranges {
+		rows, err := c.readRange(ctx, tr)
+		if err != nil {
+			return nil, fmt.Errorf("reading archive %s: %w", tr.Key, err)
+		}
+		for _, r := range rows {
+			if r.UpdatedAt.Before(from) || !r.UpdatedAt.Before(to) {
+				continue
+			}
+			if len(sensors) > 0 && !slices.Contains(sensors, r.SensorID) {
+				continue
+			}
+			out = append(out, r)
+		}
+	}
+	return out, nil
+}
+
+// bucketAvg holds the averages of one group along with the number of
+// readings behind them, so groups from the hot and cold tiers can be
+// merged. Sensor is empty when readings are not grouped by sensor.
+// CO2 and Pressure are nil when no reading in the group reported them,
+// and have their own counts since not every sensor does.
+type bucketAvg[K cmp.Ordered] struct {
+	Key           K        `bson:"_id"`
+	Sensor        string   `bson:"sensorId,omitempty"`
+	Temperature   float64  `bson:"temperature"`
+	Humidity      float64  `bson:"humidity"`
+	Count         int64    `bson:"count"`
+	CO2           *float64 `bson:"co2"`
+	CO2Count      int64    `bson:"co2Count"`
+	Pressure      *float64 `bson:"pressure"`
+	PressureCount int64    `bson:"pressureCount"`
+}
+
+// bucketStats are what a bucketAvg holds, computed over each bucket.
+// CO2 and pressure are counted separately, as only some sensors report
+// them.
+var bucketStats = []pipeline.Stat{
+	pipeline.Avg("temperature", "$temperature"),
+	pipeline.Avg("humidity", "$humidity"),
+	pipeline.Count("count"),
+	pipeline.Avg("co2", "$co2"),
+	pipeline.CountNumbers("co2Count", "$co2"),
+	pipeline.Avg("pressure", "$pressure"),
+	pipeline.CountNumbers("pressureCount", "$pressure"),
+}
+
+// mergeAvg combines an average of n samples with one of m samples,
+// either of which may be missing.
+func mergeAvg(avg *float64, n int64, other *float64, m int64) *float64 {
+	switch {
+	case other == nil || m == 0:
+		return avg
+	case avg == nil || n == 0:
+		v := *other
+		return &v
+	}
+	v := (*avg*float64(n) + *other*float64(m)) / float64(n+m)
+	return &v
+}
+
+// federate merges buckets aggregated from MongoDB with the archived
+// readings in [from, to) of the given sensors, so callers don't need to
+// know which tier holds the data. Archived rows are corrected by cal,
+// as the hot buckets should already be. key returns the group of an
+// archived row along with its sensor, or "" when not grouping by sensor.
+func federate[K cmp.Ordered](ctx context.Context, cold *coldStore, tiers *mongo.Collection, from, to time.Time, sensors []string, cal calibration, hot []bucketAvg[K], key func(coldReading) (K, string)) ([]bucketAvg[K], error) {
+	rows, err := cold.coldReadings(ctx, tiers, from, to, sensors)
+	if err != nil {
+		return nil, err
+	}
+	cal.apply(rows)
+	return mergeCold(hot, rows, key), nil
+}
+
+// mergeCold folds archived rows into existing buckets, weighting each
+// average by its sample count.
+func mergeCold[K cmp.Ordered](buckets []bucketAvg[K], rows []coldReading, key func(coldReading) (K, string)) []bucketAvg[K] {
+	if len(rows) == 0 {
+		return buckets
+	}
+	type group struct {
+		key    K
+		sensor string
+	}
+	byGroup := make(map[group]*bucketAvg[K], len(buckets))
+	for i := range buckets {
+		byGroup[group{buckets[i].Key, buckets[i].Sensor}] = &buckets[i]
+	}
+	for _, r := range rows {
+		k, sensor := key(r)
+		b, ok := byGroup[group{k, sensor}]
+		if !ok {
+			b = &bucketAvg[K]{Key: k, Sensor: sensor}
+			byGroup[group{k, sensor}] = b
+		}
+		n := float64(b.Count)
+		b.Temperature = (b.Temperature*n + r.Temperature) / (n + 1)
+		b.Humidity = (b.Humidity*n + r.Humidity) / (n + 1)
+		b.Count++
+		if r.CO2 != nil {
+			b.CO2 = mergeAvg(b.CO2, b.CO2Count, r.CO2, 1)
+			b.CO2Count++
+		}
+		if r.Pressure != nil {
+			b.Pressure = mergeAvg(b.Pressure, b.PressureCount, r.Pressure, 1)
+			b.PressureCount++
+		}
+	}
+	merged := make([]bucketAvg[K], 0, len(byGroup))
+	for _, b := range byGroup {
+		merged = append(merged, *b)
+	}
+	slices.SortFunc(merged, func(a, b bucketAvg[K]) int {
+		return cmp.Or(cmp.Compare(a.Key, b.Key), cmp.Compare(a.Sensor, b.Sensor))
+	})
+	return merged
+}
+
+// runTier moves whole months of raw readings older than the cutoff into
+// compressed Parquet archives, then deletes them from MongoDB.
+func runTier(args []string) (err error) {
+	if len(args) > 0 && args[0] == "register" {
+		return runTierRegister(args[1:])
+	}
+	if len(args) > 0 && args[0] == "templates" {
+		return runTierTemplates(args[1:])
+	}
+
+	fs := flag.NewFlagSet("tier", flag.ExitOnError)
+	months := fs.Int("older-than", 6, "archive readings older than this many months")
+	fs.Parse(args)
+
+	cold, err := newColdStore()
+	if err != nil {
+		return err
+	}
+	if cold.client == nil {
+		return configError{errors.New("TIER_BUCKET not set in environment")}
+	}
+
+	ctx, stop := commandContext()
+	defer stop()
+	connectCtx, cancel := context.WithTimeout(ctx, mongoTimeouts.connect)
+	client, err := connectMongo(connectCtx, "")
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if rerr := mongoClients.release(ctx, client); err == nil {
+			err = rerr
+		}
+	}()
+	store, err := openReadingStore(ctx, client)
+	if err != nil {
+		return err
+	}
+	defer store.close()
+	tiers := client.Database(readingsDatabase).Collection(tiersCollection)
+
+	// Only whole months before the cutoff are archived, in UTC so the
+	// ranges line up with the object keys.
+	now := time.Now().UTC()
+	cutoff := time.Date(now.Year(), now.Month()-time.Month(*months), 1, 0, 0, 0, 0, time.UTC)
+
+	// Start from the month of the oldest reading still in hot storage
+	oldest, err := store.oldest(ctx)
+	if err != nil {
+		return err
+	}
+	if oldest.IsZero() {
+		log.Println("No readings to tier")
+		return nil
+	}
+
+	start := time.Date(oldest.Year(), oldest.Month(), 1, 0, 0, 0, 0, time.UTC)
+	for month := start; month.Before(cutoff); month = month.AddDate(0, 1, 0) {
+		if err := tierMonth(ctx, store, tiers, cold, month); err != nil {
+			return fmt.Errorf("tiering %s: %w", month.Format("2006-01"), err)
+		}
+	}
+	return nil
+}
+
+// tierMonth archives the readings of one month. The archive is uploaded
+// and recorded before anything is deleted, so an interrupted run only
+// ever leaves data in both tiers, never in neither.
+func tierMonth(ctx context.Context, store readingStore, tiers *mongo.Collection, cold *coldStore, month time.Time) error {
+	end := month.AddDate(0, 1, 0)
+	key := cold.monthKey(month)
+
+	// Only the readings found now are deleted afterwards, so any arriving
+	// meanwhile stay in hot storage for the next run
+	hot, ids, err := store.findIDs(ctx, month, end)
+	if err != nil {
+		return err
+	}
+	if len(hot) == 0 {
+		return nil
+	}
+
+	// A month that was tiered before and has since received late
+	// readings is merged into its existing archive. So is one whose
+	// readings weren't all deleted last time, which mergeColdRows keeps
+	// from being archived twice.
+	var rows []coldReading
+	err = tiers.FindOne(ctx, bson.M{"_id": key}).Err()
+	if err == nil {
+		if rows, err = cold.read(ctx, key); err != nil {
+			return err
+		}
+		os.Remove(filepath.Join(cold.cacheDir, filepath.FromSlash(key)))
+	} else if !errors.Is(err, mongo.ErrNoDocuments) {
+		return err
+	}
+	fresh := make([]coldReading, len(hot))
+	for i, r := range hot {
+		fresh[i] = coldReading{UpdatedAt: r.UpdatedAt, SensorID: r.SensorID, Temperature: r.Temperature, Humidity: r.Humidity, CO2: r.CO2, Pressure: r.Pressure}
+	}
+	rows = mergeColdRows(rows, fresh)
+
+	var buf bytes.Buffer
+	w := parquet.NewGenericWriter[coldReading](&buf, parquet.Compression(&zstd.Codec{}))
+	if _, err := w.Write(rows); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if err := cold.put(ctx, key, buf.Bytes()); err != nil {
+		return err
+	}
+
+	record := tierRange{Key: key, From: month, To: end, Count: int64(len(rows)), TieredAt: time.Now()}
+	_, err = tiers.ReplaceOne(ctx, bson.M{"_id": key}, record, options.Replace().SetUpsert(true))
+	if err != nil {
+		return err
+	}
+	deleted, err := store.deleteIDs(ctx, ids)
+	if err != nil {
+		return err
+	}
+	log.Printf("Tiered %d readings to %s (deleted %d from hot storage)", len(hot), key, deleted)
+	return nil
+}
+
+// mergeColdRows adds hot rows to an archive's, one row per sensor and
+// time, the hot one winning, oldest first.
+func mergeColdRows(archived, hot []coldReading) []coldReading {
+	type rowKey struct {
+		sensor string
+		at     int64
+	}
+	// Archived times are stored to the millisecond
+	key := func(r coldReading) rowKey { return rowKey{r.SensorID, r.UpdatedAt.UnixMilli()} }
+	index := map[rowKey]int{}
+	var rows []coldReading
+	for _, r := range slices.Concat(archived, hot) {
+		if i, ok := index[key(r)]; ok {
+			rows[i] = r
+			continue
+		}
+		index[key(r)] = len(rows)
+		rows = append(rows, r)
+	}
+	slices.SortStableFunc(rows, func(a, b coldReading) int {
+		return cmp.Or(a.UpdatedAt.Compare(b.UpdatedAt), cmp.Compare(a.SensorID, b.SensorID))
+	})
+	return rows
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// timeouts bound how long commands wait on MongoDB, each set by its own
+// variable so a long export over a big range doesn't also have to wait
+// long for a cluster that is down.
+type timeouts struct {
+	// connect bounds connecting, and finding a server to send each
+	// command to: MONGO_CONNECT_TIMEOUT
+	connect time.Duration
+	// query bounds one attempt at a query of readings, from sending it
+	// to reading the last of its results, or 0 for no limit:
+	// MONGO_QUERY_TIMEOUT
+	query time.Duration
+	// run bounds a whole batch command such as export, or 0 for no
+	// limit: RUN_TIMEOUT. Services such as serve and ingest run until
+	// stopped.
+	run time.Duration
+}
+
+var mongoTimeouts = timeouts{connect: 10 * time.Second, query: 5 * time.Minute}
+
+// configureTimeouts reads mongoTimeouts from the environment.
+func configureTimeouts() error {
+	for _, t := range []struct {
+		name string
+		d    *time.Duration
+		// zero is set when 0 turns the limit off
+		zero bool
+	}{
+		{"MONGO_CONNECT_TIMEOUT", &mongoTimeouts.connect, false},
+		{"MONGO_QUERY_TIMEOUT", &mongoTimeouts.query, true},
+		{"RUN_TIMEOUT", &mongoTimeouts.run, true},
+	} {
+		v := os.Getenv(t.name)
+		if v == "" {
+			continue
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 || d == 0 && !t.zero {
+			return fmt.Errorf("%s must be a positive duration, not %q", t.name, v)
+		}
+		*t.d = d
+	}
+	return nil
+}
+
+// commandContext is the context of a batch command, which ends after
+// the run timeout.
+func commandContext() (context.Context, context.CancelFunc) {
+	if mongoTimeouts.run == 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), mongoTimeouts.run)
+}
+
+// queryContext is the context of one attempt at a query, which ends
+// after the query timeout.
+func queryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if mongoTimeouts.query == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, mongoTimeouts.query)
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// watchPollInterval is how often new readings are looked for where a
+// time-series collection has no change stream.
+const watchPollInterval = 5 * time.Second
+
+// checkGranularity checks a time-series granularity, which should be
+// about how often each sensor reports.
+func checkGranularity(granularity string) error {
+	switch granularity {
+	case "seconds", "minutes", "hours":
+		return nil
+	}
+	return fmt.Errorf("unknown granularity %q (expected seconds, minutes or hours)", granularity)
+}
+
+// collectionType returns "collection", "timeseries" or "view" for coll,
+// or "" if it doesn't exist.
+func collectionType(ctx context.Context, coll *mongo.Collection) (string, error) {
+	specs, err := coll.Database().ListCollectionSpecifications(ctx, bson.M{"name": coll.Name()})
+	if err != nil || len(specs) == 0 {
+		return "", err
+	}
+	return specs[0].Type, nil
+}
+
+// createTimeSeries creates a native time-series collection of readings,
+// bucketed by sensor.
+func createTimeSeries(ctx context.Context, db *mongo.Database, name, granularity string) error {
+	ts := options.TimeSeries().SetTimeField("updatedAt").SetMetaField("sensorId").SetGranularity(granularity)
+	return db.CreateCollection(ctx, name, options.CreateCollection().SetTimeSeriesOptions(ts))
+}
+
+// openMongoStore returns the store of the readings in coll, noticing
+// whether it is a time-series collection. A missing collection is
+// created as one when READINGS_TIMESERIES is set to its granularity.
+func openMongoStore(ctx context.Context, coll *mongo.Collection) (*mongoStore, error) {
+	typ, err := collectionType(ctx, coll)
+	if err != nil {
+		return nil, fmt.Errorf("inspecting %s: %w", coll.Name(), err)
+	}
+	if granularity := os.Getenv("READINGS_TIMESERIES"); typ == "" && granularity != "" {
+		if err := checkGranularity(granularity); err != nil {
+			return nil, fmt.Errorf("READINGS_TIMESERIES: %w", err)
+		}
+		if err := createTimeSeries(ctx, coll.Database(), coll.Name(), granularity); err != nil {
+			return nil, fmt.Errorf("creating %s: %w", coll.Name(), err)
+		}
+		log.Printf("Created %s as a time-series collection", coll.Name())
+		typ = "timeseries"
+	}
+	return &mongoStore{coll: coll, timeSeries: typ == "timeseries"}, nil
+}
+
+// insertMissing inserts the readings of rows that a time-series
+// collection doesn't have yet, as importReadings does with upserts
+// elsewhere. It returns how many were inserted.
+func insertMissing(ctx context.Context, coll *mongo.Collection, rows []reading) (int64, error) {
+	if len(rows) == 0 {
+		return 0, nil
+	}
+	keys := make(bson.A, len(rows))
+	for i, r := range rows {
+		keys[i] = r.key()
+	}
+	cursor, err := coll.Find(ctx, bson.M{"$or": keys}, options.Find().SetProjection(bson.M{"sensorId": 1, "updatedAt": 1}))
+	if err != nil {
+		return 0, err
+	}
+	var existing []reading
+	if err := cursor.All(ctx, &existing); err != nil {
+		return 0, err
+	}
+	type key struct {
+		sensor string
+		at     int64
+	}
+	seen := make(map[key]bool, len(existing))
+	for _, r := range existing {
+		seen[key{r.SensorID, r.UpdatedAt.UnixMilli()}] = true
+	}
+	var docs []any
+	for _, r := range rows {
+		k := key{r.SensorID, r.UpdatedAt.UnixMilli()}
+		if !seen[k] {
+			seen[k] = true
+			docs = append(docs, r)
+		}
+	}
+	if len(docs) == 0 {
+		return 0, nil
+	}
+	res, err := coll.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	if res != nil {
+		return int64(len(res.InsertedIDs)), err
+	}
+	return 0, err
+}
+
+// runMigrateTimeSeries converts the readings collection to a time-series
+// collection. Time-series collections can't be renamed, so the original
+// is renamed to temphums_backup and copied into a new temphums in _id
+// order, with a checkpoint in import_state so that an interrupted
+// migration can be run again to carry on. Stop anything writing readings
+// first, as a write between the rename and the create would make a
+// regular collection again.
+func runMigrateTimeSeries(args []string) (err error) {
+	fs := flag.NewFlagSet("migrate-timeseries", flag.ExitOnError)
+	granularity := fs.String("granularity", "minutes", "how often each sensor reports, roughly: seconds, minutes or hours")
+	batchSize := fs.Int("batch-size", 1000, "readings copied per insert")
+	dropBackup := fs.Bool("drop-backup", false, "drop the original collection once every reading is copied")
+	cluster := fs.String("cluster", "", "cluster from CLUSTERS_FILE to migrate, or a MongoDB URI (default MONGO_CLUSTER, or MONGO_URI)")
+	fs.Parse(args)
+	if err := checkGranularity(*granularity); err != nil {
+		return err
+	}
+	if *batchSize < 1 {
+		return errors.New("-batch-size must be at least 1")
+	}
+
+	ctx, stop := commandContext()
+	defer stop()
+	connectCtx, cancel := context.WithTimeout(ctx, mongoTimeouts.connect)
+	client, err := connectMongo(connectCtx, *cluster)
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if rerr := mongoClients.release(ctx, client); err == nil {
+			err = rerr
+		}
+	}()
+
+	db := client.Database(readingsDatabase)
+	current, backup := readings(client), db.Collection(readingsCollection+"_backup")
+	currentType, err := collectionType(ctx, current)
+	if err != nil {
+		return err
+	}
+	backupType, err := collectionType(ctx, backup)
+	if err != nil {
+		return err
+	}
+	switch {
+	case currentType == "timeseries" && backupType == "":
+		log.Printf("%s.%s is a time-series collection already", readingsDatabase, readingsCollection)
+		return nil
+	case currentType == "timeseries":
+		log.Printf("Carrying on copying from %s", backup.Name())
+	case backupType != "":
+		return fmt.Errorf("%s.%s exists already; rename or drop it first", readingsDatabase, backup.Name())
+	case currentType != "collection":
+		return fmt.Errorf("%s.%s is not a collection to migrate", readingsDatabase, readingsCollection)
+	default:
+		err := client.Database("admin").RunCommand(ctx, bson.D{
+			{Key: "renameCollection", Value: readingsDatabase + "." + readingsCollection},
+			{Key: "to", Value: readingsDatabase + "." + backup.Name()},
+		}).Err()
+		if err != nil {
+			return fmt.Errorf("renaming %s: %w", readingsCollection, err)
+		}
+		if err := createTimeSeries(ctx, db, readingsCollection, *granularity); err != nil {
+			return fmt.Errorf("creating the time-series collection (%s.%s holds the readings): %w", readingsDatabase, backup.Name(), err)
+		}
+		log.Printf("Renamed %s to %s and created a time-series %s", readingsCollection, backup.Name(), readingsCollection)
+	}
+
+	state := importState(client)
+	cur, err := loadImportCursor(ctx, state, "migrate-timeseries")
+	if err != nil {
+		return err
+	}
+	filter := bson.M{}
+	if cur.LastID != nil {
+		filter = bson.M{"_id": bson.M{"$gt": cur.LastID}}
+	}
+	cursor, err := backup.Find(ctx, filter, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	// Time-series collections don't enforce unique _ids, so the batch an
+	// interrupted run was inserting is checked for readings copied already
+	resumed := cur.LastID != nil
+	var copied int64
+	var batch []bson.M
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		docs := make([]any, 0, len(batch))
+		if resumed {
+			ids := make(bson.A, len(batch))
+			for i, doc := range batch {
+				ids[i] = doc["_id"]
+			}
+			present, err := current.Distinct(ctx, "_id", bson.M{"_id": bson.M{"$in": ids}})
+			if err != nil {
+				return err
+			}
+			seen := make(map[any]bool, len(present))
+			for _, id := range present {
+				seen[id] = true
+			}
+			for _, doc := range batch {
+				if !seen[doc["_id"]] {
+					docs = append(docs, doc)
+				}
+			}
+			resumed = false
+		} else {
+			for _, doc := range batch {
+				docs = append(docs, doc)
+			}
+		}
+		if len(docs) > 0 {
+			if _, err := current.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false)); err != nil {
+				return err
+			}
+		}
+		copied += int64(len(docs))
+		cur.LastID = batch[len(batch)-1]["_id"]
+		batch = batch[:0]
+		return saveImportCursor(ctx, state, cur)
+	}
+	for cursor.Next(ctx) {
+		var doc bson.M
+		if err := cursor.Decode(&doc); err != nil {
+			return err
+		}
+		batch = append(batch, doc)
+		if len(batch) == *batchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	// Readings written since the migration started are in the new
+	// collection only, so it may hold more
+	want, err := backup.CountDocuments(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	got, err := current.CountDocuments(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	log.Printf("Copied %d readings; %s has %d, %s %d", copied, backup.Name(), want, readingsCollection, got)
+	if got < want {
+		return fmt.Errorf("%s has %d fewer readings than %s; run the migration again", readingsCollection, want-got, backup.Name())
+	}
+	if *dropBackup {
+		if err := backup.Drop(ctx); err != nil {
+			return err
+		}
+		log.Printf("Dropped %s", backup.Name())
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// Averaging modes. A sample average counts each reading once, so a
+// sensor reporting every minute outweighs one reporting every ten. A
+// time-weighted average counts each reading for as long as it stood.
+const (
+	weightingSample = "sample"
+	weightingTime   = "time"
+)
+
+// checkWeighting validates an averaging mode given on the command line
+// or in a request.
+func checkWeighting(w string) error {
+	if w != weightingSample && w != weightingTime {
+		return fmt.Errorf("unknown weighting %q (expected sample or time)", w)
+	}
+	return nil
+}
+
+// timeWeightedAverages averages calibrated readings per bucket, and per
+// sensor when bySensor is set, weighting each reading by how long it
+// stood: until the sensor's next reading, the end of the reading's
+// bucket or offlineAfter, whichever comes first. bucket returns the key
+// and end of the bucket holding a time. Count stays the number of
+// readings, so the buckets still merge with sample averages.
+func timeWeightedAverages[K cmp.Ordered](history []reading, cal calibration, bySensor bool, bucket func(time.Time) (K, time.Time)) []bucketAvg[K] {
+	type group struct {
+		key    K
+		sensor string
+	}
+	type sums struct {
+		temperature, humidity, weight float64
+		co2, co2Weight                float64
+		pressure, pressureWeight      float64
+	}
+	// Readings of one sensor, in order, to find when each was superseded
+	bySensorID := map[string][]reading{}
+	for _, r := range history {
+		bySensorID[r.SensorID] = append(bySensorID[r.SensorID], r)
+	}
+	buckets := map[group]*bucketAvg[K]{}
+	totals := map[group]*sums{}
+	for id, rs := range bySensorID {
+		slices.SortStableFunc(rs, func(a, b reading) int { return a.UpdatedAt.Compare(b.UpdatedAt) })
+		o := cal[id]
+		for i, r := range rs {
+			key, end := bucket(r.UpdatedAt)
+			if stale := r.UpdatedAt.Add(offlineAfter); stale.Before(end) {
+				end = stale
+			}
+			if i+1 < len(rs) && rs[i+1].UpdatedAt.Before(end) {
+				end = rs[i+1].UpdatedAt
+			}
+			// Readings sharing a timestamp still count a little
+			w := max(end.Sub(r.UpdatedAt).Seconds(), 0.001)
+
+			g := group{key: key}
+			if bySensor {
+				g.sensor = id
+			}
+			b, ok := buckets[g]
+			if !ok {
+				b = &bucketAvg[K]{Key: key, Sensor: g.sensor}
+				buckets[g], totals[g] = b, &sums{}
+			}
+			s := totals[g]
+			b.Count++
+			s.temperature += (r.Temperature + o.Temperature) * w
+			s.humidity += (r.Humidity + o.Humidity) * w
+			s.weight += w
+			if r.CO2 != nil {
+				b.CO2Count++
+				s.co2 += *r.CO2 * w
+				s.co2Weight += w
+			}
+			if r.Pressure != nil {
+				b.PressureCount++
+				s.pressure += *r.Pressure * w
+				s.pressureWeight += w
+			}
+		}
+	}
+
+	out := make([]bucketAvg[K], 0, len(buckets))
+	for g, b := range buckets {
+		s := totals[g]
+		b.Temperature = s.temperature / s.weight
+		b.Humidity = s.humidity / s.weight
+		if s.co2Weight > 0 {
+			avg := s.co2 / s.co2Weight
+			b.CO2 = &avg
+		}
+		if s.pressureWeight > 0 {
+			avg := s.pressure / s.pressureWeight
+			b.Pressure = &avg
+		}
+		out = append(out, *b)
+	}
+	slices.SortFunc(out, func(a, b bucketAvg[K]) int {
+		return cmp.Or(cmp.Compare(a.Key, b.Key), cmp.Compare(a.Sensor, b.Sensor))
+	})
+	return out
+}
+
+// intervalBucket buckets times into intervals of interval milliseconds
+// aligned to the Unix epoch, as intervalAverages does.
+func intervalBucket(interval int64) func(time.Time) (int64, time.Time) {
+	return func(t time.Time) (int64, time.Time) {
+		ms := t.UnixMilli()
+		start := ms - ms%interval
+		return start, time.UnixMilli(start + interval)
+	}
+}
+
+// hourBucket buckets times into local hours in loc, keyed as
+// hourlyAverages keys them.
+func hourBucket(loc *time.Location) func(time.Time) (string, time.Time) {
+	return func(t time.Time) (string, time.Time) {
+		t = t.In(loc)
+		// Truncate would go wrong in zones offset by part of an hour
+		start := t.Add(-time.Duration(t.Minute())*time.Minute - time.Duration(t.Second())*time.Second - time.Duration(t.Nanosecond()))
+		return start.Format(time.DateTime), start.Add(time.Hour)
+	}
+}
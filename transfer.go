@@ -0,0 +1,885 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"maps"
+	"math"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+
+	"temphums_go/pipeline"
+)
+
+// Keys a transfer can upsert records by
+const (
+	transferKeyID = "id"
+	// transferKeyNatural matches records by sensor and time, for
+	// destinations that stored the same readings under other _ids
+	transferKeyNatural = "natural"
+)
+
+// runTransfer copies the readings in a date range from a MongoDB
+// deployment to another, or to PostgreSQL, SQLite, InfluxDB or a
+// Prometheus remote-write endpoint. Records
+// replace any destination record with the same key, so a transfer can
+// be repeated safely. Progress is checkpointed in the import_state
+// collection of the destination, or of the source when the destination
+// isn't MongoDB, so an interrupted transfer can pick up where it
+// stopped.
+func runTransfer(args []string) error {
+	fs := flag.NewFlagSet("transfer", flag.ExitOnError)
+	start := fs.String("start", "", "copy records updated on or after this date, YYYY-MM-DD (required)")
+	end := fs.String("end", "", "copy records updated before this date, YYYY-MM-DD (required)")
+	source := fs.String("source", "", "source cluster from CLUSTERS_FILE, or a MongoDB URI (default MONGO_CLUSTER, or MONGO_URI)")
+	dest := fs.String("dest", "", "destination cluster from CLUSTERS_FILE, or a URI: mongodb://, postgres://, sqlite:PATH, influx+http(s):// or prom+http(s):// (remote write) (required)")
+	// The names these had before clusters could be named
+	fs.StringVar(source, "source-uri", "", "same as -source")
+	fs.StringVar(dest, "dest-uri", "", "same as -dest")
+	sourceDB := fs.String("source-db", readingsDatabase, "source database")
+	sourceColl := fs.String("source-collection", readingsCollection, "source collection")
+	destDB := fs.String("dest-db", readingsDatabase, "destination database, or InfluxDB bucket")
+	destColl := fs.String("dest-collection", readingsCollection, "destination collection, table or InfluxDB measurement")
+	batchSize := fs.Int("batch-size", 1000, "records written per bulk request")
+	upsert := fs.String("upsert", transferKeyID, "key to upsert by in MongoDB: id (the source _id) or natural (sensorId and updatedAt)")
+	resume := fs.Bool("resume", false, "continue an interrupted transfer from its checkpoint")
+	restart := fs.Bool("restart", false, "discard the checkpoint of an interrupted transfer and start over")
+	dryRun := fs.Bool("dry-run", false, "report how many records and bytes would be copied without writing")
+	verify := fs.Bool("verify", false, "compare per-day counts and checksums of source and destination afterwards")
+	workers := fs.Int("workers", 1, "split the range into this many slices copied concurrently")
+	follow := fs.Bool("follow", false, "after copying, keep applying the source's inserts and updates until interrupted")
+	retries := fs.Int("retries", 3, "times to retry a failed slice from its checkpoint")
+	move := fs.Bool("move", false, "delete each batch from the source once the destination is confirmed to hold it")
+	createIndexes := fs.Bool("create-indexes", false, "create missing indexes of the source and, on MongoDB, destination collections first (see ensure-indexes)")
+	sourceTLS := mongoTLSFlags(fs, "source", "MONGO", "source")
+	destTLS := mongoTLSFlags(fs, "dest", "MONGO_DEST", "destination")
+	fs.Parse(args)
+
+	if *start == "" || *end == "" {
+		return usageError("usage: transfer -start YYYY-MM-DD -end YYYY-MM-DD [flags]")
+	}
+	startDate, err := time.Parse(time.DateOnly, *start)
+	if err != nil {
+		return fmt.Errorf("-start: %w", err)
+	}
+	endDate, err := time.Parse(time.DateOnly, *end)
+	if err != nil {
+		return fmt.Errorf("-end: %w", err)
+	}
+	if *batchSize < 1 {
+		return errors.New("-batch-size must be at least 1")
+	}
+	if *upsert != transferKeyID && *upsert != transferKeyNatural {
+		return fmt.Errorf("-upsert must be %s or %s", transferKeyID, transferKeyNatural)
+	}
+	if *workers < 1 || *retries < 0 {
+		return errors.New("-workers must be at least 1 and -retries at least 0")
+	}
+	if *resume && *restart {
+		return errors.New("-resume and -restart are mutually exclusive")
+	}
+	if *move && *verify && !*dryRun {
+		// Moved batches are verified one by one instead
+		return errors.New("-verify compares the source with the destination, which -move empties; each moved batch is verified before it is deleted")
+	}
+	if !startDate.Before(endDate) {
+		return fmt.Errorf("-start %s is not before -end %s", *start, *end)
+	}
+	if *dest == "" {
+		return errors.New("-dest is required")
+	}
+	sourceURI, err := clusterURI(*source)
+	if err != nil {
+		return fmt.Errorf("-source: %w", err)
+	}
+	destURI, err := clusterURI(*dest)
+	if err != nil {
+		return fmt.Errorf("-dest: %w", err)
+	}
+	if sameMongoCollection(sourceURI, *sourceDB, *sourceColl, destURI, *destDB, *destColl) {
+		// Each batch would be written onto itself, and -move would then
+		// delete it
+		return fmt.Errorf("-source and -dest are the same collection, %s.%s", *sourceDB, *sourceColl)
+	}
+	scheme, _, _ := strings.Cut(destURI, ":")
+	if (strings.HasPrefix(scheme, "influx") || strings.HasPrefix(scheme, "prom")) && (*move || *verify) {
+		return errors.New("-move and -verify need to read back from the destination, which isn't supported for InfluxDB or remote write")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// A transfer within one cluster shares its client
+	connect := func(uri string, t mongoTLS) (*mongo.Client, error) {
+		connectCtx, cancel := context.WithTimeout(ctx, mongoTimeouts.connect)
+		defer cancel()
+		return mongoClients.connect(connectCtx, uri, t)
+	}
+	sourceClient, err := connect(sourceURI, clusterTLSOr(*source, *sourceTLS))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := mongoClients.release(context.Background(), sourceClient); err != nil {
+			log.Print(err)
+		}
+	}()
+	src := &mongoReader{coll: sourceClient.Database(*sourceDB).Collection(*sourceColl)}
+	// A transfer leaves the expiry of either side as it is
+	if *createIndexes {
+		if err := ensureReadingIndexes(ctx, src.coll, 0); err != nil {
+			return err
+		}
+	}
+
+	// Checkpoints are kept with the destination when it is MongoDB
+	var dst transferWriter
+	state := importState(sourceClient)
+	switch scheme {
+	case "mongodb", "mongodb+srv":
+		destClient, err := connect(destURI, clusterTLSOr(*dest, *destTLS))
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := mongoClients.release(context.Background(), destClient); err != nil {
+				log.Print(err)
+			}
+		}()
+		coll := destClient.Database(*destDB).Collection(*destColl)
+		if *createIndexes {
+			if err := ensureReadingIndexes(ctx, coll, 0); err != nil {
+				return err
+			}
+		}
+		if *move {
+			// Only delete from the source what can't be rolled back on
+			// the destination
+			if coll, err = coll.Clone(options.Collection().SetWriteConcern(writeconcern.Majority())); err != nil {
+				return err
+			}
+		}
+		typ, err := collectionType(ctx, coll)
+		if err != nil {
+			return err
+		}
+		dst, state = &mongoWriter{coll: coll, upsert: *upsert, timeSeries: typ == "timeseries"}, importState(destClient)
+	case "postgres", "postgresql", "sqlite":
+		sw, err := openSQLWriter(ctx, scheme, destURI, *destColl)
+		if err != nil {
+			return err
+		}
+		defer sw.db.Close()
+		dst = sw
+	case "influx+http", "influx+https":
+		if dst, err = newInfluxWriter(destURI, *destDB, *destColl); err != nil {
+			return err
+		}
+	case "prom+http", "prom+https":
+		// Label series with the locations of the source's registry
+		registry, err := loadSensors(ctx, sourceClient.Database(*sourceDB).Collection(sensorsCollection))
+		if err != nil {
+			return err
+		}
+		if dst, err = newRemoteWriter(destURI, "temphums", registry); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("-dest: unsupported scheme %q", scheme)
+	}
+
+	job := &transferJob{
+		src:       src,
+		dst:       dst,
+		state:     state,
+		batchSize: *batchSize,
+		move:      *move,
+		keyPrefix: fmt.Sprintf("transfer:%s.%s:%s", *sourceDB, *sourceColl, dst),
+	}
+	shards := splitTransfer(startDate, endDate, *workers)
+
+	// Checkpoints are per shard, so a resumed transfer must use the same
+	// number of workers
+	var checkpointed int
+	for i := range shards {
+		if shards[i].checkpoint, err = loadImportCursor(ctx, job.state, job.checkpointKey(shards[i])); err != nil {
+			return err
+		}
+		if !shards[i].checkpoint.SyncedTo.IsZero() {
+			checkpointed++
+		}
+	}
+	followKey := job.keyPrefix + ":follow"
+	following, err := loadImportCursor(ctx, job.state, followKey)
+	if err != nil {
+		return err
+	}
+	if *follow && following.ResumeToken != nil {
+		switch {
+		case *resume:
+			// Following only starts once the copy is complete
+			log.Printf("Resuming replication from the saved change stream position")
+			return job.follow(ctx, followKey, following.ResumeToken)
+		case *restart:
+			following.ResumeToken = nil
+		default:
+			return errors.New("an earlier transfer -follow was interrupted; use -resume or -restart")
+		}
+	}
+	switch {
+	case checkpointed == 0:
+	case *resume:
+		log.Printf("Resuming %d interrupted shards from their checkpoints", checkpointed)
+	case *restart:
+		log.Printf("Discarding %d checkpoints", checkpointed)
+		for i := range shards {
+			shards[i].checkpoint.SyncedTo = time.Time{}
+		}
+	default:
+		return fmt.Errorf("an earlier transfer of this range stopped part way (%d checkpoints); use -resume or -restart", checkpointed)
+	}
+
+	// Watch before copying so no change made during the copy is missed
+	var stream transferStream
+	if *follow && !*dryRun {
+		if stream, err = job.src.watch(ctx, nil); err != nil {
+			return fmt.Errorf("opening the change stream (it needs a replica set): %w", err)
+		}
+		defer stream.Close(context.Background())
+	}
+
+	if *dryRun {
+		var count, bytes int64
+		for _, sh := range shards {
+			c, b, err := job.src.size(ctx, sh)
+			if err != nil {
+				return err
+			}
+			count += c
+			bytes += b
+		}
+		verb := "transfer"
+		if *move {
+			verb = "move"
+		}
+		log.Printf("Would %s %d records (%.1f MB) from %s.%s to %s between %s and %s",
+			verb, count, float64(bytes)/1e6, *sourceDB, *sourceColl, dst, *start, *end)
+		if *verify {
+			return verifyTransfer(ctx, src, dst, startDate, endDate)
+		}
+		return nil
+	}
+
+	for _, sh := range shards {
+		n, _, err := job.src.size(ctx, sh)
+		if err != nil {
+			return err
+		}
+		job.expected += n
+	}
+	progressDone := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-progressDone:
+				return
+			case <-ticker.C:
+				done := job.done.Load()
+				log.Printf("Transferred %d of %d records (%.0f%%)", done, job.expected, 100*float64(done)/float64(max(job.expected, 1)))
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := range shards {
+		wg.Add(1)
+		go func(sh *transferShard) {
+			defer wg.Done()
+			for sh.attempts = 1; ; sh.attempts++ {
+				var n int64
+				n, sh.err = job.run(ctx, sh)
+				sh.records += n
+				if sh.err == nil || ctx.Err() != nil || sh.attempts > *retries {
+					return
+				}
+				// Retries pick up from the shard's checkpoint
+				backoff := time.Duration(sh.attempts) * 5 * time.Second
+				log.Printf("Shard %s: %v (retrying in %s)", sh, sh.err, backoff)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(backoff):
+				}
+			}
+		}(&shards[i])
+	}
+	wg.Wait()
+	close(progressDone)
+
+	var total int64
+	var failed []string
+	for _, sh := range shards {
+		total += sh.records
+		if len(shards) > 1 {
+			status := "done"
+			if sh.err != nil {
+				status = "failed: " + sh.err.Error()
+			}
+			log.Printf("Shard %s: %d records in %d attempts, %s", sh, sh.records, sh.attempts, status)
+		}
+		if sh.err != nil {
+			failed = append(failed, sh.String())
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("transferred %d records, but %d of %d shards failed (%s); run again with -resume",
+			total, len(failed), len(shards), strings.Join(failed, ", "))
+	}
+	if total == 0 {
+		log.Printf("No records found between %s and %s", *start, *end)
+	} else {
+		verb := "Transferred"
+		if *move {
+			verb = "Moved"
+		}
+		log.Printf("%s %d records from %s.%s to %s between %s and %s",
+			verb, total, *sourceDB, *sourceColl, dst, *start, *end)
+	}
+	if *verify {
+		if err := verifyTransfer(ctx, src, dst, startDate, endDate); err != nil {
+			return err
+		}
+	}
+	if stream != nil {
+		log.Printf("Following changes to %s.%s; interrupt to stop", *sourceDB, *sourceColl)
+		return job.apply(ctx, followKey, stream)
+	}
+	return nil
+}
+
+// transferJob holds what every shard of a transfer shares.
+type transferJob struct {
+	src       transferReader
+	dst       transferWriter
+	state     *mongo.Collection
+	batchSize int
+	// move deletes each batch from the source once it is verified
+	move      bool
+	keyPrefix string
+
+	expected int64
+	done     atomic.Int64
+}
+
+// transferReader is the source of a transfer. Only MongoDB can be a
+// source so far.
+type transferReader interface {
+	// read streams the shard's remaining records ordered by updatedAt
+	// and _id, so a checkpoint marks everything before it
+	read(ctx context.Context, sh transferShard, batchSize int) (transferCursor, error)
+	// size returns how many records of the shard remain and their size
+	size(ctx context.Context, sh transferShard) (count, bytes int64, err error)
+	digest(ctx context.Context, from, to time.Time) (map[string]dayDigest, error)
+	// remove deletes records by _id
+	remove(ctx context.Context, ids []any) error
+	// watch opens a stream of inserts and updates, from token when it
+	// is set
+	watch(ctx context.Context, token bson.Raw) (transferStream, error)
+}
+
+// transferCursor iterates over source records; *mongo.Cursor is one.
+type transferCursor interface {
+	Next(ctx context.Context) bool
+	Decode(v any) error
+	Err() error
+	Close(ctx context.Context) error
+}
+
+// transferStream is a transferCursor over changes that can be resumed.
+type transferStream interface {
+	transferCursor
+	ResumeToken() bson.Raw
+}
+
+// transferWriter is the destination of a transfer. Its String names it
+// in logs and checkpoint keys.
+type transferWriter interface {
+	fmt.Stringer
+	// write replaces the destination's copy of each record
+	write(ctx context.Context, records []bson.M) error
+	// missing counts the records that the destination doesn't hold
+	missing(ctx context.Context, records []bson.M) (int64, error)
+	digest(ctx context.Context, from, to time.Time) (map[string]dayDigest, error)
+}
+
+// transferShard is one time slice of a transfer, copied by its own
+// worker.
+type transferShard struct {
+	from, to   time.Time
+	checkpoint importCursor
+
+	records  int64
+	attempts int
+	err      error
+}
+
+func (sh transferShard) String() string {
+	return sh.from.Format(time.RFC3339) + "/" + sh.to.Format(time.RFC3339)
+}
+
+// filter matches the shard's records not yet copied.
+func (sh transferShard) filter() bson.M {
+	filter := bson.M{"updatedAt": bson.M{"$gte": sh.from, "$lt": sh.to}}
+	if cp := sh.checkpoint; !cp.SyncedTo.IsZero() {
+		filter = bson.M{"$and": bson.A{filter, bson.M{"$or": bson.A{
+			bson.M{"updatedAt": bson.M{"$gt": cp.SyncedTo}},
+			bson.M{"updatedAt": cp.SyncedTo, "_id": bson.M{"$gt": cp.LastID}},
+		}}}}
+	}
+	return filter
+}
+
+// sameMongoCollection reports whether two MongoDB URIs, databases and
+// collections name the same collection: the URIs have the same scheme
+// and hosts, whatever their credentials, options and order of hosts.
+func sameMongoCollection(aURI, aDB, aColl, bURI, bDB, bColl string) bool {
+	if aDB != bDB || aColl != bColl {
+		return false
+	}
+	a, aOK := mongoHosts(aURI)
+	b, bOK := mongoHosts(bURI)
+	if !aOK || !bOK {
+		return aURI == bURI
+	}
+	return a == b
+}
+
+// mongoHosts returns the scheme and sorted hosts of a MongoDB URI, ports
+// filled in, or false when it isn't one. The hosts are split by hand, as
+// url.Parse rejects most lists of them.
+func mongoHosts(uri string) (string, bool) {
+	scheme, rest, ok := strings.Cut(uri, "://")
+	if !ok || (scheme != "mongodb" && scheme != "mongodb+srv") {
+		return "", false
+	}
+	if i := strings.IndexAny(rest, "/?"); i >= 0 {
+		rest = rest[:i]
+	}
+	if i := strings.LastIndex(rest, "@"); i >= 0 {
+		rest = rest[i+1:]
+	}
+	hosts := strings.Split(strings.ToLower(rest), ",")
+	for i, h := range hosts {
+		// An IPv6 address is bracketed, so its port follows "]:"
+		hasPort := strings.Contains(h, "]:") || (!strings.HasPrefix(h, "[") && strings.Contains(h, ":"))
+		if scheme == "mongodb" && !hasPort {
+			hosts[i] = h + ":27017"
+		}
+	}
+	slices.Sort(hosts)
+	return scheme + "://" + strings.Join(hosts, ","), true
+}
+
+// splitTransfer divides [from, to) into n slices of equal length, on
+// whole seconds.
+func splitTransfer(from, to time.Time, n int) []transferShard {
+	step := (to.Sub(from) / time.Duration(n)).Truncate(time.Second)
+	if step <= 0 {
+		n, step = 1, to.Sub(from)
+	}
+	shards := make([]transferShard, n)
+	for i := range shards {
+		shards[i].from = from.Add(time.Duration(i) * step)
+		shards[i].to = from.Add(time.Duration(i+1) * step)
+	}
+	shards[n-1].to = to
+	return shards
+}
+
+// A checkpoint belongs to one slice between one source and destination
+func (j *transferJob) checkpointKey(sh transferShard) string {
+	return j.keyPrefix + ":" + sh.String()
+}
+
+// run copies the shard's remaining records, advancing its checkpoint
+// after each batch, and returns how many it copied.
+func (j *transferJob) run(ctx context.Context, sh *transferShard) (int64, error) {
+	// Stream the cursor so memory use is bounded by the batch size
+	cursor, err := j.src.read(ctx, *sh, j.batchSize)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	batch := make([]bson.M, 0, j.batchSize)
+	var total int64
+	last := sh.checkpoint
+	last.Key = j.checkpointKey(*sh)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := j.dst.write(ctx, batch); err != nil {
+			return fmt.Errorf("after %d records: %w", total, err)
+		}
+		if j.move {
+			if err := j.remove(ctx, batch); err != nil {
+				return fmt.Errorf("after %d records: %w", total, err)
+			}
+		}
+		total += int64(len(batch))
+		j.done.Add(int64(len(batch)))
+		batch = batch[:0]
+		if err := saveImportCursor(ctx, j.state, last); err != nil {
+			return fmt.Errorf("saving checkpoint: %w", err)
+		}
+		sh.checkpoint = last
+		return nil
+	}
+	for cursor.Next(ctx) {
+		var record bson.M
+		if err := cursor.Decode(&record); err != nil {
+			return total, err
+		}
+		if t, ok := record["updatedAt"].(primitive.DateTime); ok {
+			last.SyncedTo, last.LastID = t.Time(), record["_id"]
+		}
+		batch = append(batch, record)
+		if len(batch) == j.batchSize {
+			if err := flush(); err != nil {
+				return total, err
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return total, err
+	}
+	if err := flush(); err != nil {
+		return total, err
+	}
+	_, err = j.state.DeleteOne(ctx, bson.M{"_id": last.Key})
+	return total, err
+}
+
+// remove deletes a written batch from the source, once the destination
+// is confirmed to hold every record of it.
+func (j *transferJob) remove(ctx context.Context, batch []bson.M) error {
+	missing, err := j.dst.missing(ctx, batch)
+	if err != nil {
+		return fmt.Errorf("verifying batch: %w", err)
+	}
+	if missing > 0 {
+		return fmt.Errorf("destination lacks %d of the %d records just written; leaving them in the source", missing, len(batch))
+	}
+	ids := make([]any, len(batch))
+	for i, record := range batch {
+		ids[i] = record["_id"]
+	}
+	if err := j.src.remove(ctx, ids); err != nil {
+		return fmt.Errorf("deleting from source: %w", err)
+	}
+	return nil
+}
+
+// dayDigest summarises one day of records. The sums act as a checksum
+// that changes when any reading is missing, extra or altered.
+type dayDigest struct {
+	Day         string  `bson:"_id"`
+	Count       int64   `bson:"count"`
+	Temperature float64 `bson:"temperature"`
+	Humidity    float64 `bson:"humidity"`
+	Times       int64   `bson:"times"`
+}
+
+func digestDays(ctx context.Context, coll *mongo.Collection, from, to time.Time) (map[string]dayDigest, error) {
+	cursor, err := coll.Aggregate(ctx, pipeline.New().
+		Match(bson.M{"updatedAt": bson.M{"$gte": from, "$lt": to}}).
+		Bucket(pipeline.DateString("%Y-%m-%d", "$updatedAt", "")).
+		Stats(
+			pipeline.Count("count"),
+			pipeline.Sum("temperature", "$temperature"),
+			pipeline.Sum("humidity", "$humidity"),
+			pipeline.Sum("times", pipeline.EpochMillis("$updatedAt")),
+		).
+		Pipeline())
+	if err != nil {
+		return nil, err
+	}
+	var days []dayDigest
+	if err := cursor.All(ctx, &days); err != nil {
+		return nil, err
+	}
+	out := make(map[string]dayDigest, len(days))
+	for _, d := range days {
+		out[d.Day] = d
+	}
+	return out, nil
+}
+
+// verifyTransfer compares the source and destination day by day and
+// fails if any day differs.
+func verifyTransfer(ctx context.Context, src transferReader, dst transferWriter, from, to time.Time) error {
+	want, err := src.digest(ctx, from, to)
+	if err != nil {
+		return fmt.Errorf("digesting source: %w", err)
+	}
+	got, err := dst.digest(ctx, from, to)
+	if err != nil {
+		return fmt.Errorf("digesting destination: %w", err)
+	}
+	days := make([]string, 0, len(want)+len(got))
+	for day := range want {
+		days = append(days, day)
+	}
+	for day := range got {
+		if _, ok := want[day]; !ok {
+			days = append(days, day)
+		}
+	}
+	slices.Sort(days)
+
+	// Sums of floats can differ in the last bits with summation order
+	same := func(a, b float64) bool { return math.Abs(a-b) <= 1e-6*max(1, math.Abs(a)) }
+	var bad int
+	for _, day := range days {
+		w, g := want[day], got[day]
+		switch {
+		case w.Count != g.Count:
+			log.Printf("%s: %d records in source, %d in destination", day, w.Count, g.Count)
+		case w.Times != g.Times || !same(w.Temperature, g.Temperature) || !same(w.Humidity, g.Humidity):
+			log.Printf("%s: %d records in both, but their contents differ", day, w.Count)
+		default:
+			continue
+		}
+		bad++
+	}
+	if bad > 0 {
+		return fmt.Errorf("verification failed: %d of %d days differ", bad, len(days))
+	}
+	log.Printf("Verified %d days: source and destination match", len(days))
+	return nil
+}
+
+// mongoReader reads a transfer from a MongoDB collection.
+type mongoReader struct {
+	coll *mongo.Collection
+}
+
+func (m *mongoReader) read(ctx context.Context, sh transferShard, batchSize int) (transferCursor, error) {
+	return m.coll.Find(ctx, sh.filter(), options.Find().
+		SetBatchSize(int32(batchSize)).
+		SetSort(bson.D{{Key: "updatedAt", Value: 1}, {Key: "_id", Value: 1}}))
+}
+
+func (m *mongoReader) size(ctx context.Context, sh transferShard) (int64, int64, error) {
+	var rows []struct {
+		Count int64 `bson:"count"`
+		Bytes int64 `bson:"bytes"`
+	}
+	cursor, err := m.coll.Aggregate(ctx, pipeline.New().
+		Match(sh.filter()).
+		Bucket(nil).
+		Stats(pipeline.Count("count"), pipeline.Sum("bytes", bson.M{"$bsonSize": "$$ROOT"})).
+		Pipeline())
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := cursor.All(ctx, &rows); err != nil || len(rows) == 0 {
+		return 0, 0, err
+	}
+	return rows[0].Count, rows[0].Bytes, nil
+}
+
+func (m *mongoReader) digest(ctx context.Context, from, to time.Time) (map[string]dayDigest, error) {
+	return digestDays(ctx, m.coll, from, to)
+}
+
+func (m *mongoReader) remove(ctx context.Context, ids []any) error {
+	_, err := m.coll.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	return err
+}
+
+// watch follows inserts and updates only. Deletes are not replicated,
+// so tiering or moving old data off the source leaves the destination
+// intact.
+func (m *mongoReader) watch(ctx context.Context, token bson.Raw) (transferStream, error) {
+	pipeline := bson.A{bson.M{"$match": bson.M{"operationType": bson.M{"$in": bson.A{"insert", "update", "replace"}}}}}
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	if token != nil {
+		opts.SetResumeAfter(token)
+	}
+	return m.coll.Watch(ctx, pipeline, opts)
+}
+
+// mongoWriter writes a transfer to a MongoDB collection, keyed by the
+// source _id or by sensor and time.
+type mongoWriter struct {
+	coll   *mongo.Collection
+	upsert string
+	// timeSeries is set for a time-series collection, which can't
+	// replace documents, so records it has already are skipped instead
+	timeSeries bool
+}
+
+func (m *mongoWriter) String() string {
+	return m.coll.Database().Name() + "." + m.coll.Name()
+}
+
+func (m *mongoWriter) write(ctx context.Context, records []bson.M) error {
+	if m.timeSeries {
+		return m.insertNew(ctx, records)
+	}
+	models := make([]mongo.WriteModel, len(records))
+	for i, record := range records {
+		models[i] = m.model(record)
+	}
+	_, err := m.coll.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+// model replaces the destination's copy of record.
+func (m *mongoWriter) model(record bson.M) mongo.WriteModel {
+	filter := bson.M{"_id": record["_id"]}
+	if m.upsert == transferKeyNatural {
+		// A matched record keeps its own _id, which can't be replaced
+		filter = bson.M{"sensorId": record["sensorId"], "updatedAt": record["updatedAt"]}
+		record = maps.Clone(record)
+		delete(record, "_id")
+	}
+	return mongo.NewReplaceOneModel().SetFilter(filter).SetReplacement(record).SetUpsert(true)
+}
+
+// insertNew inserts the records the destination doesn't have yet.
+func (m *mongoWriter) insertNew(ctx context.Context, records []bson.M) error {
+	if len(records) == 0 {
+		return nil
+	}
+	key := func(record bson.M) string {
+		if m.upsert == transferKeyNatural {
+			return fmt.Sprint(record["sensorId"], record["updatedAt"])
+		}
+		return fmt.Sprint(record["_id"])
+	}
+	filters := make(bson.A, len(records))
+	for i, record := range records {
+		filters[i] = bson.M{"_id": record["_id"]}
+		if m.upsert == transferKeyNatural {
+			filters[i] = bson.M{"sensorId": record["sensorId"], "updatedAt": record["updatedAt"]}
+		}
+	}
+	cursor, err := m.coll.Find(ctx, bson.M{"$or": filters},
+		options.Find().SetProjection(bson.M{"_id": 1, "sensorId": 1, "updatedAt": 1}))
+	if err != nil {
+		return err
+	}
+	var existing []bson.M
+	if err := cursor.All(ctx, &existing); err != nil {
+		return err
+	}
+	seen := make(map[string]bool, len(existing))
+	for _, record := range existing {
+		seen[key(record)] = true
+	}
+	var docs []any
+	for _, record := range records {
+		k := key(record)
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		if m.upsert == transferKeyNatural {
+			record = maps.Clone(record)
+			delete(record, "_id")
+		}
+		docs = append(docs, record)
+	}
+	if len(docs) == 0 {
+		return nil
+	}
+	_, err = m.coll.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	return err
+}
+
+func (m *mongoWriter) missing(ctx context.Context, records []bson.M) (int64, error) {
+	ids := make(bson.A, len(records))
+	keys := make(bson.A, len(records))
+	distinct := map[string]bool{}
+	for i, record := range records {
+		ids[i] = record["_id"]
+		keys[i] = bson.M{"sensorId": record["sensorId"], "updatedAt": record["updatedAt"]}
+		distinct[fmt.Sprint(record["sensorId"], record["updatedAt"])] = true
+	}
+	filter := bson.M{"_id": bson.M{"$in": ids}}
+	want := int64(len(records))
+	if m.upsert == transferKeyNatural {
+		// Source records sharing a key were written as one
+		filter, want = bson.M{"$or": keys}, int64(len(distinct))
+	}
+	got, err := m.coll.CountDocuments(ctx, filter)
+	return want - got, err
+}
+
+func (m *mongoWriter) digest(ctx context.Context, from, to time.Time) (map[string]dayDigest, error) {
+	return digestDays(ctx, m.coll, from, to)
+}
+
+// follow resumes replication from a saved change stream position.
+func (j *transferJob) follow(ctx context.Context, key string, token bson.Raw) error {
+	stream, err := j.src.watch(ctx, token)
+	if err != nil {
+		return err
+	}
+	defer stream.Close(context.Background())
+	return j.apply(ctx, key, stream)
+}
+
+// apply copies each change to the destination until ctx is done,
+// saving the stream position under key after each one.
+func (j *transferJob) apply(ctx context.Context, key string, stream transferStream) error {
+	var applied int
+	lastLog := time.Now()
+	for stream.Next(ctx) {
+		var event struct {
+			FullDocument bson.M `bson:"fullDocument"`
+		}
+		if err := stream.Decode(&event); err != nil {
+			return err
+		}
+		// The document may be gone by the time an update is looked up
+		if event.FullDocument != nil {
+			if err := j.dst.write(ctx, []bson.M{event.FullDocument}); err != nil {
+				return err
+			}
+			applied++
+		}
+		if err := saveImportCursor(ctx, j.state, importCursor{Key: key, ResumeToken: stream.ResumeToken()}); err != nil {
+			return fmt.Errorf("saving stream position: %w", err)
+		}
+		if time.Since(lastLog) >= time.Minute {
+			log.Printf("Applied %d changes", applied)
+			lastLog = time.Now()
+		}
+	}
+	if ctx.Err() != nil {
+		log.Printf("Stopped following after %d changes", applied)
+		return nil
+	}
+	return stream.Err()
+}
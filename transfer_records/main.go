@@ -1,7 +0,0 @@
-package main
-
-import "temphums_go/transfer_recs"
-
-func main() {
-	transfer_recs.TransferRecords()
-}
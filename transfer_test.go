@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestSameMongoCollection(t *testing.T) {
+	const uri = "mongodb://localhost:27017"
+	tests := []struct {
+		name             string
+		aURI, aDB, aColl string
+		bURI, bDB, bColl string
+		want             bool
+	}{
+		{"defaults", uri, "ts", "temphums", uri, "ts", "temphums", true},
+		{"default port", "mongodb://localhost", "ts", "temphums", uri, "ts", "temphums", true},
+		{"credentials and options", "mongodb://u:p@LocalHost:27017/admin?retryWrites=true", "ts", "temphums", uri + "/", "ts", "temphums", true},
+		{"host order", "mongodb://a:27017,b:27018/", "ts", "temphums", "mongodb://b:27018,a", "ts", "temphums", true},
+		{"ipv6", "mongodb://[::1]", "ts", "temphums", "mongodb://[::1]:27017", "ts", "temphums", true},
+		{"srv", "mongodb+srv://cluster0.example.net/", "ts", "temphums", "mongodb+srv://u:p@cluster0.example.net", "ts", "temphums", true},
+		{"other collection", uri, "ts", "temphums", uri, "ts", "archive", false},
+		{"other database", uri, "ts", "temphums", uri, "archive", "temphums", false},
+		{"other host", uri, "ts", "temphums", "mongodb://backup:27017", "ts", "temphums", false},
+		{"other port", uri, "ts", "temphums", "mongodb://localhost:27018", "ts", "temphums", false},
+		{"srv and seed list", "mongodb+srv://cluster0.example.net", "ts", "temphums", "mongodb://cluster0.example.net", "ts", "temphums", false},
+		{"not mongodb", uri, "ts", "temphums", "sqlite:ts.db", "ts", "temphums", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sameMongoCollection(tt.aURI, tt.aDB, tt.aColl, tt.bURI, tt.bDB, tt.bColl); got != tt.want {
+				t.Errorf("sameMongoCollection(%q, %q, %q, %q, %q, %q) = %v, want %v", tt.aURI, tt.aDB, tt.aColl, tt.bURI, tt.bDB, tt.bColl, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSQLMissingInBatches(t *testing.T) {
+	ctx := context.Background()
+	w, err := openSQLWriter(ctx, "sqlite", "sqlite:"+filepath.Join(t.TempDir(), "transfer.db"), "temphums")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.db.Close()
+	// More records than a query looks up, and than its parameters allow
+	start := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	records := make([]bson.M, 2*missingBatchSize+500)
+	for i := range records {
+		records[i] = bson.M{"sensorId": "a", "updatedAt": start.Add(time.Duration(i) * time.Minute), "temperature": 20.0, "humidity": 50.0}
+	}
+	// Every other record written, and one repeated
+	var written []bson.M
+	for i := 0; i < len(records); i += 2 {
+		written = append(written, records[i])
+	}
+	if err := w.write(ctx, written); err != nil {
+		t.Fatal(err)
+	}
+	got, err := w.missing(ctx, append(records, records[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(len(records) - len(written)); got != want {
+		t.Errorf("missing %d records, want %d", got, want)
+	}
+}
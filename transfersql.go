@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	_ "modernc.org/sqlite"
+)
+
+// sqliteTime is how SQLite destinations store times: text that sorts in
+// time order and that SQLite's date functions understand.
+const sqliteTime = "2006-01-02T15:04:05.000Z"
+
+// missingBatchSize is how many records missing looks up per query.
+const missingBatchSize = 10000
+
+var sqlIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// sqlWriter writes a transfer to a PostgreSQL (or TimescaleDB) or
+// SQLite table, keyed by sensor and time.
+type sqlWriter struct {
+	db      *sql.DB
+	dialect string
+	table   string
+}
+
+// openSQLWriter connects to a postgres:// URI or a sqlite:PATH file and
+// creates the table if it doesn't exist.
+func openSQLWriter(ctx context.Context, scheme, uri, table string) (*sqlWriter, error) {
+	if !sqlIdentifier.MatchString(table) {
+		return nil, fmt.Errorf("table name %q must be letters, digits and underscores", table)
+	}
+	w := &sqlWriter{dialect: "postgres", table: table}
+	driver, dsn := "postgres", uri
+	if scheme == "sqlite" {
+		w.dialect, driver = "sqlite", "sqlite"
+		dsn = sqliteDSN(strings.TrimPrefix(strings.TrimPrefix(uri, "sqlite:"), "//"))
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	w.db = db
+	if err := createReadingsTable(ctx, db, w.dialect, table); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating table %s: %w", table, err)
+	}
+	return w, nil
+}
+
+// sqliteDSN is the SQLite URI of a file path. URIs separate with
+// forward slashes, and a Windows drive letter needs one before it, as in
+// file:/C:/Users/me/archive.db.
+func sqliteDSN(path string) string {
+	path = filepath.ToSlash(path)
+	if filepath.VolumeName(path) != "" && !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return "file:" + path + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+}
+
+// createReadingsTable creates a readings table if it doesn't exist, in
+// the layout both transfers and STORAGE=postgres use. On TimescaleDB it
+// is made a hypertable.
+func createReadingsTable(ctx context.Context, db *sql.DB, dialect, table string) error {
+	timeType, floatType := "TIMESTAMPTZ", "DOUBLE PRECISION"
+	if dialect == "sqlite" {
+		timeType, floatType = "TEXT", "REAL"
+	}
+	// Hypertables need the time in every unique key, so records are
+	// keyed by sensor and time rather than the source _id
+	_, err := db.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %[1]s (
+		sensor_id TEXT NOT NULL,
+		updated_at %[2]s NOT NULL,
+		temperature %[3]s NOT NULL,
+		humidity %[3]s NOT NULL,
+		co2 %[3]s,
+		pressure %[3]s,
+		source_id TEXT,
+		PRIMARY KEY (sensor_id, updated_at)
+	)`, table, timeType, floatType))
+	if err != nil || dialect != "postgres" {
+		return err
+	}
+	var timescale bool
+	if err := db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'timescaledb')`).Scan(&timescale); err != nil {
+		return err
+	}
+	if timescale {
+		_, err = db.ExecContext(ctx, `SELECT create_hypertable($1, 'updated_at', if_not_exists => TRUE, migrate_data => TRUE)`, table)
+	}
+	return err
+}
+
+func (w *sqlWriter) String() string {
+	return w.dialect + ":" + w.table
+}
+
+// arg numbers query parameters the way the dialect expects.
+func (w *sqlWriter) arg(n int) string {
+	if w.dialect == "sqlite" {
+		return "?"
+	}
+	return fmt.Sprintf("$%d", n)
+}
+
+// time converts t to the column's type.
+func (w *sqlWriter) time(t time.Time) any {
+	if w.dialect == "sqlite" {
+		return t.UTC().Format(sqliteTime)
+	}
+	return t.UTC()
+}
+
+func (w *sqlWriter) write(ctx context.Context, records []bson.M) error {
+	rs := make([]reading, len(records))
+	ids := make([]string, len(records))
+	for i, record := range records {
+		r, err := recordReading(record)
+		if err != nil {
+			return err
+		}
+		rs[i], ids[i] = r, recordID(record)
+	}
+	return w.insert(ctx, rs, ids)
+}
+
+// insert writes readings, replacing any with the same sensor and time.
+// ids are the readings' source IDs, or nil if they have none.
+func (w *sqlWriter) insert(ctx context.Context, rs []reading, ids []string) error {
+	tx, err := w.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	args := make([]string, 7)
+	for i := range args {
+		args[i] = w.arg(i + 1)
+	}
+	stmt, err := tx.PrepareContext(ctx, fmt.Sprintf(`INSERT INTO %s
+		(sensor_id, updated_at, temperature, humidity, co2, pressure, source_id)
+		VALUES (%s)
+		ON CONFLICT (sensor_id, updated_at) DO UPDATE SET
+			temperature = excluded.temperature, humidity = excluded.humidity,
+			co2 = excluded.co2, pressure = excluded.pressure, source_id = excluded.source_id`,
+		w.table, strings.Join(args, ", ")))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for i, r := range rs {
+		var id *string
+		if ids != nil {
+			id = &ids[i]
+		}
+		if _, err := stmt.ExecContext(ctx, r.SensorID, w.time(r.UpdatedAt), r.Temperature, r.Humidity, r.CO2, r.Pressure, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (w *sqlWriter) missing(ctx context.Context, records []bson.M) (int64, error) {
+	// Source records sharing a key were written as one row
+	type key struct {
+		sensor string
+		at     time.Time
+	}
+	distinct := map[key]bool{}
+	var keys []key
+	for _, record := range records {
+		r, err := recordReading(record)
+		if err != nil {
+			return 0, err
+		}
+		k := key{r.SensorID, r.UpdatedAt}
+		if distinct[k] {
+			continue
+		}
+		distinct[k] = true
+		keys = append(keys, k)
+	}
+	cast := ""
+	if w.dialect == "postgres" {
+		cast = "::timestamptz"
+	}
+	var missing int64
+	for len(keys) > 0 {
+		// Two parameters a key, well under PostgreSQL's 65535 and SQLite's
+		// 32766 a query
+		batch := keys[:min(len(keys), missingBatchSize)]
+		keys = keys[len(batch):]
+		values := make([]string, len(batch))
+		args := make([]any, 0, 2*len(batch))
+		for i, k := range batch {
+			values[i] = fmt.Sprintf("(%s, %s%s)", w.arg(len(args)+1), w.arg(len(args)+2), cast)
+			args = append(args, k.sensor, w.time(k.at))
+		}
+		var got int64
+		err := w.db.QueryRowContext(ctx, fmt.Sprintf(`SELECT COUNT(*) FROM %s WHERE (sensor_id, updated_at) IN (VALUES %s)`,
+			w.table, strings.Join(values, ", ")), args...).Scan(&got)
+		if err != nil {
+			return 0, err
+		}
+		missing += int64(len(batch)) - got
+	}
+	return missing, nil
+}
+
+func (w *sqlWriter) digest(ctx context.Context, from, to time.Time) (map[string]dayDigest, error) {
+	// Days and times in UTC, as MongoDB digests them
+	day := `to_char(updated_at AT TIME ZONE 'UTC', 'YYYY-MM-DD')`
+	ms := `(EXTRACT(EPOCH FROM updated_at) * 1000)::BIGINT`
+	if w.dialect == "sqlite" {
+		day = `substr(updated_at, 1, 10)`
+		ms = `CAST(round((julianday(updated_at) - 2440587.5) * 86400000) AS INTEGER)`
+	}
+	rows, err := w.db.QueryContext(ctx, fmt.Sprintf(`SELECT %s AS day, COUNT(*), SUM(temperature), SUM(humidity), SUM(%s)
+		FROM %s WHERE updated_at >= %s AND updated_at < %s GROUP BY day`,
+		day, ms, w.table, w.arg(1), w.arg(2)), w.time(from), w.time(to))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := map[string]dayDigest{}
+	for rows.Next() {
+		var d dayDigest
+		if err := rows.Scan(&d.Day, &d.Count, &d.Temperature, &d.Humidity, &d.Times); err != nil {
+			return nil, err
+		}
+		out[d.Day] = d
+	}
+	return out, rows.Err()
+}
+
+// recordReading decodes a transferred record.
+func recordReading(record bson.M) (reading, error) {
+	var r reading
+	data, err := bson.Marshal(record)
+	if err != nil {
+		return r, err
+	}
+	err = bson.Unmarshal(data, &r)
+	return r, err
+}
+
+// recordID is the source _id of a record as text.
+func recordID(record bson.M) string {
+	if id, ok := record["_id"].(primitive.ObjectID); ok {
+		return id.Hex()
+	}
+	return fmt.Sprint(record["_id"])
+}
@@ -0,0 +1,6 @@
+package main
+
+// Windows has no IANA time zone database, and Go only finds one there
+// in its own installation, so reports in reportTimezone would fail on
+// machines without Go. Embed it instead.
+import _ "time/tzdata"
@@ -0,0 +1,493 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Settings for pre-signed bulk uploads
+const (
+	uploadsCollection = "uploads"
+	rejectsCollection = "upload_rejects"
+	uploadURLLifetime = time.Hour
+	maxUploadBody     = 64 << 20
+	uploadInsertBatch = 1000
+)
+
+// Upload job states
+const (
+	uploadPending    = "pending"
+	uploadProcessing = "processing"
+	uploadDone       = "done"
+	uploadFailed     = "failed"
+)
+
+// errUploadInterrupted fails the uploads the server stopped processing
+// part way through. The readings inserted before stay stored.
+var errUploadInterrupted = errors.New("interrupted when the server stopped; readings up to processed were stored")
+
+// uploadJob tracks one bulk upload from URL issue to ingestion.
+type uploadJob struct {
+	ID     string `bson:"_id" json:"id"`
+	Status string `bson:"status" json:"status"`
+	Mode   string `bson:"mode" json:"mode"`
+	// Template names the import template mapping a CSV upload
+	Template  string      `bson:"template,omitempty" json:"template,omitempty"`
+	Mapping   *csvMapping `bson:"mapping,omitempty" json:"-"`
+	CreatedAt time.Time   `bson:"createdAt" json:"createdAt"`
+	UpdatedAt time.Time   `bson:"updatedAt" json:"updatedAt"`
+	// Device is the device that created the job, or Key the credential
+	// ID of the API key, and only they may follow it
+	Device string `bson:"device,omitempty" json:"device,omitempty"`
+	Key    string `bson:"key,omitempty" json:"-"`
+
+	// Progress, updated after every batch
+	Total     int `bson:"total" json:"total"`
+	Processed int `bson:"processed" json:"processed"`
+	Inserted  int `bson:"inserted" json:"inserted"`
+	Rejected  int `bson:"rejected" json:"rejected"`
+	// Coerced counts rows fixed up in lenient mode
+	Coerced int `bson:"coerced" json:"coerced"`
+
+	// Error is set when the file as a whole could not be processed
+	Error string `bson:"error,omitempty" json:"error,omitempty"`
+}
+
+// uploadOwner identifies who is calling: the device, or else the API key
+// by its credential ID.
+func uploadOwner(r *http.Request) (device, key string) {
+	if d := contextDevice(r.Context()); d != nil {
+		return d.ID, ""
+	}
+	return "", credentialID(requestKey(r))
+}
+
+// ownedBy reports whether the caller of r created the job. Jobs from
+// before uploads had owners are left to the API keys.
+func (job uploadJob) ownedBy(r *http.Request) bool {
+	device, key := uploadOwner(r)
+	if job.Device == "" && job.Key == "" {
+		return device == ""
+	}
+	return job.Device == device && job.Key == key
+}
+
+// uploadReject is a row that failed validation, kept for download.
+type uploadReject struct {
+	UploadID string `bson:"uploadId" json:"-"`
+	Line     int    `bson:"line" json:"line"`
+	Row      string `bson:"row" json:"row"`
+	Error    string `bson:"error" json:"error"`
+}
+
+// uploadRow is one row of an uploaded file, either parsed or rejected.
+type uploadRow struct {
+	line     int
+	raw      string
+	reading  reading
+	warnings []string
+	err      error
+}
+
+// uploadSigningKey returns the key used to sign upload URLs. Without
+// UPLOAD_SIGNING_KEY a random key is used, so outstanding URLs stop
+// working when the server restarts.
+func uploadSigningKey() []byte {
+	if k := os.Getenv("UPLOAD_SIGNING_KEY"); k != "" {
+		return []byte(k)
+	}
+	log.Println("UPLOAD_SIGNING_KEY not set; upload URLs will not survive a restart")
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}
+
+func (s *server) signUpload(id string, expires int64) string {
+	mac := hmac.New(sha256.New, s.uploadKey)
+	fmt.Fprintf(mac, "%s:%d", id, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// handleCreateUpload issues a job ID and a pre-signed URL the caller can
+// PUT a batch file to without presenting an API key. The mode query
+// parameter picks strict or lenient parsing for the file, and template
+// a saved import template for the columns and units of a CSV.
+func (s *server) handleCreateUpload(w http.ResponseWriter, r *http.Request) {
+	// Uploaded rows are checked later, without the request's device
+	if d := contextDevice(r.Context()); d != nil && len(d.Sensors) > 0 {
+		writeError(w, http.StatusForbidden, fmt.Errorf("device %s is limited to some sensors and can't upload in bulk", d.ID))
+		return
+	}
+	mode, err := parseModeNamed(r.URL.Query().Get("mode"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	now := time.Now()
+	job := uploadJob{ID: hex.EncodeToString(b), Status: uploadPending, Mode: mode.String(), CreatedAt: now, UpdatedAt: now}
+	job.Device, job.Key = uploadOwner(r)
+	if name := r.URL.Query().Get("template"); name != "" {
+		m, err := loadTemplate(r.Context(), s.templates, name)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		job.Template, job.Mapping = name, &m
+	}
+	auditNote(r.Context(), "upload", job.ID)
+	auditNote(r.Context(), "mode", job.Mode)
+	if job.Template != "" {
+		auditNote(r.Context(), "template", job.Template)
+	}
+	if _, err := s.uploads.InsertOne(r.Context(), job); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	base := os.Getenv("PUBLIC_URL")
+	if base == "" {
+		base = "http://" + r.Host
+	}
+	base = strings.TrimRight(base, "/")
+	expires := now.Add(uploadURLLifetime)
+	uploadURL := fmt.Sprintf("%s/api/uploads/%s/data?expires=%d&signature=%s",
+		base, job.ID, expires.Unix(), s.signUpload(job.ID, expires.Unix()))
+
+	writeJSON(w, http.StatusCreated, map[string]any{
+		"id":        job.ID,
+		"uploadUrl": uploadURL,
+		"expiresAt": expires,
+		"statusUrl": fmt.Sprintf("%s/api/uploads/%s", base, job.ID),
+	})
+}
+
+// handleUploadData accepts the batch file for a pre-signed URL and
+// queues it for ingestion.
+func (s *server) handleUploadData(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	auditNote(r.Context(), "upload", id)
+	expires, err := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		writeError(w, http.StatusForbidden, errors.New("upload URL expired"))
+		return
+	}
+	want := s.signUpload(id, expires)
+	if !hmac.Equal([]byte(want), []byte(r.URL.Query().Get("signature"))) {
+		writeError(w, http.StatusForbidden, errors.New("invalid upload signature"))
+		return
+	}
+
+	// Each URL accepts exactly one file
+	var job uploadJob
+	err = s.uploads.FindOneAndUpdate(r.Context(),
+		bson.M{"_id": id, "status": uploadPending},
+		bson.M{"$set": bson.M{"status": uploadProcessing, "updatedAt": time.Now()}}).Decode(&job)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		writeError(w, http.StatusConflict, errors.New("upload already received"))
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	// The signed URL stands in for the credential that created the job
+	if rec := contextAudit(r.Context()); rec != nil {
+		rec.Device, rec.Key = job.Device, job.Key
+	}
+	mode, err := parseModeNamed(job.Mode)
+	if err != nil {
+		s.finishUpload(id, err)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	path := filepath.Join(s.uploadDir, id)
+	if err := saveUpload(path, http.MaxBytesReader(w, r.Body, maxUploadBody)); err != nil {
+		s.finishUpload(id, err)
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	csv := strings.HasPrefix(r.Header.Get("Content-Type"), "text/csv")
+	var mapping csvMapping
+	if job.Mapping != nil {
+		mapping = *job.Mapping
+	}
+	s.uploading.Add(1)
+	go func() {
+		defer s.uploading.Done()
+		s.processUpload(s.background, id, path, csv, mode, mapping)
+	}()
+	writeJSON(w, http.StatusAccepted, map[string]string{"id": id, "status": uploadProcessing})
+}
+
+// handleUploadStatus reports the state of an upload job.
+func (s *server) handleUploadStatus(w http.ResponseWriter, r *http.Request) {
+	job, ok := s.callerUpload(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+// callerUpload finds the upload job of the request's path, answering
+// 404 if there is none or it belongs to another device or key, as if it
+// didn't exist.
+func (s *server) callerUpload(w http.ResponseWriter, r *http.Request) (uploadJob, bool) {
+	var job uploadJob
+	err := s.uploads.FindOne(r.Context(), bson.M{"_id": r.PathValue("id")}).Decode(&job)
+	if errors.Is(err, mongo.ErrNoDocuments) || err == nil && !job.ownedBy(r) {
+		writeError(w, http.StatusNotFound, errors.New("no such upload"))
+		return job, false
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return job, false
+	}
+	return job, true
+}
+
+func saveUpload(path string, body io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, body); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
+
+// processUpload ingests the valid rows of the file in batches and
+// records every invalid row as a reject, updating progress as it goes.
+// In strict mode a single invalid row fails the job before anything is
+// inserted. When ctx is done it stops after the current batch.
+func (s *server) processUpload(ctx context.Context, id, path string, csv bool, mode parseMode, mapping csvMapping) {
+	defer os.Remove(path)
+
+	rows, err := parseUpload(path, csv, mode, mapping)
+	if err != nil {
+		s.finishUpload(id, err)
+		return
+	}
+	if mode == parseStrict {
+		for _, row := range rows {
+			if row.err != nil {
+				s.finishUpload(id, fmt.Errorf("line %d: %w", row.line, row.err))
+				return
+			}
+		}
+	}
+
+	job := uploadJob{Total: len(rows)}
+	for start := 0; start < len(rows); start += uploadInsertBatch {
+		if ctx.Err() != nil {
+			s.finishUpload(id, errUploadInterrupted)
+			return
+		}
+		var docs []reading
+		var rejects []any
+		for _, row := range rows[start:min(start+uploadInsertBatch, len(rows))] {
+			if len(row.warnings) > 0 {
+				job.Coerced++
+			}
+			if row.err != nil {
+				rejects = append(rejects, uploadReject{UploadID: id, Line: row.line, Row: row.raw, Error: row.err.Error()})
+				continue
+			}
+			docs = append(docs, row.reading)
+		}
+		if len(docs) > 0 {
+			if err := s.store.insert(ctx, docs); err != nil {
+				s.finishUpload(id, interruptedOr(ctx, err))
+				return
+			}
+		}
+		if len(rejects) > 0 {
+			if _, err := s.rejects.InsertMany(ctx, rejects); err != nil {
+				s.finishUpload(id, interruptedOr(ctx, err))
+				return
+			}
+		}
+
+		job.Processed += len(docs) + len(rejects)
+		job.Inserted += len(docs)
+		job.Rejected += len(rejects)
+		progress := bson.M{
+			"total":     job.Total,
+			"processed": job.Processed,
+			"inserted":  job.Inserted,
+			"rejected":  job.Rejected,
+			"coerced":   job.Coerced,
+			"updatedAt": time.Now(),
+		}
+		if _, err := s.uploads.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": progress}); err != nil {
+			log.Printf("Error updating upload %s: %v", id, err)
+		}
+	}
+	s.finishUpload(id, nil)
+}
+
+// parseUpload reads a CSV file or JSON readings, either as an array or
+// one object per line. Bad rows are returned with their error rather
+// than failing the whole file; only an unreadable file is an error.
+func parseUpload(path string, csv bool, mode parseMode, mapping csvMapping) ([]uploadRow, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+
+	var rows []uploadRow
+	addJSON := func(line int, raw []byte) {
+		row := uploadRow{line: line, raw: string(raw)}
+		var p readingPayload
+		if p, row.warnings, row.err = mode.decodePayload(raw); row.err == nil {
+			row.reading, row.err = p.reading(now)
+		}
+		rows = append(rows, row)
+	}
+
+	switch {
+	case csv:
+		cr, err := newCSVRows(bytes.NewReader(data), mode, mapping)
+		if err != nil {
+			return nil, err
+		}
+		for {
+			c, rec, err := cr.next()
+			if err == io.EOF {
+				break
+			}
+			row := uploadRow{line: cr.line, raw: strings.Join(rec, ","), warnings: slices.Clone(cr.warnings), err: err}
+			if err == nil {
+				p := readingPayload{SensorID: c.SensorID, Temperature: &c.Temperature, Humidity: &c.Humidity, UpdatedAt: &c.UpdatedAt}
+				row.reading, row.err = p.reading(now)
+			}
+			rows = append(rows, row)
+		}
+	case bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")):
+		// Elements are numbered from 1 in place of line numbers
+		var elems []json.RawMessage
+		if err := json.Unmarshal(data, &elems); err != nil {
+			return nil, err
+		}
+		for i, e := range elems {
+			addJSON(i+1, e)
+		}
+	default:
+		sc := bufio.NewScanner(bytes.NewReader(data))
+		for line := 1; sc.Scan(); line++ {
+			if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+				continue
+			}
+			addJSON(line, bytes.Clone(sc.Bytes()))
+		}
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return rows, nil
+}
+
+// handleUploadRejects downloads the rejected rows of an upload as NDJSON,
+// one object per row with its line number, raw content and reason.
+func (s *server) handleUploadRejects(w http.ResponseWriter, r *http.Request) {
+	job, ok := s.callerUpload(w, r)
+	if !ok {
+		return
+	}
+	id := job.ID
+	cursor, err := s.rejects.Find(r.Context(), bson.M{"uploadId": id}, options.Find().SetSort(bson.M{"line": 1}))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer cursor.Close(r.Context())
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-rejects.ndjson"`, id))
+	enc := json.NewEncoder(w)
+	for cursor.Next(r.Context()) {
+		var rej uploadReject
+		if err := cursor.Decode(&rej); err != nil {
+			log.Printf("Error decoding reject: %v", err)
+			return
+		}
+		if err := enc.Encode(rej); err != nil {
+			return
+		}
+	}
+}
+
+// interruptedOr returns err, or errUploadInterrupted when it came of the
+// server stopping.
+func interruptedOr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return errUploadInterrupted
+	}
+	return err
+}
+
+// failInterruptedUploads fails the uploads left processing when the
+// server last stopped without finishing them, as after a crash. Their
+// files are still staged in uploadDir, which tells them from uploads
+// another server is processing.
+func (s *server) failInterruptedUploads(ctx context.Context) error {
+	cursor, err := s.uploads.Find(ctx, bson.M{"status": uploadProcessing}, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return err
+	}
+	var jobs []uploadJob
+	if err := cursor.All(ctx, &jobs); err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		path := filepath.Join(s.uploadDir, job.ID)
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		s.finishUpload(job.ID, errUploadInterrupted)
+		os.Remove(path)
+	}
+	return nil
+}
+
+// finishUpload records the outcome of an upload job.
+func (s *server) finishUpload(id string, err error) {
+	set := bson.M{"status": uploadDone, "updatedAt": time.Now()}
+	if err != nil {
+		set["status"] = uploadFailed
+		set["error"] = err.Error()
+		log.Printf("Upload %s failed: %v", id, err)
+	}
+	if _, err := s.uploads.UpdateOne(context.Background(), bson.M{"_id": id}, bson.M{"$set": set}); err != nil {
+		log.Printf("Error updating upload %s: %v", id, err)
+	}
+}
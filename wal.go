@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// walSegmentSize is the size at which the write-ahead log starts a new
+// segment, so that inserted readings can be deleted while later ones are
+// still outstanding.
+const walSegmentSize = 1 << 20
+
+// readingWAL is a write-ahead log of readings a collector has received
+// but not yet inserted, so that a power cut on a Raspberry Pi doesn't
+// lose them. It is a directory of numbered segments of JSON lines, each
+// deleted once all its readings are inserted. The segments left behind
+// by a previous run are recovered when the log is opened.
+type readingWAL struct {
+	mu  sync.Mutex
+	dir string
+	f   *os.File
+	seg int
+	// size is how much of the current segment is written
+	size int64
+	// outstanding counts the readings of each segment not yet inserted
+	outstanding map[int]int
+
+	// recovered are the readings of earlier runs, with their segments
+	recovered     []reading
+	recoveredSegs []int
+}
+
+// openWAL opens the log in dir, creating it if needed, and recovers the
+// readings a previous run left in it.
+func openWAL(dir string) (*readingWAL, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	w := &readingWAL{dir: dir, outstanding: map[int]int{}}
+	segs, err := w.segments()
+	if err != nil {
+		return nil, err
+	}
+	for _, seg := range segs {
+		rs, err := readWALSegment(w.path(seg))
+		if err != nil {
+			return nil, err
+		}
+		if len(rs) == 0 {
+			os.Remove(w.path(seg))
+			continue
+		}
+		w.outstanding[seg] = len(rs)
+		for _, r := range rs {
+			w.recovered = append(w.recovered, r)
+			w.recoveredSegs = append(w.recoveredSegs, seg)
+		}
+		w.seg = seg
+	}
+	if len(w.recovered) > 0 {
+		log.Printf("Recovered %d readings from the write-ahead log in %s", len(w.recovered), dir)
+	}
+	if err := w.rotate(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *readingWAL) path(seg int) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%08d.wal", seg))
+}
+
+// segments lists the numbers of the segments in the directory, oldest
+// first.
+func (w *readingWAL) segments() ([]int, error) {
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return nil, err
+	}
+	var segs []int
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ".wal")
+		if seg, err := strconv.Atoi(name); ok && err == nil {
+			segs = append(segs, seg)
+		}
+	}
+	sort.Ints(segs)
+	return segs, nil
+}
+
+// readWALSegment reads the readings of a segment. A partial last line,
+// cut off by the power failing mid-write, is skipped: its reading was
+// never acknowledged.
+func readWALSegment(path string) ([]reading, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var rs []reading
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var r reading
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			log.Printf("%s: skipping damaged entry: %v", path, err)
+			continue
+		}
+		rs = append(rs, r)
+	}
+	return rs, sc.Err()
+}
+
+// rotate starts the next segment. The caller holds mu, or has the log to
+// itself.
+func (w *readingWAL) rotate() error {
+	if w.f != nil {
+		if err := w.f.Close(); err != nil {
+			return err
+		}
+		if w.outstanding[w.seg] == 0 {
+			os.Remove(w.path(w.seg))
+		}
+	}
+	w.seg++
+	f, err := os.OpenFile(w.path(w.seg), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	// Make the new file itself survive a power cut
+	if d, err := os.Open(w.dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	w.f, w.size = f, 0
+	return nil
+}
+
+// append writes r to the log and syncs it to disk, returning the segment
+// to pass to done once r is inserted.
+func (w *readingWAL) append(r reading) (int, error) {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return 0, err
+	}
+	line = append(line, '\n')
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.size >= walSegmentSize && w.outstanding[w.seg] > 0 {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := w.f.Write(line); err != nil {
+		return 0, err
+	}
+	if err := w.f.Sync(); err != nil {
+		return 0, err
+	}
+	w.size += int64(len(line))
+	w.outstanding[w.seg]++
+	return w.seg, nil
+}
+
+// done records that the readings appended to segs have been inserted,
+// deleting the segments that have nothing left outstanding.
+func (w *readingWAL) done(segs []int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, seg := range segs {
+		// 0 marks a reading that couldn't be appended
+		if seg > 0 {
+			w.outstanding[seg]--
+		}
+	}
+	for seg, n := range w.outstanding {
+		if n > 0 {
+			continue
+		}
+		delete(w.outstanding, seg)
+		if seg == w.seg {
+			// Start afresh rather than let a drained segment grow
+			if w.size > 0 {
+				if err := w.rotate(); err != nil {
+					log.Printf("Write-ahead log: %v", err)
+				}
+			}
+			continue
+		}
+		if err := os.Remove(w.path(seg)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Write-ahead log: %v", err)
+		}
+	}
+}
+
+func (w *readingWAL) close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.f.Close()
+}
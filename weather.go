@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Weather providers for -outdoor
+const (
+	weatherOpenMeteo      = "open-meteo"
+	weatherOpenWeatherMap = "openweathermap"
+)
+
+// outdoorConditions is the weather outside during an hour, its
+// temperature in Celsius as both providers are asked for.
+type outdoorConditions struct {
+	Temperature float64
+	Humidity    float64
+}
+
+// temperatureIn returns the outdoor temperature in unit, to compare with
+// a sensor reporting in it.
+func (c outdoorConditions) temperatureIn(unit string) float64 {
+	if unit == unitFahrenheit {
+		return c.Temperature*9/5 + 32
+	}
+	return c.Temperature
+}
+
+// weatherSource looks up the hourly outdoor weather at a place.
+type weatherSource interface {
+	// hourly returns the conditions of the hours in [from, to), keyed by
+	// the Unix time the hour starts at
+	hourly(ctx context.Context, from, to time.Time) (map[int64]outdoorConditions, error)
+}
+
+// newWeatherSource returns the provider's source for a location given as
+// "latitude,longitude". OpenWeatherMap needs OPENWEATHERMAP_API_KEY,
+// subscribed to One Call 3.0 for its history.
+func newWeatherSource(provider, location string) (weatherSource, error) {
+	lat, lon, ok := strings.Cut(location, ",")
+	latitude, err1 := strconv.ParseFloat(strings.TrimSpace(lat), 64)
+	longitude, err2 := strconv.ParseFloat(strings.TrimSpace(lon), 64)
+	if !ok || err1 != nil || err2 != nil || latitude < -90 || latitude > 90 || longitude < -180 || longitude > 180 {
+		return nil, fmt.Errorf("location %q is not latitude,longitude", location)
+	}
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	switch provider {
+	case weatherOpenMeteo:
+		return &openMeteo{lat: latitude, lon: longitude, http: httpClient}, nil
+	case weatherOpenWeatherMap:
+		key := os.Getenv("OPENWEATHERMAP_API_KEY")
+		if key == "" {
+			return nil, configError{errors.New("OPENWEATHERMAP_API_KEY not set in environment")}
+		}
+		return &openWeatherMap{lat: latitude, lon: longitude, key: key, http: httpClient}, nil
+	}
+	return nil, fmt.Errorf("unknown weather provider %q (expected open-meteo or openweathermap)", provider)
+}
+
+// outdoorByHour looks up the weather of [from, to), keyed like hourly
+// averages by the start of each hour in loc.
+func outdoorByHour(ctx context.Context, src weatherSource, from, to time.Time, loc *time.Location) (map[string]outdoorConditions, error) {
+	hours, err := src.hourly(ctx, from, to)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]outdoorConditions, len(hours))
+	for unix, c := range hours {
+		out[time.Unix(unix, 0).In(loc).Format(time.DateTime)] = c
+	}
+	return out, nil
+}
+
+// openMeteo reads Open-Meteo, which is free and needs no key. Its
+// archive lags a few days behind, so recent hours come from the
+// forecast API instead, which keeps three months.
+type openMeteo struct {
+	lat, lon float64
+	http     *http.Client
+}
+
+func (o *openMeteo) hourly(ctx context.Context, from, to time.Time) (map[int64]outdoorConditions, error) {
+	endpoint := "https://api.open-meteo.com/v1/forecast"
+	if time.Since(from) > 60*24*time.Hour {
+		endpoint = "https://archive-api.open-meteo.com/v1/archive"
+	}
+	// Celsius, as outdoorConditions holds it
+	q := url.Values{
+		"latitude":         {strconv.FormatFloat(o.lat, 'f', -1, 64)},
+		"longitude":        {strconv.FormatFloat(o.lon, 'f', -1, 64)},
+		"start_date":       {from.UTC().Format(time.DateOnly)},
+		"end_date":         {to.Add(-time.Nanosecond).UTC().Format(time.DateOnly)},
+		"hourly":           {"temperature_2m,relative_humidity_2m"},
+		"temperature_unit": {"celsius"},
+		"timeformat":       {"unixtime"},
+		"timezone":         {"UTC"},
+	}
+	var body struct {
+		Hourly struct {
+			Time        []int64    `json:"time"`
+			Temperature []*float64 `json:"temperature_2m"`
+			Humidity    []*float64 `json:"relative_humidity_2m"`
+		} `json:"hourly"`
+	}
+	if err := getWeatherJSON(ctx, o.http, endpoint+"?"+q.Encode(), &body); err != nil {
+		return nil, err
+	}
+	h := body.Hourly
+	if len(h.Temperature) != len(h.Time) || len(h.Humidity) != len(h.Time) {
+		return nil, errors.New("open-meteo: hourly series of different lengths")
+	}
+	out := map[int64]outdoorConditions{}
+	for i, unix := range h.Time {
+		// Hours not yet in the archive are null
+		if h.Temperature[i] == nil || h.Humidity[i] == nil || unix < from.Unix() || unix >= to.Unix() {
+			continue
+		}
+		out[unix] = outdoorConditions{Temperature: *h.Temperature[i], Humidity: *h.Humidity[i]}
+	}
+	return out, nil
+}
+
+// openWeatherMap reads the One Call 3.0 history, one request per hour.
+type openWeatherMap struct {
+	lat, lon float64
+	key      string
+	http     *http.Client
+}
+
+func (o *openWeatherMap) hourly(ctx context.Context, from, to time.Time) (map[int64]outdoorConditions, error) {
+	out := map[int64]outdoorConditions{}
+	for hour := from.Truncate(time.Hour); hour.Before(to); hour = hour.Add(time.Hour) {
+		if hour.Before(from) || hour.After(time.Now()) {
+			continue
+		}
+		// Metric units give Celsius, as outdoorConditions holds it
+		q := url.Values{
+			"lat":   {strconv.FormatFloat(o.lat, 'f', -1, 64)},
+			"lon":   {strconv.FormatFloat(o.lon, 'f', -1, 64)},
+			"dt":    {strconv.FormatInt(hour.Unix(), 10)},
+			"units": {"metric"},
+			"appid": {o.key},
+		}
+		var body struct {
+			Data []struct {
+				Temperature float64 `json:"temp"`
+				Humidity    float64 `json:"humidity"`
+			} `json:"data"`
+		}
+		if err := getWeatherJSON(ctx, o.http, "https://api.openweathermap.org/data/3.0/onecall/timemachine?"+q.Encode(), &body); err != nil {
+			return nil, err
+		}
+		if len(body.Data) > 0 {
+			out[hour.Unix()] = outdoorConditions{Temperature: body.Data[0].Temperature, Humidity: body.Data[0].Humidity}
+		}
+	}
+	return out, nil
+}
+
+// getWeatherJSON fetches a provider's JSON into v.
+func getWeatherJSON(ctx context.Context, client *http.Client, u string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		// The URL may carry the API key
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+		return fmt.Errorf("fetching the weather from %s: %w", req.URL.Host, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching the weather from %s: %s", req.URL.Host, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestOutdoorInSensorUnit(t *testing.T) {
+	registry := map[string]sensorInfo{
+		"attic":  {ID: "attic", Name: "Attic", TemperatureUnit: unitFahrenheit},
+		"cellar": {ID: "cellar", Name: "Cellar", TemperatureUnit: unitCelsius},
+	}
+	results := []bucketAvg[string]{
+		{Key: "2024-05-01 10:00:00", Sensor: "attic", Temperature: 72, Humidity: 40, Count: 1},
+		{Key: "2024-05-01 10:00:00", Sensor: "cellar", Temperature: 14, Humidity: 70, Count: 1},
+		{Key: "2024-05-01 10:00:00", Sensor: "garage", Temperature: 15, Humidity: 60, Count: 1},
+	}
+	outdoor := map[string]outdoorConditions{"2024-05-01 10:00:00": {Temperature: 20, Humidity: 55}}
+	rnd, err := parseRounding("temperature=1,humidity=0", roundHalfUp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var text bytes.Buffer
+	if err := printSensorAverages(&text, "text", results, registry, outdoor, nil, nil, rnd); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(text.String()), "\n")
+	want := []string{
+		"Hour: 2024-05-01 10:00:00, Sensor: Attic, Avg Humidity: 40, Avg Temperature: 72.0, Outdoor Humidity: 55, Outdoor Temperature: 68.0F",
+		"Hour: 2024-05-01 10:00:00, Sensor: Cellar, Avg Humidity: 70, Avg Temperature: 14.0, Outdoor Humidity: 55, Outdoor Temperature: 20.0C",
+		// Unregistered sensors are taken to report Celsius
+		"Hour: 2024-05-01 10:00:00, Sensor: garage, Avg Humidity: 60, Avg Temperature: 15.0, Outdoor Humidity: 55, Outdoor Temperature: 20.0C",
+	}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("text:\n%s\nwant:\n%s", strings.Join(lines, "\n"), strings.Join(want, "\n"))
+	}
+
+	var csv bytes.Buffer
+	if err := printSensorAverages(&csv, "csv", results[:1], registry, outdoor, nil, nil, rnd); err != nil {
+		t.Fatal(err)
+	}
+	wantCSV := "hour,sensor_id,sensor_name,avg_humidity,avg_temperature,avg_co2,avg_pressure,outdoor_temp,outdoor_humidity,outdoor_temp_unit\n" +
+		"2024-05-01 10:00:00,attic,Attic,40,72.0,,,68.0,55,F\n"
+	if csv.String() != wantCSV {
+		t.Errorf("csv:\n%s\nwant:\n%s", csv.String(), wantCSV)
+	}
+}